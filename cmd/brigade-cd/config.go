@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/mumoshu/brigade-cd/pkg/customresource"
+	"sigs.k8s.io/yaml"
+)
+
+// fileConfig is the configuration loaded from the YAML file of -config. The
+// keys of mappings are the fields of customresource.Mapping in lower camel
+// case, like brigadeProject.
+type fileConfig struct {
+	Mappings            []customresource.Mapping `json:"mappings"`
+	Authors             []string                 `json:"authors"`
+	Events              []string                 `json:"events"`
+	AppID               int                      `json:"appID"`
+	DefaultSharedSecret string                   `json:"defaultSharedSecret"`
+	KeyFile             string                   `json:"keyFile"`
+}
+
+// loadConfig reads the config file at path. Unknown keys are rejected, to catch
+// typos, and the mappings are validated like the ones of -mapping.
+func loadConfig(path string) (*fileConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg fileConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for i, m := range cfg.Mappings {
+		if err := m.Validate(); err != nil {
+			return nil, fmt.Errorf("mapping at index %d in %s: %v", i, path, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// apply sets the values of cfg whose flags aren't in set, the names of the flags
+// given on the command line, so that flags override the file.
+func (cfg *fileConfig) apply(set map[string]bool) {
+	if !set["key-file"] && cfg.KeyFile != "" {
+		keyFile = cfg.KeyFile
+	}
+	if !set["mapping"] && len(cfg.Mappings) > 0 {
+		mappings = cfg.Mappings
+	}
+	if !set["authors"] && len(cfg.Authors) > 0 {
+		(&allowedAuthors).Set(strings.Join(cfg.Authors, ","))
+	}
+	if !set["events"] && len(cfg.Events) > 0 {
+		(&emittedEvents).Set(strings.Join(cfg.Events, ","))
+	}
+}
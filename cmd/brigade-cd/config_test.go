@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/brigade-cd/pkg/customresource"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func writeTestConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "brigade-cd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfig(t *testing.T) {
+	path, cleanup := writeTestConfig(t, `
+appID: 1234
+defaultSharedSecret: mysecret
+keyFile: /etc/brigade-cd/app.pem
+authors: [owner, member]
+events:
+- push
+- pull_request
+mappings:
+- group: cd.brigade.sh
+  version: v1alpha1
+  kind: ReleaseSet
+  brigadeProject: myorg/myapp
+  deletion: ignore
+  branchProjects:
+    main: myorg/prod
+  cascadeKinds:
+  - group: cd.brigade.sh
+    version: v1alpha1
+    kind: Release
+  fields:
+    tag: spec.image.tag
+`)
+	defer cleanup()
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &fileConfig{
+		AppID:               1234,
+		DefaultSharedSecret: "mysecret",
+		KeyFile:             "/etc/brigade-cd/app.pem",
+		Authors:             []string{"owner", "member"},
+		Events:              []string{"push", "pull_request"},
+		Mappings: []customresource.Mapping{{
+			Group:          "cd.brigade.sh",
+			Version:        "v1alpha1",
+			Kind:           "ReleaseSet",
+			BrigadeProject: "myorg/myapp",
+			Deletion:       "ignore",
+			BranchProjects: map[string]string{"main": "myorg/prod"},
+			CascadeKinds:   []schema.GroupVersionKind{{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "Release"}},
+			Fields:         map[string]string{"tag": "spec.image.tag"},
+		}},
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("expected %+v, got %+v", expected, cfg)
+	}
+}
+
+func TestLoadConfig_invalid(t *testing.T) {
+	tests := map[string]string{
+		"malformed":     "mappings:\n- kind: ReleaseSet\n  brigadeProject: [myorg/myapp\n",
+		"unknown key":   "mapping:\n- kind: ReleaseSet\n",
+		"wrong type":    "events: push\n",
+		"invalid phase": "mappings:\n- kind: ReleaseSet\n  phases:\n    Ready: deploy\n",
+	}
+	for name, content := range tests {
+		path, cleanup := writeTestConfig(t, content)
+		_, err := loadConfig(path)
+		cleanup()
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		} else if !strings.Contains(err.Error(), path) {
+			t.Errorf("%s: expected the error to name the file, got %v", name, err)
+		}
+	}
+}
+
+func TestFileConfig_apply(t *testing.T) {
+	defer func(k string, m Mappings, a authors, e events) {
+		keyFile, mappings, allowedAuthors, emittedEvents = k, m, a, e
+	}(keyFile, mappings, allowedAuthors, emittedEvents)
+
+	keyFile = "/from/flag.pem"
+	mappings = Mappings{{Kind: "FromFlag"}}
+	allowedAuthors, emittedEvents = nil, nil
+	cfg := &fileConfig{
+		KeyFile:  "/from/file.pem",
+		Mappings: []customresource.Mapping{{Kind: "FromFile"}},
+		Authors:  []string{"owner"},
+		Events:   []string{"push"},
+	}
+	cfg.apply(map[string]bool{"key-file": true, "mapping": true})
+
+	if keyFile != "/from/flag.pem" {
+		t.Errorf("expected -key-file to override the file, got %s", keyFile)
+	}
+	if len(mappings) != 1 || mappings[0].Kind != "FromFlag" {
+		t.Errorf("expected -mapping to override the file, got %v", mappings)
+	}
+	if !reflect.DeepEqual([]string(allowedAuthors), []string{"OWNER"}) {
+		t.Errorf("expected the authors of the file, got %v", allowedAuthors)
+	}
+	if !reflect.DeepEqual([]string(emittedEvents), []string{"PUSH"}) {
+		t.Errorf("expected the events of the file, got %v", emittedEvents)
+	}
+}
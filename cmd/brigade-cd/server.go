@@ -1,37 +1,106 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/mumoshu/brigade-cd/pkg/customresource"
 	"io/ioutil"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/gin-gonic/gin.v1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
-	"github.com/brigadecore/brigade/pkg/storage/kube"
+	"github.com/brigadecore/brigade/pkg/brigade"
 
 	"github.com/mumoshu/brigade-cd/pkg/webhook"
 )
 
 var (
-	kubeconfig     string
-	master         string
-	namespace      string
-	gatewayPort    string
-	keyFile        string
-	allowedAuthors authors
-	emittedEvents  events
-	mappings Mappings
+	kubeconfig       string
+	master           string
+	namespace        string
+	gatewayPort      string
+	keyFile          string
+	requireMergeable bool
+	debounceWindow   time.Duration
+	rejectUnsigned   bool
+	allowUnsigned    bool
+	allowedAuthors   authors
+	emittedEvents    events
+	mappings         Mappings
+	eventRoutes      keyValues
+	payloadPretty    bool
+	checkRunAppID    bool
+	basePath         string
+	serviceAccounts  keyValues
+	rateLimits       keyValues
+	emitOnDraftPR    bool
+	ignoredStatus    int
+	bodyFields       keyValues
+	signatureAlgs    keyValues
+	emitPing         bool
+	annotationPrefix string
+	jwtBackdate      time.Duration
+	refTemplate      string
+	checkEvents      bool
+	compressPayloads bool
+	compressAbove    int
+	provider         string
+	enterpriseSuffix bool
+	repoInfo         bool
+	prCacheSize      int
+	maxProcessBody   int
+	maxRetainBody    int
+	deliveryCache    int
+	buildTypes       keyValues
+	coalesceActions  bool
+	verifyPRHead     bool
+	pullStats        bool
+	deadLetterDir    string
+	requestTimeout   time.Duration
+	defaultInstID    int64
+	auditLog         string
+	githubAPIURL     string
+	githubUploadURL  string
+	githubCAFile     string
+	githubCertFile   string
+	githubKeyFile    string
+	bufferSize       int
+	strictRepos      bool
+	storeKind        string
+	memoryProjects   string
+	workflowRunConcl string
+	spoolDir         string
+	spoolSize        int
+	approvalReaction string
+	emitErrors       bool
+	caseInsensitive  bool
+	requireTLS       bool
+	trustedProxies   string
+	defaultBranch    string
+	targetTypes      string
+	decoupleCtrl     bool
+	validateOnly     bool
+	configFile       string
 )
 
+// version is the version of the gateway binary, set at build time via
+// -ldflags "-X main.version=..."
+var version = "dev"
+
 // defaultAllowedAuthors is the default set of authors allowed to PR
 // https://developer.github.com/v4/reference/enum/commentauthorassociation/
 var defaultAllowedAuthors = []string{"COLLABORATOR", "OWNER", "MEMBER"}
@@ -41,26 +110,117 @@ var defaultEmittedEvents = []string{"*"}
 
 func main() {
 	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.StringVar(&configFile, "config", "", "YAML file with the mappings, authors, events, appID, defaultSharedSecret and keyFile, overridden by the corresponding flags and by the APP_ID and DEFAULT_SHARED_SECRET environment variables")
 	flags.StringVar(&kubeconfig, "kubeconfig", "", "absolute path to the kubeconfig file")
 	flags.StringVar(&master, "master", "", "master url")
 	flags.StringVar(&namespace, "namespace", defaultNamespace(), "kubernetes namespace")
 	flags.StringVar(&gatewayPort, "gateway-port", defaultGatewayPort(), "TCP port to use for brigade-cd")
+	flags.StringVar(&basePath, "base-path", "", "path prefix of all routes, e.g. /brigade-cd when served behind a shared ingress")
+	flags.StringVar(&storeKind, "store", storeKube, "Brigade store to create builds in: kube, or memory to keep projects and builds in memory for local development, without running the builds")
+	flags.StringVar(&memoryProjects, "memory-store-projects", "", "JSON file with the projects of the memory store, like [{\"name\": \"myorg/myapp\", \"sharedSecret\": \"...\"}]")
 	flags.StringVar(&keyFile, "key-file", "/etc/brigade-cd/key.pem", "path to x509 key for GitHub app")
 	flags.Var(&allowedAuthors, "authors", "allowed author associations, separated by commas (COLLABORATOR, CONTRIBUTOR, FIRST_TIMER, FIRST_TIME_CONTRIBUTOR, MEMBER, OWNER, NONE)")
 	flags.Var(&emittedEvents, "events", "events to be emitted and passed to worker, separated by commas (defaults to `*`, which matches everything)")
 	flags.Var(&mappings, "mapping", "Mappings from custom resources to Brigade projects")
+	flags.StringVar(&annotationPrefix, "annotation-prefix", customresource.DefaultAnnotationPrefix, "prefix of the annotations of custom resources, to tell apart instances with different semantics")
+	flags.Var(&eventRoutes, "event-project", "routes from event types to Brigade projects in the form EVENT=PROJECT, separated by commas, overriding the project of the repo")
+	flags.Var(&rateLimits, "rate-limit", "maximum number of builds created per minute for Brigade projects in the form PROJECT=BUILDS_PER_MINUTE, separated by commas. Deliveries beyond the limit are answered with 429")
+	flags.Var(&serviceAccounts, "service-account", "Kubernetes service accounts for the workers of Brigade projects in the form PROJECT=SERVICE_ACCOUNT, separated by commas")
+	flags.Var(&buildTypes, "build-type", "renames of build types in the form EVENT=TYPE, separated by commas, like issue_comment:created=deploy_comment")
+	flags.Var(&signatureAlgs, "signature-algorithms", "signature algorithms the deliveries of Brigade projects must be signed with, in the form PROJECT=ALGORITHM;ALGORITHM, separated by commas, like myorg/myapp=sha256. Deliveries of other projects are validated with the sha256 signature, or the sha1 one if they carry no sha256 one")
+	flags.Var(&bodyFields, "body-fields", "allowlists of payload body fields in the form EVENT=FIELD;FIELD, separated by commas, like issue_comment=action;comment.id (defaults to the full body)")
+	flags.StringVar(&defaultBranch, "default-branch", webhook.DefaultBranch, "branch of the ref of builds for events that aren't about a ref, like comments on issues, and for custom resources without a git-commit or git-branch annotation")
+	flags.StringVar(&refTemplate, "ref-template", "", "Go template for the ref of the revision of builds, like {{.Branch}} or {{.Branch}}@{{.Commit}}, given .Provider, .EventType, .Ref, .Branch and .Commit (defaults to refs/heads/BRANCH)")
+	flags.StringVar(&githubAPIURL, "github-api-url", "", "URL of the GitHub API for projects without a GitHub base URL of their own, like https://ghe.example.com/api/v3/ (defaults to github.com)")
+	flags.StringVar(&githubUploadURL, "github-upload-url", "", "URL of the GitHub upload API for projects without a GitHub base URL of their own (defaults to -github-api-url)")
+	flags.StringVar(&githubCAFile, "github-ca-file", "", "PEM bundle of CA certificates to trust for the GitHub API in addition to the system roots, like the internal CA of GitHub Enterprise")
+	flags.StringVar(&githubCertFile, "github-cert-file", "", "PEM client certificate to present to the GitHub API, for mTLS (requires -github-key-file)")
+	flags.StringVar(&githubKeyFile, "github-key-file", "", "PEM key of the client certificate of -github-cert-file")
+	flags.DurationVar(&jwtBackdate, "jwt-backdate", webhook.JWTBackdate, "how far the issue time of JWTs is set in the past, to tolerate the local clock being ahead of GitHub's")
+	flags.DurationVar(&debounceWindow, "debounce-window", 0, "quiet period after which only the latest of rapid successive builds for the same project and ref is emitted (0 disables debouncing)")
+	flags.BoolVar(&rejectUnsigned, "reject-unsigned", false, "reject deliveries for repos without a configured secret with 403")
+	flags.BoolVar(&allowUnsigned, "allow-unsigned", false, "accept deliveries for repos without a configured secret, e.g. behind a trusted network")
+	flags.BoolVar(&payloadPretty, "payload-pretty", false, "debug: log the indented payload of every build, with the token redacted")
+	flags.BoolVar(&checkRunAppID, "check-run-app-id", false, "pass the ID of the app that created a re-requested check run through to the payload")
+	flags.BoolVar(&emitOnDraftPR, "emit-on-draft-pr", false, "build draft pull requests, which are skipped by default")
+	flags.IntVar(&ignoredStatus, "ignored-status", http.StatusOK, "HTTP status of responses to valid deliveries that are not built, e.g. 202 or 204")
+	flags.BoolVar(&emitPing, "emit-ping", false, "emit a ping build for pings of repo hooks, to test the wiring from GitHub to the worker")
+	flags.BoolVar(&checkEvents, "check-subscriptions", true, "warn at startup about emitted events the App isn't subscribed to, and vice versa")
+	flags.BoolVar(&compressPayloads, "build-payload-compression", false, "gzip build payloads larger than -build-payload-compression-threshold, for workers that decompress them")
+	flags.IntVar(&compressAbove, "build-payload-compression-threshold", 256*1024, "size in bytes above which build payloads are compressed")
+	flags.StringVar(&provider, "provider", defaultProvider(), "provider of the builds emitted for webhook events, e.g. github-enterprise")
+	flags.BoolVar(&enterpriseSuffix, "provider-enterprise-suffix", false, "append -enterprise to the provider of builds for projects on a GitHub Enterprise host")
+	flags.IntVar(&prCacheSize, "pull-request-cache-size", 0, "number of pull requests of issue comments to cache along with their ETag, which GitHub answers with 304 without counting against the rate limit while they are unchanged (0 disables the cache)")
+	flags.IntVar(&maxProcessBody, "max-process-body-bytes", 0, "size in bytes above which webhook deliveries are rejected with 413 (0 accepts any size)")
+	flags.IntVar(&maxRetainBody, "max-retain-body-bytes", 0, "size in bytes above which the body embedded into build payloads and their logs is truncated (0 retains any size)")
+	flags.IntVar(&deliveryCache, "delivery-cache-size", webhook.DefaultDeliveryCacheSize, "number of X-GitHub-Delivery IDs and their builds to remember, so that redeliveries are answered as duplicates without building anything again")
+	flags.BoolVar(&repoInfo, "repo-info", false, "add the topics and description of the repo to the payload, at the cost of an extra API call per repo every 10 minutes")
+	flags.BoolVar(&coalesceActions, "coalesce-actions", false, "emit a single build listing the emitted event types in the actions field, instead of one build per event type, for events with an action")
+	flags.BoolVar(&verifyPRHead, "verify-pull-request-head", false, "fetch pull requests again right before emitting builds for comments on them, and skip the build if the head moved")
+	flags.BoolVar(&pullStats, "pull-stats", false, "add the additions, deletions and changed files of pull requests to the payload of builds for comments on them")
+	flags.Int64Var(&defaultInstID, "default-installation-id", 0, "installation of the App to negotiate tokens for when a webhook event or custom resource carries none")
+	flags.DurationVar(&requestTimeout, "request-timeout", 0, "time after which webhook deliveries are answered with 504 and their GitHub API calls and build retries cancelled, e.g. 9s to stay within GitHub's delivery timeout (0 disables the timeout)")
+	flags.StringVar(&auditLog, "audit-log", "", "file to append a JSON line to for every created build, for auditing, or - for stdout")
+	flags.IntVar(&bufferSize, "buffer-size", 0, "number of builds of webhook deliveries to hold in memory while the Brigade store is unavailable, answering the deliveries with 202, and to create once it recovers (0 disables buffering)")
+	flags.StringVar(&spoolDir, "event-queue-persistence", "", "directory, like on a persistent volume, to persist debounced and buffered builds to, and to replay them from on startup (empty holds them in memory only)")
+	flags.IntVar(&spoolSize, "event-queue-persistence-size", webhook.DefaultSpoolSize, "maximum number of builds persisted to the -event-queue-persistence directory, beyond which builds are held in memory only")
+	flags.StringVar(&deadLetterDir, "dead-letter-dir", "", "directory to write builds that could not be created in Brigade to as JSON files, for inspection and replay")
+	flags.BoolVar(&caseInsensitive, "case-insensitive-repos", false, "match the repos of webhook deliveries that no project is found for to projects case-insensitively and ignoring the host, at the cost of listing the projects for such deliveries")
+	flags.BoolVar(&requireTLS, "require-tls", false, "reject webhook deliveries that didn't arrive over TLS, directly or via a -trusted-proxies proxy setting X-Forwarded-Proto: https, with 400")
+	flags.StringVar(&trustedProxies, "trusted-proxies", "", "CIDRs or IPs of the proxies, like the ingress controller, whose X-Forwarded-Proto header is trusted for -require-tls, separated by commas")
+	flags.StringVar(&targetTypes, "installation-target-types", "", "installation target types of the hooks whose deliveries are processed, separated by commas, like repository to ignore organization hooks (defaults to all)")
+	flags.BoolVar(&strictRepos, "strict-repos", false, "fail at startup if a Brigade project has no repo name in the form HOST/OWNER/NAME, and reject deliveries for such projects with 500")
+	flags.StringVar(&workflowRunConcl, "workflow-run-conclusions", strings.Join(webhook.DefaultWorkflowRunConclusions, ","), "conclusions of completed GitHub Actions workflow runs that emit workflow_run builds, separated by commas, like success,neutral")
+	flags.StringVar(&approvalReaction, "approval-reaction", "", "reaction, like +1, with which an allowed author approves a comment of the App on a pull request, emitting issue_comment:approved builds for its head when the comment is delivered (empty disables approvals by reaction)")
+	flags.BoolVar(&emitErrors, "emit-errors", false, "emit an EVENT:error build with the reason when the build for an event can't be prepared, like when fetching the pull request of a comment fails, so that the worker can tell the user")
+	flags.BoolVar(&decoupleCtrl, "decouple-controller", false, "keep serving webhooks when the custom resource controller fails to start or stops with an error, instead of exiting")
+	flags.BoolVar(&validateOnly, "validate-config", false, "validate the configuration like at startup, print the resolved configuration, and exit, without reading -key-file or starting any server (APP_ID is not discovered from APP_CLIENT_ID)")
+	flags.BoolVar(&requireMergeable, "require-mergeable", false, "skip builds for pull requests that GitHub reports as not mergeable")
 
 	flags.Parse(os.Args[1:])
 
-	if len(keyFile) == 0 {
-		log.Fatal("Key file is required")
-		os.Exit(1)
+	if jwtBackdate < 0 || jwtBackdate > webhook.MaxJWTBackdate {
+		log.Fatalf("-jwt-backdate must be between 0 and %s", webhook.MaxJWTBackdate)
+	}
+	webhook.JWTBackdate = jwtBackdate
+	if err := webhook.SetDefaultURLs(githubAPIURL, githubUploadURL); err != nil {
+		log.Fatalf("invalid -github-api-url or -github-upload-url: %s", err)
+	}
+	if err := webhook.SetTLSFiles(githubCAFile, githubCertFile, githubKeyFile); err != nil {
+		log.Fatalf("invalid -github-ca-file, -github-cert-file or -github-key-file: %s", err)
 	}
 
-	key, err := ioutil.ReadFile(keyFile)
-	if err != nil {
-		log.Fatalf("could not load key from %q: %s", keyFile, err)
-		os.Exit(1)
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "default-installation-id" && defaultInstID == 0 {
+			log.Fatal("-default-installation-id must not be zero when set")
+		}
+		set[f.Name] = true
+	})
+
+	fileCfg := &fileConfig{}
+	if configFile != "" {
+		var err error
+		fileCfg, err = loadConfig(configFile)
+		if err != nil {
+			log.Fatalf("invalid -config: %s", err)
+		}
+		fileCfg.apply(set)
+	}
+
+	var key []byte
+	var err error
+	if !validateOnly {
+		if len(keyFile) == 0 {
+			log.Fatal("Key file is required")
+			os.Exit(1)
+		}
+
+		key, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			log.Fatalf("could not load key from %q: %s", keyFile, err)
+			os.Exit(1)
+		}
 	}
 
 	if len(allowedAuthors) == 0 {
@@ -96,48 +256,236 @@ func main() {
 		return realVal
 	}
 
-	appID := envOrInt("APP_ID", 0)
+	appID := envOrInt("APP_ID", fileCfg.AppID)
+	defaultSecret := fileCfg.DefaultSharedSecret
+	if s, ok := os.LookupEnv("DEFAULT_SHARED_SECRET"); ok {
+		defaultSecret = s
+	}
+	if clientID := os.Getenv("APP_CLIENT_ID"); appID == 0 && clientID != "" && !validateOnly {
+		appID, err = webhook.DiscoverAppID(context.Background(), clientID, key, brigade.Github{})
+		if err != nil {
+			log.Fatalf("APP_ID is unset and discovering it for client ID %q failed: %s", clientID, err)
+		}
+		log.Printf("Discovered GitHub App ID %d", appID)
+	}
+	if checkEvents && appID != 0 && !validateOnly {
+		webhook.CheckEventSubscriptions(context.Background(), appID, key, brigade.Github{}, emittedEvents)
+	}
 	ghOpts := webhook.GithubOpts{
-		AppID:               appID,
-		DefaultSharedSecret: os.Getenv("DEFAULT_SHARED_SECRET"),
-		EmittedEvents:       emittedEvents,
+		AppID:                 appID,
+		DefaultSharedSecret:   defaultSecret,
+		EmittedEvents:         emittedEvents,
+		RequireMergeable:      requireMergeable,
+		ApprovalReaction:      approvalReaction,
+		EmitErrors:            emitErrors,
+		CaseInsensitiveRepos:  caseInsensitive,
+		DebounceWindow:        debounceWindow,
+		RejectUnsigned:        rejectUnsigned,
+		AllowUnsigned:         allowUnsigned,
+		EventProjects:         eventRoutes,
+		PayloadPretty:         payloadPretty,
+		CheckRunAppID:         checkRunAppID,
+		ServiceAccounts:       serviceAccounts,
+		EmitOnDraftPR:         emitOnDraftPR,
+		IgnoredStatus:         ignoredStatus,
+		EmitPing:              emitPing,
+		Provider:              provider,
+		EnterpriseSuffix:      enterpriseSuffix,
+		RepoInfo:              repoInfo,
+		PullRequestCacheSize:  prCacheSize,
+		MaxProcessBodyBytes:   maxProcessBody,
+		MaxRetainBodyBytes:    maxRetainBody,
+		DeliveryCacheSize:     deliveryCache,
+		BuildTypes:            buildTypes,
+		CoalesceActions:       coalesceActions,
+		VerifyPullRequestHead: verifyPRHead,
+		PullStats:             pullStats,
+		DefaultInstallationID: defaultInstID,
+		StrictRepos:           strictRepos,
+		RequireTLS:            requireTLS,
+		DefaultBranch:         defaultBranch,
 	}
-
-	kc, err := clientcmd.BuildConfigFromFlags(master, kubeconfig)
-	if err != nil {
+	if targetTypes != "" {
+		ghOpts.InstallationTargetTypes = strings.Split(targetTypes, ",")
+	}
+	if trustedProxies != "" {
+		ghOpts.TrustedProxies = strings.Split(trustedProxies, ",")
+	}
+	if workflowRunConcl != "" {
+		ghOpts.WorkflowRunConclusions = strings.Split(workflowRunConcl, ",")
+	}
+	if compressPayloads {
+		if compressAbove <= 0 {
+			log.Fatal("-build-payload-compression-threshold must be positive")
+		}
+		ghOpts.CompressionThreshold = compressAbove
+	}
+	if refTemplate != "" {
+		if ghOpts.RefTemplate, err = webhook.ParseRefTemplate(refTemplate); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for p, v := range rateLimits {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("-rate-limit for project %q must be a number of builds per minute, got %q", p, v)
+		}
+		if ghOpts.RateLimits == nil {
+			ghOpts.RateLimits = map[string]int{}
+		}
+		ghOpts.RateLimits[p] = n
+	}
+	for et, fields := range bodyFields {
+		if ghOpts.BodyFields == nil {
+			ghOpts.BodyFields = map[string][]string{}
+		}
+		ghOpts.BodyFields[et] = strings.Split(fields, ";")
+	}
+	for p, algs := range signatureAlgs {
+		if ghOpts.SignatureAlgorithms == nil {
+			ghOpts.SignatureAlgorithms = map[string][]string{}
+		}
+		ghOpts.SignatureAlgorithms[p] = strings.Split(algs, ";")
+	}
+	cfg := resolvedConfig{namespace, allowedAuthors, ghOpts, mappings, annotationPrefix}
+	if validateOnly {
+		if err := validateConfig(os.Stdout, cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := ghOpts.Validate(); err != nil {
 		log.Fatal(err)
 	}
+	if events := ghOpts.WildcardAppEvents(); ghOpts.AppID == 0 && len(events) > 0 {
+		log.Printf("WARNING: APP_ID is not set, so the builds of the %s events matched by -events fail to authenticate as the GitHub App. Set APP_ID, or exclude them with -events entries like !%s", strings.Join(events, ", "), events[0])
+	}
+	if auditLog != "" {
+		if ghOpts.AuditLog, err = webhook.OpenAuditLog(auditLog); err != nil {
+			log.Fatalf("could not open the audit log: %s", err)
+		}
+	}
+	if deadLetterDir != "" {
+		if ghOpts.DeadLetters, err = webhook.NewDirDeadLetters(deadLetterDir); err != nil {
+			log.Fatalf("could not create the dead-letter directory: %s", err)
+		}
+	}
 
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(kc)
+	// Secrets are left out of the JSON form of the options, and thus out of the hash
+	configHash, err := webhook.ConfigHash(cfg)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("could not compute config hash: %s", err)
+	}
+	gateway := webhook.Gateway{Version: version, ConfigHash: configHash}
+	ghOpts.Gateway = gateway
+	log.Printf("brigade-cd version %s, config hash %s", version, configHash)
+
+	// The memory store needs no cluster, unless custom resources are mapped
+	var kc *rest.Config
+	if storeKind != storeMemory || len(mappings) > 0 {
+		if kc, err = clientcmd.BuildConfigFromFlags(master, kubeconfig); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	store := kube.New(clientset, namespace)
-
-	router := gin.New()
-	router.Use(gin.Recovery())
+	store, err := newStore(storeKind, namespace, memoryProjects, kc)
+	if err != nil {
+		log.Fatalf("could not create the %s store: %s", storeKind, err)
+	}
 
-	events := router.Group("/events")
-	{
-		events.Use(gin.Logger())
-		events.POST("/github", webhook.NewGithubHookHandler(store, allowedAuthors, key, ghOpts))
-		events.POST("/github/:app/:inst", webhook.NewGithubHookHandler(store, allowedAuthors, key, ghOpts))
+	if strictRepos {
+		if err := webhook.ValidateProjectRepos(store); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	router.GET("/healthz", healthz)
+	if bufferSize < 0 {
+		log.Fatal("-buffer-size must not be negative")
+	}
+	// Everything stops on the first SIGINT or SIGTERM, after draining what's in flight
+	ctx := signalContext(syscall.SIGINT, syscall.SIGTERM)
+	if bufferSize > 0 {
+		ghOpts.Buffer = webhook.NewBuildBuffer(store, bufferSize)
+		go ghOpts.Buffer.Run(ctx.Done())
+	}
+	if spoolDir != "" {
+		if ghOpts.Spool, err = webhook.NewSpool(spoolDir, spoolSize); err != nil {
+			log.Fatalf("could not open the event queue persistence directory: %s", err)
+		}
+	}
 
 	keys := mappings
-	c := customresource.New(store, appID, key, kc, keys)
-	if err := c.Run(); err != nil {
-		log.Fatal(err)
+	c := customresource.New(store, appID, key, kc, keys).
+		WithGateway(gateway).
+		WithAnnotationPrefix(annotationPrefix).
+		WithRefTemplate(ghOpts.RefTemplate).
+		WithCompressionThreshold(ghOpts.CompressionThreshold).
+		WithBuildTypes(buildTypes)
+	if ghOpts.DeadLetters != nil {
+		c.WithDeadLetters(ghOpts.DeadLetters)
+	}
+	c.WithDefaultInstallationID(int(defaultInstID))
+	c.WithDefaultBranch(ghOpts.DefaultBranch)
+	c.WithStop(ctx.Done())
+	if ghOpts.AuditLog != nil {
+		c.WithAuditLog(ghOpts.AuditLog)
 	}
+	if len(mappings) > 0 {
+		if err := c.Run(); err != nil {
+			if !decoupleCtrl {
+				log.Fatal(err)
+			}
+			log.Printf("WARNING: not reconciling custom resources, as the controller failed to start: %s", err)
+		} else if !decoupleCtrl {
+			go func() {
+				if err := c.Wait(); err != nil {
+					log.Fatalf("custom resource controller failed: %s", err)
+				}
+			}()
+		}
+	}
+
+	router := newRouter(basePath, webhook.NewGithubHookHandler(store, allowedAuthors, key, ghOpts), webhook.NewProjectsHealthHandler(store, key, ghOpts), c, requestTimeout)
 
 	formattedGatewayPort := fmt.Sprintf(":%v", gatewayPort)
-	if err := router.Run(formattedGatewayPort); err != nil {
+	ln, err := net.Listen("tcp", formattedGatewayPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := serve(ctx, &http.Server{Handler: router}, ln, shutdownTimeout); err != nil {
 		log.Fatal(err)
 	}
+	if err := c.Wait(); err != nil {
+		log.Printf("WARNING: custom resource controller failed: %s", err)
+	}
+}
+
+// reconciler reconciles custom resources on demand
+type reconciler interface {
+	Reconcile(c context.Context, kind, namespace, name string, dryRun bool) (string, error)
+}
+
+// newRouter registers every route under basePath, e.g. "/brigade-cd".
+// Webhook deliveries time out after requestTimeout, unlike the admin endpoints,
+// which may legitimately take longer.
+func newRouter(basePath string, gh, projectsHealth gin.HandlerFunc, rc reconciler, requestTimeout time.Duration) http.Handler {
+	router := gin.New()
+	router.Use(gin.Recovery())
+
+	root := router.Group("/" + strings.Trim(basePath, "/"))
+	events := root.Group("/events")
+	{
+		events.Use(gin.Logger())
+		// Both routes share a handler so that they share any in-memory state like pending builds
+		events.POST("/github", gh)
+		events.POST("/github/:app/:inst", gh)
+	}
+
+	root.POST("/reconcile/:namespace/:name", reconcileHandler(rc))
+	root.GET("/projects/health", projectsHealth)
+	root.GET("/healthz", healthz)
+	root.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	return withTimeout(router, path.Join("/", basePath, "events")+"/", requestTimeout)
 }
 
 func defaultNamespace() string {
@@ -147,6 +495,13 @@ func defaultNamespace() string {
 	return v1.NamespaceDefault
 }
 
+func defaultProvider() string {
+	if p, ok := os.LookupEnv("BRIGADE_PROVIDER"); ok {
+		return p
+	}
+	return webhook.DefaultProvider
+}
+
 func defaultGatewayPort() string {
 	if port, ok := os.LookupEnv("BRIGADE_GATEWAY_PORT"); ok {
 		return port
@@ -154,6 +509,31 @@ func defaultGatewayPort() string {
 	return "7746"
 }
 
+// reconcileHandler forces a reconcile of a custom resource without editing it,
+// for debugging. The kind is given by the "kind" query parameter, and
+// "dryRun=true" determines the event type without emitting the build.
+func reconcileHandler(rc reconciler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		kind := c.Query("kind")
+		dryRun := c.Query("dryRun") == "true"
+		ns, name := c.Param("namespace"), c.Param("name")
+
+		eventType, err := rc.Reconcile(c.Request.Context(), kind, ns, name, dryRun)
+		switch {
+		case err == customresource.ErrUnknownKind:
+			c.JSON(http.StatusNotFound, gin.H{"status": fmt.Sprintf("no mapping for kind %q", kind)})
+		case apierrors.IsNotFound(err):
+			c.JSON(http.StatusNotFound, gin.H{"status": err.Error()})
+		case err != nil:
+			log.Printf("Failed to reconcile %s %s/%s: %s", kind, ns, name, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"status": err.Error()})
+		default:
+			log.Printf("Reconciled %s %s/%s into %q (dry run: %t)", kind, ns, name, eventType, dryRun)
+			c.JSON(http.StatusOK, gin.H{"status": "Reconciled", "eventType": eventType, "dryRun": dryRun})
+		}
+	}
+}
+
 func healthz(c *gin.Context) {
 	c.String(http.StatusOK, http.StatusText(http.StatusOK))
 }
@@ -169,7 +549,10 @@ func (a *Mappings) Set(value string) error {
 	}
 	kvs := strings.Split(value, ",")
 	for i, kv := range kvs {
-		split := strings.Split(kv, "=")
+		split := strings.SplitN(kv, "=", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("mapping %q must be in the form KEY=VALUE", kv)
+		}
 		k, v := split[0], split[1]
 		switch k {
 		case "group", "g":
@@ -180,10 +563,118 @@ func (a *Mappings) Set(value string) error {
 			m.Kind = v
 		case "project", "p":
 			m.BrigadeProject = v
+		case "phase-field":
+			m.PhaseField = v
+		case "phase":
+			pa := strings.SplitN(v, ":", 2)
+			if len(pa) != 2 {
+				return fmt.Errorf("phase at index %d, %q, in input %q must be in the form PHASE:ACTION", i, v, value)
+			}
+			if m.Phases == nil {
+				m.Phases = map[string]string{}
+			}
+			m.Phases[pa[0]] = pa[1]
+		case "service-account", "sa":
+			m.ServiceAccount = v
+		case "cascade":
+			gvk, err := customresource.ParseKind(v)
+			if err != nil {
+				return fmt.Errorf("cascade at index %d in input %q: %v", i, value, err)
+			}
+			m.CascadeKinds = append(m.CascadeKinds, gvk)
+		case "reference":
+			// KIND:FIELD, like ConfigMap:spec.configMapRef.name
+			ref := strings.SplitN(v, ":", 2)
+			if len(ref) != 2 {
+				return fmt.Errorf("reference at index %d, %q, in input %q must be in the form KIND:FIELD", i, v, value)
+			}
+			m.References = append(m.References, customresource.Reference{Kind: ref[0], Field: ref[1]})
+		case "field":
+			// KEY:PATH, like tag:spec.image.tag
+			kp := strings.SplitN(v, ":", 2)
+			if len(kp) != 2 {
+				return fmt.Errorf("field at index %d, %q, in input %q must be in the form KEY:PATH", i, v, value)
+			}
+			if m.Fields == nil {
+				m.Fields = map[string]string{}
+			}
+			m.Fields[kp[0]] = kp[1]
+		case "branch-project":
+			// BRANCH:PROJECT, like main:myorg/prod, as branch names can't contain colons
+			bp := strings.SplitN(v, ":", 2)
+			if len(bp) != 2 {
+				return fmt.Errorf("branch project at index %d, %q, in input %q must be in the form BRANCH:PROJECT", i, v, value)
+			}
+			if m.BranchProjects == nil {
+				m.BranchProjects = map[string]string{}
+			}
+			m.BranchProjects[bp[0]] = bp[1]
+		case "deletion":
+			m.Deletion = v
+		case "unapproved":
+			m.Unapproved = v
+		case "apply":
+			m.ApplyEvent = v
+		case "plan":
+			m.PlanEvent = v
+		case "destroy":
+			m.DestroyEvent = v
+		case "default-branch":
+			m.DefaultBranch = v
+		case "type-case":
+			m.TypeCase = v
+		case "namespace":
+			m.Namespace = v
+		case "label-selector":
+			// Requirements are separated by semicolons, as commas separate the keys
+			m.LabelSelector = strings.Replace(v, ";", ",", -1)
+		case "previous-build":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("previous-build at index %d, %q, in input %q must be true or false", i, v, value)
+			}
+			m.PreviousBuild = b
+		case "action-only":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("action-only at index %d, %q, in input %q must be true or false", i, v, value)
+			}
+			m.ActionOnly = b
+		case "recreate-window":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("recreate-window at index %d, %q, in input %q must be a duration like 30s", i, v, value)
+			}
+			m.RecreateWindow = d
+		case "max-concurrent-reconciles":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("max-concurrent-reconciles at index %d, %q, in input %q must be a number", i, v, value)
+			}
+			m.MaxConcurrentReconciles = n
+		case "commit-status":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("commit-status at index %d, %q, in input %q must be true or false", i, v, value)
+			}
+			m.CommitStatus = b
+		case "commit-state":
+			// ACTION:OUTCOME:STATE, like apply:failure:failure
+			j := strings.LastIndex(v, ":")
+			if j < 0 {
+				return fmt.Errorf("commit state at index %d, %q, in input %q must be in the form ACTION:OUTCOME:STATE", i, v, value)
+			}
+			if m.CommitStates == nil {
+				m.CommitStates = map[string]string{}
+			}
+			m.CommitStates[v[:j]] = v[j+1:]
 		default:
 			return fmt.Errorf("unexpected key at index %d, %q, in input %q", i, k, value)
 		}
 	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
 	*a = append(*a, m)
 	return nil
 }
@@ -221,3 +712,27 @@ func (a *events) Set(value string) error {
 func (a *events) String() string {
 	return strings.Join(*a, ",")
 }
+
+type keyValues map[string]string
+
+func (a *keyValues) Set(value string) error {
+	if *a == nil {
+		*a = keyValues{}
+	}
+	for _, kv := range strings.Split(value, ",") {
+		split := strings.SplitN(kv, "=", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("%q in input %q must be in the form KEY=VALUE", kv, value)
+		}
+		(*a)[split[0]] = split[1]
+	}
+	return nil
+}
+
+func (a *keyValues) String() string {
+	strs := []string{}
+	for k, v := range *a {
+		strs = append(strs, k+"="+v)
+	}
+	return strings.Join(strs, ",")
+}
@@ -1,6 +1,22 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mumoshu/brigade-cd/pkg/customresource"
+	"gopkg.in/gin-gonic/gin.v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
 
 func TestAuthors(t *testing.T) {
 	expand := "a,b,c"
@@ -22,3 +38,399 @@ func TestAuthors(t *testing.T) {
 		t.Errorf("Expected %q, got %q", expect, got)
 	}
 }
+
+func TestMappings(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("group=cd.brigade.sh,version=v1alpha1,kind=ReleaseSet,project=myorg/myapp,phase-field=spec.phase,phase=provision:apply,phase=teardown:destroy"); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 {
+		t.Fatalf("expected one mapping, got %d", len(m))
+	}
+	if m[0].PhaseField != "spec.phase" {
+		t.Errorf("unexpected phase field %q", m[0].PhaseField)
+	}
+	if m[0].Phases["provision"] != "apply" || m[0].Phases["teardown"] != "destroy" {
+		t.Errorf("unexpected phases %v", m[0].Phases)
+	}
+
+	for _, invalid := range []string{
+		"kind=ReleaseSet,phase-field=spec.phase,phase=provision",
+		"kind=ReleaseSet,phase-field=spec.phase,phase=provision:deploy",
+		"kind=ReleaseSet,phase=provision:apply",
+	} {
+		if err := (&Mappings{}).Set(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestMappings_malformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "no equals", value: "kind"},
+		{name: "trailing key", value: "kind=ReleaseSet,project"},
+		{name: "empty pair", value: "kind=ReleaseSet,,project=myorg/myapp"},
+		{name: "empty", value: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Mappings{}).Set(tt.value)
+			if err == nil || !strings.Contains(err.Error(), "must be in the form KEY=VALUE") {
+				t.Errorf("expected an error for %q, got %v", tt.value, err)
+			}
+		})
+	}
+}
+
+func TestKeyValues(t *testing.T) {
+	e := keyValues{}
+	if err := e.Set("release=release-pipeline,push:deleted=cleanup"); err != nil {
+		t.Fatal(err)
+	}
+	if e["release"] != "release-pipeline" || e["push:deleted"] != "cleanup" {
+		t.Errorf("unexpected routes %v", e)
+	}
+	if err := e.Set("release"); err == nil {
+		t.Error("expected an error for a route without a project")
+	}
+}
+
+func TestNewRouter(t *testing.T) {
+	tests := []struct {
+		basePath string
+		prefix   string
+	}{
+		{basePath: "", prefix: ""},
+		{basePath: "/brigade-cd", prefix: "/brigade-cd"},
+		{basePath: "brigade-cd/", prefix: "/brigade-cd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.basePath, func(t *testing.T) {
+			var hooks []string
+			router := newRouter(tt.basePath, func(c *gin.Context) {
+				hooks = append(hooks, c.Param("app")+"/"+c.Param("inst"))
+				c.Status(http.StatusOK)
+			}, func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			}, &testReconciler{}, 0)
+
+			for _, r := range []struct {
+				method string
+				path   string
+			}{
+				{"GET", "/healthz"},
+				{"GET", "/metrics"},
+				{"POST", "/events/github"},
+				{"POST", "/events/github/13/2311213"},
+				{"POST", "/reconcile/default/myapp"},
+				{"GET", "/projects/health"},
+			} {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(r.method, tt.prefix+r.path, nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("%s %s: expected 200, got %d", r.method, tt.prefix+r.path, w.Code)
+				}
+			}
+
+			if len(hooks) != 2 || hooks[0] != "/" || hooks[1] != "13/2311213" {
+				t.Errorf("unexpected webhook params %v", hooks)
+			}
+
+			if tt.prefix != "" {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+				if w.Code != http.StatusNotFound {
+					t.Errorf("expected unprefixed routes to be gone, got %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestMappings_cascade(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("group=cd.brigade.sh,version=v1alpha1,kind=ReleaseSet,project=myorg/myapp,cascade=cd.brigade.sh/v1alpha1/Release"); err != nil {
+		t.Fatal(err)
+	}
+	if len(m[0].CascadeKinds) != 1 || m[0].CascadeKinds[0].Kind != "Release" {
+		t.Errorf("unexpected cascade kinds %v", m[0].CascadeKinds)
+	}
+	if err := (&Mappings{}).Set("kind=ReleaseSet,cascade=Release"); err == nil {
+		t.Error("expected an error for a cascade kind without an API version")
+	}
+}
+
+func TestMappings_references(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp,reference=ConfigMap:spec.configMapRef.name,reference=Secret:spec.secretName"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []customresource.Reference{{Kind: "ConfigMap", Field: "spec.configMapRef.name"}, {Kind: "Secret", Field: "spec.secretName"}}
+	if !reflect.DeepEqual(m[0].References, expected) {
+		t.Errorf("expected references %v, got %v", expected, m[0].References)
+	}
+	for _, invalid := range []string{"kind=ReleaseSet,reference=spec.configMapRef", "kind=ReleaseSet,reference=Deployment:spec.deployment"} {
+		if err := (&Mappings{}).Set(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestMappings_fields(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp,field=tag:spec.image.tag,field=replicas:spec.replicas"); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"tag": "spec.image.tag", "replicas": "spec.replicas"}
+	if !reflect.DeepEqual(m[0].Fields, expected) {
+		t.Errorf("expected fields %v, got %v", expected, m[0].Fields)
+	}
+	for _, invalid := range []string{"kind=ReleaseSet,field=spec.image.tag", "kind=ReleaseSet,field=tag:spec..tag", "kind=ReleaseSet,field=tag:spec.containers[0].image"} {
+		if err := (&Mappings{}).Set(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestMappings_maxConcurrentReconciles(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp,max-concurrent-reconciles=4"); err != nil {
+		t.Fatal(err)
+	}
+	if n := m[0].MaxConcurrentReconciles; n != 4 {
+		t.Errorf("expected 4 concurrent reconciles, got %d", n)
+	}
+	for _, invalid := range []string{"kind=ReleaseSet,max-concurrent-reconciles=many", "kind=ReleaseSet,max-concurrent-reconciles=-1"} {
+		if err := (&Mappings{}).Set(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestMappings_deletion(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=Preview,project=myorg/myapp,deletion=ignore"); err != nil {
+		t.Fatal(err)
+	}
+	if d := m[0].Deletion; d != customresource.DeletionIgnore {
+		t.Errorf("expected the ignore deletion mode, got %q", d)
+	}
+	if err := (&Mappings{}).Set("kind=Preview,deletion=orphan"); err == nil {
+		t.Error("expected an error for an unknown deletion mode")
+	}
+}
+
+func TestMappings_unapproved(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp,unapproved=reject"); err != nil {
+		t.Fatal(err)
+	}
+	if u := m[0].Unapproved; u != customresource.UnapprovedReject {
+		t.Errorf("expected the reject unapproved mode, got %q", u)
+	}
+	if err := (&Mappings{}).Set("kind=ReleaseSet,unapproved=queue"); err == nil {
+		t.Error("expected an error for an unknown unapproved mode")
+	}
+}
+
+func TestMappings_previousBuild(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp,previous-build=true"); err != nil {
+		t.Fatal(err)
+	}
+	if !m[0].PreviousBuild {
+		t.Error("expected previous builds to be enabled")
+	}
+	if err := (&Mappings{}).Set("kind=ReleaseSet,previous-build=maybe"); err == nil {
+		t.Error("expected an error for a previous-build that is not a bool")
+	}
+}
+
+func TestMappings_actionOnly(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set("kind=Preview,project=myorg/myapp,action-only=true"); err != nil {
+		t.Fatal(err)
+	}
+	if m[0].ActionOnly || !m[1].ActionOnly {
+		t.Errorf("expected only the second mapping to be action-only, got %v and %v", m[0].ActionOnly, m[1].ActionOnly)
+	}
+	if err := (&Mappings{}).Set("kind=ReleaseSet,action-only=maybe"); err == nil {
+		t.Error("expected an error for an action-only that is not a bool")
+	}
+}
+
+func TestMappings_eventTypes(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("group=prod.example.com,kind=App,project=myorg/prod,apply=deploy:prod,plan=diff:prod,destroy=teardown:prod,default-branch=main"); err != nil {
+		t.Fatal(err)
+	}
+	expected := customresource.Mapping{
+		Group:          "prod.example.com",
+		Kind:           "App",
+		BrigadeProject: "myorg/prod",
+		ApplyEvent:     "deploy:prod",
+		PlanEvent:      "diff:prod",
+		DestroyEvent:   "teardown:prod",
+		DefaultBranch:  "main",
+	}
+	if !reflect.DeepEqual(m[0], expected) {
+		t.Errorf("expected %+v, got %+v", expected, m[0])
+	}
+	if err := (&Mappings{}).Set("kind=App,apply=deploy,plan=deploy"); err == nil {
+		t.Error("expected an error for actions with the same event type")
+	}
+	if err := (&Mappings{}).Set("kind=App,destroy=app:apply"); err == nil {
+		t.Error("expected an error for an event type of another action by default")
+	}
+}
+
+func TestMappings_typeCase(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp,type-case=original"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set("group=prod.example.com,kind=ReleaseSet,project=myorg/prod,type-case={{.Kind | upper}}"); err != nil {
+		t.Fatal(err)
+	}
+	if m[0].TypeCase != customresource.TypeCaseOriginal || m[1].TypeCase != "{{.Kind | upper}}" {
+		t.Errorf("expected the type cases original and {{.Kind | upper}}, got %q and %q", m[0].TypeCase, m[1].TypeCase)
+	}
+	if err := (&Mappings{}).Set("kind=ReleaseSet,type-case=upper"); err == nil {
+		t.Error("expected an error for an unknown type case")
+	}
+}
+
+func TestMappings_scope(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp,namespace=tenant-a,label-selector=app=myapp;tier!=test"); err != nil {
+		t.Fatal(err)
+	}
+	if m[0].Namespace != "tenant-a" || m[0].LabelSelector != "app=myapp,tier!=test" {
+		t.Errorf("expected namespace tenant-a and label selector app=myapp,tier!=test, got %q and %q", m[0].Namespace, m[0].LabelSelector)
+	}
+	if err := (&Mappings{}).Set("kind=ReleaseSet,label-selector=app in myapp"); err == nil {
+		t.Error("expected an error for an invalid label selector")
+	}
+}
+
+func TestMappings_recreateWindow(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp,recreate-window=30s"); err != nil {
+		t.Fatal(err)
+	}
+	if w := m[0].RecreateWindow; w != 30*time.Second {
+		t.Errorf("expected a recreate window of 30s, got %s", w)
+	}
+	for _, invalid := range []string{"kind=ReleaseSet,recreate-window=soon", "kind=ReleaseSet,recreate-window=-1s", "kind=ReleaseSet,deletion=ignore,recreate-window=30s"} {
+		if err := (&Mappings{}).Set(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestMappings_branchProjects(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp,branch-project=main:myorg/prod,branch-project=develop:myorg/staging"); err != nil {
+		t.Fatal(err)
+	}
+	if bp := m[0].BranchProjects; len(bp) != 2 || bp["main"] != "myorg/prod" || bp["develop"] != "myorg/staging" {
+		t.Errorf("unexpected branch projects %v", bp)
+	}
+	for _, invalid := range []string{"kind=ReleaseSet,branch-project=main", "kind=ReleaseSet,branch-project=main:", "kind=ReleaseSet,branch-project=:myorg/prod"} {
+		if err := (&Mappings{}).Set(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestMappings_commitStatus(t *testing.T) {
+	m := Mappings{}
+	if err := m.Set("kind=ReleaseSet,project=myorg/myapp,commit-status=true,commit-state=apply:failure:failure"); err != nil {
+		t.Fatal(err)
+	}
+	if !m[0].CommitStatus || m[0].CommitStates["apply:failure"] != "failure" {
+		t.Errorf("unexpected commit status settings %v %v", m[0].CommitStatus, m[0].CommitStates)
+	}
+	for _, invalid := range []string{
+		"kind=ReleaseSet,commit-status=maybe",
+		"kind=ReleaseSet,commit-status=true,commit-state=apply",
+		"kind=ReleaseSet,commit-status=true,commit-state=apply:failure:broken",
+		"kind=ReleaseSet,commit-state=apply:failure:failure",
+	} {
+		if err := (&Mappings{}).Set(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+// testReconciler records reconciles, and fails them with err
+type testReconciler struct {
+	reconciled []string
+	err        error
+}
+
+func (r *testReconciler) Reconcile(c context.Context, kind, namespace, name string, dryRun bool) (string, error) {
+	if r.err != nil {
+		return "", r.err
+	}
+	r.reconciled = append(r.reconciled, fmt.Sprintf("%s %s/%s %t", kind, namespace, name, dryRun))
+	if dryRun {
+		return "releaseset:plan", nil
+	}
+	return "releaseset:apply", nil
+}
+
+func TestReconcileHandler(t *testing.T) {
+	notFound := apierrors.NewNotFound(schema.GroupResource{Group: "cd.brigade.sh", Resource: "releasesets"}, "myapp")
+	tests := []struct {
+		name       string
+		query      string
+		err        error
+		code       int
+		eventType  string
+		reconciled string
+	}{
+		{name: "apply", query: "?kind=ReleaseSet", code: http.StatusOK, eventType: "releaseset:apply", reconciled: "ReleaseSet default/myapp false"},
+		{name: "dry run", query: "?kind=ReleaseSet&dryRun=true", code: http.StatusOK, eventType: "releaseset:plan", reconciled: "ReleaseSet default/myapp true"},
+		{name: "unknown kind", query: "?kind=Unknown", err: customresource.ErrUnknownKind, code: http.StatusNotFound},
+		{name: "object not found", query: "?kind=ReleaseSet", err: notFound, code: http.StatusNotFound},
+		{name: "failure", query: "?kind=ReleaseSet", err: errors.New("store unavailable"), code: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &testReconciler{err: tt.err}
+			router := newRouter("", func(c *gin.Context) {}, func(c *gin.Context) {}, rc, 0)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("POST", "/reconcile/default/myapp"+tt.query, nil))
+
+			if w.Code != tt.code {
+				t.Fatalf("expected %d, got %d\n%s", tt.code, w.Code, w.Body.String())
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			res := struct {
+				EventType string `json:"eventType"`
+			}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.EventType != tt.eventType {
+				t.Errorf("expected event type %q, got %q", tt.eventType, res.EventType)
+			}
+			if len(rc.reconciled) != 1 || rc.reconciled[0] != tt.reconciled {
+				t.Errorf("expected %q to be reconciled, got %v", tt.reconciled, rc.reconciled)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// shutdownTimeout bounds how long in-flight requests are waited for on shutdown.
+// Kubernetes kills the pod 30 seconds after SIGTERM by default.
+const shutdownTimeout = 25 * time.Second
+
+// signalContext returns a context that is cancelled once one of sigs is received.
+func signalContext(sigs ...os.Signal) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		s := <-ch
+		log.Printf("Received %s, shutting down", s)
+		signal.Stop(ch)
+		cancel()
+	}()
+	return ctx
+}
+
+// serve serves srv on ln until ctx is cancelled, and then stops accepting
+// connections and waits up to timeout for in-flight requests, like webhook
+// deliveries, to complete.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdown); err != nil {
+		return err
+	}
+	if err := <-errs; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
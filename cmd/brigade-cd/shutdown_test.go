@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServe_shutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	inFlight := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(inFlight)
+		<-release
+		w.Write([]byte(`{"status":"Complete"}`))
+	})}
+
+	ctx := signalContext(syscall.SIGUSR1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, srv, ln, time.Second)
+	}()
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		res, err := http.Post("http://"+addr+"/events/github", "application/json", nil)
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		responses <- result{code: res.StatusCode, body: string(body), err: err}
+	}()
+	<-inFlight
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the signal to cancel the context")
+	}
+
+	// The listener closes once the shutdown started
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("expected new connections to be refused during the shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("expected serve to wait for the in-flight request, returned %v", err)
+	default:
+	}
+
+	close(release)
+	res := <-responses
+	if res.err != nil || res.code != http.StatusOK || res.body != `{"status":"Complete"}` {
+		t.Errorf("expected the in-flight request to complete, got %d %q: %v", res.code, res.body, res.err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected serve to return once the in-flight request completed")
+	}
+}
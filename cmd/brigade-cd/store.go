@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brigadecore/brigade/pkg/storage"
+	"github.com/brigadecore/brigade/pkg/storage/kube"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/mumoshu/brigade-cd/pkg/memstore"
+)
+
+// Kinds of stores of -store
+const (
+	storeKube   = "kube"
+	storeMemory = "memory"
+)
+
+// newStore creates the Brigade store of the given kind. The kube store keeps
+// projects and builds as secrets in namespace of the cluster of kc. The memory
+// store loads its projects from projectsFile, if set.
+func newStore(kind, namespace, projectsFile string, kc *rest.Config) (storage.Store, error) {
+	switch kind {
+	case storeKube:
+		clientset, err := kubernetes.NewForConfig(kc)
+		if err != nil {
+			return nil, err
+		}
+		return kube.New(clientset, namespace), nil
+	case storeMemory:
+		if projectsFile == "" {
+			return memstore.New(), nil
+		}
+		projs, err := memstore.LoadProjects(projectsFile)
+		if err != nil {
+			return nil, err
+		}
+		return memstore.New(projs...), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q, must be %s or %s", kind, storeKube, storeMemory)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/mumoshu/brigade-cd/pkg/customresource"
+	"github.com/mumoshu/brigade-cd/pkg/webhook"
+)
+
+func TestNewStore_unknown(t *testing.T) {
+	if _, err := newStore("etcd", "default", "", nil); err == nil {
+		t.Error("expected an error for an unknown store")
+	}
+}
+
+func TestServer_memoryStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	projectsFile := filepath.Join(dir, "projects.json")
+	if err := ioutil.WriteFile(projectsFile, []byte(`[{"name": "myorg/myapp", "sharedSecret": "asdf"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newStore(storeMemory, "default", projectsFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := webhook.GithubOpts{EmittedEvents: []string{"*"}}
+	c := customresource.New(store, 0, nil, nil, nil)
+	ts := httptest.NewServer(newRouter("", webhook.NewGithubHookHandler(store, nil, nil, opts), webhook.NewProjectsHealthHandler(store, nil, opts), c, 0))
+	defer ts.Close()
+
+	payload := []byte(`{
+  "action": "created",
+  "milestone": {"id": 3361444, "number": 1, "title": "v1.0"},
+  "repository": {"id": 35129377, "full_name": "myorg/myapp"},
+  "sender": {"id": 6752317, "login": "octocat"}
+}`)
+	req, err := http.NewRequest("POST", ts.URL+"/events/github", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-GitHub-Event", "milestone")
+	req.Header.Set("X-Hub-Signature", webhook.SHA1HMAC([]byte("asdf"), payload))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", res.StatusCode, body)
+	}
+
+	builds, err := store.GetBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 || builds[0].Type != "milestone" || builds[1].Type != "milestone:created" {
+		t.Fatalf("expected milestone builds in the memory store, got %v", builds)
+	}
+	if id := brigade.ProjectID("myorg/myapp"); builds[0].ProjectID != id || builds[0].ID == "" {
+		t.Errorf("expected a build with an ID for project %s, got %q of %s", id, builds[0].ID, builds[0].ProjectID)
+	}
+}
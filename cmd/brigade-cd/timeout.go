@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeoutBody is the body of the response to requests that timed out
+const timeoutBody = `{"status":"Timed out"}`
+
+// timeoutWriter buffers the response of the handler, so that it can be
+// discarded in favor of the timeout response.
+type timeoutWriter struct {
+	header http.Header
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.buf.Write(b)
+}
+
+// withTimeout responds with 504 to requests under prefix whose handling takes
+// longer than d in total, and cancels their context, which aborts outstanding
+// GitHub API calls made with it. Zero disables the timeout.
+//
+// Like http.TimeoutHandler, the response is buffered, and the handler keeps
+// running after the timeout until it returns. Unlike it, the timeout response is
+// a 504, as the gateway timed out waiting for GitHub or the store.
+func withTimeout(h http.Handler, prefix string, d time.Duration) http.Handler {
+	if d <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			h.ServeHTTP(rw, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		w := &timeoutWriter{header: http.Header{}}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			h.ServeHTTP(w, r)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			dst := rw.Header()
+			for k, v := range w.header {
+				dst[k] = v
+			}
+			if w.code == 0 {
+				w.code = http.StatusOK
+			}
+			rw.WriteHeader(w.code)
+			rw.Write(w.buf.Bytes())
+		case <-ctx.Done():
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.timedOut = true
+			log.Printf("Request to %s timed out after %s", r.URL.Path, d)
+			rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+			rw.WriteHeader(http.StatusGatewayTimeout)
+			rw.Write([]byte(timeoutBody))
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		delay    time.Duration
+		expected int
+	}{
+		{name: "fast handler", timeout: time.Second, delay: 0, expected: http.StatusOK},
+		{name: "slow handler", timeout: 10 * time.Millisecond, delay: time.Second, expected: http.StatusGatewayTimeout},
+		{name: "disabled", timeout: 0, delay: 20 * time.Millisecond, expected: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancelled := make(chan bool, 1)
+			router := gin.New()
+			router.POST("/events/github", func(c *gin.Context) {
+				select {
+				case <-time.After(tt.delay):
+					cancelled <- false
+				case <-c.Request.Context().Done():
+					cancelled <- true
+				}
+				c.Header("X-Handled", "true")
+				c.JSON(http.StatusOK, gin.H{"status": "Complete"})
+			})
+
+			w := httptest.NewRecorder()
+			withTimeout(router, "/events/", tt.timeout).ServeHTTP(w, httptest.NewRequest("POST", "/events/github", nil))
+
+			if w.Code != tt.expected {
+				t.Fatalf("expected %d, got %d\n%s", tt.expected, w.Code, w.Body.String())
+			}
+			timedOut := tt.expected == http.StatusGatewayTimeout
+			if got := <-cancelled; got != timedOut {
+				t.Errorf("expected the request context to be cancelled: %v, got %v", timedOut, got)
+			}
+			if timedOut {
+				if w.Header().Get("X-Handled") != "" {
+					t.Error("expected the header of the handler to be discarded")
+				}
+				if body := w.Body.String(); body != timeoutBody {
+					t.Errorf("unexpected body %s", body)
+				}
+			} else if w.Header().Get("X-Handled") != "true" {
+				t.Error("expected the header of the handler")
+			}
+		})
+	}
+}
+
+func TestNewRouter_requestTimeout(t *testing.T) {
+	slow := func(c *gin.Context) {
+		<-c.Request.Context().Done()
+		c.Status(http.StatusOK)
+	}
+	router := newRouter("/brigade-cd", slow, func(c *gin.Context) {
+		time.Sleep(30 * time.Millisecond)
+		c.Status(http.StatusOK)
+	}, &testReconciler{}, 10*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/brigade-cd/events/github", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected deliveries to time out with 504, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/brigade-cd/projects/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected admin endpoints not to time out, got %d", w.Code)
+	}
+}
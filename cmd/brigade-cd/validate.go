@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/mumoshu/brigade-cd/pkg/webhook"
+)
+
+// resolvedConfig is the configuration of the gateway as resolved from the flags
+// and the environment. Its JSON form is hashed into the config hash, and
+// printed by -validate-config. Secrets are left out of the JSON form.
+type resolvedConfig struct {
+	Namespace        string
+	AllowedAuthors   []string
+	Github           webhook.GithubOpts
+	Mappings         Mappings
+	AnnotationPrefix string
+}
+
+// validateConfig validates cfg like at startup and writes it to w as indented
+// JSON, for operators to check the flags of a deploy beforehand. The mappings
+// have been validated when parsing the flags.
+func validateConfig(w io.Writer, cfg resolvedConfig) error {
+	if err := cfg.Github.Validate(); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/brigade-cd/pkg/webhook"
+)
+
+func TestValidateConfig(t *testing.T) {
+	var m Mappings
+	var a authors
+	var e events
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Var(&m, "mapping", "")
+	flags.Var(&a, "authors", "")
+	flags.Var(&e, "events", "")
+	if err := flags.Parse([]string{"-mapping", "kind=ReleaseSet,project=myorg/myapp,deletion=ignore", "-authors", "owner,member", "-events", "push"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cfg := resolvedConfig{Namespace: "default", AllowedAuthors: a, Github: webhook.GithubOpts{EmittedEvents: e}, Mappings: m}
+	if err := validateConfig(&out, cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expected := range []string{`"Kind": "ReleaseSet"`, `"Deletion": "ignore"`, `"OWNER"`, `"PUSH"`} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %s in the resolved configuration, got\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestValidateConfig_invalid(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.Var(&Mappings{}, "mapping", "")
+	if err := flags.Parse([]string{"-mapping", "kind=ReleaseSet,deletion=orphan"}); err == nil {
+		t.Error("expected an error for an invalid mapping")
+	}
+
+	var out bytes.Buffer
+	cfg := resolvedConfig{Github: webhook.GithubOpts{EmittedEvents: []string{"issue_comment"}}}
+	if err := validateConfig(&out, cfg); err == nil || !strings.Contains(err.Error(), "APP_ID must be set") {
+		t.Errorf("expected an error for issue comments without an App, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected nothing to be printed for an invalid configuration, got\n%s", out.String())
+	}
+}
@@ -11,7 +11,7 @@ require (
 	github.com/google/go-github/v27 v27.0.4
 	github.com/mattn/go-isatty v0.0.7 // indirect
 	github.com/oklog/ulid v1.3.1 // indirect
-	github.com/prometheus/client_golang v1.0.0 // indirect
+	github.com/prometheus/client_golang v1.0.0
 	github.com/summerwind/whitebox-controller v0.7.0
 	github.com/ugorji/go/codec v0.0.0-20181204163529-d75b2dcb6bc8 // indirect
 	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4 // indirect
@@ -24,6 +24,7 @@ require (
 	k8s.io/client-go v11.0.1-0.20190409021438-1a26190bd76a+incompatible
 	k8s.io/kube-openapi v0.0.0-20190722073852-5e22f3d471e6 // indirect
 	sigs.k8s.io/controller-runtime v0.2.0-beta.4
+	sigs.k8s.io/yaml v1.1.0
 )
 
 replace github.com/docker/distribution => github.com/docker/distribution v2.7.1+incompatible
@@ -0,0 +1,73 @@
+package customresource
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// annotationCascadedFrom is set on owned objects to have them reconciled after their owner
+const annotationCascadedFrom = "cascaded-from"
+
+// cascade updates every object of the cascade kinds that o owns, so that their own
+// controllers reconcile them and re-emit their builds.
+//
+// The owned objects must be of mapped kinds for builds to be emitted for them.
+func (h *Handler) cascade(o *Object) error {
+	for _, gvk := range h.cascadeKinds {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		if err := h.kubeclient.List(context.TODO(), list, client.InNamespace(o.Namespace)); err != nil {
+			return fmt.Errorf("failed listing %s in %s: %v", gvk.Kind, o.Namespace, err)
+		}
+
+		for i := range list.Items {
+			child := &list.Items[i]
+			if !isOwnedBy(child, o.UID) {
+				continue
+			}
+
+			a := child.GetAnnotations()
+			if a == nil {
+				a = map[string]string{}
+			}
+			a[h.annotationPrefix+annotationCascadedFrom] = fmt.Sprintf("%s/%s@%s", o.Kind, o.Name, o.ResourceVersion)
+			child.SetAnnotations(a)
+
+			fmt.Fprintf(os.Stderr, "Cascading %s/%s to %s/%s\n", o.Kind, o.Name, gvk.Kind, child.GetName())
+			if err := h.kubeclient.Update(context.TODO(), child); err != nil {
+				return fmt.Errorf("failed updating %s %s/%s: %v", gvk.Kind, o.Namespace, child.GetName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func isOwnedBy(o *unstructured.Unstructured, uid types.UID) bool {
+	for _, ref := range o.GetOwnerReferences() {
+		if ref.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseKind parses a kind in the form APIVERSION/KIND, like `cd.brigade.sh/v1alpha1/Release`
+// or `v1/ConfigMap`.
+func ParseKind(s string) (schema.GroupVersionKind, error) {
+	i := strings.LastIndex(s, "/")
+	if i <= 0 || i == len(s)-1 {
+		return schema.GroupVersionKind{}, fmt.Errorf("kind %q must be in the form APIVERSION/KIND", s)
+	}
+	gv, err := schema.ParseGroupVersion(s[:i])
+	if err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	return gv.WithKind(s[i+1:]), nil
+}
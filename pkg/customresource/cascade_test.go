@@ -0,0 +1,142 @@
+package customresource
+
+import (
+	"context"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// testClient serves a fixed set of objects to Get and List and records updates
+type testClient struct {
+	objects []unstructured.Unstructured
+	updated []string
+	client.Client
+}
+
+func (c *testClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	u := obj.(*unstructured.Unstructured)
+	for _, o := range c.objects {
+		if o.GetKind() == u.GetKind() && o.GetNamespace() == key.Namespace && o.GetName() == key.Name {
+			o.DeepCopyInto(u)
+			return nil
+		}
+	}
+	return apierrors.NewNotFound(schema.GroupResource{Resource: u.GetKind()}, key.Name)
+}
+
+func (c *testClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOptionFunc) error {
+	l := list.(*unstructured.UnstructuredList)
+	kind := l.GetKind()[:len(l.GetKind())-len("List")]
+	for _, o := range c.objects {
+		if o.GetKind() == kind {
+			l.Items = append(l.Items, o)
+		}
+	}
+	return nil
+}
+
+func (c *testClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOptionFunc) error {
+	o := obj.(*unstructured.Unstructured)
+	c.updated = append(c.updated, o.GetName()+" "+o.GetAnnotations()[DefaultAnnotationPrefix+annotationCascadedFrom])
+	return nil
+}
+
+func newTestChild(kind, name string, owners ...types.UID) unstructured.Unstructured {
+	o := unstructured.Unstructured{}
+	o.SetAPIVersion("cd.brigade.sh/v1alpha1")
+	o.SetKind(kind)
+	o.SetNamespace("default")
+	o.SetName(name)
+	refs := []metav1.OwnerReference{}
+	for _, uid := range owners {
+		refs = append(refs, metav1.OwnerReference{APIVersion: "cd.brigade.sh/v1alpha1", Kind: "ReleaseSet", Name: "owner", UID: uid})
+	}
+	o.SetOwnerReferences(refs)
+	return o
+}
+
+func TestHandleState_cascade(t *testing.T) {
+	parent := types.UID("2d4a1d7e-5d0c-4f3b-8f3e-0f6d5a1b7c11")
+	other := types.UID("9a0c6b3e-3a4b-4b7e-a1d2-6c2f7e8d9b00")
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    []string
+	}{
+		{
+			name:     "apply cascades to owned children",
+			expected: []string{"web ReleaseSet/myapp-set@100", "worker ReleaseSet/myapp-set@100"},
+		},
+		{
+			name:        "plan doesn't cascade",
+			annotations: map[string]string{"cd.brigade.sh/approved": "false"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kc := &testClient{
+				objects: []unstructured.Unstructured{
+					newTestChild("Release", "web", parent),
+					newTestChild("Release", "worker", other, parent),
+					newTestChild("Release", "unrelated", other),
+					newTestChild("Release", "orphan"),
+					newTestChild("Canary", "web-canary", parent),
+				},
+			}
+			store := newTestStore()
+			h := newTestHandler(store)
+			h.kubeclient = kc
+			kind, err := ParseKind("cd.brigade.sh/v1alpha1/Release")
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.cascadeKinds = append(h.cascadeKinds, kind)
+
+			ss := newTestState(tt.annotations, map[string]interface{}{"image": "myapp:v1"})
+			ss.Object.SetName("myapp-set")
+			ss.Object.SetUID(parent)
+			ss.Object.SetResourceVersion("100")
+
+			if err := h.HandleState(ss); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(kc.updated) != len(tt.expected) {
+				t.Fatalf("expected updates %v, got %v", tt.expected, kc.updated)
+			}
+			for i, u := range tt.expected {
+				if kc.updated[i] != u {
+					t.Errorf("expected update %q, got %q", u, kc.updated[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseKind(t *testing.T) {
+	gvk, err := ParseKind("cd.brigade.sh/v1alpha1/Release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gvk.Group != "cd.brigade.sh" || gvk.Version != "v1alpha1" || gvk.Kind != "Release" {
+		t.Errorf("unexpected kind %v", gvk)
+	}
+
+	if gvk, err := ParseKind("v1/ConfigMap"); err != nil || gvk.Group != "" || gvk.Kind != "ConfigMap" {
+		t.Errorf("unexpected kind %v, err %v", gvk, err)
+	}
+
+	for _, invalid := range []string{"Release", "cd.brigade.sh/v1alpha1/", "/Release"} {
+		if _, err := ParseKind(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package customresource
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"github.com/mumoshu/brigade-cd/pkg/webhook"
+)
+
+// Outcomes of emitting the build for an action
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// commitStates are the states GitHub accepts for commit statuses
+var commitStates = []string{"pending", "success", "failure", "error"}
+
+// DefaultCommitStates maps ACTION:OUTCOME to the state of the commit status set
+// for it. A plan leaves the commit pending, as the change is yet to be applied,
+// and a build that failed to be emitted is an error rather than a failed check.
+var DefaultCommitStates = map[string]string{
+	ActionPlan + ":" + OutcomeSuccess:    "pending",
+	ActionApply + ":" + OutcomeSuccess:   "success",
+	ActionDestroy + ":" + OutcomeSuccess: "success",
+	ActionPlan + ":" + OutcomeFailure:    "error",
+	ActionApply + ":" + OutcomeFailure:   "error",
+	ActionDestroy + ":" + OutcomeFailure: "error",
+}
+
+// CommitState returns the state of the commit status for the outcome of an
+// action, as mapped by states or else by DefaultCommitStates.
+func CommitState(states map[string]string, action, outcome string) string {
+	key := action + ":" + outcome
+	if s, ok := states[key]; ok {
+		return s
+	}
+	return DefaultCommitStates[key]
+}
+
+// ValidateCommitStates checks that states maps ACTION:OUTCOME keys to commit states.
+func ValidateCommitStates(states map[string]string) error {
+	for key, s := range states {
+		if _, ok := DefaultCommitStates[key]; !ok {
+			return fmt.Errorf("commit state key %q must be in the form ACTION:OUTCOME, with one of the actions %s and one of the outcomes %s, %s", key, strings.Join(AllowedActions, ", "), OutcomeSuccess, OutcomeFailure)
+		}
+		if !isCommitState(s) {
+			return fmt.Errorf("%q maps to %q, which is not one of the commit states %s", key, s, strings.Join(commitStates, ", "))
+		}
+	}
+	return nil
+}
+
+func isCommitState(s string) bool {
+	for _, c := range commitStates {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
+
+// setCommitStatus sets the status of the commit of the git-commit annotation to
+// the state mapped to the outcome of action, if commit statuses are enabled.
+// Failures are logged rather than failing the reconcile, as the build has
+// already been emitted or failed for a reason of its own.
+func (h *Handler) setCommitStatus(o *Object, proj *brigade.Project, payload *Payload, action, outcome string) {
+	if !h.commitStatus || payload.Commit == "" || h.setStatus == nil {
+		return
+	}
+
+	// The commit is in the repo of the git-repo annotation, which may differ from the repo of the project
+	p := *proj
+	p.Repo.Name = fmt.Sprintf("github.com/%s/%s", payload.Owner, payload.Repo)
+	cfg, err := webhook.Credentials(&p, func() (string, error) { return payload.Token, nil })
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Not setting the status of commit %s for %s/%s: %s\n", payload.Commit, o.Namespace, o.Name, err)
+		return
+	}
+	p.Github = cfg
+
+	state := CommitState(h.commitStates, action, outcome)
+	status := &github.RepoStatus{
+		State:       github.String(state),
+		Context:     github.String("brigade-cd/" + strings.ToLower(o.Kind)),
+		Description: github.String(fmt.Sprintf("%s of %s/%s: %s", action, o.Namespace, o.Name, outcome)),
+	}
+	if err := h.setStatus(payload.Commit, &p, status); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set the status of commit %s to %q for %s/%s: %s\n", payload.Commit, state, o.Namespace, o.Name, err)
+	}
+}
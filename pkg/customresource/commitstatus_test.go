@@ -0,0 +1,143 @@
+package customresource
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+)
+
+// failingBuildStore fails to create builds, but not to get projects
+type failingBuildStore struct {
+	*testStore
+}
+
+func (s failingBuildStore) CreateBuild(build *brigade.Build) error {
+	return errors.New("store unavailable")
+}
+
+func TestCommitState(t *testing.T) {
+	overrides := map[string]string{"apply:failure": "failure"}
+	tests := []struct {
+		action, outcome string
+		states          map[string]string
+		expected        string
+	}{
+		{ActionPlan, OutcomeSuccess, nil, "pending"},
+		{ActionApply, OutcomeSuccess, nil, "success"},
+		{ActionDestroy, OutcomeSuccess, nil, "success"},
+		{ActionPlan, OutcomeFailure, nil, "error"},
+		{ActionApply, OutcomeFailure, nil, "error"},
+		{ActionApply, OutcomeFailure, overrides, "failure"},
+		{ActionDestroy, OutcomeFailure, overrides, "error"},
+	}
+	for _, tt := range tests {
+		if got := CommitState(tt.states, tt.action, tt.outcome); got != tt.expected {
+			t.Errorf("%s:%s with %v: expected %q, got %q", tt.action, tt.outcome, tt.states, tt.expected, got)
+		}
+	}
+}
+
+func TestValidateCommitStates(t *testing.T) {
+	if err := ValidateCommitStates(map[string]string{"plan:success": "success"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	for _, invalid := range []map[string]string{
+		{"deploy:success": "success"},
+		{"apply:done": "success"},
+		{"apply:success": "ok"},
+	} {
+		if err := ValidateCommitStates(invalid); err == nil {
+			t.Errorf("expected an error for %v", invalid)
+		}
+	}
+}
+
+func TestHandleState_commitStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		failBuild   bool
+		noToken     bool
+		expected    string
+	}{
+		{
+			name:        "apply",
+			annotations: map[string]string{"cd.brigade.sh/git-commit": "abc123"},
+			expected:    "success",
+		},
+		{
+			name: "plan",
+			annotations: map[string]string{
+				"cd.brigade.sh/git-commit": "abc123",
+				"cd.brigade.sh/approved":   "false",
+			},
+			expected: "pending",
+		},
+		{
+			name:        "failed build",
+			annotations: map[string]string{"cd.brigade.sh/git-commit": "abc123"},
+			failBuild:   true,
+			expected:    "error",
+		},
+		{
+			name: "no commit",
+		},
+		{
+			name:        "no credentials",
+			annotations: map[string]string{"cd.brigade.sh/git-commit": "abc123"},
+			noToken:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			if !tt.noToken {
+				store.proj.Github.Token = "project-token"
+			}
+			h := newTestHandler(store)
+			if tt.failBuild {
+				h.store = failingBuildStore{store}
+			}
+			h.commitStatus = true
+
+			var commits []string
+			var statuses []*github.RepoStatus
+			var repo string
+			h.setStatus = func(commit string, proj *brigade.Project, status *github.RepoStatus) error {
+				commits = append(commits, commit)
+				statuses = append(statuses, status)
+				repo = proj.Repo.Name
+				return nil
+			}
+
+			ss := newTestState(tt.annotations, nil)
+			if err := h.HandleState(ss); (err != nil) != tt.failBuild {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.expected == "" {
+				if len(statuses) != 0 {
+					t.Fatalf("expected no status, got %v", statuses)
+				}
+				return
+			}
+			if len(statuses) != 1 {
+				t.Fatalf("expected 1 status, got %d", len(statuses))
+			}
+			if commits[0] != "abc123" {
+				t.Errorf("expected the status on commit abc123, got %q", commits[0])
+			}
+			if got := statuses[0].GetState(); got != tt.expected {
+				t.Errorf("expected state %q, got %q", tt.expected, got)
+			}
+			if got := statuses[0].GetContext(); got != "brigade-cd/releaseset" {
+				t.Errorf("unexpected context %q", got)
+			}
+			if repo != "github.com/myorg/myapp" {
+				t.Errorf("unexpected repo %q", repo)
+			}
+		})
+	}
+}
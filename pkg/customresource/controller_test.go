@@ -0,0 +1,348 @@
+package customresource
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mumoshu/brigade-cd/pkg/webhook"
+	"github.com/summerwind/whitebox-controller/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crmanager "sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// testManager serves a fake client instead of connecting to an API server
+type testManager struct {
+	client    client.Client
+	started   chan struct{}
+	runnables []crmanager.Runnable
+	// err fails Start, like a manager that can't reach the API server
+	err error
+	crmanager.Manager
+}
+
+func (m *testManager) GetClient() client.Client {
+	return m.client
+}
+
+func (m *testManager) Add(r crmanager.Runnable) error {
+	m.runnables = append(m.runnables, r)
+	return nil
+}
+
+func (m *testManager) Start(stop <-chan struct{}) error {
+	close(m.started)
+	if m.err != nil {
+		return m.err
+	}
+	for _, r := range m.runnables {
+		go r.Start(stop)
+	}
+	<-stop
+	return nil
+}
+
+func TestController_Run(t *testing.T) {
+	o := newTestState(nil, map[string]interface{}{"image": "myapp:v1"}).Object
+	mgr := &testManager{
+		client:  &testClient{objects: []unstructured.Unstructured{*o}},
+		started: make(chan struct{}),
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var resources []*config.ResourceConfig
+	store := newTestStore()
+	mappings := []Mapping{{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp"}}
+	ct := New(store, 0, nil, &rest.Config{}, mappings).
+		WithManager(func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+			resources = c.Resources
+			return mgr, nil
+		}, stop)
+
+	if err := ct.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-mgr.started
+
+	if len(resources) != 1 || resources[0].GroupVersionKind != o.GroupVersionKind() {
+		t.Fatalf("expected a reconciler for %v, got %v", o.GroupVersionKind(), resources)
+	}
+
+	eventType, err := ct.Reconcile(context.Background(), "ReleaseSet", "default", "myapp", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if eventType != "releaseset:apply" {
+		t.Errorf("expected releaseset:apply, got %q", eventType)
+	}
+	if len(store.builds) != 2 || store.builds[0].Type != "releaseset" || store.builds[1].Type != "releaseset:apply" {
+		t.Errorf("expected a releaseset and a releaseset:apply build, got %d builds", len(store.builds))
+	}
+}
+
+func TestController_Run_actionOnly(t *testing.T) {
+	o := newTestState(nil, map[string]interface{}{"image": "myapp:v1"}).Object
+	mgr := &testManager{
+		client:  &testClient{objects: []unstructured.Unstructured{*o}},
+		started: make(chan struct{}),
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+
+	store := newTestStore()
+	mappings := []Mapping{{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp", ActionOnly: true}}
+	ct := New(store, 0, nil, &rest.Config{}, mappings).
+		WithManager(func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+			return mgr, nil
+		}, stop)
+
+	if err := ct.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-mgr.started
+
+	if _, err := ct.Reconcile(context.Background(), "ReleaseSet", "default", "myapp", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(store.builds) != 1 || store.builds[0].Type != "releaseset:apply" {
+		t.Errorf("expected only a releaseset:apply build, got %d builds", len(store.builds))
+	}
+}
+
+func TestController_Wait(t *testing.T) {
+	mgr := &testManager{client: &testClient{}, started: make(chan struct{})}
+	stop := make(chan struct{})
+
+	mappings := []Mapping{{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp"}}
+	ct := New(newTestStore(), 0, nil, &rest.Config{}, mappings).
+		WithManager(func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+			return mgr, nil
+		}, nil).
+		WithStop(stop)
+
+	if err := ct.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-mgr.started
+
+	stopped := make(chan struct{})
+	go func() {
+		if err := ct.Wait(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("expected Wait to block while the manager runs")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected Wait to return once the manager stopped")
+	}
+}
+
+func TestController_Run_managerFails(t *testing.T) {
+	mgr := &testManager{client: &testClient{}, started: make(chan struct{}), err: errors.New("no API server")}
+
+	mappings := []Mapping{{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp"}}
+	ct := New(newTestStore(), 0, nil, &rest.Config{}, mappings).
+		WithManager(func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+			return mgr, nil
+		}, make(chan struct{}))
+
+	if err := ct.Run(); err == nil || !strings.Contains(err.Error(), "no API server") {
+		t.Fatalf("expected the error of the manager, got %v", err)
+	}
+	if err := ct.Wait(); err == nil {
+		t.Error("expected Wait to return the error of the manager")
+	}
+}
+
+func TestController_Run_defaultBranch(t *testing.T) {
+	o := newTestState(nil, map[string]interface{}{"image": "myapp:v1"}).Object
+	mgr := &testManager{
+		client:  &testClient{objects: []unstructured.Unstructured{*o}},
+		started: make(chan struct{}),
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+
+	store := newTestStore()
+	mappings := []Mapping{{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp"}}
+	ct := New(store, 0, nil, &rest.Config{}, mappings).
+		WithDefaultBranch("main").
+		WithManager(func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+			return mgr, nil
+		}, stop)
+
+	if err := ct.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-mgr.started
+
+	if _, err := ct.Reconcile(context.Background(), "ReleaseSet", "default", "myapp", false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(store.builds) != 2 || store.builds[0].Revision.Ref != "refs/heads/main" || store.builds[1].Revision.Ref != "refs/heads/main" {
+		t.Fatalf("expected a build for refs/heads/main, got %v", store.builds)
+	}
+}
+
+func TestController_Run_options(t *testing.T) {
+	tests := []struct {
+		name, prefix, expected string
+	}{
+		{name: "default", expected: DefaultAnnotationPrefix},
+		{name: "prefix", prefix: "cd.myco.io/", expected: "cd.myco.io/"},
+		{name: "prefix without a slash", prefix: "cd.myco.io", expected: "cd.myco.io/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := &testManager{client: &testClient{}, started: make(chan struct{})}
+			stop := make(chan struct{})
+			defer close(stop)
+
+			mappings := []Mapping{{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp"}}
+			buildTypes := map[string]string{"apply": "deploy"}
+			gateway := webhook.Gateway{Version: "v1.2.3", ConfigHash: "abc123"}
+			ct := New(newTestStore(), 0, nil, &rest.Config{}, mappings).
+				WithGateway(gateway).
+				WithAnnotationPrefix(tt.prefix).
+				WithCompressionThreshold(1024).
+				WithBuildTypes(buildTypes).
+				WithManager(func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+					return mgr, nil
+				}, stop)
+
+			if err := ct.Run(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			<-mgr.started
+
+			h := ct.handlers[0]
+			if h.annotationPrefix != tt.expected {
+				t.Errorf("expected annotation prefix %q, got %q", tt.expected, h.annotationPrefix)
+			}
+			if h.gateway != gateway {
+				t.Errorf("expected the gateway %+v, got %+v", gateway, h.gateway)
+			}
+			if h.compressionThreshold != 1024 || !reflect.DeepEqual(h.buildTypes, buildTypes) {
+				t.Errorf("expected the compression threshold and build types of the controller, got %d and %v", h.compressionThreshold, h.buildTypes)
+			}
+		})
+	}
+}
+
+func TestController_Run_eventTypes(t *testing.T) {
+	mgr := &testManager{client: &testClient{}, started: make(chan struct{})}
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// Two CRDs of the same kind, built in different projects with their own event types
+	store := newNamedProjectsStore()
+	mappings := []Mapping{
+		{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp", ActionOnly: true},
+		{Group: "prod.example.com", Version: "v1", Kind: "ReleaseSet", BrigadeProject: "myorg/prod", ActionOnly: true,
+			ApplyEvent: "deploy:prod", PlanEvent: "diff:prod", DestroyEvent: "teardown:prod", DefaultBranch: "main"},
+	}
+	ct := New(store, 0, nil, &rest.Config{}, mappings).
+		WithManager(func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+			return mgr, nil
+		}, stop)
+
+	if err := ct.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-mgr.started
+
+	expected := []struct{ apply, plan, destroy, project, ref string }{
+		{"releaseset:apply", "releaseset:plan", "releaseset:destroy", "brigade-1234", "refs/heads/master"},
+		{"deploy:prod", "diff:prod", "teardown:prod", "brigade-prod", "refs/heads/main"},
+	}
+	for i, h := range ct.handlers {
+		store.builds = nil
+		ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+		if err := h.HandleState(ss); err != nil {
+			t.Fatalf("%s: unexpected error: %v", h.groupVersionKind, err)
+		}
+		ss.Object.SetResourceVersion("2")
+		ss.Object.SetAnnotations(map[string]string{"cd.brigade.sh/git-repo": "myorg/myapp", "cd.brigade.sh/approved": "false"})
+		if err := h.HandleState(ss); err != nil {
+			t.Fatalf("%s: unexpected error: %v", h.groupVersionKind, err)
+		}
+		ss.Object.SetResourceVersion("3")
+		now := metav1.Now()
+		ss.Object.SetDeletionTimestamp(&now)
+		if err := h.HandleState(ss); err != nil {
+			t.Fatalf("%s: unexpected error: %v", h.groupVersionKind, err)
+		}
+
+		e := expected[i]
+		if len(store.builds) != 3 {
+			t.Fatalf("%s: expected 3 builds, got %d", h.groupVersionKind, len(store.builds))
+		}
+		for j, et := range []string{e.apply, e.plan, e.destroy} {
+			if b := store.builds[j]; b.Type != et || b.ProjectID != e.project || b.Revision.Ref != e.ref {
+				t.Errorf("%s: expected a %s build for %s of %s, got a %s build for %s of %s", h.groupVersionKind, et, e.project, e.ref, b.Type, b.ProjectID, b.Revision.Ref)
+			}
+		}
+	}
+}
+
+func TestController_Run_missingBranchProject(t *testing.T) {
+	store := newNamedProjectsStore()
+	mappings := []Mapping{{Kind: "ReleaseSet", BrigadeProject: "myorg/myapp", BranchProjects: map[string]string{"main": "myorg/gone"}}}
+	ct := New(store, 0, nil, &rest.Config{}, mappings).
+		WithManager(func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+			t.Fatal("expected the controller to fail before creating the manager")
+			return nil, nil
+		}, nil)
+
+	if err := ct.Run(); err == nil || !strings.Contains(err.Error(), "myorg/gone") {
+		t.Fatalf("expected an error about the missing project, got %v", err)
+	}
+}
+
+func TestController_Run_deletion(t *testing.T) {
+	mgr := &testManager{client: &testClient{}, started: make(chan struct{})}
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var resources []*config.ResourceConfig
+	mappings := []Mapping{
+		{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp"},
+		{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "Preview", BrigadeProject: "myorg/myapp", Deletion: DeletionIgnore},
+	}
+	ct := New(newTestStore(), 0, nil, &rest.Config{}, mappings).
+		WithManager(func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+			resources = c.Resources
+			return mgr, nil
+		}, stop)
+
+	if err := ct.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-mgr.started
+
+	if len(resources) != 2 {
+		t.Fatalf("expected 2 resources, got %d", len(resources))
+	}
+	if resources[0].Finalizer == nil || resources[0].Finalizer.StateHandler == nil {
+		t.Error("expected a finalizer for the kind emitting destroy builds")
+	}
+	if resources[1].Finalizer != nil {
+		t.Error("expected no finalizer for the kind ignoring deletion")
+	}
+}
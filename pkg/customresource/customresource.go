@@ -3,9 +3,11 @@ package customresource
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/brigadecore/brigade/pkg/brigade"
 	"github.com/brigadecore/brigade/pkg/storage"
+	"github.com/google/go-github/v27/github"
 	"github.com/mumoshu/brigade-cd/pkg/webhook"
 	"k8s.io/client-go/rest"
 	"os"
@@ -14,17 +16,20 @@ import (
 	"strings"
 	"time"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/azure"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 	kconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+	crmanager "sigs.k8s.io/controller-runtime/pkg/manager"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 	"sigs.k8s.io/controller-runtime/pkg/runtime/signals"
 
 	"github.com/summerwind/whitebox-controller/config"
-	"github.com/summerwind/whitebox-controller/manager"
 	"github.com/summerwind/whitebox-controller/reconciler/state"
 )
 
@@ -38,6 +43,47 @@ type Object struct {
 
 type Status struct {
 	Phase string `json:"phase"`
+	// BuildID is the ID of the last build emitted for the object
+	BuildID string `json:"buildID,omitempty"`
+	// LastEventType is the event type of the last build, like
+	// releaseset:apply, and LastBuildTime is when it was emitted
+	LastEventType string       `json:"lastEventType,omitempty"`
+	LastBuildTime *metav1.Time `json:"lastBuildTime,omitempty"`
+	// ObservedGeneration is the metadata.generation of the object that the
+	// last build was emitted for
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// unknown holds every status field as read from the object, so that fields
+	// set by other controllers survive when we write the status back
+	unknown map[string]json.RawMessage
+}
+
+// statusFields is Status without its JSON methods
+type statusFields Status
+
+func (s *Status) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, (*statusFields)(s)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &s.unknown)
+}
+
+// MarshalJSON merges our own fields into the status fields read from the object.
+func (s Status) MarshalJSON() ([]byte, error) {
+	known, err := json.Marshal(statusFields(s))
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(known, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range s.unknown {
+		if _, ok := fields[k]; !ok {
+			fields[k] = v
+		}
+	}
+	return json.Marshal(fields)
 }
 
 type State struct {
@@ -47,10 +93,32 @@ type State struct {
 type Handler struct {
 	store                  storage.Store
 	brigadeProject         string
+	branchProjects         map[string]string
 	eventTypeActionApply   string
 	eventTypeActionDestroy string
 	eventTypeActionPlan    string
+	kindType               string
 	defaultBranch          string
+	phaseField             string
+	deletion               string
+	unapproved             string
+	previousBuild          bool
+	bareEvent              bool
+	scope                  scope
+	phases                 map[string]string
+	cascadeKinds           []schema.GroupVersionKind
+	references             []Reference
+	fields                 map[string]string
+	serviceAccount         string
+	annotationPrefix       string
+	refTemplate            *webhook.RefTemplate
+	compressionThreshold   int
+	buildTypes             map[string]string
+	commitStatus           bool
+	commitStates           map[string]string
+	// defaultInstallationID is the installation of objects without the
+	// github-app-inst-id annotation, if non-zero
+	defaultInstallationID int
 
 	kubeclient client.Client
 
@@ -60,17 +128,93 @@ type Handler struct {
 	key []byte
 
 	appID int
+
+	// gateway is stamped into the payload of every emitted build
+	gateway webhook.Gateway
+
+	// builds guards against creating builds twice for the same change
+	builds *webhook.DeliveryGuard
+
+	// recreates defers destroy builds to skip them for objects recreated with
+	// the same spec, if set
+	recreates *recreateGuard
+
+	// deadLetters persists builds that could not be created, if set
+	deadLetters webhook.DeadLetters
+
+	// auditLog records every created build, if set
+	auditLog *webhook.AuditLog
+
+	// appSlug is the slug of the App, added to payloads with installation tokens
+	appSlug *webhook.AppSlug
+
+	// getToken negotiates a token for an installation of the App
+	getToken func(appID, installationID int, cfg brigade.Github) (string, time.Time, error)
+
+	// setStatus sets the status of a commit, if commitStatus is enabled
+	setStatus func(commit string, proj *brigade.Project, status *github.RepoStatus) error
+
+	now func() time.Time
 }
 
+// annotation returns the value of the annotation of o with the given name, without the prefix.
+func (h *Handler) annotation(o *Object, name string) string {
+	return o.Annotations[h.annotationPrefix+name]
+}
+
+// HandleState emits the build for the object of ss, and records the outcome and
+// duration of the reconcile in the metrics.
 func (h *Handler) HandleState(ss *state.State) error {
+	start := h.now()
+	_, outcome, err := h.handleState(ss, true, false)
+	if _, ok := err.(authError); ok {
+		outcome = reconcileAuthFailed
+	} else if err != nil {
+		outcome = reconcileError
+	}
+	kind := h.groupVersionKind.Kind
+	reconcilesTotal.WithLabelValues(kind, outcome).Inc()
+	reconcileDurationSeconds.WithLabelValues(kind).Observe(h.now().Sub(start).Seconds())
+
+	if o := ss.Object; o != nil && o.GetDeletionTimestamp() != nil {
+		// The finalizer is removed unless the reconcile fails or is requeued
+		held := hasFinalizer(o, finalizerName(h.groupVersionKind)) && (err != nil || ss.Requeue || ss.RequeueAfter > 0)
+		setHeld(kind, o.GetNamespace()+"/"+o.GetName(), held)
+	}
+	return err
+}
+
+// handleState determines the event type of the build for the object of ss, and
+// emits the build unless emit is false. It returns the event type, and the
+// outcome of the reconcile for the metrics unless it fails.
+//
+// Unless force is set, no build is emitted for a generation of the object that
+// was already built with the same event type, like on no-op updates.
+func (h *Handler) handleState(ss *state.State, emit, force bool) (string, string, error) {
 	s := State{}
 
 	err := state.Unpack(ss, &s)
 	if err != nil {
-		return err
+		return "", "", err
+	}
+
+	o := &s.Object
+
+	if !h.scope.contains(o) {
+		// Like objects whose labels no longer match, which pass the watch while
+		// they carry the finalizer
+		fmt.Fprintf(os.Stderr, "Ignoring %s/%s, which is outside the namespace or label selector of the mapping\n", o.Namespace, o.Name)
+		return "", reconcileIgnored, nil
 	}
 
-	o := s.Object
+	if o.ObjectMeta.DeletionTimestamp != nil && h.deletion == DeletionIgnore {
+		fmt.Fprintf(os.Stderr, "Ignoring deletion of %s/%s\n", o.Namespace, o.Name)
+		// Objects deleted while the kind was in the destroy mode still carry the finalizer
+		if ss.Object != nil {
+			removeFinalizer(ss.Object, finalizerName(h.groupVersionKind))
+		}
+		return "", reconcileIgnored, nil
+	}
 
 	// Here we build/populate Brigade's Payload object
 	//
@@ -78,30 +222,42 @@ func (h *Handler) HandleState(ss *state.State) error {
 	// included in the github.IssueCommentEvent (here payload.Body)
 	// The check run utility that requests check runs requires these values
 	// and does not have access to he brigade.Revision object above.
-	eventType := strings.ToLower(o.Kind)
+	eventType := h.kindType
 	payload := &Payload{
-		Type: eventType,
+		Type:            eventType,
+		ResourceUID:     string(o.UID),
+		ResourceVersion: o.ResourceVersion,
 		//Token:        tok,
 		//TokenExpires: timeout,
 		//Commit:       rev.Commit,
 		//Branch: h.defaultBranch,
 	}
 
-	instIDStr := o.Annotations["cd.brigade.sh/github-app-inst-id"]
-	approvedStr := o.Annotations["cd.brigade.sh/approved"]
-	dryRunStr := o.Annotations["cd.brigade.sh/dry-run"]
-	gitRepo := o.Annotations["cd.brigade.sh/git-repo"]
-	gitCommitId := o.Annotations["cd.brigade.sh/git-commit"]
-	gitBranch := o.Annotations["cd.brigade.sh/git-branch"]
-	pullIdStr := o.Annotations["cd.brigade.sh/github-pull-id"]
+	instIDStr := h.annotation(o, "github-app-inst-id")
+	approvedStr := h.annotation(o, "approved")
+	dryRunStr := h.annotation(o, "dry-run")
+	gitRepo := h.annotation(o, "git-repo")
+	gitCommitId := h.annotation(o, "git-commit")
+	gitBranch := h.annotation(o, "git-branch")
+	pullIdStr := h.annotation(o, "github-pull-id")
+
+	var notBefore time.Time
+	if v := h.annotation(o, annotationNotBefore); v != "" {
+		notBefore, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid %s%s annotation %q on %s/%s: must be an RFC3339 time like 2006-01-02T15:04:05Z", h.annotationPrefix, annotationNotBefore, v, o.Namespace, o.Name)
+		}
+	}
 
 	{
 		tmp := strings.Split(gitRepo, "/")
+		if len(tmp) != 2 || tmp[0] == "" || tmp[1] == "" {
+			return "", "", fmt.Errorf("invalid %sgit-repo annotation %q on %s/%s: must be in the form OWNER/REPO", h.annotationPrefix, gitRepo, o.Namespace, o.Name)
+		}
 		owner := tmp[0]
 		repo := tmp[1]
 		payload.Owner = owner
 		payload.Repo = repo
-		payload.Pull = pullIdStr
 	}
 
 	if gitCommitId != "" {
@@ -121,39 +277,65 @@ func (h *Handler) HandleState(ss *state.State) error {
 	if len(instIDStr) > 0 {
 		instID, err = strconv.Atoi(instIDStr)
 		if err != nil {
-			return fmt.Errorf("failed converting %q: %v", instIDStr, err)
+			return "", "", fmt.Errorf("failed converting %q: %v", instIDStr, err)
 		}
 		payload.InstID = instID
+	} else if h.defaultInstallationID != 0 {
+		instID = h.defaultInstallationID
+		payload.InstID = instID
 	}
 
 	projName := h.brigadeProject
+	if p, ok := h.branchProjects[payload.Branch]; ok {
+		projName = p
+	}
 
 	proj, err := h.store.GetProject(projName)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Project %q not found. No secret loaded. %s\n", projName, err)
-		return err
+		return "", "", err
 	}
 
+	if instID > 0 && appID == 0 {
+		return "", "", authError{fmt.Errorf("%s/%s has the %sgithub-app-inst-id annotation, but APP_ID is not set to negotiate a token for the installation", o.Namespace, o.Name, h.annotationPrefix)}
+	}
 	if instID > 0 && appID > 0 {
-		tok, timeout, err := h.installationToken(int(appID), int(instID), proj.Github)
+		tok, timeout, err := h.getToken(int(appID), int(instID), proj.Github)
 		if err != nil {
-			return fmt.Errorf("Failed to negotiate a token: %s", err)
+			return "", "", authError{fmt.Errorf("Failed to negotiate a token: %s", err)}
 		}
 		payload.Token = tok
 		payload.TokenExpires = timeout
+		payload.InstallationID = instID
+		if payload.AppSlug, err = h.appSlug.Get(context.TODO()); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get the slug of App %d: %s\n", appID, err)
+		}
 	}
 
 	// Check if it can be marshalled into JSON
 	if _, err := json.Marshal(o); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to marshal object into body: %s\n", err)
-		return err
+		return "", "", err
 	}
 
-	pullUrl := fmt.Sprintf(`https://api.github.com/repos/%s/pulls/%s`, projName, pullIdStr)
-	payload.PullURL = pullUrl
+	if pullIdStr != "" {
+		if pullID, err := strconv.Atoi(pullIdStr); err != nil || pullID <= 0 {
+			fmt.Fprintf(os.Stderr, "Ignoring invalid %sgithub-pull-id annotation %q on %s/%s: must be a pull request number\n", h.annotationPrefix, pullIdStr, o.Namespace, o.Name)
+		} else {
+			payload.Pull = pullIdStr
+			if payload.PullURL, err = webhook.PullRequestURL(proj.Github.BaseURL, payload.Owner, payload.Repo, pullID); err != nil {
+				return "", "", fmt.Errorf("failed to build the URL of pull request %d: %v", pullID, err)
+			}
+		}
+	}
 
 	// Save the object as-is for use from within brigade.js
 	payload.Body = o
+	payload.Fields = h.extractFields(ss.Object)
+
+	if h.previousBuild && emit {
+		h.stampPreviousBuild(o, payload)
+	}
 
 	//obj := &unstructured.Unstructured{}
 	//obj.SetGroupVersionKind(h.groupVersionKind)
@@ -175,52 +357,503 @@ func (h *Handler) HandleState(ss *state.State) error {
 	var eventTypeAction string
 	if o.ObjectMeta.DeletionTimestamp != nil {
 		eventTypeAction = h.eventTypeActionDestroy
-	} else if approvedStr == "" || approvedStr == "true" || approvedStr == "yes" && (dryRunStr == "" || dryRunStr == "no" || dryRunStr == "false") {
+	} else if action, err := h.phaseAction(ss); err != nil {
+		return "", "", err
+	} else if action != "" {
+		eventTypeAction = h.eventTypeForAction(action)
+	} else if isApproved(approvedStr) && !isDryRun(dryRunStr) {
 		eventTypeAction = h.eventTypeActionApply
+	} else if h.unapproved == UnapprovedReject && !isApproved(approvedStr) {
+		fmt.Fprintf(os.Stderr, "Blocking %s/%s until it is approved with the %sapproved annotation\n", o.Namespace, o.Name, h.annotationPrefix)
+		if o.Status.Phase != phaseBlocked {
+			o.Status.Phase = phaseBlocked
+		}
+		if err := state.Pack(&s, ss); err != nil {
+			return "", "", err
+		}
+		return "", reconcileIgnored, nil
 	} else {
 		eventTypeAction = h.eventTypeActionPlan
 	}
 
-	if err := h.build(eventTypeAction, payload, proj); err != nil {
-		return err
+	// The resource version identifies the change, like the delivery ID of a webhook,
+	// so that retrying a failed reconcile doesn't create the build twice
+	key := fmt.Sprintf("%s/%s/%s", o.UID, o.ResourceVersion, eventTypeAction)
+	if len(h.references) > 0 && ss.Object != nil {
+		// Changed references are changes of the object, even though its own version is the same
+		versions, err := h.referenceVersions(ss.Object)
+		if err != nil {
+			return "", "", err
+		}
+		if versions != "" {
+			key += "/" + versions
+		}
+	}
+	var outcome string
+	if !emit {
+		fmt.Fprintf(os.Stderr, "Dry run: not emitting event %q for %s/%s\n", eventTypeAction, o.Namespace, o.Name)
+		return eventTypeAction, reconcileIgnored, nil
+	} else if wait := notBefore.Sub(h.now()); wait > 0 {
+		// Requeue for the time, rounded up as the requeue is in whole seconds
+		ss.RequeueAfter = int((wait + time.Second - 1) / time.Second)
+		fmt.Fprintf(os.Stderr, "Deferring event %q for %s/%s until %s\n", eventTypeAction, o.Namespace, o.Name, notBefore.Format(time.RFC3339))
+		return eventTypeAction, reconcileDeferred, nil
+	} else if !force && h.builtGeneration(o, eventTypeAction) {
+		fmt.Fprintf(os.Stderr, "Skipping event %q already emitted for %s/%s at generation %d\n", eventTypeAction, o.Namespace, o.Name, o.Generation)
+		outcome = reconcileSkippedUnchanged
+	} else if h.builds != nil && o.UID != "" && h.builds.Seen(key) {
+		fmt.Fprintf(os.Stderr, "Skipping event %q already emitted for %s/%s at resource version %s\n", eventTypeAction, o.Namespace, o.Name, o.ResourceVersion)
+		outcome = reconcileSkippedUnchanged
+	} else if h.recreates != nil && o.ObjectMeta.DeletionTimestamp != nil {
+		hash, err := specHash(o)
+		if err != nil {
+			return "", "", err
+		}
+		// The deletion completes meanwhile, so that the object can be recreated
+		fmt.Fprintf(os.Stderr, "Deferring event %q for %s/%s by %s, in case it is recreated with the same spec\n", eventTypeAction, o.Namespace, o.Name, h.recreates.window)
+		h.recreates.schedule(o.Namespace+"/"+o.Name, hash, func() error {
+			_, err := h.emit(o, key, eventTypeAction, payload, proj)
+			return err
+		})
+		outcome = reconcileDeferred
+	} else {
+		if h.recreates != nil {
+			hash, err := specHash(o)
+			if err != nil {
+				return "", "", err
+			}
+			if err := h.recreates.recreated(o.Namespace+"/"+o.Name, hash); err != nil {
+				return "", "", err
+			}
+		}
+		id, err := h.emit(o, key, eventTypeAction, payload, proj)
+		if err != nil {
+			return "", "", err
+		}
+		o.Status.BuildID = id
+		o.Status.LastEventType = eventTypeAction
+		o.Status.LastBuildTime = &metav1.Time{Time: h.now()}
+		o.Status.ObservedGeneration = o.Generation
+		outcome = reconcileBuildEmitted
 	}
 
-	if o.Status.Phase != "completed" {
-		o.Status.Phase = "completed"
+	if eventTypeAction == h.eventTypeActionApply {
+		if err := h.cascade(o); err != nil {
+			return "", "", err
+		}
+	}
+
+	if o.Status.Phase != phaseCompleted {
+		o.Status.Phase = phaseCompleted
 	}
 
 	err = state.Pack(&s, ss)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	return nil
+	return eventTypeAction, outcome, nil
+}
+
+// builtGeneration tells whether the last build for o was of eventTypeAction
+// for its current generation, which only changes along with the spec. Changes
+// of metadata, like of the approved annotation, result in another event type,
+// and deletions are never deduplicated.
+//
+// Objects without a generation, and kinds with references, whose changes don't
+// change the generation of the object, are always built.
+func (h *Handler) builtGeneration(o *Object, eventTypeAction string) bool {
+	if o.ObjectMeta.DeletionTimestamp != nil || o.Generation == 0 || len(h.references) > 0 {
+		return false
+	}
+	return o.Status.ObservedGeneration == o.Generation && o.Status.LastEventType == eventTypeAction
+}
+
+// isApproved tells whether the value of the approved annotation approves the
+// object. Objects without the annotation are approved.
+func isApproved(v string) bool {
+	return v == "" || v == "true" || v == "yes"
+}
+
+// isDryRun tells whether the value of the dry-run annotation makes changes of
+// the object dry runs, which are planned rather than applied. Objects without
+// the annotation are not dry runs, and unknown values are, to be safe.
+func isDryRun(v string) bool {
+	return v != "" && v != "no" && v != "false"
+}
+
+// Reconcile fetches the object with the given name and runs it through the same
+// logic as the controller loop, returning the event type of the resulting build.
+// With dryRun, the event type is determined without emitting the build. The
+// build is emitted even if the generation of the object was already built, and
+// the status of the object is not written back.
+func (h *Handler) Reconcile(c context.Context, namespace, name string, dryRun bool) (string, error) {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(h.groupVersionKind)
+	if err := h.kubeclient.Get(c, types.NamespacedName{Namespace: namespace, Name: name}, obj); err != nil {
+		return "", err
+	}
+	if !h.scope.contains(obj) {
+		gr := schema.GroupResource{Group: h.groupVersionKind.Group, Resource: strings.ToLower(h.groupVersionKind.Kind)}
+		return "", apierrors.NewNotFound(gr, name)
+	}
+	eventType, _, err := h.handleState(state.New(obj, nil, nil), !dryRun, true)
+	return eventType, err
+}
+
+// phaseAction returns the action selected by the value of the mapping's phase field.
+//
+// An empty action is returned when no phase field is configured or the object
+// doesn't set it, in which case the default apply/plan/destroy logic applies.
+func (h *Handler) phaseAction(ss *state.State) (string, error) {
+	if h.phaseField == "" || ss.Object == nil {
+		return "", nil
+	}
+	value, found, err := unstructured.NestedString(ss.Object.Object, strings.Split(h.phaseField, ".")...)
+	if err != nil {
+		return "", fmt.Errorf("failed reading phase field %q: %v", h.phaseField, err)
+	}
+	if !found || value == "" {
+		return "", nil
+	}
+	action := value
+	if a, ok := h.phases[value]; ok {
+		action = a
+	}
+	if !IsAllowedAction(action) {
+		return "", fmt.Errorf("phase %q in field %q does not map to any of the allowed actions %s", value, h.phaseField, strings.Join(AllowedActions, ", "))
+	}
+	return action, nil
+}
+
+func (h *Handler) eventTypeForAction(action string) string {
+	switch action {
+	case ActionApply:
+		return h.eventTypeActionApply
+	case ActionPlan:
+		return h.eventTypeActionPlan
+	default:
+		return h.eventTypeActionDestroy
+	}
 }
 
-func (h *Handler) build(eventAction string, payload *Payload, proj *brigade.Project) error {
+// actionForEventType returns the action of an event type returned by eventTypeForAction.
+func (h *Handler) actionForEventType(eventType string) string {
+	switch eventType {
+	case h.eventTypeActionApply:
+		return ActionApply
+	case h.eventTypeActionPlan:
+		return ActionPlan
+	default:
+		return ActionDestroy
+	}
+}
+
+// emit creates the build for eventAction and sets the commit status of its
+// outcome. It returns the ID of the build.
+//
+// With bareEvent, the build of the bare kind is created first. The returned ID
+// is that of the build of the kind and action.
+func (h *Handler) emit(o *Object, key, eventAction string, payload *Payload, proj *brigade.Project) (string, error) {
+	var err error
+	if bare := strings.SplitN(eventAction, ":", 2)[0]; h.bareEvent && bare != eventAction {
+		_, err = h.build(key, bare, payload, proj)
+	}
+	id := ""
+	if err == nil {
+		id, err = h.build(key, eventAction, payload, proj)
+	}
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeFailure
+	}
+	h.setCommitStatus(o, proj, payload, h.actionForEventType(eventAction), outcome)
+	if err != nil {
+		return "", err
+	}
+	if h.builds != nil && o.UID != "" {
+		h.builds.Record(key)
+	}
+	return id, nil
+}
+
+// build creates the build for eventAction, and records it in the audit log for
+// key, which identifies the change like a delivery ID. It returns the ID of the build.
+func (h *Handler) build(key, eventAction string, payload *Payload, proj *brigade.Project) (string, error) {
 	payloadJsonBytes, err := json.Marshal(payload)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "JSON encoding error: %v\n", err)
-		return err
+		return "", err
+	}
+
+	payloadJsonBytes, err = webhook.StampGateway(payloadJsonBytes, h.gateway)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to stamp gateway info: %v\n", err)
+		return "", err
+	}
+
+	if h.serviceAccount != "" {
+		payloadJsonBytes, err = webhook.StampServiceAccount(payloadJsonBytes, h.serviceAccount)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to stamp service account: %v\n", err)
+			return "", err
+		}
+	}
+
+	payloadJsonBytes, err = webhook.CompressPayload(payloadJsonBytes, h.compressionThreshold)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to compress payload: %v\n", err)
+		return "", err
+	}
+
+	rev := brigade.Revision{
+		Commit: payload.Commit,
+	}
+	// A commit without a branch is checked out as is, rather than from a ref
+	// of an empty branch name
+	if payload.Branch != "" {
+		rev.Ref = fmt.Sprintf("refs/heads/%s", payload.Branch)
+	}
+	if err := h.refTemplate.Apply("brigade-cd", eventAction, &rev); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to render the ref of %q build, emitting %q: %v\n", eventAction, rev.Ref, err)
 	}
 
 	b := &brigade.Build{
 		ProjectID: proj.ID,
-		Type:      eventAction,
+		Type:      webhook.RenameBuildType(h.buildTypes, eventAction),
 		Provider:  "brigade-cd",
-		Revision: &brigade.Revision{
-			Commit: payload.Commit,
-			Ref:    fmt.Sprintf("refs/heads/%s", payload.Branch),
-		},
-		Payload: payloadJsonBytes,
+		Revision:  &rev,
+		Payload:   payloadJsonBytes,
+	}
+	fmt.Fprintf(os.Stderr, "Emitting event %q, payload %s\n", eventAction, payloadJsonBytes)
+	if err := webhook.CreateBuildOrDeadLetter(context.TODO(), h.store, h.deadLetters, b); err != nil {
+		return "", err
+	}
+	if err := h.auditLog.Record(webhook.NewAuditRecord(key, proj.Name, b)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to record event %q in the audit log: %v\n", eventAction, err)
 	}
-	fmt.Fprintf(os.Stderr, "Emitting event %q, payload %s\n", eventAction, payload)
-	return h.store.CreateBuild(b)
+	return b.ID, nil
+}
+
+// Deletion modes, which determine what the deletion of a custom resource results in
+const (
+	// DeletionDestroy emits a destroy build, holding off the deletion with a
+	// finalizer until the build is created
+	DeletionDestroy = "destroy"
+	// DeletionIgnore emits nothing
+	DeletionIgnore = "ignore"
+)
+
+// Unapproved modes, which determine what changes of custom resources that are
+// not approved with the approved annotation result in
+const (
+	// UnapprovedPlan emits a plan build
+	UnapprovedPlan = "plan"
+	// UnapprovedReject emits nothing and sets the phase of the status to
+	// "blocked", until the object is approved
+	UnapprovedReject = "reject"
+)
+
+// Phases of the status of custom resources
+const (
+	// phaseCompleted is the phase of objects whose build was emitted
+	phaseCompleted = "completed"
+	// phaseBlocked is the phase of objects waiting to be approved, see UnapprovedReject
+	phaseBlocked = "blocked"
+)
+
+// finalizerName is the finalizer whitebox-controller sets on objects of gvk
+func finalizerName(gvk schema.GroupVersionKind) string {
+	return fmt.Sprintf("%s-controller.%s", strings.ToLower(gvk.Kind), gvk.Group)
+}
+
+// removeFinalizer removes the finalizer named name from o, if set.
+func removeFinalizer(o *unstructured.Unstructured, name string) {
+	finalizers := []string{}
+	for _, f := range o.GetFinalizers() {
+		if f != name {
+			finalizers = append(finalizers, f)
+		}
+	}
+	if len(finalizers) != len(o.GetFinalizers()) {
+		o.SetFinalizers(finalizers)
+	}
+}
+
+// Actions a custom resource change can be turned into
+const (
+	ActionApply   = "apply"
+	ActionPlan    = "plan"
+	ActionDestroy = "destroy"
+)
+
+// AllowedActions lists every action a custom resource change can be turned into
+var AllowedActions = []string{ActionApply, ActionPlan, ActionDestroy}
+
+// IsAllowedAction returns true if action is one of AllowedActions
+func IsAllowedAction(action string) bool {
+	for _, a := range AllowedActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
 }
 
 type Mapping struct {
 	Group, Version, Kind string
 	BrigadeProject       string
+	// BranchProjects maps the branches of the git-branch annotation, or the
+	// default branch, to the projects their builds are created in instead of
+	// BrigadeProject, like `main` to a production project
+	BranchProjects map[string]string
+
+	// PhaseField is a dot-separated path to a field of the object, like `spec.phase`,
+	// whose value selects the action instead of the default approval-based logic.
+	// Deletion always results in the destroy action, unless Deletion is DeletionIgnore.
+	PhaseField string
+	// Phases maps values of PhaseField to actions. Values that are missing here
+	// must be action names themselves.
+	Phases map[string]string
+	// CascadeKinds are the kinds of objects owned by the custom resource that are
+	// reconciled again after it is applied, like `cd.brigade.sh/v1alpha1/Release`
+	CascadeKinds []schema.GroupVersionKind
+	// ServiceAccount is the Kubernetes service account the worker runs as, passed
+	// to the worker in the payload
+	ServiceAccount string
+	// CommitStatus sets the status of the commit of the git-commit annotation
+	// whenever a build is emitted for the custom resource
+	CommitStatus bool
+	// CommitStates maps ACTION:OUTCOME, like `apply:failure`, to the states of
+	// the commit statuses, overriding DefaultCommitStates
+	CommitStates map[string]string
+	// MaxConcurrentReconciles is the number of objects of the kind reconciled in
+	// parallel, 1 if zero. Each object is still reconciled by one worker at a time.
+	MaxConcurrentReconciles int
+	// Fields maps payload keys to dot-separated paths to fields of objects, like
+	// `spec.image.tag`, whose values are added to the payload under "fields"
+	Fields map[string]string
+	// References are fields naming ConfigMaps or Secrets, whose changes emit
+	// builds for the custom resources referencing them
+	References []Reference
+	// Deletion is the deletion mode of the kind, DeletionDestroy if empty
+	Deletion string
+	// PreviousBuild adds the ID and outcome of the previous build emitted for an
+	// object to the payload of the next one, like of the plan preceding an
+	// apply
+	PreviousBuild bool
+	// ActionOnly emits only the build of the kind and action, like
+	// releaseset:apply, and not the build of the bare kind, like releaseset,
+	// preceding it
+	ActionOnly bool
+	// Unapproved is what changes of objects that are not approved result in,
+	// UnapprovedPlan if empty
+	Unapproved string
+	// ApplyEvent, PlanEvent and DestroyEvent override the event types of the
+	// builds of the actions, like deploy:myapp. They default to KIND:apply,
+	// KIND:plan and KIND:destroy with the kind cased by TypeCase.
+	ApplyEvent, PlanEvent, DestroyEvent string
+	// TypeCase determines the casing of the kind in the payload type and the
+	// default event types: TypeCaseLower, the default, TypeCaseOriginal, or a
+	// template of the Group, Version and Kind with the lower and upper
+	// functions, like `{{.Kind | upper}}`.
+	TypeCase string
+	// Namespace restricts the watched objects of the kind to the namespace. All
+	// namespaces are watched if empty.
+	Namespace string
+	// LabelSelector restricts the watched objects of the kind to those whose
+	// labels match it, like `app=myapp,tier!=test`
+	LabelSelector string
+	// DefaultBranch is the branch of objects of the kind without the git-commit
+	// and git-branch annotations, the default branch of the controller if empty
+	DefaultBranch string
+	// RecreateWindow defers the destroy builds of deleted objects by the
+	// duration, and skips them if the objects are recreated with the same spec
+	// meantime, like by a re-apply. Deferred builds are lost if the gateway
+	// exits. Zero emits destroy builds right away.
+	RecreateWindow time.Duration
+}
+
+// Validate checks that the mapping is usable.
+func (m Mapping) Validate() error {
+	for phase, action := range m.Phases {
+		if !IsAllowedAction(action) {
+			return fmt.Errorf("phase %q maps to %q, which is not one of the allowed actions %s", phase, action, strings.Join(AllowedActions, ", "))
+		}
+	}
+	if len(m.Phases) > 0 && m.PhaseField == "" {
+		return fmt.Errorf("phases are configured for kind %q but no phase field is set", m.Kind)
+	}
+	if m.ServiceAccount != "" {
+		if err := webhook.ValidateServiceAccount(m.ServiceAccount); err != nil {
+			return fmt.Errorf("kind %q: %v", m.Kind, err)
+		}
+	}
+	for branch, p := range m.BranchProjects {
+		if branch == "" || p == "" {
+			return fmt.Errorf("kind %q: invalid route from branch %q to project %q", m.Kind, branch, p)
+		}
+	}
+	if err := ValidateCommitStates(m.CommitStates); err != nil {
+		return fmt.Errorf("kind %q: %v", m.Kind, err)
+	}
+	if err := ValidateFields(m.Fields); err != nil {
+		return fmt.Errorf("kind %q: %v", m.Kind, err)
+	}
+	for _, ref := range m.References {
+		if err := ref.Validate(); err != nil {
+			return fmt.Errorf("kind %q: %v", m.Kind, err)
+		}
+	}
+	if m.Deletion != "" && m.Deletion != DeletionDestroy && m.Deletion != DeletionIgnore {
+		return fmt.Errorf("kind %q: deletion mode %q must be one of %s, %s", m.Kind, m.Deletion, DeletionDestroy, DeletionIgnore)
+	}
+	if m.Unapproved != "" && m.Unapproved != UnapprovedPlan && m.Unapproved != UnapprovedReject {
+		return fmt.Errorf("kind %q: unapproved mode %q must be one of %s, %s", m.Kind, m.Unapproved, UnapprovedPlan, UnapprovedReject)
+	}
+	if m.RecreateWindow < 0 {
+		return fmt.Errorf("kind %q: recreate window %s must not be negative", m.Kind, m.RecreateWindow)
+	}
+	if m.RecreateWindow > 0 && m.Deletion == DeletionIgnore {
+		return fmt.Errorf("kind %q: a recreate window is set but deletions are ignored", m.Kind)
+	}
+	if m.MaxConcurrentReconciles < 0 {
+		return fmt.Errorf("kind %q: max concurrent reconciles %d must not be negative", m.Kind, m.MaxConcurrentReconciles)
+	}
+	if len(m.CommitStates) > 0 && !m.CommitStatus {
+		return fmt.Errorf("commit states are configured for kind %q but commit statuses are not enabled", m.Kind)
+	}
+	if _, err := newScope(m); err != nil {
+		return fmt.Errorf("kind %q: invalid label selector %q: %v", m.Kind, m.LabelSelector, err)
+	}
+	apply, plan, destroy := m.eventTypes()
+	if _, err := m.kindType(); err != nil {
+		return fmt.Errorf("kind %q: %v", m.Kind, err)
+	}
+	if apply == plan || apply == destroy || plan == destroy {
+		return fmt.Errorf("kind %q: the event types %q, %q and %q of the apply, plan and destroy actions must differ", m.Kind, apply, plan, destroy)
+	}
+	return nil
+}
+
+// eventTypes returns the event types of the apply, plan and destroy actions.
+func (m Mapping) eventTypes() (apply, plan, destroy string) {
+	kind, err := m.kindType()
+	if err != nil {
+		// Rejected by Validate
+		kind = strings.ToLower(m.Kind)
+	}
+	apply, plan, destroy = m.ApplyEvent, m.PlanEvent, m.DestroyEvent
+	if apply == "" {
+		apply = fmt.Sprintf("%s:apply", kind)
+	}
+	if plan == "" {
+		plan = fmt.Sprintf("%s:plan", kind)
+	}
+	if destroy == "" {
+		destroy = fmt.Sprintf("%s:destroy", kind)
+	}
+	return apply, plan, destroy
 }
 
 type controller struct {
@@ -228,10 +861,117 @@ type controller struct {
 	s        storage.Store
 	kc       *rest.Config
 	// key is the x509 certificate key as ASCII-armored (PEM) data
-	key   []byte
-	appID int
+	key     []byte
+	appID   int
+	gateway webhook.Gateway
+	// annotationPrefix is prepended to the names of every annotation we read or write
+	annotationPrefix string
+	// refTemplate renders the Ref of the revision of every build, if set
+	refTemplate *webhook.RefTemplate
+	// compressionThreshold is the size in bytes above which payloads are gzipped
+	compressionThreshold int
+	// buildTypes renames the types of builds
+	buildTypes map[string]string
+	// deadLetters persists builds that could not be created, if set
+	deadLetters webhook.DeadLetters
+	// defaultInstallationID is the installation of objects without the annotation, if non-zero
+	defaultInstallationID int
+	// defaultBranch is the branch of objects without a commit or branch annotation
+	defaultBranch string
+	// auditLog records every created build, if set
+	auditLog *webhook.AuditLog
+	// handlers are the handlers of the mappings, set once the controller runs
+	handlers []*Handler
+
+	newManager ManagerFunc
+	// stop stops the manager, which stops on SIGTERM or SIGINT if nil
+	stop <-chan struct{}
+	// done is closed once the manager stopped, and is nil until Run started it
+	done chan struct{}
+	// err is the error the manager stopped with, set before done is closed
+	err error
+}
+
+// ManagerFunc creates the controller manager that runs the reconcilers of c.
+type ManagerFunc func(c *config.Config, kc *rest.Config) (crmanager.Manager, error)
+
+// WithManager makes Run create the controller manager with newManager, and stop
+// it once stop is closed. Tests can use it to drive reconciles with a fake client
+// rather than a real API server.
+func (ct *controller) WithManager(newManager ManagerFunc, stop <-chan struct{}) *controller {
+	ct.newManager = newManager
+	ct.stop = stop
+	return ct
+}
+
+// WithStop makes Run stop the controller manager once stop is closed, instead
+// of on SIGTERM or SIGINT, so that the caller can shut it down along with
+// everything else.
+func (ct *controller) WithStop(stop <-chan struct{}) *controller {
+	ct.stop = stop
+	return ct
 }
 
+// Wait blocks until the controller manager stopped, and returns the error it
+// failed with, if any. It returns immediately if Run didn't start it.
+func (ct *controller) Wait() error {
+	if ct.done == nil {
+		return nil
+	}
+	<-ct.done
+	return ct.err
+}
+
+// WithDeadLetters makes the handlers put builds that could not be created into dl.
+func (ct *controller) WithDeadLetters(dl webhook.DeadLetters) *controller {
+	ct.deadLetters = dl
+	return ct
+}
+
+// WithAuditLog makes the handlers record every created build in a.
+func (ct *controller) WithAuditLog(a *webhook.AuditLog) *controller {
+	ct.auditLog = a
+	return ct
+}
+
+// WithDefaultBranch makes the handlers emit builds for the branch for objects
+// without the git-commit and git-branch annotations, instead of webhook.DefaultBranch.
+func (ct *controller) WithDefaultBranch(branch string) *controller {
+	if branch != "" {
+		ct.defaultBranch = branch
+	}
+	return ct
+}
+
+// WithDefaultInstallationID makes the handlers negotiate tokens for the
+// installation id for objects without the github-app-inst-id annotation.
+func (ct *controller) WithDefaultInstallationID(id int) *controller {
+	ct.defaultInstallationID = id
+	return ct
+}
+
+// ErrUnknownKind is returned by Reconcile for kinds that don't have a mapping
+var ErrUnknownKind = errors.New("no mapping for kind")
+
+// Reconcile runs the object of the given kind and name through the handler of
+// its mapping, as the controller loop would, and returns the event type of the
+// resulting build. The kind can be omitted when there is only one mapping.
+func (ct *controller) Reconcile(c context.Context, kind, namespace, name string, dryRun bool) (string, error) {
+	for _, h := range ct.handlers {
+		if strings.EqualFold(h.groupVersionKind.Kind, kind) || kind == "" && len(ct.handlers) == 1 {
+			return h.Reconcile(c, namespace, name, dryRun)
+		}
+	}
+	return "", ErrUnknownKind
+}
+
+// DefaultAnnotationPrefix is the prefix of the annotations of custom resources
+const DefaultAnnotationPrefix = "cd.brigade.sh/"
+
+// annotationNotBefore defers builds for a custom resource until the RFC3339 time it is set to
+const annotationNotBefore = "not-before"
+
+// New creates a controller for the custom resources of the mappings.
 func New(s storage.Store, appID int, key []byte, kc *rest.Config, mappings []Mapping) *controller {
 	return &controller{
 		s:        s,
@@ -239,31 +979,136 @@ func New(s storage.Store, appID int, key []byte, kc *rest.Config, mappings []Map
 		kc:       kc,
 		key:      key,
 		appID:    appID,
+
+		annotationPrefix: DefaultAnnotationPrefix,
+		defaultBranch:    webhook.DefaultBranch,
+	}
+}
+
+// WithGateway makes the handlers stamp the version and configuration of the
+// gateway into the payloads of builds.
+func (ct *controller) WithGateway(gateway webhook.Gateway) *controller {
+	ct.gateway = gateway
+	return ct
+}
+
+// WithAnnotationPrefix makes the handlers read the annotations of objects under
+// prefix instead of DefaultAnnotationPrefix, to distinguish the annotations of
+// instances with different semantics. An empty prefix keeps the default.
+func (ct *controller) WithAnnotationPrefix(prefix string) *controller {
+	if prefix == "" {
+		return ct
 	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	ct.annotationPrefix = prefix
+	return ct
+}
+
+// WithRefTemplate makes the handlers render the refs of builds with t.
+func (ct *controller) WithRefTemplate(t *webhook.RefTemplate) *controller {
+	ct.refTemplate = t
+	return ct
+}
+
+// WithCompressionThreshold makes the handlers compress the payloads of builds
+// larger than threshold bytes. Zero doesn't compress them.
+func (ct *controller) WithCompressionThreshold(threshold int) *controller {
+	ct.compressionThreshold = threshold
+	return ct
+}
+
+// WithBuildTypes makes the handlers rename the event types of builds as in types.
+func (ct *controller) WithBuildTypes(types map[string]string) *controller {
+	ct.buildTypes = types
+	return ct
 }
 
+// Run starts the controller manager, and returns once its controllers started,
+// or the error the manager failed to start with. Errors of the manager after
+// that are returned by Wait.
 func (ct *controller) Run() error {
 	logf.SetLogger(logf.ZapLogger(false))
 
+	// Fail fast rather than on the first build for a branch
+	for _, k := range ct.mappings {
+		for branch, p := range k.BranchProjects {
+			if _, err := ct.s.GetProject(p); err != nil {
+				fmt.Fprintf(os.Stderr, "Project %q of branch %q of kind %q not found: %s\n", p, branch, k.Kind, err)
+				return fmt.Errorf("project %q of branch %q of kind %q not found: %v", p, branch, k.Kind, err)
+			}
+		}
+	}
+
 	configs := []*config.ResourceConfig{}
 	handlers := []*Handler{}
+	mappings := map[schema.GroupVersionKind]Mapping{}
+	var appSlug *webhook.AppSlug
+	if ct.appID != 0 {
+		appSlug = webhook.NewAppSlug(ct.appID, ct.key)
+	}
 	for _, k := range ct.mappings {
 		groupVersionKind := schema.GroupVersionKind{
 			Group:   k.Group,
 			Version: k.Version,
 			Kind:    k.Kind,
 		}
-		lkind := strings.ToLower(k.Kind)
+		mappings[groupVersionKind] = k
+		apply, plan, destroy := k.eventTypes()
+		kindType, err := k.kindType()
+		if err != nil {
+			return fmt.Errorf("invalid type case of kind %q: %v", k.Kind, err)
+		}
+		sc, err := newScope(k)
+		if err != nil {
+			return fmt.Errorf("invalid label selector %q of kind %q: %v", k.LabelSelector, k.Kind, err)
+		}
+		branch := ct.defaultBranch
+		if k.DefaultBranch != "" {
+			branch = k.DefaultBranch
+		}
 		handler := &Handler{
 			store:                  ct.s,
 			brigadeProject:         k.BrigadeProject,
-			eventTypeActionDestroy: fmt.Sprintf("%s:destroy", lkind),
-			eventTypeActionApply:   fmt.Sprintf("%s:apply", lkind),
-			eventTypeActionPlan:    fmt.Sprintf("%s:plan", lkind),
-			defaultBranch:          "master",
+			branchProjects:         k.BranchProjects,
+			eventTypeActionDestroy: destroy,
+			eventTypeActionApply:   apply,
+			eventTypeActionPlan:    plan,
+			kindType:               kindType,
+			defaultBranch:          branch,
+			phaseField:             k.PhaseField,
+			deletion:               k.Deletion,
+			unapproved:             k.Unapproved,
+			previousBuild:          k.PreviousBuild,
+			bareEvent:              !k.ActionOnly,
+			scope:                  sc,
+			phases:                 k.Phases,
+			cascadeKinds:           k.CascadeKinds,
+			references:             k.References,
+			fields:                 k.Fields,
+			serviceAccount:         k.ServiceAccount,
+			annotationPrefix:       ct.annotationPrefix,
+			refTemplate:            ct.refTemplate,
+			compressionThreshold:   ct.compressionThreshold,
+			buildTypes:             ct.buildTypes,
+			commitStatus:           k.CommitStatus,
+			commitStates:           k.CommitStates,
+			setStatus:              webhook.SetRepoStatus,
 			groupVersionKind:       groupVersionKind,
 			key:                    ct.key,
 			appID:                  ct.appID,
+			gateway:                ct.gateway,
+			builds:                 webhook.NewDeliveryGuard(webhook.DefaultDeliveryTTL),
+			deadLetters:            ct.deadLetters,
+			defaultInstallationID:  ct.defaultInstallationID,
+			auditLog:               ct.auditLog,
+			appSlug:                appSlug,
+			now:                    time.Now,
+		}
+		handler.getToken = handler.installationToken
+		if k.RecreateWindow > 0 {
+			handler.recreates = newRecreateGuard(k.RecreateWindow)
 		}
 		cfg := &config.ResourceConfig{
 			GroupVersionKind: groupVersionKind,
@@ -274,6 +1119,11 @@ func (ct *controller) Run() error {
 			},
 		}
 
+		if k.Deletion != DeletionIgnore {
+			// The finalizer holds off the deletion until the destroy build is created
+			cfg.Finalizer = &config.HandlerConfig{StateHandler: handler}
+		}
+
 		configs = append(configs, cfg)
 		handlers = append(handlers, handler)
 	}
@@ -294,7 +1144,11 @@ func (ct *controller) Run() error {
 		}
 	}
 
-	mgr, err := manager.New(c, kc)
+	newMgr := ct.newManager
+	if newMgr == nil {
+		newMgr = newManager(mappings)
+	}
+	mgr, err := newMgr(c, kc)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to create controller manager: %s\n", err)
 		return err
@@ -303,16 +1157,42 @@ func (ct *controller) Run() error {
 	for i, _ := range configs {
 		handlers[i].kubeclient = mgr.GetClient()
 	}
+	ct.handlers = handlers
+
+	stop := ct.stop
+	if stop == nil {
+		stop = signals.SetupSignalHandler()
+	}
+	// The manager starts its runnables once its caches synced, so that this one
+	// tells that the controllers started
+	ready := make(chan struct{})
+	if err := mgr.Add(crmanager.RunnableFunc(func(stop <-chan struct{}) error {
+		close(ready)
+		<-stop
+		return nil
+	})); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to add to controller manager: %s\n", err)
+		return err
+	}
 
+	ct.done = make(chan struct{})
 	go func() {
-		err = mgr.Start(signals.SetupSignalHandler())
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to start controller manager: %s\n", err)
-			panic(err)
+		defer close(ct.done)
+		if err := mgr.Start(stop); err != nil {
+			fmt.Fprintf(os.Stderr, "Controller manager failed: %s\n", err)
+			ct.err = err
 		}
 	}()
 
-	return nil
+	select {
+	case <-ready:
+		return nil
+	case <-ct.done:
+		if ct.err != nil {
+			return fmt.Errorf("failed to start controller manager: %v", ct.err)
+		}
+		return nil
+	}
 }
 
 func (s *Handler) installationToken(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
@@ -335,9 +1215,10 @@ func (s *Handler) installationToken(appID, installationID int, cfg brigade.Githu
 	}
 
 	ctx := context.Background()
-	itok, _, err := ghc.Apps.CreateInstallationToken(ctx, int64(installationID))
+	itok, res, err := ghc.Apps.CreateInstallationToken(ctx, int64(installationID))
 	if err != nil {
 		return "", time.Time{}, err
 	}
+	webhook.ObserveInstallationToken(itok.GetExpiresAt(), res)
 	return itok.GetToken(), itok.GetExpiresAt(), nil
 }
@@ -0,0 +1,1069 @@
+package customresource
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+	"github.com/mumoshu/brigade-cd/pkg/webhook"
+	"github.com/summerwind/whitebox-controller/reconciler/state"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type testStore struct {
+	proj   *brigade.Project
+	builds []*brigade.Build
+	err    error
+	storage.Store
+}
+
+func (s *testStore) GetProject(name string) (*brigade.Project, error) {
+	return s.proj, s.err
+}
+
+func (s *testStore) CreateBuild(build *brigade.Build) error {
+	s.builds = append(s.builds, build)
+	return s.err
+}
+
+func newTestStore() *testStore {
+	return &testStore{
+		proj: &brigade.Project{
+			ID:   "brigade-1234",
+			Name: "myorg/myapp",
+		},
+	}
+}
+
+func newTestHandler(store storage.Store) *Handler {
+	return &Handler{
+		store:                  store,
+		brigadeProject:         "myorg/myapp",
+		eventTypeActionApply:   "releaseset:apply",
+		eventTypeActionPlan:    "releaseset:plan",
+		eventTypeActionDestroy: "releaseset:destroy",
+		kindType:               "releaseset",
+		defaultBranch:          "master",
+		annotationPrefix:       DefaultAnnotationPrefix,
+		now:                    time.Now,
+	}
+}
+
+// newTestState returns a state for a ReleaseSet object with the given annotations and spec.
+func newTestState(annotations map[string]string, spec map[string]interface{}) *state.State {
+	o := &unstructured.Unstructured{}
+	o.SetAPIVersion("cd.brigade.sh/v1alpha1")
+	o.SetKind("ReleaseSet")
+	o.SetNamespace("default")
+	o.SetName("myapp")
+
+	a := map[string]string{"cd.brigade.sh/git-repo": "myorg/myapp"}
+	for k, v := range annotations {
+		a[k] = v
+	}
+	o.SetAnnotations(a)
+
+	if spec != nil {
+		unstructured.SetNestedMap(o.Object, spec, "spec")
+	}
+
+	return state.New(o, nil, nil)
+}
+
+func TestHandleState_phaseField(t *testing.T) {
+	tests := []struct {
+		name        string
+		phase       interface{}
+		annotations map[string]string
+		expected    string
+		mustFail    bool
+	}{
+		{
+			name:     "mapped phase",
+			phase:    "provision",
+			expected: "releaseset:apply",
+		},
+		{
+			name:     "mapped destroy phase",
+			phase:    "teardown",
+			expected: "releaseset:destroy",
+		},
+		{
+			name:     "action name as phase",
+			phase:    "plan",
+			expected: "releaseset:plan",
+		},
+		{
+			name:        "phase overrides approval",
+			phase:       "provision",
+			annotations: map[string]string{"cd.brigade.sh/approved": "false"},
+			expected:    "releaseset:apply",
+		},
+		{
+			name:        "no phase falls back to approval",
+			annotations: map[string]string{"cd.brigade.sh/approved": "false"},
+			expected:    "releaseset:plan",
+		},
+		{
+			name:     "unknown phase",
+			phase:    "frobnicate",
+			mustFail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+			h.phaseField = "spec.phase"
+			h.phases = map[string]string{
+				"provision": ActionApply,
+				"teardown":  ActionDestroy,
+			}
+
+			spec := map[string]interface{}{"image": "myapp:v1"}
+			if tt.phase != nil {
+				spec["phase"] = tt.phase
+			}
+
+			err := h.HandleState(newTestState(tt.annotations, spec))
+			if tt.mustFail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if len(store.builds) != 0 {
+					t.Fatalf("expected no builds, got %d", len(store.builds))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(store.builds) != 1 {
+				t.Fatalf("expected 1 build, got %d", len(store.builds))
+			}
+			if got := store.builds[0].Type; got != tt.expected {
+				t.Errorf("expected build type %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMapping_Validate(t *testing.T) {
+	valid := Mapping{Kind: "ReleaseSet", PhaseField: "spec.phase", Phases: map[string]string{"provision": "apply"}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	invalidAction := Mapping{Kind: "ReleaseSet", PhaseField: "spec.phase", Phases: map[string]string{"provision": "deploy"}}
+	if err := invalidAction.Validate(); err == nil || !strings.Contains(err.Error(), "deploy") {
+		t.Errorf("expected an error naming the invalid action, got %v", err)
+	}
+
+	missingField := Mapping{Kind: "ReleaseSet", Phases: map[string]string{"provision": "apply"}}
+	if err := missingField.Validate(); err == nil {
+		t.Error("expected an error for phases without a phase field")
+	}
+
+	unknownDeletion := Mapping{Kind: "ReleaseSet", Deletion: "orphan"}
+	if err := unknownDeletion.Validate(); err == nil || !strings.Contains(err.Error(), "orphan") {
+		t.Errorf("expected an error naming the invalid deletion mode, got %v", err)
+	}
+
+	unknownUnapproved := Mapping{Kind: "ReleaseSet", Unapproved: "queue"}
+	if err := unknownUnapproved.Validate(); err == nil || !strings.Contains(err.Error(), "queue") {
+		t.Errorf("expected an error naming the invalid unapproved mode, got %v", err)
+	}
+
+	emptyBranchProject := Mapping{Kind: "ReleaseSet", BranchProjects: map[string]string{"main": ""}}
+	if err := emptyBranchProject.Validate(); err == nil {
+		t.Error("expected an error for a branch without a project")
+	}
+
+	invalidSelector := Mapping{Kind: "ReleaseSet", LabelSelector: "app in myapp"}
+	if err := invalidSelector.Validate(); err == nil || !strings.Contains(err.Error(), "app in myapp") {
+		t.Errorf("expected an error naming the invalid label selector, got %v", err)
+	}
+}
+
+func TestHandleState_preservesUnknownStatus(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+
+	ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+	unstructured.SetNestedField(ss.Object.Object, "pending", "status", "phase")
+	unstructured.SetNestedField(ss.Object.Object, true, "status", "otherController", "ready")
+	unstructured.SetNestedField(ss.Object.Object, int64(3), "status", "replicas")
+
+	if err := h.HandleState(ss); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	phase, _, _ := unstructured.NestedString(ss.Object.Object, "status", "phase")
+	if phase != "completed" {
+		t.Errorf("expected phase to be updated to completed, got %q", phase)
+	}
+	ready, found, _ := unstructured.NestedBool(ss.Object.Object, "status", "otherController", "ready")
+	if !found || !ready {
+		t.Errorf("expected status.otherController.ready to survive the reconcile, got %v", ss.Object.Object["status"])
+	}
+	replicas, found, _ := unstructured.NestedFieldNoCopy(ss.Object.Object, "status", "replicas")
+	if !found || replicas != int64(3) {
+		t.Errorf("expected status.replicas to survive the reconcile, got %v (%T)", replicas, replicas)
+	}
+}
+
+func TestHandleState_buildStatus(t *testing.T) {
+	store := &workersStore{testStore: newTestStore()}
+	h := newTestHandler(store)
+	now := time.Date(2019, 7, 2, 1, 0, 0, 0, time.UTC)
+	h.now = func() time.Time { return now }
+
+	ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+	if err := h.HandleState(ss); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if id, _, _ := unstructured.NestedString(ss.Object.Object, "status", "buildID"); id != "build-1" {
+		t.Errorf("expected the ID of the build in the status, got %q", id)
+	}
+	if et, _, _ := unstructured.NestedString(ss.Object.Object, "status", "lastEventType"); et != "releaseset:apply" {
+		t.Errorf("expected the event type of the build in the status, got %q", et)
+	}
+	if at, _, _ := unstructured.NestedString(ss.Object.Object, "status", "lastBuildTime"); at != "2019-07-02T01:00:00Z" {
+		t.Errorf("expected the time of the build in the status, got %q", at)
+	}
+}
+
+func TestHandleState_observedGeneration(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+
+	ss := newTestState(map[string]string{"cd.brigade.sh/approved": "false"}, map[string]interface{}{"image": "myapp:v1"})
+	ss.Object.SetGeneration(1)
+	reconcile := func(resourceVersion string) {
+		ss.Object.SetResourceVersion(resourceVersion)
+		if err := h.HandleState(ss); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	reconcile("100")
+	if g, _, _ := unstructured.NestedInt64(ss.Object.Object, "status", "observedGeneration"); g != 1 {
+		t.Errorf("expected the observed generation 1 in the status, got %d", g)
+	}
+	reconcile("101")
+	if len(store.builds) != 1 {
+		t.Fatalf("expected a single build for a no-op update, got %d", len(store.builds))
+	}
+
+	// Approving changes the annotations but not the generation
+	ss.Object.SetAnnotations(map[string]string{"cd.brigade.sh/git-repo": "myorg/myapp"})
+	reconcile("102")
+	if len(store.builds) != 2 || store.builds[1].Type != "releaseset:apply" {
+		t.Fatalf("expected an apply build once approved, got %d builds", len(store.builds))
+	}
+
+	unstructured.SetNestedField(ss.Object.Object, "myapp:v2", "spec", "image")
+	ss.Object.SetGeneration(2)
+	reconcile("103")
+	if len(store.builds) != 3 {
+		t.Fatalf("expected a build for the spec change, got %d builds", len(store.builds))
+	}
+	if g, _, _ := unstructured.NestedInt64(ss.Object.Object, "status", "observedGeneration"); g != 2 {
+		t.Errorf("expected the observed generation 2 in the status, got %d", g)
+	}
+
+	now := metav1.Now()
+	ss.Object.SetDeletionTimestamp(&now)
+	reconcile("104")
+	if len(store.builds) != 4 || store.builds[3].Type != "releaseset:destroy" {
+		t.Errorf("expected a destroy build for the deletion, got %d builds", len(store.builds))
+	}
+}
+
+func TestHandleState_bareEvent(t *testing.T) {
+	store := &workersStore{testStore: newTestStore()}
+	h := newTestHandler(store)
+	h.bareEvent = true
+
+	ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+	if err := h.HandleState(ss); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(store.builds) != 2 || store.builds[0].Type != "releaseset" || store.builds[1].Type != "releaseset:apply" {
+		t.Fatalf("expected a releaseset and a releaseset:apply build, got %d builds", len(store.builds))
+	}
+	if !bytes.Equal(store.builds[0].Payload, store.builds[1].Payload) {
+		t.Errorf("expected both builds to carry the same payload, got %s and %s", store.builds[0].Payload, store.builds[1].Payload)
+	}
+	if id, _, _ := unstructured.NestedString(ss.Object.Object, "status", "buildID"); id != "build-2" {
+		t.Errorf("expected the ID of the releaseset:apply build in the status, got %q", id)
+	}
+
+	// Event types without a kind have no bare event
+	h.eventTypeActionApply = "deploy"
+	ss.Object.SetResourceVersion("2")
+	if err := h.HandleState(ss); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(store.builds) != 3 || store.builds[2].Type != "deploy" {
+		t.Errorf("expected a single deploy build, got %d builds", len(store.builds))
+	}
+}
+
+func TestHandleState_retriedReconcile(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+	h.builds = webhook.NewDeliveryGuard(webhook.DefaultDeliveryTTL)
+
+	reconcile := func(resourceVersion string) {
+		ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+		ss.Object.SetUID("8b1f3c2e-0b7a-4c1e-9d57-3f7c0c6a2a10")
+		ss.Object.SetResourceVersion(resourceVersion)
+		if err := h.HandleState(ss); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	reconcile("100")
+	reconcile("100")
+	if len(store.builds) != 1 {
+		t.Fatalf("expected a single build for the same resource version, got %d", len(store.builds))
+	}
+
+	reconcile("101")
+	if len(store.builds) != 2 {
+		t.Fatalf("expected a build for the new resource version, got %d", len(store.builds))
+	}
+}
+
+func TestHandleState_serviceAccount(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+	h.serviceAccount = "deployer"
+
+	if err := h.HandleState(newTestState(nil, map[string]interface{}{"image": "myapp:v1"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pl := struct {
+		ServiceAccount string `json:"serviceAccount"`
+	}{}
+	if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if pl.ServiceAccount != "deployer" {
+		t.Errorf("expected service account deployer, got %q", pl.ServiceAccount)
+	}
+
+	if err := (Mapping{Kind: "ReleaseSet", ServiceAccount: "Deployer"}).Validate(); err == nil {
+		t.Error("expected an error for an invalid service account")
+	}
+}
+
+func TestHandleState_refTemplate(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+	tmpl, err := webhook.ParseRefTemplate("{{.Branch}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.refTemplate = tmpl
+
+	if err := h.HandleState(newTestState(nil, map[string]interface{}{"image": "myapp:v1"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(store.builds) != 1 {
+		t.Fatalf("expected 1 build, got %d", len(store.builds))
+	}
+	if ref := store.builds[0].Revision.Ref; ref != "master" {
+		t.Errorf("expected the ref to be rendered by the template as master, got %q", ref)
+	}
+}
+
+func TestHandleState_compression(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+	h.compressionThreshold = 1
+
+	if err := h.HandleState(newTestState(nil, map[string]interface{}{"image": "myapp:v1"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	payload, err := webhook.DecompressPayload(store.builds[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := Payload{}
+	if err := json.Unmarshal(payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if pl.Type != "releaseset" || pl.Repo != "myapp" {
+		t.Errorf("unexpected decompressed payload %s", payload)
+	}
+	if string(payload) == string(store.builds[0].Payload) {
+		t.Error("expected the payload to be compressed")
+	}
+}
+
+func TestHandleState_buildTypes(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+	h.buildTypes = map[string]string{"releaseset:apply": "deploy"}
+
+	if err := h.HandleState(newTestState(nil, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b := store.builds[0]; b.Type != "deploy" {
+		t.Errorf("expected the build type to be renamed to deploy, got %q", b.Type)
+	}
+}
+
+func TestHandleState_annotationPrefix(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+	h.annotationPrefix = "cd.myco.io/"
+
+	ss := newTestState(map[string]string{
+		"cd.myco.io/git-repo":    "myorg/myapp",
+		"cd.myco.io/git-branch":  "release",
+		"cd.myco.io/approved":    "false",
+		"cd.brigade.sh/approved": "true",
+	}, map[string]interface{}{"image": "myapp:v1"})
+
+	if err := h.HandleState(ss); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(store.builds) != 1 {
+		t.Fatalf("expected 1 build, got %d", len(store.builds))
+	}
+	b := store.builds[0]
+	if b.Type != "releaseset:plan" {
+		t.Errorf("expected the approval annotation with the custom prefix to be honored, got %q", b.Type)
+	}
+	if b.Revision.Ref != "refs/heads/release" {
+		t.Errorf("expected the branch annotation with the custom prefix to be honored, got %q", b.Revision.Ref)
+	}
+}
+
+func TestHandleState_revision(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		commit      string
+		ref         string
+	}{
+		{name: "no commit or branch", ref: "refs/heads/master"},
+		{name: "branch only", annotations: map[string]string{"cd.brigade.sh/git-branch": "release"}, ref: "refs/heads/release"},
+		{name: "commit only", annotations: map[string]string{"cd.brigade.sh/git-commit": "abc123"}, commit: "abc123"},
+		{name: "commit on branch", annotations: map[string]string{"cd.brigade.sh/git-commit": "abc123", "cd.brigade.sh/git-branch": "release"}, commit: "abc123", ref: "refs/heads/release"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+
+			if err := h.HandleState(newTestState(tt.annotations, map[string]interface{}{"image": "myapp:v1"})); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(store.builds) != 1 {
+				t.Fatalf("expected 1 build, got %d", len(store.builds))
+			}
+			if rev := store.builds[0].Revision; rev.Commit != tt.commit || rev.Ref != tt.ref {
+				t.Errorf("expected commit %q and ref %q, got %q and %q", tt.commit, tt.ref, rev.Commit, rev.Ref)
+			}
+		})
+	}
+}
+
+func TestHandler_Reconcile(t *testing.T) {
+	o := newTestState(map[string]string{"cd.brigade.sh/approved": "false"}, nil).Object
+	o.SetUID("2d4a1d7e-5d0c-4f3b-8f3e-0f6d5a1b7c11")
+
+	tests := []struct {
+		name      string
+		object    string
+		dryRun    bool
+		eventType string
+		builds    int
+		mustFail  bool
+	}{
+		{name: "reconcile", object: "myapp", eventType: "releaseset:plan", builds: 1},
+		{name: "dry run", object: "myapp", dryRun: true, eventType: "releaseset:plan"},
+		{name: "not found", object: "missing", mustFail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+			h.groupVersionKind = o.GroupVersionKind()
+			h.kubeclient = &testClient{objects: []unstructured.Unstructured{*o}}
+
+			eventType, err := h.Reconcile(context.Background(), "default", tt.object, tt.dryRun)
+			if tt.mustFail {
+				if !apierrors.IsNotFound(err) {
+					t.Fatalf("expected a not found error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if eventType != tt.eventType {
+				t.Errorf("expected event type %q, got %q", tt.eventType, eventType)
+			}
+			if len(store.builds) != tt.builds {
+				t.Errorf("expected %d builds, got %d", tt.builds, len(store.builds))
+			}
+		})
+	}
+}
+
+func TestController_Reconcile(t *testing.T) {
+	ct := &controller{handlers: []*Handler{newTestHandler(newTestStore())}}
+	if _, err := ct.Reconcile(context.Background(), "Release", "default", "myapp", true); err != ErrUnknownKind {
+		t.Errorf("expected ErrUnknownKind, got %v", err)
+	}
+}
+
+func TestHandleState_notBefore(t *testing.T) {
+	now := time.Date(2019, 7, 1, 22, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		notBefore    string
+		builds       int
+		requeueAfter int
+		mustFail     bool
+	}{
+		{name: "past", notBefore: "2019-07-01T21:00:00Z", builds: 1},
+		{name: "now", notBefore: "2019-07-01T22:00:00Z", builds: 1},
+		{name: "future", notBefore: "2019-07-02T01:30:00+02:00", requeueAfter: 90 * 60},
+		{name: "fraction of a second", notBefore: "2019-07-01T22:00:00.5Z", requeueAfter: 1},
+		{name: "not RFC3339", notBefore: "2019-07-02 01:30", mustFail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+			h.now = func() time.Time { return now }
+
+			ss := newTestState(map[string]string{"cd.brigade.sh/not-before": tt.notBefore}, nil)
+			err := h.HandleState(ss)
+			if tt.mustFail {
+				if err == nil || !strings.Contains(err.Error(), "RFC3339") {
+					t.Fatalf("expected an error explaining the format, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(store.builds) != tt.builds {
+				t.Errorf("expected %d builds, got %d", tt.builds, len(store.builds))
+			}
+			if ss.RequeueAfter != tt.requeueAfter {
+				t.Errorf("expected requeue after %ds, got %ds", tt.requeueAfter, ss.RequeueAfter)
+			}
+		})
+	}
+}
+
+func TestHandleState_invalidGitRepo(t *testing.T) {
+	for _, gitRepo := range []string{"", "myapp", "myorg/", "github.com/myorg/myapp"} {
+		t.Run(gitRepo, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+
+			err := h.HandleState(newTestState(map[string]string{"cd.brigade.sh/git-repo": gitRepo}, nil))
+			if err == nil || !strings.Contains(err.Error(), "OWNER/REPO") {
+				t.Fatalf("expected an error explaining the format, got %v", err)
+			}
+			if len(store.builds) != 0 {
+				t.Errorf("expected no build, got %d", len(store.builds))
+			}
+		})
+	}
+}
+
+func TestHandleState_installationWithoutAppID(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+
+	err := h.HandleState(newTestState(map[string]string{"cd.brigade.sh/github-app-inst-id": "2311213"}, nil))
+	if err == nil || !strings.Contains(err.Error(), "APP_ID is not set") {
+		t.Fatalf("expected an error about APP_ID, got %v", err)
+	}
+	if len(store.builds) != 0 {
+		t.Errorf("expected no builds, got %d", len(store.builds))
+	}
+}
+
+func TestHandleState_defaultInstallation(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    int
+	}{
+		{name: "annotated installation", annotations: map[string]string{"cd.brigade.sh/github-app-inst-id": "2311213"}, expected: 2311213},
+		{name: "default installation", expected: 42},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+			h.appID = 13
+			h.defaultInstallationID = 42
+			var gotInstID int
+			h.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+				gotInstID = installationID
+				return "v1.installation-token", time.Now().Add(time.Hour), nil
+			}
+
+			if err := h.HandleState(newTestState(tt.annotations, nil)); err != nil {
+				t.Fatal(err)
+			}
+			if gotInstID != tt.expected {
+				t.Errorf("expected the token of installation %d, got installation %d", tt.expected, gotInstID)
+			}
+			p := Payload{}
+			if err := json.Unmarshal(store.builds[0].Payload, &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Token != "v1.installation-token" {
+				t.Errorf("unexpected token %q in the payload", p.Token)
+			}
+			if p.InstallationID != tt.expected {
+				t.Errorf("expected installation %d in the payload, got %d", tt.expected, p.InstallationID)
+			}
+		})
+	}
+}
+
+func TestHandleState_appSlug(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":13,"slug":"brigade-cd"}`))
+	}))
+	defer ts.Close()
+	defer webhook.SetDefaultURLs("", "")
+	if err := webhook.SetDefaultURLs(ts.URL+"/", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newTestStore()
+	h := newTestHandler(store)
+	h.appID = 13
+	h.appSlug = webhook.NewAppSlug(13, key)
+	h.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+		return "v1.installation-token", time.Now().Add(time.Hour), nil
+	}
+
+	if err := h.HandleState(newTestState(map[string]string{"cd.brigade.sh/github-app-inst-id": "2311213"}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(store.builds[0].Payload, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["installationID"] != 2311213.0 || fields["appSlug"] != "brigade-cd" {
+		t.Errorf("expected the installation and slug in the payload, got %v and %v", fields["installationID"], fields["appSlug"])
+	}
+}
+
+// testDeadLetters records the builds put into it
+type testDeadLetters struct {
+	builds []*brigade.Build
+}
+
+func (d *testDeadLetters) Put(b *brigade.Build, cause error) error {
+	d.builds = append(d.builds, b)
+	return nil
+}
+
+func TestHandleState_deadLetters(t *testing.T) {
+	h := newTestHandler(failingBuildStore{newTestStore()})
+	dl := &testDeadLetters{}
+	h.deadLetters = dl
+
+	if err := h.HandleState(newTestState(nil, nil)); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(dl.builds) != 1 || dl.builds[0].Type != "releaseset:apply" {
+		t.Fatalf("expected the apply build to be a dead letter, got %v", dl.builds)
+	}
+}
+
+func TestHandleState_auditLog(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+	buf := &bytes.Buffer{}
+	h.auditLog = webhook.NewAuditLog(buf)
+
+	ss := newTestState(nil, nil)
+	ss.Object.SetUID("8a2b2c9e")
+	ss.Object.SetResourceVersion("42")
+	if err := h.HandleState(ss); err != nil {
+		t.Fatal(err)
+	}
+
+	r := webhook.AuditRecord{}
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Delivery != "8a2b2c9e/42/releaseset:apply" || r.Event != "releaseset:apply" || r.Provider != "brigade-cd" || r.Repo != "myorg/myapp" || r.ProjectID != "brigade-1234" {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+// namedProjectsStore serves the projects by name
+type namedProjectsStore struct {
+	*testStore
+	projs map[string]*brigade.Project
+}
+
+func (s *namedProjectsStore) GetProject(name string) (*brigade.Project, error) {
+	if p, ok := s.projs[name]; ok {
+		return p, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func newNamedProjectsStore() *namedProjectsStore {
+	return &namedProjectsStore{
+		testStore: newTestStore(),
+		projs: map[string]*brigade.Project{
+			"myorg/myapp":   {ID: "brigade-1234", Name: "myorg/myapp"},
+			"myorg/prod":    {ID: "brigade-prod", Name: "myorg/prod"},
+			"myorg/staging": {ID: "brigade-staging", Name: "myorg/staging"},
+		},
+	}
+}
+
+func TestHandleState_branchProjects(t *testing.T) {
+	tests := []struct {
+		name     string
+		branch   string
+		expected string
+	}{
+		{name: "production branch", branch: "main", expected: "brigade-prod"},
+		{name: "staging branch", branch: "develop", expected: "brigade-staging"},
+		{name: "other branch", branch: "feature", expected: "brigade-1234"},
+		{name: "default branch", expected: "brigade-1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newNamedProjectsStore()
+			h := newTestHandler(store)
+			h.branchProjects = map[string]string{"main": "myorg/prod", "develop": "myorg/staging"}
+
+			annotations := map[string]string{}
+			if tt.branch != "" {
+				annotations["cd.brigade.sh/git-branch"] = tt.branch
+			}
+			if err := h.HandleState(newTestState(annotations, nil)); err != nil {
+				t.Fatal(err)
+			}
+			if len(store.builds) != 1 || store.builds[0].ProjectID != tt.expected {
+				t.Fatalf("expected a build in project %s, got %v", tt.expected, store.builds)
+			}
+		})
+	}
+}
+
+func TestHandleState_pull(t *testing.T) {
+	tests := []struct {
+		name                    string
+		pullID                  string
+		gitRepo                 string
+		baseURL, defaultBaseURL string
+		pull, pullURL           string
+	}{
+		{name: "pull request", pullID: "12", pull: "12", pullURL: "https://api.github.com/repos/myorg/myapp/pulls/12"},
+		{name: "pull request of another repository", pullID: "12", gitRepo: "myorg/myapp-config", pull: "12", pullURL: "https://api.github.com/repos/myorg/myapp-config/pulls/12"},
+		{name: "pull request on the default API", pullID: "12", defaultBaseURL: "https://ghe.example.com/api/v3/", pull: "12", pullURL: "https://ghe.example.com/api/v3/repos/myorg/myapp/pulls/12"},
+		{name: "pull request on the API of the project", pullID: "12", baseURL: "https://ghe.example.com/api/v3", defaultBaseURL: "https://other.example.com/api/v3/", pull: "12", pullURL: "https://ghe.example.com/api/v3/repos/myorg/myapp/pulls/12"},
+		{name: "no pull request"},
+		{name: "invalid pull request", pullID: "twelve"},
+		{name: "non-positive pull request", pullID: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := webhook.SetDefaultURLs(tt.defaultBaseURL, ""); err != nil {
+				t.Fatal(err)
+			}
+			defer webhook.SetDefaultURLs("", "")
+
+			store := newTestStore()
+			store.proj.Github.BaseURL = tt.baseURL
+			h := newTestHandler(store)
+			annotations := map[string]string{}
+			if tt.pullID != "" {
+				annotations["cd.brigade.sh/github-pull-id"] = tt.pullID
+			}
+			if tt.gitRepo != "" {
+				annotations["cd.brigade.sh/git-repo"] = tt.gitRepo
+			}
+			if err := h.HandleState(newTestState(annotations, nil)); err != nil {
+				t.Fatal(err)
+			}
+			p := Payload{}
+			if err := json.Unmarshal(store.builds[0].Payload, &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Pull != tt.pull || p.PullURL != tt.pullURL {
+				t.Errorf("expected pull %q at %q, got %q at %q", tt.pull, tt.pullURL, p.Pull, p.PullURL)
+			}
+		})
+	}
+}
+
+func TestHandleState_deletion(t *testing.T) {
+	finalizer := "releaseset-controller.cd.brigade.sh"
+	tests := []struct {
+		deletion   string
+		build      string
+		finalizers []string
+	}{
+		{deletion: "", build: "releaseset:destroy", finalizers: []string{finalizer, "other"}},
+		{deletion: DeletionDestroy, build: "releaseset:destroy", finalizers: []string{finalizer, "other"}},
+		{deletion: DeletionIgnore, finalizers: []string{"other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.deletion, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+			h.deletion = tt.deletion
+			h.groupVersionKind = schema.GroupVersionKind{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet"}
+
+			ss := newTestState(nil, nil)
+			now := metav1.Now()
+			ss.Object.SetDeletionTimestamp(&now)
+			ss.Object.SetFinalizers([]string{finalizer, "other"})
+
+			if err := h.HandleState(ss); err != nil {
+				t.Fatal(err)
+			}
+			if tt.build == "" && len(store.builds) != 0 {
+				t.Errorf("expected no builds, got %s", store.builds[0].Type)
+			}
+			if tt.build != "" && (len(store.builds) != 1 || store.builds[0].Type != tt.build) {
+				t.Errorf("expected a %s build, got %d builds", tt.build, len(store.builds))
+			}
+			if got := ss.Object.GetFinalizers(); strings.Join(got, ",") != strings.Join(tt.finalizers, ",") {
+				t.Errorf("expected finalizers %v, got %v", tt.finalizers, got)
+			}
+		})
+	}
+}
+
+func TestHandleState_approval(t *testing.T) {
+	tests := []struct {
+		approved, dryRun string
+		expected         string
+	}{
+		{expected: "releaseset:apply"},
+		{approved: "true", expected: "releaseset:apply"},
+		{approved: "yes", dryRun: "false", expected: "releaseset:apply"},
+		{approved: "true", dryRun: "no", expected: "releaseset:apply"},
+		{approved: "true", dryRun: "true", expected: "releaseset:plan"},
+		{approved: "yes", dryRun: "yes", expected: "releaseset:plan"},
+		{dryRun: "true", expected: "releaseset:plan"},
+		{approved: "false", expected: "releaseset:plan"},
+		{approved: "false", dryRun: "false", expected: "releaseset:plan"},
+		{approved: "false", dryRun: "true", expected: "releaseset:plan"},
+	}
+	for _, tt := range tests {
+		t.Run("approved="+tt.approved+",dry-run="+tt.dryRun, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+
+			annotations := map[string]string{}
+			if tt.approved != "" {
+				annotations["cd.brigade.sh/approved"] = tt.approved
+			}
+			if tt.dryRun != "" {
+				annotations["cd.brigade.sh/dry-run"] = tt.dryRun
+			}
+			if err := h.HandleState(newTestState(annotations, map[string]interface{}{"image": "myapp:v1"})); err != nil {
+				t.Fatal(err)
+			}
+			if len(store.builds) != 1 || store.builds[0].Type != tt.expected {
+				t.Fatalf("expected a %s build, got %v", tt.expected, store.builds)
+			}
+		})
+	}
+}
+
+func TestHandleState_unapproved(t *testing.T) {
+	tests := []struct {
+		unapproved string
+		approved   string
+		build      string
+		phase      string
+	}{
+		{unapproved: "", approved: "false", build: "releaseset:plan", phase: "completed"},
+		{unapproved: UnapprovedPlan, approved: "false", build: "releaseset:plan", phase: "completed"},
+		{unapproved: UnapprovedReject, approved: "false", phase: "blocked"},
+		{unapproved: UnapprovedReject, approved: "true", build: "releaseset:apply", phase: "completed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.unapproved+"/"+tt.approved, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+			h.unapproved = tt.unapproved
+
+			ss := newTestState(map[string]string{"cd.brigade.sh/approved": tt.approved}, map[string]interface{}{"image": "myapp:v1"})
+			if err := h.HandleState(ss); err != nil {
+				t.Fatal(err)
+			}
+			if tt.build == "" && len(store.builds) != 0 {
+				t.Errorf("expected no builds, got %s", store.builds[0].Type)
+			}
+			if tt.build != "" && (len(store.builds) != 1 || store.builds[0].Type != tt.build) {
+				t.Errorf("expected a %s build, got %d builds", tt.build, len(store.builds))
+			}
+			if phase, _, _ := unstructured.NestedString(ss.Object.Object, "status", "phase"); phase != tt.phase {
+				t.Errorf("expected phase %q, got %q", tt.phase, phase)
+			}
+		})
+	}
+}
+
+func TestHandleState_resourceVersion(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+	ss := newTestState(nil, nil)
+	ss.Object.SetUID("8b1f3c2e-0b7a-4c1e-9d57-3f7c0c6a2a10")
+	ss.Object.SetResourceVersion("100")
+
+	if err := h.HandleState(ss); err != nil {
+		t.Fatal(err)
+	}
+	p := Payload{}
+	if err := json.Unmarshal(store.builds[0].Payload, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.ResourceUID != "8b1f3c2e-0b7a-4c1e-9d57-3f7c0c6a2a10" || p.ResourceVersion != "100" {
+		t.Errorf("expected the UID and resource version of the object, got %q and %q", p.ResourceUID, p.ResourceVersion)
+	}
+}
+
+func TestHandleState_recreate(t *testing.T) {
+	spec := map[string]interface{}{"image": "myapp:v1"}
+	tests := []struct {
+		name     string
+		recreate map[string]interface{}
+		expected []string
+	}{
+		{name: "same spec", recreate: spec, expected: []string{"releaseset:apply"}},
+		{name: "other spec", recreate: map[string]interface{}{"image": "myapp:v2"}, expected: []string{"releaseset:destroy", "releaseset:apply"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+			h.recreates = newRecreateGuard(time.Hour)
+
+			deleted := newTestState(nil, spec)
+			deleted.Object.SetUID("old")
+			now := metav1.Now()
+			deleted.Object.SetDeletionTimestamp(&now)
+			if err := h.HandleState(deleted); err != nil {
+				t.Fatal(err)
+			}
+			if len(store.builds) != 0 {
+				t.Fatalf("expected the destroy event to be deferred, got %s", store.builds[0].Type)
+			}
+			if deleted.Requeue || deleted.RequeueAfter != 0 {
+				t.Error("expected the deletion to complete, so that the object can be recreated")
+			}
+
+			recreated := newTestState(nil, tt.recreate)
+			recreated.Object.SetUID("new")
+			if err := h.HandleState(recreated); err != nil {
+				t.Fatal(err)
+			}
+			var types []string
+			for _, b := range store.builds {
+				types = append(types, b.Type)
+			}
+			if strings.Join(types, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected builds %v, got %v", tt.expected, types)
+			}
+		})
+	}
+}
+
+func TestHandleState_recreateWindowElapsed(t *testing.T) {
+	store := &lockedStore{testStore: newTestStore()}
+	h := newTestHandler(store)
+	h.recreates = newRecreateGuard(time.Millisecond)
+
+	ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+	now := metav1.Now()
+	ss.Object.SetDeletionTimestamp(&now)
+	if err := h.HandleState(ss); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.types() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the deferred destroy event")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := store.types(); got != "releaseset:destroy" {
+		t.Errorf("expected a destroy build once the window elapsed, got %s", got)
+	}
+}
+
+// lockedStore is a testStore that builds can be created in from timers
+type lockedStore struct {
+	*testStore
+	mu sync.Mutex
+}
+
+func (s *lockedStore) CreateBuild(build *brigade.Build) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.testStore.CreateBuild(build)
+}
+
+// types returns the types of the created builds, separated by commas
+func (s *lockedStore) types() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var types []string
+	for _, b := range s.builds {
+		types = append(types, b.Type)
+	}
+	return strings.Join(types, ",")
+}
@@ -0,0 +1,55 @@
+package customresource
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// fieldPath splits a dot-separated path to a field of an object, like
+// `spec.image.tag`. A leading dot, like in `.spec.image.tag`, is allowed.
+func fieldPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "."), ".")
+}
+
+// ValidateFields checks that every field of Mapping.Fields has a payload key and
+// a path without empty segments or JSONPath expressions, which aren't supported.
+func ValidateFields(fields map[string]string) error {
+	for key, path := range fields {
+		if key == "" {
+			return fmt.Errorf("no payload key is set for the field %q", path)
+		}
+		if strings.ContainsAny(path, "[]*{}@$ ") {
+			return fmt.Errorf("field %q of payload key %q must be a dot-separated path like spec.image.tag", path, key)
+		}
+		for _, s := range fieldPath(path) {
+			if s == "" {
+				return fmt.Errorf("field %q of payload key %q must be a dot-separated path like spec.image.tag", path, key)
+			}
+		}
+	}
+	return nil
+}
+
+// extractFields returns the values of the fields of h in o by payload key.
+// Fields that o doesn't set are left out, so that workers can tell them from
+// fields set to empty values.
+func (h *Handler) extractFields(o *unstructured.Unstructured) map[string]interface{} {
+	if len(h.fields) == 0 || o == nil {
+		return nil
+	}
+	values := map[string]interface{}{}
+	for key, path := range h.fields {
+		v, found, err := unstructured.NestedFieldCopy(o.Object, fieldPath(path)...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring field %q of %s/%s: %v\n", path, o.GetNamespace(), o.GetName(), err)
+			continue
+		}
+		if found {
+			values[key] = v
+		}
+	}
+	return values
+}
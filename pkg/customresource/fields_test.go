@@ -0,0 +1,79 @@
+package customresource
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestHandleState_fields(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+	h.fields = map[string]string{
+		"tag":      "spec.image.tag",
+		"replicas": ".spec.replicas",
+		"name":     "metadata.name",
+		"missing":  "spec.image.digest",
+		"scalar":   "spec.replicas.count",
+	}
+
+	ss := newTestState(nil, map[string]interface{}{
+		"image":    map[string]interface{}{"repository": "myapp", "tag": "v1"},
+		"replicas": int64(3),
+	})
+	if err := h.HandleState(ss); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(store.builds) != 1 {
+		t.Fatalf("expected 1 build, got %d", len(store.builds))
+	}
+
+	pl := struct {
+		Fields map[string]interface{} `json:"fields"`
+	}{}
+	if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"tag": "v1", "replicas": float64(3), "name": "myapp"}
+	if !reflect.DeepEqual(pl.Fields, expected) {
+		t.Errorf("expected fields %v without the missing ones, got %v", expected, pl.Fields)
+	}
+}
+
+func TestHandleState_noFields(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+
+	if err := h.HandleState(newTestState(nil, map[string]interface{}{"image": "myapp:v1"})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pl := map[string]interface{}{}
+	if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pl["fields"]; ok {
+		t.Errorf("expected no fields in the payload, got %v", pl["fields"])
+	}
+}
+
+func TestValidateFields(t *testing.T) {
+	tests := []struct {
+		fields map[string]string
+		valid  bool
+	}{
+		{valid: true},
+		{fields: map[string]string{"tag": "spec.image.tag"}, valid: true},
+		{fields: map[string]string{"tag": ".spec.image.tag"}, valid: true},
+		{fields: map[string]string{"": "spec.image.tag"}},
+		{fields: map[string]string{"tag": ""}},
+		{fields: map[string]string{"tag": "spec..tag"}},
+		{fields: map[string]string{"tag": "spec.image."}},
+		{fields: map[string]string{"image": "spec.containers[0].image"}},
+		{fields: map[string]string{"tag": "{.spec.image.tag}"}},
+	}
+	for _, tt := range tests {
+		if err := ValidateFields(tt.fields); (err == nil) != tt.valid {
+			t.Errorf("%v: unexpected error %v", tt.fields, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package customresource
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/summerwind/whitebox-controller/config"
+	"github.com/summerwind/whitebox-controller/reconciler"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	crcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	crmanager "sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// newController creates the controllers of addControllers
+var newController = crcontroller.New
+
+// newManager returns a ManagerFunc that creates the manager like manager.New of
+// whitebox-controller does, except that the controller of each resource runs up
+// to the MaxConcurrentReconciles of its mapping in parallel, and watches the
+// References of the mapping. Reconciles of the same object are never run in
+// parallel, as the work queue hands out an object to only one worker at a time.
+//
+// If every mapping has a Namespace, the cache only watches those namespaces.
+func newManager(mappings map[schema.GroupVersionKind]Mapping) ManagerFunc {
+	return func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration: %v", err)
+		}
+		mgr, err := crmanager.New(kc, managerOptions(mappings))
+		if err != nil {
+			return nil, err
+		}
+		if err := addControllers(mgr, c, mappings); err != nil {
+			return nil, err
+		}
+		return mgr, nil
+	}
+}
+
+// managerOptions restricts the cache of the manager to the cacheNamespaces of
+// mappings.
+func managerOptions(mappings map[schema.GroupVersionKind]Mapping) crmanager.Options {
+	o := crmanager.Options{}
+	switch namespaces := cacheNamespaces(mappings); len(namespaces) {
+	case 0:
+	case 1:
+		o.Namespace = namespaces[0]
+	default:
+		o.NewCache = cache.MultiNamespacedCacheBuilder(namespaces)
+	}
+	return o
+}
+
+// addControllers adds a controller to mgr for each resource of c with a
+// reconciler, watching the objects of the resource and the objects referenced by
+// them. Events of objects outside the Namespace and LabelSelector of the
+// mapping are filtered out. Only resources like those of Run are supported,
+// i.e. without dependents, resyncs or webhooks.
+func addControllers(mgr crmanager.Manager, c *config.Config, mappings map[schema.GroupVersionKind]Mapping) error {
+	for _, rc := range c.Resources {
+		if rc.Reconciler == nil {
+			continue
+		}
+		name := fmt.Sprintf("%s-controller", strings.ToLower(rc.Kind))
+
+		r, err := reconciler.New(rc, mgr.GetEventRecorderFor(name))
+		if err != nil {
+			return fmt.Errorf("could not create reconciler: %v", err)
+		}
+
+		m := mappings[rc.GroupVersionKind]
+		sc, err := newScope(m)
+		if err != nil {
+			return fmt.Errorf("invalid label selector %q of kind %q: %v", m.LabelSelector, rc.Kind, err)
+		}
+		ctrl, err := newController(name, mgr, crcontroller.Options{
+			Reconciler:              r,
+			MaxConcurrentReconciles: m.MaxConcurrentReconciles,
+		})
+		if err != nil {
+			return fmt.Errorf("could not create controller: %v", err)
+		}
+
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(rc.GroupVersionKind)
+		if err := ctrl.Watch(&source.Kind{Type: obj}, &handler.EnqueueRequestForObject{}, sc.predicate(rc.GroupVersionKind)); err != nil {
+			return fmt.Errorf("failed to watch resource: %v", err)
+		}
+		for _, ref := range m.References {
+			if err := watchReference(mgr, ctrl, rc.GroupVersionKind, sc, ref); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
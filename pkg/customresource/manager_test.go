@@ -0,0 +1,83 @@
+package customresource
+
+import (
+	"testing"
+
+	"github.com/summerwind/whitebox-controller/config"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	crcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	crmanager "sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// recordingManager serves a fake event recorder
+type recordingManager struct {
+	crmanager.Manager
+}
+
+func (m *recordingManager) GetEventRecorderFor(name string) record.EventRecorder {
+	return record.NewFakeRecorder(10)
+}
+
+// testController records its watches
+type testController struct {
+	crcontroller.Controller
+	watches int
+	watch   func(source.Source, handler.EventHandler)
+}
+
+func (c *testController) Watch(src source.Source, h handler.EventHandler, predicates ...predicate.Predicate) error {
+	c.watches++
+	if c.watch != nil {
+		c.watch(src, h)
+	}
+	return nil
+}
+
+func TestAddControllers_maxConcurrentReconciles(t *testing.T) {
+	releaseSet := schema.GroupVersionKind{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet"}
+	release := schema.GroupVersionKind{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "Release"}
+	c := &config.Config{}
+	for _, gvk := range []schema.GroupVersionKind{releaseSet, release} {
+		c.Resources = append(c.Resources, &config.ResourceConfig{
+			GroupVersionKind: gvk,
+			Reconciler: &config.ReconcilerConfig{
+				HandlerConfig: config.HandlerConfig{StateHandler: newTestHandler(newTestStore())},
+			},
+		})
+	}
+
+	options := map[string]crcontroller.Options{}
+	controllers := map[string]*testController{}
+	orig := newController
+	defer func() { newController = orig }()
+	newController = func(name string, mgr crmanager.Manager, o crcontroller.Options) (crcontroller.Controller, error) {
+		options[name] = o
+		controllers[name] = &testController{}
+		return controllers[name], nil
+	}
+
+	if err := addControllers(&recordingManager{}, c, map[schema.GroupVersionKind]Mapping{releaseSet: {MaxConcurrentReconciles: 4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int{"releaseset-controller": 4, "release-controller": 0}
+	for name, n := range expected {
+		o, ok := options[name]
+		if !ok {
+			t.Fatalf("expected controller %s to be created, got %v", name, options)
+		}
+		if o.MaxConcurrentReconciles != n {
+			t.Errorf("expected %s to run %d reconciles in parallel, got %d", name, n, o.MaxConcurrentReconciles)
+		}
+		if o.Reconciler == nil {
+			t.Errorf("expected %s to have a reconciler", name)
+		}
+		if controllers[name].watches != 1 {
+			t.Errorf("expected %s to watch its resource, got %d watches", name, controllers[name].watches)
+		}
+	}
+}
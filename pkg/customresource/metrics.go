@@ -0,0 +1,92 @@
+package customresource
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// reconcilesTotal counts the reconciles of custom resources, labelled by kind and outcome.
+	reconcilesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "brigade_cd_reconciles_total",
+			Help: "Number of reconciles of custom resources, partitioned by kind and outcome.",
+		},
+		[]string{"kind", "outcome"},
+	)
+
+	// reconcileDurationSeconds observes how long reconciles of custom resources take.
+	reconcileDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "brigade_cd_reconcile_duration_seconds",
+			Help:    "Seconds reconciles of custom resources took, partitioned by kind.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"kind"},
+	)
+
+	// finalizerHeldObjects is the number of objects whose deletion the finalizer holds off.
+	finalizerHeldObjects = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "brigade_cd_finalizer_held_objects",
+			Help: "Number of deleted custom resources whose deletion is held off by the finalizer, as their destroy build failed or is deferred, partitioned by kind.",
+		},
+		[]string{"kind"},
+	)
+)
+
+// Outcomes of reconciles
+const (
+	// reconcileBuildEmitted is a reconcile that created a build
+	reconcileBuildEmitted = "build_emitted"
+	// reconcileSkippedUnchanged is a reconcile of a change that was already built
+	reconcileSkippedUnchanged = "skipped_unchanged"
+	// reconcileDeferred is a reconcile whose build is emitted later, like for
+	// the not-before annotation or the recreate window
+	reconcileDeferred = "deferred"
+	// reconcileIgnored is a reconcile that emits nothing, like for objects
+	// outside the scope of the mapping, ignored deletions, unapproved objects
+	// blocked until they are approved or dry runs
+	reconcileIgnored = "ignored"
+	// reconcileAuthFailed is a reconcile that failed negotiating an
+	// installation token, see authError
+	reconcileAuthFailed = "auth_failed"
+	// reconcileError is a reconcile that failed otherwise
+	reconcileError = "error"
+)
+
+// authError is an error authenticating as an installation of the App, which
+// is counted apart from other errors of reconciles.
+type authError struct {
+	error
+}
+
+// heldObjects are the keys of the objects of each kind that are counted in
+// finalizerHeldObjects.
+var heldObjects = struct {
+	sync.Mutex
+	keys map[string]map[string]bool
+}{keys: map[string]map[string]bool{}}
+
+// setHeld records whether the deletion of the object of kind with key is held
+// off by the finalizer.
+func setHeld(kind, key string, held bool) {
+	heldObjects.Lock()
+	defer heldObjects.Unlock()
+	keys := heldObjects.keys[kind]
+	if keys == nil {
+		keys = map[string]bool{}
+		heldObjects.keys[kind] = keys
+	}
+	if held {
+		keys[key] = true
+	} else {
+		delete(keys, key)
+	}
+	finalizerHeldObjects.WithLabelValues(kind).Set(float64(len(keys)))
+}
+
+func init() {
+	prometheus.MustRegister(reconcilesTotal, reconcileDurationSeconds, finalizerHeldObjects)
+}
@@ -0,0 +1,121 @@
+package customresource
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mumoshu/brigade-cd/pkg/webhook"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/summerwind/whitebox-controller/reconciler/state"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestHandleState_metrics(t *testing.T) {
+	releaseSet := schema.GroupVersionKind{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet"}
+
+	tests := []struct {
+		name    string
+		outcome string
+		setup   func(h *Handler, store *testStore) *state.State
+	}{
+		{
+			name:    "build emitted",
+			outcome: reconcileBuildEmitted,
+			setup: func(h *Handler, store *testStore) *state.State {
+				return newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+			},
+		},
+		{
+			name:    "skipped unchanged",
+			outcome: reconcileSkippedUnchanged,
+			setup: func(h *Handler, store *testStore) *state.State {
+				h.builds = webhook.NewDeliveryGuard(webhook.DefaultDeliveryTTL)
+				ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+				ss.Object.SetUID("8b1f3c2e-0b7a-4c1e-9d57-3f7c0c6a2a10")
+				ss.Object.SetResourceVersion("100")
+				if err := h.HandleState(ss.Copy()); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return ss
+			},
+		},
+		{
+			name:    "deferred",
+			outcome: reconcileDeferred,
+			setup: func(h *Handler, store *testStore) *state.State {
+				return newTestState(map[string]string{"cd.brigade.sh/not-before": "2999-01-01T00:00:00Z"}, nil)
+			},
+		},
+		{
+			name:    "ignored",
+			outcome: reconcileIgnored,
+			setup: func(h *Handler, store *testStore) *state.State {
+				h.scope = scope{namespace: "tenant-a"}
+				return newTestState(nil, nil)
+			},
+		},
+		{
+			name:    "auth failed",
+			outcome: reconcileAuthFailed,
+			setup: func(h *Handler, store *testStore) *state.State {
+				return newTestState(map[string]string{"cd.brigade.sh/github-app-inst-id": "1"}, nil)
+			},
+		},
+		{
+			name:    "error",
+			outcome: reconcileError,
+			setup: func(h *Handler, store *testStore) *state.State {
+				store.err = errors.New("boom")
+				return newTestState(nil, nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			h := newTestHandler(store)
+			h.groupVersionKind = releaseSet
+			ss := tt.setup(h, store)
+
+			before := testutil.ToFloat64(reconcilesTotal.WithLabelValues("ReleaseSet", tt.outcome))
+			h.HandleState(ss)
+			if got := testutil.ToFloat64(reconcilesTotal.WithLabelValues("ReleaseSet", tt.outcome)); got != before+1 {
+				t.Errorf("expected the %s counter to be incremented, got %v from %v", tt.outcome, got, before)
+			}
+		})
+	}
+}
+
+func TestHandleState_finalizerHeldObjects(t *testing.T) {
+	// A kind of its own, so that other tests don't change the gauge
+	kind := schema.GroupVersionKind{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "HeldReleaseSet"}
+	store := newTestStore()
+	h := newTestHandler(store)
+	h.groupVersionKind = kind
+
+	newDeleted := func() *state.State {
+		ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+		now := metav1.Now()
+		ss.Object.SetDeletionTimestamp(&now)
+		ss.Object.SetFinalizers([]string{finalizerName(kind)})
+		return ss
+	}
+
+	store.err = errors.New("boom")
+	if err := h.HandleState(newDeleted()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if got := testutil.ToFloat64(finalizerHeldObjects.WithLabelValues("HeldReleaseSet")); got != 1 {
+		t.Errorf("expected the object whose destroy build failed to be held, got %v", got)
+	}
+
+	store.err = nil
+	if err := h.HandleState(newDeleted()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := testutil.ToFloat64(finalizerHeldObjects.WithLabelValues("HeldReleaseSet")); got != 0 {
+		t.Errorf("expected the finalized object to be released, got %v", got)
+	}
+}
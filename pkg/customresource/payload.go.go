@@ -12,10 +12,27 @@ type Payload struct {
 	InstID       int         `json:"-"`
 	Commit       string      `json:"commit"`
 	Branch       string      `json:"branch"`
+	// InstallationID and AppSlug identify the installation of the App the token
+	// was negotiated for, for workers that negotiate tokens of their own
+	InstallationID int    `json:"installationID,omitempty"`
+	AppSlug        string `json:"appSlug,omitempty"`
+	// ResourceUID and ResourceVersion identify the version of the object the
+	// build is for, for workers to deduplicate builds with
+	ResourceUID     string `json:"resourceUID,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
 
 	Owner   string `json:"owner"`
 	Repo    string `json:"repo"`
 	Pull    string `json:"pull"`
 	PullURL string `json:"pullURL"`
+
+	// Fields are the values of the fields of Mapping.Fields by payload key
+	Fields map[string]interface{} `json:"fields,omitempty"`
+
+	// PreviousBuildID and PreviousOutcome identify the previous build emitted for
+	// the object and the status of its worker, like "Succeeded", if enabled by
+	// Mapping.PreviousBuild
+	PreviousBuildID string `json:"previousBuildID,omitempty"`
+	PreviousOutcome string `json:"previousOutcome,omitempty"`
 }
 
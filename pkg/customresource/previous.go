@@ -0,0 +1,27 @@
+package customresource
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+// stampPreviousBuild adds the ID of the previous build emitted for o, as
+// recorded in its status, and the status of its worker to the payload, so that
+// an apply can tell the outcome of the plan preceding it. A worker that can't
+// be read, like of a pruned build, results in brigade.JobUnknown.
+func (h *Handler) stampPreviousBuild(o *Object, payload *Payload) {
+	id := o.Status.BuildID
+	if id == "" {
+		return
+	}
+	payload.PreviousBuildID = id
+	w, err := h.store.GetWorker(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get the worker of the previous build %s of %s/%s: %v\n", id, o.Namespace, o.Name, err)
+		payload.PreviousOutcome = brigade.JobUnknown.String()
+		return
+	}
+	payload.PreviousOutcome = w.Status.String()
+}
@@ -0,0 +1,110 @@
+package customresource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// workersStore assigns IDs to builds and serves the workers of some of them
+type workersStore struct {
+	workers map[string]*brigade.Worker
+	*testStore
+}
+
+func (s *workersStore) CreateBuild(build *brigade.Build) error {
+	build.ID = fmt.Sprintf("build-%d", len(s.builds)+1)
+	return s.testStore.CreateBuild(build)
+}
+
+func (s *workersStore) GetWorker(buildID string) (*brigade.Worker, error) {
+	if w, ok := s.workers[buildID]; ok {
+		return w, nil
+	}
+	return nil, errors.New("worker not found")
+}
+
+func TestHandleState_previousBuild(t *testing.T) {
+	tests := []struct {
+		name     string
+		workers  map[string]*brigade.Worker
+		expected string
+	}{
+		{name: "succeeded plan", workers: map[string]*brigade.Worker{"build-1": {Status: brigade.JobSucceeded}}, expected: "Succeeded"},
+		{name: "failed plan", workers: map[string]*brigade.Worker{"build-1": {Status: brigade.JobFailed}}, expected: "Failed"},
+		{name: "pruned plan", expected: "Unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &workersStore{workers: tt.workers, testStore: newTestStore()}
+			h := newTestHandler(store)
+			h.previousBuild = true
+
+			ss := newTestState(map[string]string{"cd.brigade.sh/approved": "false"}, map[string]interface{}{"image": "myapp:v1"})
+			ss.Object.SetResourceVersion("1")
+			if err := h.HandleState(ss); err != nil {
+				t.Fatal(err)
+			}
+			if id, _, _ := unstructured.NestedString(ss.Object.Object, "status", "buildID"); id != "build-1" {
+				t.Fatalf("expected the ID of the plan build in the status, got %q", id)
+			}
+
+			ss.Object.SetAnnotations(map[string]string{"cd.brigade.sh/git-repo": "myorg/myapp", "cd.brigade.sh/approved": "true"})
+			ss.Object.SetResourceVersion("2")
+			if err := h.HandleState(ss); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(store.builds) != 2 || store.builds[0].Type != "releaseset:plan" || store.builds[1].Type != "releaseset:apply" {
+				t.Fatalf("expected a plan and an apply build, got %d builds", len(store.builds))
+			}
+			first := Payload{}
+			if err := json.Unmarshal(store.builds[0].Payload, &first); err != nil {
+				t.Fatal(err)
+			}
+			if first.PreviousBuildID != "" || first.PreviousOutcome != "" {
+				t.Errorf("expected no previous build for the first build, got %q (%s)", first.PreviousBuildID, first.PreviousOutcome)
+			}
+			pl := Payload{}
+			if err := json.Unmarshal(store.builds[1].Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.PreviousBuildID != "build-1" || pl.PreviousOutcome != tt.expected {
+				t.Errorf("expected the apply to carry build-1 with outcome %s, got %q with %q", tt.expected, pl.PreviousBuildID, pl.PreviousOutcome)
+			}
+			if id, _, _ := unstructured.NestedString(ss.Object.Object, "status", "buildID"); id != "build-2" {
+				t.Errorf("expected the ID of the apply build in the status, got %q", id)
+			}
+		})
+	}
+}
+
+func TestHandleState_previousBuildDisabled(t *testing.T) {
+	store := &workersStore{testStore: newTestStore()}
+	h := newTestHandler(store)
+
+	ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+	ss.Object.SetResourceVersion("1")
+	if err := h.HandleState(ss); err != nil {
+		t.Fatal(err)
+	}
+	ss.Object.SetResourceVersion("2")
+	if err := h.HandleState(ss); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.builds) != 2 {
+		t.Fatalf("expected 2 builds, got %d", len(store.builds))
+	}
+	pl := Payload{}
+	if err := json.Unmarshal(store.builds[1].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if pl.PreviousBuildID != "" || pl.PreviousOutcome != "" {
+		t.Errorf("expected no previous build in the payload, got %q (%s)", pl.PreviousBuildID, pl.PreviousOutcome)
+	}
+}
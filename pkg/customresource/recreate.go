@@ -0,0 +1,104 @@
+package customresource
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// specHash returns the checksum of the spec of o, which is the same for equal
+// specs, as the keys of maps are marshaled in order.
+func specHash(o *Object) (string, error) {
+	b, err := json.Marshal(o.Spec)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// recreateGuard defers the destroy builds of deleted objects, and drops them if
+// the objects are recreated with the same spec in the meantime, like by a
+// re-apply, so that only the apply build is emitted.
+type recreateGuard struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingDestroy
+}
+
+type pendingDestroy struct {
+	specHash string
+	timer    *time.Timer
+	// emit creates the destroy build
+	emit func() error
+}
+
+func newRecreateGuard(window time.Duration) *recreateGuard {
+	return &recreateGuard{
+		window:  window,
+		pending: map[string]*pendingDestroy{},
+	}
+}
+
+// schedule emits the destroy build of the object named key with the spec hash
+// specHash once the window elapses, unless the object is recreated first.
+func (g *recreateGuard) schedule(key, specHash string, emit func() error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if p, ok := g.pending[key]; ok {
+		p.timer.Stop()
+	}
+	p := &pendingDestroy{specHash: specHash, emit: emit}
+	p.timer = time.AfterFunc(g.window, func() { g.fire(key, p) })
+	g.pending[key] = p
+}
+
+func (g *recreateGuard) fire(key string, p *pendingDestroy) {
+	g.mu.Lock()
+	if g.pending[key] != p {
+		// Resolved by a recreate while the timer was firing
+		g.mu.Unlock()
+		return
+	}
+	delete(g.pending, key)
+	g.mu.Unlock()
+
+	if err := p.emit(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to emit the deferred destroy event for %s: %v\n", key, err)
+	}
+}
+
+// recreated resolves the pending destroy build of the object named key, which
+// exists again with the spec hash specHash. The build is dropped if the spec is
+// the same, and emitted right away otherwise, before the build for the object.
+// A build that fails to be emitted remains pending, for the reconcile to be retried.
+func (g *recreateGuard) recreated(key, specHash string) error {
+	g.mu.Lock()
+	p, ok := g.pending[key]
+	if !ok {
+		g.mu.Unlock()
+		return nil
+	}
+	p.timer.Stop()
+	if p.specHash == specHash {
+		delete(g.pending, key)
+		g.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "Skipping the destroy event for %s, which was recreated with the same spec\n", key)
+		return nil
+	}
+	g.mu.Unlock()
+
+	if err := p.emit(); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	if g.pending[key] == p {
+		delete(g.pending, key)
+	}
+	g.mu.Unlock()
+	return nil
+}
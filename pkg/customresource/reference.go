@@ -0,0 +1,124 @@
+package customresource
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	crmanager "sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// referenceKinds are the kinds of objects custom resources can reference
+var referenceKinds = map[string]schema.GroupVersionKind{
+	"ConfigMap": {Version: "v1", Kind: "ConfigMap"},
+	"Secret":    {Version: "v1", Kind: "Secret"},
+}
+
+// Reference is a field of custom resources naming a ConfigMap or Secret in their
+// namespace. Changes of the referenced object reconcile the custom resource
+// again, which emits a build as if the custom resource itself changed.
+type Reference struct {
+	// Kind is the kind of the referenced object, ConfigMap or Secret
+	Kind string
+	// Field is a dot-separated path to the name of the object, like `spec.configMapRef.name`
+	Field string
+}
+
+// Validate checks that the reference is to a supported kind.
+func (r Reference) Validate() error {
+	if _, ok := referenceKinds[r.Kind]; !ok {
+		return fmt.Errorf("referenced kind %q must be ConfigMap or Secret", r.Kind)
+	}
+	if r.Field == "" {
+		return fmt.Errorf("no field is set for the reference to a %s", r.Kind)
+	}
+	return nil
+}
+
+// indexField is the name of the index of custom resources by the name of the referenced object
+func (r Reference) indexField() string {
+	return "ref." + r.Kind + "." + r.Field
+}
+
+// name returns the name of the object referenced by o, or "" if it references none.
+func (r Reference) name(o *unstructured.Unstructured) string {
+	name, _, _ := unstructured.NestedString(o.Object, strings.Split(r.Field, ".")...)
+	return name
+}
+
+// watchReference indexes the custom resources of gvk by the name of the object
+// of ref, and enqueues the custom resources in sc referencing an object of the
+// kind of ref whenever it changes.
+func watchReference(mgr crmanager.Manager, ctrl crcontroller.Controller, gvk schema.GroupVersionKind, sc scope, ref Reference) error {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	err := mgr.GetFieldIndexer().IndexField(obj, ref.indexField(), func(o runtime.Object) []string {
+		if name := ref.name(o.(*unstructured.Unstructured)); name != "" {
+			return []string{name}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index %s by %s: %v", gvk.Kind, ref.Field, err)
+	}
+
+	refObj := &unstructured.Unstructured{}
+	refObj.SetGroupVersionKind(referenceKinds[ref.Kind])
+	return ctrl.Watch(&source.Kind{Type: refObj}, &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(a handler.MapObject) []reconcile.Request {
+			return referrers(mgr.GetClient(), gvk, sc, ref, a.Meta.GetNamespace(), a.Meta.GetName())
+		}),
+	})
+}
+
+// referrers returns requests to reconcile the custom resources of gvk in sc
+// whose reference ref names the object namespace/name.
+func referrers(c client.Client, gvk schema.GroupVersionKind, sc scope, ref Reference, namespace, name string) []reconcile.Request {
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	if err := c.List(context.TODO(), list, client.InNamespace(namespace), client.MatchingField(ref.indexField(), name)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed listing %s referencing %s %s/%s: %s\n", gvk.Kind, ref.Kind, namespace, name, err)
+		return nil
+	}
+	reqs := []reconcile.Request{}
+	for _, o := range list.Items {
+		if !sc.contains(&o) {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Reconciling %s/%s as its %s %s changed\n", gvk.Kind, o.GetName(), ref.Kind, name)
+		reqs = append(reqs, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()}})
+	}
+	return reqs
+}
+
+// referenceVersions returns the kinds, names and resource versions of the
+// objects referenced by o, like `ConfigMap/myapp@123`, separated by commas.
+// Missing objects have an empty version, so that their creation is a change.
+func (h *Handler) referenceVersions(o *unstructured.Unstructured) (string, error) {
+	versions := []string{}
+	for _, ref := range h.references {
+		name := ref.name(o)
+		if name == "" {
+			continue
+		}
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(referenceKinds[ref.Kind])
+		err := h.kubeclient.Get(context.TODO(), types.NamespacedName{Namespace: o.GetNamespace(), Name: name}, obj)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("failed getting %s %s/%s referenced by %s: %v", ref.Kind, o.GetNamespace(), name, o.GetName(), err)
+		}
+		versions = append(versions, fmt.Sprintf("%s/%s@%s", ref.Kind, name, obj.GetResourceVersion()))
+	}
+	return strings.Join(versions, ","), nil
+}
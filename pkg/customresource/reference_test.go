@@ -0,0 +1,202 @@
+package customresource
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mumoshu/brigade-cd/pkg/webhook"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	crmanager "sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+func newTestConfigMap(name, resourceVersion string) unstructured.Unstructured {
+	o := unstructured.Unstructured{}
+	o.SetAPIVersion("v1")
+	o.SetKind("ConfigMap")
+	o.SetNamespace("default")
+	o.SetName(name)
+	o.SetResourceVersion(resourceVersion)
+	return o
+}
+
+func TestHandleState_references(t *testing.T) {
+	kc := &testClient{objects: []unstructured.Unstructured{newTestConfigMap("myapp-config", "1")}}
+	store := newTestStore()
+	h := newTestHandler(store)
+	h.kubeclient = kc
+	h.builds = webhook.NewDeliveryGuard(webhook.DefaultDeliveryTTL)
+	h.references = []Reference{{Kind: "ConfigMap", Field: "spec.configMapRef"}, {Kind: "Secret", Field: "spec.secretRef"}}
+
+	reconcile := func() {
+		ss := newTestState(nil, map[string]interface{}{"configMapRef": "myapp-config", "secretRef": "myapp-secret"})
+		ss.Object.SetUID(types.UID("2d4a1d7e-5d0c-4f3b-8f3e-0f6d5a1b7c11"))
+		ss.Object.SetResourceVersion("100")
+		if err := h.HandleState(ss); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reconcile()
+	reconcile()
+	if len(store.builds) != 1 {
+		t.Fatalf("expected a build for the unchanged object, got %d", len(store.builds))
+	}
+
+	kc.objects[0].SetResourceVersion("2")
+	reconcile()
+	if len(store.builds) != 2 || store.builds[1].Type != "releaseset:apply" {
+		t.Fatalf("expected an apply build for the changed config map, got %d builds", len(store.builds))
+	}
+
+	// The referenced secret doesn't exist yet, so creating it is a change too
+	secret := newTestConfigMap("myapp-secret", "7")
+	secret.SetKind("Secret")
+	kc.objects = append(kc.objects, secret)
+	reconcile()
+	if len(store.builds) != 3 {
+		t.Fatalf("expected a build for the created secret, got %d builds", len(store.builds))
+	}
+}
+
+// indexedClient lists the objects matching the field selectors of the indexes of a testIndexer
+type indexedClient struct {
+	*testClient
+	indexer *testIndexer
+}
+
+func (c *indexedClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOptionFunc) error {
+	all := &unstructured.UnstructuredList{}
+	all.SetGroupVersionKind(list.GetObjectKind().GroupVersionKind())
+	if err := c.testClient.List(ctx, all, opts...); err != nil {
+		return err
+	}
+	o := &client.ListOptions{}
+	o.ApplyOptions(opts)
+	l := list.(*unstructured.UnstructuredList)
+	for i := range all.Items {
+		item := &all.Items[i]
+		if o.Namespace != "" && item.GetNamespace() != o.Namespace {
+			continue
+		}
+		matches := true
+		for _, r := range o.FieldSelector.Requirements() {
+			extract := c.indexer.indexes[r.Field]
+			if extract == nil || !contains(extract(item), r.Value) {
+				matches = false
+			}
+		}
+		if matches {
+			l.Items = append(l.Items, *item)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// testIndexer records the index functions
+type testIndexer struct {
+	indexes map[string]client.IndexerFunc
+}
+
+func (i *testIndexer) IndexField(obj runtime.Object, field string, extractValue client.IndexerFunc) error {
+	i.indexes[field] = extractValue
+	return nil
+}
+
+// indexingManager serves an indexedClient and its testIndexer
+type indexingManager struct {
+	client  *indexedClient
+	indexer *testIndexer
+	crmanager.Manager
+}
+
+func (m *indexingManager) GetClient() client.Client {
+	return m.client
+}
+
+func (m *indexingManager) GetFieldIndexer() client.FieldIndexer {
+	return m.indexer
+}
+
+func TestWatchReference(t *testing.T) {
+	releaseSet := schema.GroupVersionKind{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet"}
+	ref := Reference{Kind: "ConfigMap", Field: "spec.configMapRef"}
+
+	referencing := func(name, namespace, configMap string) unstructured.Unstructured {
+		o := newTestChild("ReleaseSet", name)
+		o.SetNamespace(namespace)
+		if configMap != "" {
+			unstructured.SetNestedField(o.Object, configMap, "spec", "configMapRef")
+		}
+		return o
+	}
+	indexer := &testIndexer{indexes: map[string]client.IndexerFunc{}}
+	mgr := &indexingManager{
+		indexer: indexer,
+		client: &indexedClient{
+			testClient: &testClient{objects: []unstructured.Unstructured{
+				referencing("myapp", "default", "myapp-config"),
+				referencing("myapp-canary", "default", "myapp-config"),
+				referencing("other", "default", "other-config"),
+				referencing("unreferencing", "default", ""),
+				referencing("myapp", "staging", "myapp-config"),
+			}},
+			indexer: indexer,
+		},
+	}
+	ctrl := &testController{}
+
+	var src source.Source
+	var h handler.EventHandler
+	ctrl.watch = func(s source.Source, eh handler.EventHandler) {
+		src, h = s, eh
+	}
+	if err := watchReference(mgr, ctrl, releaseSet, scope{}, ref); err != nil {
+		t.Fatal(err)
+	}
+
+	if kind, ok := src.(*source.Kind); !ok || kind.Type.GetObjectKind().GroupVersionKind().Kind != "ConfigMap" {
+		t.Fatalf("expected a watch of config maps, got %v", src)
+	}
+	mapper, ok := h.(*handler.EnqueueRequestsFromMapFunc)
+	if !ok {
+		t.Fatalf("unexpected handler %v", h)
+	}
+
+	cm := newTestConfigMap("myapp-config", "2")
+	reqs := mapper.ToRequests.Map(handler.MapObject{Meta: &cm, Object: &cm})
+	if len(reqs) != 2 || reqs[0].Name != "myapp" || reqs[1].Name != "myapp-canary" || reqs[0].Namespace != "default" {
+		t.Errorf("expected requests to reconcile default/myapp and default/myapp-canary, got %v", reqs)
+	}
+}
+
+func TestReference_Validate(t *testing.T) {
+	tests := []struct {
+		ref   Reference
+		valid bool
+	}{
+		{ref: Reference{Kind: "ConfigMap", Field: "spec.configMapRef.name"}, valid: true},
+		{ref: Reference{Kind: "Secret", Field: "spec.secretName"}, valid: true},
+		{ref: Reference{Kind: "Deployment", Field: "spec.deployment"}},
+		{ref: Reference{Kind: "ConfigMap"}},
+	}
+	for _, tt := range tests {
+		if err := tt.ref.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: unexpected error %v", tt.ref, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package customresource
+
+import (
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// scope is the namespace and label selector of the objects of a mapping. The
+// zero scope contains every object.
+type scope struct {
+	namespace string
+	selector  labels.Selector
+}
+
+func newScope(m Mapping) (scope, error) {
+	s := scope{namespace: m.Namespace}
+	if m.LabelSelector != "" {
+		sel, err := labels.Parse(m.LabelSelector)
+		if err != nil {
+			return s, err
+		}
+		s.selector = sel
+	}
+	return s, nil
+}
+
+// contains tells whether o is in the namespace of s and matches its selector.
+func (s scope) contains(o metav1.Object) bool {
+	if s.namespace != "" && o.GetNamespace() != s.namespace {
+		return false
+	}
+	return s.selector == nil || s.selector.Matches(labels.Set(o.GetLabels()))
+}
+
+// predicate filters out the events of objects outside s. Objects that still
+// carry the finalizer of gvk, like ones whose labels no longer match, pass, so
+// that their deletion isn't held off forever.
+func (s scope) predicate(gvk schema.GroupVersionKind) predicate.Funcs {
+	passes := func(o metav1.Object) bool {
+		return s.contains(o) || hasFinalizer(o, finalizerName(gvk))
+	}
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return passes(e.Meta) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return passes(e.Meta) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return passes(e.MetaOld) || passes(e.MetaNew) },
+		GenericFunc: func(e event.GenericEvent) bool { return passes(e.Meta) },
+	}
+}
+
+// hasFinalizer tells whether o carries the finalizer named name.
+func hasFinalizer(o metav1.Object, name string) bool {
+	for _, f := range o.GetFinalizers() {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheNamespaces returns the namespaces the cache of the manager can be
+// restricted to, so that the gateway only needs to be allowed to watch those. It
+// returns nil if a mapping watches all namespaces.
+func cacheNamespaces(mappings map[schema.GroupVersionKind]Mapping) []string {
+	seen := map[string]bool{}
+	namespaces := []string{}
+	for _, m := range mappings {
+		if m.Namespace == "" {
+			return nil
+		}
+		if !seen[m.Namespace] {
+			seen[m.Namespace] = true
+			namespaces = append(namespaces, m.Namespace)
+		}
+	}
+	if len(namespaces) == 0 {
+		return nil
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
@@ -0,0 +1,123 @@
+package customresource
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func newTestScopedObject(namespace string, labels map[string]string, finalizers ...string) *unstructured.Unstructured {
+	o := newTestChild("ReleaseSet", "myapp")
+	o.SetNamespace(namespace)
+	o.SetLabels(labels)
+	o.SetFinalizers(finalizers)
+	return &o
+}
+
+func TestScope_predicate(t *testing.T) {
+	releaseSet := schema.GroupVersionKind{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet"}
+	sc, err := newScope(Mapping{Namespace: "tenant-a", LabelSelector: "app=myapp,tier!=test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := sc.predicate(releaseSet)
+
+	tests := []struct {
+		name   string
+		o      *unstructured.Unstructured
+		passes bool
+	}{
+		{name: "matching", o: newTestScopedObject("tenant-a", map[string]string{"app": "myapp"}), passes: true},
+		{name: "other namespace", o: newTestScopedObject("tenant-b", map[string]string{"app": "myapp"})},
+		{name: "other labels", o: newTestScopedObject("tenant-a", map[string]string{"app": "other"})},
+		{name: "excluded label", o: newTestScopedObject("tenant-a", map[string]string{"app": "myapp", "tier": "test"})},
+		{name: "no labels", o: newTestScopedObject("tenant-a", nil)},
+		{name: "finalizer", o: newTestScopedObject("tenant-a", nil, finalizerName(releaseSet)), passes: true},
+	}
+	for _, tt := range tests {
+		if got := p.Create(event.CreateEvent{Meta: tt.o, Object: tt.o}); got != tt.passes {
+			t.Errorf("%s: expected the create event to pass %v, got %v", tt.name, tt.passes, got)
+		}
+		if got := p.Delete(event.DeleteEvent{Meta: tt.o, Object: tt.o}); got != tt.passes {
+			t.Errorf("%s: expected the delete event to pass %v, got %v", tt.name, tt.passes, got)
+		}
+		if got := p.Generic(event.GenericEvent{Meta: tt.o, Object: tt.o}); got != tt.passes {
+			t.Errorf("%s: expected the generic event to pass %v, got %v", tt.name, tt.passes, got)
+		}
+	}
+
+	// Objects leaving the scope pass once more
+	in := newTestScopedObject("tenant-a", map[string]string{"app": "myapp"})
+	out := newTestScopedObject("tenant-a", map[string]string{"app": "other"})
+	if !p.Update(event.UpdateEvent{MetaOld: in, ObjectOld: in, MetaNew: out, ObjectNew: out}) {
+		t.Error("expected the update of an object leaving the scope to pass")
+	}
+	if p.Update(event.UpdateEvent{MetaOld: out, ObjectOld: out, MetaNew: out, ObjectNew: out}) {
+		t.Error("expected the update of an object outside the scope not to pass")
+	}
+
+	everything := scope{}
+	if o := newTestScopedObject("tenant-b", nil); !everything.contains(o) {
+		t.Error("expected the zero scope to contain every object")
+	}
+}
+
+func TestHandleState_scope(t *testing.T) {
+	store := newTestStore()
+	h := newTestHandler(store)
+	sc, err := newScope(Mapping{Namespace: "tenant-a", LabelSelector: "app=myapp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.scope = sc
+
+	for _, o := range []*unstructured.Unstructured{
+		newTestScopedObject("tenant-b", map[string]string{"app": "myapp"}),
+		newTestScopedObject("tenant-a", map[string]string{"app": "other"}),
+	} {
+		ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+		ss.Object.SetNamespace(o.GetNamespace())
+		ss.Object.SetLabels(o.GetLabels())
+		if err := h.HandleState(ss); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(store.builds) != 0 {
+		t.Fatalf("expected no builds for objects outside the scope, got %d", len(store.builds))
+	}
+
+	ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+	ss.Object.SetNamespace("tenant-a")
+	ss.Object.SetLabels(map[string]string{"app": "myapp"})
+	if err := h.HandleState(ss); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(store.builds) != 1 {
+		t.Errorf("expected a build for the object in the scope, got %d", len(store.builds))
+	}
+}
+
+func TestManagerOptions(t *testing.T) {
+	releaseSet := schema.GroupVersionKind{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet"}
+	release := schema.GroupVersionKind{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "Release"}
+
+	all := managerOptions(map[schema.GroupVersionKind]Mapping{releaseSet: {Namespace: "tenant-a"}, release: {}})
+	if all.Namespace != "" || all.NewCache != nil {
+		t.Errorf("expected a cluster-wide cache when a mapping has no namespace, got %+v", all)
+	}
+	one := managerOptions(map[schema.GroupVersionKind]Mapping{releaseSet: {Namespace: "tenant-a"}, release: {Namespace: "tenant-a"}})
+	if one.Namespace != "tenant-a" {
+		t.Errorf("expected a cache of tenant-a, got %+v", one)
+	}
+	if two := managerOptions(map[schema.GroupVersionKind]Mapping{releaseSet: {Namespace: "tenant-b"}, release: {Namespace: "tenant-a"}}); two.NewCache == nil {
+		t.Errorf("expected a cache of several namespaces, got %+v", two)
+	}
+
+	namespaces := cacheNamespaces(map[schema.GroupVersionKind]Mapping{releaseSet: {Namespace: "tenant-b"}, release: {Namespace: "tenant-a"}})
+	if !reflect.DeepEqual(namespaces, []string{"tenant-a", "tenant-b"}) {
+		t.Errorf("expected the sorted namespaces, got %v", namespaces)
+	}
+}
@@ -0,0 +1,55 @@
+package customresource
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Type cases, which determine how the kind is cased in the payload type and
+// the default event types of the builds of a mapping. Any other type case is a
+// template, see Mapping.TypeCase.
+const (
+	// TypeCaseLower lowercases the kind, like releaseset
+	TypeCaseLower = "lower"
+	// TypeCaseOriginal keeps the kind as is, like ReleaseSet
+	TypeCaseOriginal = "original"
+)
+
+// typeData is the data type case templates are rendered with
+type typeData struct {
+	Group, Version, Kind string
+}
+
+// typeFuncs are the functions available to type case templates
+var typeFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// kindType returns the kind of m as cased by its TypeCase.
+func (m Mapping) kindType() (string, error) {
+	switch m.TypeCase {
+	case "", TypeCaseLower:
+		return strings.ToLower(m.Kind), nil
+	case TypeCaseOriginal:
+		return m.Kind, nil
+	}
+	if !strings.Contains(m.TypeCase, "{{") {
+		return "", fmt.Errorf("type case %q must be %s, %s or a template like {{.Kind | upper}}", m.TypeCase, TypeCaseLower, TypeCaseOriginal)
+	}
+	tmpl, err := template.New("type").Funcs(typeFuncs).Parse(m.TypeCase)
+	if err != nil {
+		return "", fmt.Errorf("invalid type case template %q: %v", m.TypeCase, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, typeData{Group: m.Group, Version: m.Version, Kind: m.Kind}); err != nil {
+		return "", fmt.Errorf("invalid type case template %q: %v", m.TypeCase, err)
+	}
+	// Colons separate the kind from the action in event types
+	if t := buf.String(); t == "" || strings.Contains(t, ":") {
+		return "", fmt.Errorf("type case template %q renders %q, which must not be empty or contain colons", m.TypeCase, t)
+	}
+	return buf.String(), nil
+}
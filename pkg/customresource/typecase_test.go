@@ -0,0 +1,94 @@
+package customresource
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/summerwind/whitebox-controller/config"
+	"k8s.io/client-go/rest"
+	crmanager "sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+func TestMapping_kindType(t *testing.T) {
+	tests := []struct {
+		typeCase string
+		expected string
+		invalid  bool
+	}{
+		{typeCase: "", expected: "releaseset"},
+		{typeCase: TypeCaseLower, expected: "releaseset"},
+		{typeCase: TypeCaseOriginal, expected: "ReleaseSet"},
+		{typeCase: "{{.Kind | upper}}", expected: "RELEASESET"},
+		{typeCase: "{{.Group}}.{{.Kind | lower}}", expected: "cd.brigade.sh.releaseset"},
+		{typeCase: "Original", invalid: true},
+		{typeCase: "{{.Kind", invalid: true},
+		{typeCase: "{{.Namespace}}", invalid: true},
+		{typeCase: "{{.Kind}}:{{.Version}}", invalid: true},
+		{typeCase: "{{if false}}{{end}}", invalid: true},
+	}
+	for _, tt := range tests {
+		m := Mapping{Group: "cd.brigade.sh", Version: "v1alpha1", Kind: "ReleaseSet", TypeCase: tt.typeCase}
+		got, err := m.kindType()
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tt.typeCase, got)
+			}
+			if err := m.Validate(); err == nil {
+				t.Errorf("%q: expected the mapping to be invalid", tt.typeCase)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.typeCase, err)
+		} else if got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.typeCase, tt.expected, got)
+		}
+	}
+}
+
+func TestController_Run_typeCase(t *testing.T) {
+	mgr := &testManager{client: &testClient{}, started: make(chan struct{})}
+	stop := make(chan struct{})
+	defer close(stop)
+
+	store := newNamedProjectsStore()
+	mappings := []Mapping{
+		{Group: "lower.example.com", Version: "v1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp"},
+		{Group: "original.example.com", Version: "v1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp", TypeCase: TypeCaseOriginal},
+		{Group: "template.example.com", Version: "v1", Kind: "ReleaseSet", BrigadeProject: "myorg/myapp", TypeCase: "{{.Kind | upper}}"},
+	}
+	ct := New(store, 0, nil, &rest.Config{}, mappings).
+		WithManager(func(c *config.Config, kc *rest.Config) (crmanager.Manager, error) {
+			return mgr, nil
+		}, stop)
+
+	if err := ct.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-mgr.started
+
+	expected := []string{"releaseset", "ReleaseSet", "RELEASESET"}
+	for i, h := range ct.handlers {
+		store.builds = nil
+		ss := newTestState(nil, map[string]interface{}{"image": "myapp:v1"})
+		if err := h.HandleState(ss); err != nil {
+			t.Fatalf("%s: unexpected error: %v", h.groupVersionKind, err)
+		}
+
+		kind := expected[i]
+		if len(store.builds) != 2 || store.builds[0].Type != kind || store.builds[1].Type != kind+":apply" {
+			t.Fatalf("%s: expected a %s and a %s:apply build, got %d builds", h.groupVersionKind, kind, kind, len(store.builds))
+		}
+		for _, b := range store.builds {
+			pl := struct {
+				Type string `json:"type"`
+			}{}
+			if err := json.Unmarshal(b.Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.Type != kind {
+				t.Errorf("%s: expected the payload type %q of the %s build, got %q", h.groupVersionKind, kind, b.Type, pl.Type)
+			}
+		}
+	}
+}
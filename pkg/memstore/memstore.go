@@ -0,0 +1,258 @@
+package memstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+)
+
+// ErrNotSupported is returned for jobs, workers and their logs, which only exist
+// for builds run by Brigade
+var ErrNotSupported = errors.New("not supported by the in-memory store")
+
+// ProjectConfig is a project of a projects file. Unlike brigade.Project, it
+// includes the secrets, which are never encoded into the JSON of projects.
+type ProjectConfig struct {
+	// Name is the name of the project, like myorg/myapp
+	Name string `json:"name"`
+	// Repo is the name of the repo, github.com/NAME if empty
+	Repo         string            `json:"repo"`
+	SharedSecret string            `json:"sharedSecret"`
+	GithubToken  string            `json:"githubToken"`
+	Secrets      map[string]string `json:"secrets"`
+}
+
+// Project returns the Brigade project of c.
+func (c ProjectConfig) Project() *brigade.Project {
+	repo := c.Repo
+	if repo == "" {
+		repo = "github.com/" + c.Name
+	}
+	return &brigade.Project{
+		ID:           brigade.ProjectID(c.Name),
+		Name:         c.Name,
+		Repo:         brigade.Repo{Name: repo},
+		SharedSecret: c.SharedSecret,
+		Github:       brigade.Github{Token: c.GithubToken},
+		Secrets:      c.Secrets,
+	}
+}
+
+// LoadProjects reads the projects of the JSON array of ProjectConfigs at path.
+func LoadProjects(path string) ([]*brigade.Project, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configs := []ProjectConfig{}
+	if err := json.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse projects file %s: %v", path, err)
+	}
+	projs := []*brigade.Project{}
+	for i, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("project at index %d of projects file %s has no name", i, path)
+		}
+		projs = append(projs, c.Project())
+	}
+	return projs, nil
+}
+
+// Store keeps projects and builds in memory, for running the gateway locally or
+// in tests without a cluster. Builds are recorded but never run. It is safe for
+// concurrent use.
+type Store struct {
+	mu       sync.Mutex
+	projects []*brigade.Project
+	builds   []*brigade.Build
+	nextID   int
+}
+
+var _ storage.Store = &Store{}
+
+// New creates a Store with the given projects.
+func New(projs ...*brigade.Project) *Store {
+	return &Store{projects: append([]*brigade.Project{}, projs...)}
+}
+
+// GetProjects returns every project.
+func (s *Store) GetProjects() ([]*brigade.Project, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*brigade.Project{}, s.projects...), nil
+}
+
+// GetProject returns the project with the given ID or name, like the kube store.
+func (s *Store) GetProject(id string) (*brigade.Project, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.project(brigade.ProjectID(id)); i >= 0 {
+		return s.projects[i], nil
+	}
+	return nil, fmt.Errorf("project %q not found", id)
+}
+
+// project returns the index of the project with the given ID, or -1.
+func (s *Store) project(id string) int {
+	for i, p := range s.projects {
+		if p.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetProjectBuilds returns the builds of proj.
+func (s *Store) GetProjectBuilds(proj *brigade.Project) ([]*brigade.Build, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	builds := []*brigade.Build{}
+	for _, b := range s.builds {
+		if b.ProjectID == proj.ID {
+			builds = append(builds, b)
+		}
+	}
+	return builds, nil
+}
+
+// CreateProject adds proj, whose ID is derived from its name if empty.
+func (s *Store) CreateProject(proj *brigade.Project) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if proj.ID == "" {
+		proj.ID = brigade.ProjectID(proj.Name)
+	}
+	if s.project(proj.ID) >= 0 {
+		return fmt.Errorf("project %q already exists", proj.Name)
+	}
+	s.projects = append(s.projects, proj)
+	return nil
+}
+
+// ReplaceProject replaces the project with the ID of proj.
+func (s *Store) ReplaceProject(proj *brigade.Project) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.project(proj.ID)
+	if i < 0 {
+		return fmt.Errorf("project %q not found", proj.ID)
+	}
+	s.projects[i] = proj
+	return nil
+}
+
+// DeleteProject deletes the project with the given ID.
+func (s *Store) DeleteProject(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.project(id)
+	if i < 0 {
+		return fmt.Errorf("project %q not found", id)
+	}
+	s.projects = append(s.projects[:i], s.projects[i+1:]...)
+	return nil
+}
+
+// GetBuilds returns every build, in the order they were created.
+func (s *Store) GetBuilds() ([]*brigade.Build, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*brigade.Build{}, s.builds...), nil
+}
+
+// GetBuild returns the build with the given ID.
+func (s *Store) GetBuild(id string) (*brigade.Build, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.builds {
+		if b.ID == id {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("build %q not found", id)
+}
+
+// DeleteBuild deletes the build with the given ID. There are no running builds
+// to skip, as builds are never run.
+func (s *Store) DeleteBuild(id string, options storage.DeleteBuildOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, b := range s.builds {
+		if b.ID == id {
+			s.builds = append(s.builds[:i], s.builds[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("build %q not found", id)
+}
+
+// CreateBuild adds build, setting its ID if empty. The build is never run.
+func (s *Store) CreateBuild(build *brigade.Build) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.project(build.ProjectID) < 0 {
+		return fmt.Errorf("project %q not found", build.ProjectID)
+	}
+	if build.ID == "" {
+		s.nextID++
+		build.ID = fmt.Sprintf("memory-%d", s.nextID)
+	}
+	s.builds = append(s.builds, build)
+	return nil
+}
+
+// GetBuildJobs is not supported, as builds are never run.
+func (s *Store) GetBuildJobs(build *brigade.Build) ([]*brigade.Job, error) {
+	return nil, ErrNotSupported
+}
+
+// GetWorker is not supported, as builds are never run.
+func (s *Store) GetWorker(buildID string) (*brigade.Worker, error) {
+	return nil, ErrNotSupported
+}
+
+// GetJob is not supported, as builds are never run.
+func (s *Store) GetJob(id string) (*brigade.Job, error) {
+	return nil, ErrNotSupported
+}
+
+// GetJobLog is not supported, as builds are never run.
+func (s *Store) GetJobLog(job *brigade.Job) (string, error) {
+	return "", ErrNotSupported
+}
+
+// GetJobLogStream is not supported, as builds are never run.
+func (s *Store) GetJobLogStream(job *brigade.Job) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// GetJobLogStreamFollow is not supported, as builds are never run.
+func (s *Store) GetJobLogStreamFollow(job *brigade.Job) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// GetWorkerLog is not supported, as builds are never run.
+func (s *Store) GetWorkerLog(worker *brigade.Worker) (string, error) {
+	return "", ErrNotSupported
+}
+
+// GetWorkerLogStream is not supported, as builds are never run.
+func (s *Store) GetWorkerLogStream(worker *brigade.Worker) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// GetWorkerLogStreamFollow is not supported, as builds are never run.
+func (s *Store) GetWorkerLogStreamFollow(worker *brigade.Worker) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+// GetStorageClassNames returns no storage classes, as there is no cluster.
+func (s *Store) GetStorageClassNames() ([]string, error) {
+	return []string{}, nil
+}
@@ -0,0 +1,105 @@
+package memstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+)
+
+func TestLoadProjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		file     string
+		mustFail bool
+	}{
+		{name: "valid", file: `[{"name": "myorg/myapp", "sharedSecret": "asdf", "githubToken": "tok"}, {"name": "myorg/other", "repo": "ghe.example.com/myorg/other"}]`},
+		{name: "no name", file: `[{"sharedSecret": "asdf"}]`, mustFail: true},
+		{name: "malformed", file: `{"name": "myorg/myapp"}`, mustFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".json")
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			projs, err := LoadProjects(path)
+			if tt.mustFail {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(projs) != 2 {
+				t.Fatalf("expected 2 projects, got %d", len(projs))
+			}
+			p := projs[0]
+			if p.ID != brigade.ProjectID("myorg/myapp") || p.SharedSecret != "asdf" || p.Github.Token != "tok" || p.Repo.Name != "github.com/myorg/myapp" {
+				t.Errorf("unexpected project %+v", p)
+			}
+			if projs[1].Repo.Name != "ghe.example.com/myorg/other" {
+				t.Errorf("unexpected repo %q", projs[1].Repo.Name)
+			}
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := New(ProjectConfig{Name: "myorg/myapp"}.Project())
+
+	for _, id := range []string{"myorg/myapp", brigade.ProjectID("myorg/myapp")} {
+		if _, err := s.GetProject(id); err != nil {
+			t.Errorf("expected the project to be found by %q: %v", id, err)
+		}
+	}
+	if _, err := s.GetProject("myorg/gone"); err == nil {
+		t.Error("expected an error for a missing project")
+	}
+
+	proj, _ := s.GetProject("myorg/myapp")
+	if err := s.CreateBuild(&brigade.Build{ProjectID: proj.ID, Type: "push"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateBuild(&brigade.Build{ProjectID: "brigade-gone", Type: "push"}); err == nil {
+		t.Error("expected an error for a build of a missing project")
+	}
+	builds, _ := s.GetProjectBuilds(proj)
+	if len(builds) != 1 || builds[0].ID == "" {
+		t.Fatalf("expected a build with an ID, got %v", builds)
+	}
+	if b, err := s.GetBuild(builds[0].ID); err != nil || b.Type != "push" {
+		t.Errorf("expected the push build, got %v, %v", b, err)
+	}
+	if err := s.DeleteBuild(builds[0].ID, storage.DeleteBuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if builds, _ := s.GetBuilds(); len(builds) != 0 {
+		t.Errorf("expected the build to be deleted, got %v", builds)
+	}
+
+	other := &brigade.Project{Name: "myorg/other"}
+	if err := s.CreateProject(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateProject(&brigade.Project{Name: "myorg/other"}); err == nil {
+		t.Error("expected an error for a duplicate project")
+	}
+	if err := s.DeleteProject(other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if projs, _ := s.GetProjects(); len(projs) != 1 {
+		t.Errorf("expected 1 project, got %d", len(projs))
+	}
+}
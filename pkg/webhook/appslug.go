@@ -0,0 +1,53 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+// AppSlug fetches the slug of a GitHub App, like "brigade-cd", on first use and
+// caches it, as it never changes while the App exists. It is safe for
+// concurrent use.
+type AppSlug struct {
+	get func(c context.Context) (string, error)
+
+	mu   sync.Mutex
+	slug string
+}
+
+// NewAppSlug creates an AppSlug for the App appID, fetching the slug via GET
+// /app authenticated with key.
+func NewAppSlug(appID int, key []byte) *AppSlug {
+	return &AppSlug{get: func(c context.Context) (string, error) {
+		a, err := getApp(c, appID, key, brigade.Github{})
+		if err != nil {
+			return "", err
+		}
+		if a.Slug == "" {
+			return "", errors.New("GitHub returned no app slug")
+		}
+		return a.Slug, nil
+	}}
+}
+
+// Get returns the slug, fetching it unless cached. Failures are not cached, so
+// that the next call tries again. A nil AppSlug returns an empty slug.
+func (a *AppSlug) Get(c context.Context) (string, error) {
+	if a == nil {
+		return "", nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.slug != "" {
+		return a.slug, nil
+	}
+	slug, err := a.get(c)
+	if err != nil {
+		return "", err
+	}
+	a.slug = slug
+	return slug, nil
+}
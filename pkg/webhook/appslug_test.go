@@ -0,0 +1,119 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestAppSlug(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, `{"message":"unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":13,"slug":"brigade-cd","events":["push"]}`))
+	}))
+	defer ts.Close()
+	defer SetDefaultURLs("", "")
+	if err := SetDefaultURLs(ts.URL+"/", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAppSlug(13, key)
+	if _, err := a.Get(context.Background()); err == nil {
+		t.Fatal("expected the failed fetch to return an error")
+	}
+	for i := 0; i < 2; i++ {
+		slug, err := a.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slug != "brigade-cd" {
+			t.Errorf("expected the slug brigade-cd, got %q", slug)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("expected the slug to be fetched again after the failure only, got %d requests", requests)
+	}
+
+	if slug, err := (*AppSlug)(nil).Get(context.Background()); slug != "" || err != nil {
+		t.Errorf("expected no slug without an App, got %q, %v", slug, err)
+	}
+}
+
+func TestHandleIssueCommentEvent_installation(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/github-issue_comment_pull_request_author_allowed-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		slugErr  error
+		expected string
+	}{
+		{name: "slug", expected: "brigade-cd"},
+		{name: "slug unavailable", slugErr: errors.New("unavailable")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestGithubHandler(newTestStore(), t)
+			s.opts.AppID = 13
+			s.appSlug = &AppSlug{get: func(c context.Context) (string, error) { return "brigade-cd", tt.slugErr }}
+			s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+				return "v1.installation-token", time.Time{}, nil
+			}
+			s.getPullRequest = func(c *gin.Context, s *githubHook, token, repo string, number int, proj *brigade.Project) (*github.PullRequest, error) {
+				return &github.PullRequest{Number: github.Int(2), Head: &github.PullRequestBranch{SHA: github.String("c1")}}, nil
+			}
+
+			ice := &github.IssueCommentEvent{}
+			if err := json.Unmarshal(body, ice); err != nil {
+				t.Fatal(err)
+			}
+			ice.Installation = &github.Installation{ID: github.Int64(2311213)}
+
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request, _ = http.NewRequest("POST", "", nil)
+
+			_, payload, err := handleIssueCommentEvent(ctx, s, ice, brigade.Revision{}, newTestStore().proj, body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v\n%s", err, w.Body.String())
+			}
+			fields := map[string]interface{}{}
+			if err := json.Unmarshal(payload, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if id, ok := fields["installationID"].(float64); !ok || id != 2311213 {
+				t.Errorf("expected installation 2311213 in the payload, got %v", fields["installationID"])
+			}
+			if slug, _ := fields["appSlug"].(string); slug != tt.expected {
+				t.Errorf("expected the slug %q in the payload, got %v", tt.expected, fields["appSlug"])
+			}
+		})
+	}
+}
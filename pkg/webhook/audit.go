@@ -0,0 +1,127 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+// AuditSchemaVersion is the version of the schema of AuditRecord. Fields are
+// only ever added within a version.
+const AuditSchemaVersion = 1
+
+// AuditRecord is a line of the audit log, describing a build that was created.
+type AuditRecord struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// Delivery identifies what the build was created for: the X-GitHub-Delivery
+	// of webhook events, which is empty for debounced builds, or the UID, resource
+	// version and event type of custom resources
+	Delivery string `json:"delivery,omitempty"`
+	Provider string `json:"provider"`
+	// Event is the type of the build
+	Event string `json:"event"`
+	// Sender is the login of the GitHub user that triggered the event, if any
+	Sender string `json:"sender,omitempty"`
+	// Repo is the owner/name of the repo the event is about
+	Repo string `json:"repo,omitempty"`
+	// Project is the name of the project, which is empty for debounced builds,
+	// and ProjectID its ID
+	Project   string `json:"project,omitempty"`
+	ProjectID string `json:"projectID"`
+	Commit    string `json:"commit,omitempty"`
+	Ref       string `json:"ref,omitempty"`
+}
+
+// auditedPayload is the part of payloads that AuditRecords are made from
+type auditedPayload struct {
+	Owner string `json:"owner"`
+	Repo  string `json:"repo"`
+	Body  struct {
+		Sender struct {
+			Login string `json:"login"`
+		} `json:"sender"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	} `json:"body"`
+}
+
+// NewAuditRecord describes the creation of b in the named project for delivery.
+// The sender and repo are read from the payload of b.
+func NewAuditRecord(delivery, project string, b *brigade.Build) AuditRecord {
+	r := AuditRecord{
+		Version:   AuditSchemaVersion,
+		Delivery:  delivery,
+		Provider:  b.Provider,
+		Event:     b.Type,
+		Project:   project,
+		ProjectID: b.ProjectID,
+	}
+	if b.Revision != nil {
+		r.Commit = b.Revision.Commit
+		r.Ref = b.Revision.Ref
+	}
+	if payload, err := DecompressPayload(b.Payload); err == nil {
+		ap := auditedPayload{}
+		if err := json.Unmarshal(payload, &ap); err == nil {
+			r.Sender = ap.Body.Sender.Login
+			r.Repo = ap.Body.Repository.FullName
+			if r.Repo == "" && ap.Owner != "" && ap.Repo != "" {
+				r.Repo = ap.Owner + "/" + ap.Repo
+			}
+		}
+	}
+	return r
+}
+
+// AuditLog writes an AuditRecord per line, as JSON. It is safe for concurrent use.
+type AuditLog struct {
+	now func() time.Time
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAuditLog creates an AuditLog that writes to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w, now: time.Now}
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if
+// missing. A path of "-" writes to stdout.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if path == "-" {
+		return NewAuditLog(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditLog(f), nil
+}
+
+// Record writes r, stamped with the current time unless it has one. Recording
+// to a nil AuditLog is a no-op.
+func (a *AuditLog) Record(r AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+	if r.Time.IsZero() {
+		r.Time = a.now().UTC()
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.w.Write(line)
+	return err
+}
@@ -0,0 +1,139 @@
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestAuditLog_Record(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := NewAuditLog(buf)
+	a.now = func() time.Time { return time.Date(2019, 7, 2, 1, 0, 0, 0, time.UTC) }
+
+	// The body of the payload is the milestone event itself, which has the sender and repo
+	payload, err := CompressPayload([]byte(`{"type":"milestone","body":`+fmt.Sprintf(testMilestonePayload, "created")+`}`), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &brigade.Build{
+		ProjectID: "brigade-1234",
+		Type:      "milestone:created",
+		Provider:  "github",
+		Revision:  &brigade.Revision{Ref: "refs/heads/master", Commit: "abc123"},
+		Payload:   payload,
+	}
+	if err := a.Record(NewAuditRecord("72d3162e", "baxterthehacker/public-repo", b)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"version":1,"time":"2019-07-02T01:00:00Z","delivery":"72d3162e","provider":"github","event":"milestone:created","sender":"baxterthehacker","repo":"baxterthehacker/public-repo","project":"baxterthehacker/public-repo","projectID":"brigade-1234","commit":"abc123","ref":"refs/heads/master"}` + "\n"
+	if got := buf.String(); got != expected {
+		t.Errorf("unexpected audit record\nexpected: %s\ngot:      %s", expected, got)
+	}
+
+	var nilLog *AuditLog
+	if err := nilLog.Record(AuditRecord{}); err != nil {
+		t.Errorf("expected recording to a nil audit log to be a no-op, got %v", err)
+	}
+}
+
+func TestNewAuditRecord_customResource(t *testing.T) {
+	b := &brigade.Build{ProjectID: "brigade-1234", Type: "releaseset:apply", Provider: "brigade-cd", Payload: []byte(`{"owner":"myorg","repo":"myapp","body":{"kind":"ReleaseSet"}}`)}
+	r := NewAuditRecord("uid/1/releaseset:apply", "myorg/myapp", b)
+	if r.Repo != "myorg/myapp" || r.Sender != "" {
+		t.Errorf("unexpected repo %q and sender %q", r.Repo, r.Sender)
+	}
+}
+
+func TestAuditLog_concurrent(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := NewAuditLog(buf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a.Record(AuditRecord{Version: AuditSchemaVersion, Event: fmt.Sprintf("event-%d", i)})
+		}(i)
+	}
+	wg.Wait()
+
+	var events []string
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		r := AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("interleaved line %q: %s", scanner.Text(), err)
+		}
+		events = append(events, r.Event)
+	}
+	if len(events) != 50 {
+		t.Errorf("expected 50 records, got %d", len(events))
+	}
+}
+
+func TestGithubHandler_audit(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	buf := &bytes.Buffer{}
+	s.opts.AuditLog = NewAuditLog(buf)
+
+	payload := []byte(fmt.Sprintf(testMilestonePayload, "created"))
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Add("X-GitHub-Event", "milestone")
+	r.Header.Add("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+	r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = r
+	s.Handle(ctx)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a record per build, got %q", buf.String())
+	}
+	for i, et := range []string{"milestone", "milestone:created"} {
+		rec := AuditRecord{}
+		if err := json.Unmarshal([]byte(lines[i]), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Event != et || rec.Delivery != "72d3162e-cc78-11e3-81ab-4c9367dc0958" || rec.Sender != "baxterthehacker" || rec.Repo != "baxterthehacker/public-repo" || rec.Project != store.proj.Name || rec.ProjectID != store.proj.ID {
+			t.Errorf("unexpected record %+v", rec)
+		}
+		if rec.Time.IsZero() {
+			t.Error("expected the record to have a time")
+		}
+	}
+}
+
+func TestGithubHandler_auditFailedBuild(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.store = &flakyBuildStore{testStore: store, failType: "milestone", failures: createBuildAttempts}
+	buf := &bytes.Buffer{}
+	s.opts.AuditLog = NewAuditLog(buf)
+
+	handleTestEvent(t, s, "milestone", []byte(fmt.Sprintf(testMilestonePayload, "created")))
+
+	if strings.Contains(buf.String(), `"event":"milestone",`) {
+		t.Errorf("expected no record for the failed build, got %s", buf.String())
+	}
+}
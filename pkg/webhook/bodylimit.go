@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"unicode/utf8"
+)
+
+// errBodyTooLarge is returned by readBody for bodies above the process limit
+var errBodyTooLarge = errors.New("body too large")
+
+// readBody reads the body of a delivery, failing with errBodyTooLarge if it
+// exceeds max bytes. Zero reads bodies of any size.
+func readBody(r io.Reader, max int) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > max {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// truncateBody replaces the "body" of a JSON object payload that exceeds max
+// bytes in its JSON form with a string of its first max bytes, and notes the
+// truncation in "bodyTruncated" and the original size in "bodySize". It returns
+// whether the body was truncated.
+func truncateBody(payload []byte, max int) ([]byte, bool, error) {
+	if max <= 0 || len(payload) == 0 {
+		return payload, false, nil
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, false, fmt.Errorf("payload is not a JSON object: %v", err)
+	}
+	raw, ok := fields["body"]
+	if !ok || len(raw) <= max {
+		return payload, false, nil
+	}
+
+	// Cut at a rune boundary, so that the string stays valid UTF-8
+	cut := max
+	for cut > 0 && !utf8.RuneStart(raw[cut]) {
+		cut--
+	}
+	b, err := json.Marshal(string(raw[:cut]))
+	if err != nil {
+		return nil, false, err
+	}
+	fields["body"] = b
+	fields["bodyTruncated"] = json.RawMessage("true")
+	fields["bodySize"] = json.RawMessage(fmt.Sprintf("%d", len(raw)))
+	truncated, err := json.Marshal(fields)
+	return truncated, true, err
+}
@@ -0,0 +1,111 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestReadBody(t *testing.T) {
+	if body, err := readBody(strings.NewReader("12345"), 5); err != nil || string(body) != "12345" {
+		t.Errorf("expected the body at the limit to be read, got %q, %v", body, err)
+	}
+	if _, err := readBody(strings.NewReader("123456"), 5); err != errBodyTooLarge {
+		t.Errorf("expected errBodyTooLarge, got %v", err)
+	}
+	if body, err := readBody(strings.NewReader("123456"), 0); err != nil || string(body) != "123456" {
+		t.Errorf("expected no limit, got %q, %v", body, err)
+	}
+}
+
+func TestTruncateBody(t *testing.T) {
+	payload := []byte(`{"type":"push","body":{"ref":"refs/heads/master","message":"héllo"}}`)
+
+	if same, ok, err := truncateBody(payload, 0); err != nil || ok || !bytes.Equal(same, payload) {
+		t.Errorf("expected no limit, got %s, %v, %v", same, ok, err)
+	}
+	if same, ok, err := truncateBody(payload, 1024); err != nil || ok || !bytes.Equal(same, payload) {
+		t.Errorf("expected the small body to be kept, got %s, %v, %v", same, ok, err)
+	}
+
+	// The limit falls inside the two bytes of "é"
+	max := strings.Index(`{"ref":"refs/heads/master","message":"héllo"}`, "é") + 1
+	truncated, ok, err := truncateBody(payload, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected the body to be truncated")
+	}
+	pl := struct {
+		Type          string `json:"type"`
+		Body          string `json:"body"`
+		BodyTruncated bool   `json:"bodyTruncated"`
+		BodySize      int    `json:"bodySize"`
+	}{}
+	if err := json.Unmarshal(truncated, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if pl.Type != "push" || !pl.BodyTruncated || pl.BodySize != 46 {
+		t.Errorf("expected the truncation to be noted, got %s", truncated)
+	}
+	if pl.Body != `{"ref":"refs/heads/master","message":"h` || !utf8.ValidString(pl.Body) {
+		t.Errorf("expected the body to be cut before the split rune, got %q", pl.Body)
+	}
+}
+
+func TestGithubHandler_maxProcessBodyBytes(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.MaxProcessBodyBytes = len(payload) - 1
+	if w := handleTestEvent(t, s, "push", payload); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d: %s", w.Code, w.Body)
+	}
+	if len(store.builds) != 0 {
+		t.Errorf("expected no builds, got %d", len(store.builds))
+	}
+
+	s.opts.MaxProcessBodyBytes = len(payload)
+	if w := handleTestEvent(t, s, "push", payload); w.Code != http.StatusOK {
+		t.Errorf("expected the body at the limit to be processed, got %d: %s", w.Code, w.Body)
+	}
+	if len(store.builds) != 1 {
+		t.Errorf("expected a build, got %d", len(store.builds))
+	}
+}
+
+func TestGithubHandler_maxRetainBodyBytes(t *testing.T) {
+	body := `{"action":"created","comment":{"id":1,"body":"` + strings.Repeat("x", 4096) + `"},"repository":{"full_name":"baxterthehacker/public-repo"}}`
+	payload := []byte(`{"type":"issue_comment","body":` + body + `}`)
+
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.MaxRetainBodyBytes = 512
+	if _, err := s.build(context.Background(), "", "issue_comment:created", brigade.Revision{Ref: "refs/heads/master"}, payload, store.proj); err != nil {
+		t.Fatal(err)
+	}
+	pl := struct {
+		Type          string `json:"type"`
+		Body          string `json:"body"`
+		BodyTruncated bool   `json:"bodyTruncated"`
+		BodySize      int    `json:"bodySize"`
+	}{}
+	if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if pl.Type != "issue_comment" || len(pl.Body) != 512 || !pl.BodyTruncated || pl.BodySize != len(body) {
+		t.Errorf("expected the body to be truncated to 512 bytes, got %d bytes of %d, truncated %v", len(pl.Body), pl.BodySize, pl.BodyTruncated)
+	}
+}
@@ -0,0 +1,170 @@
+package webhook
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+)
+
+// Delays between attempts to flush a BuildBuffer while the store is unavailable,
+// doubled for every failed attempt up to the maximum
+var (
+	bufferRetryInterval    = time.Second
+	maxBufferRetryInterval = time.Minute
+)
+
+// statusBuffered is the status of a build that is held in the buffer until the store recovers
+const statusBuffered = "buffered"
+
+// bufferedBuild is a build held in a BuildBuffer
+type bufferedBuild struct {
+	build *brigade.Build
+	// created is called once the build is created
+	created func()
+	// spooled is the name of the build in the spool, if persisted
+	spooled string
+}
+
+// BuildBuffer holds builds of validated deliveries that could not be created in
+// the Brigade store, up to a bounded number, and creates them in the background
+// once the store recovers, in the order they were buffered. The buffer is held in
+// memory, so buffered builds are lost when the gateway exits, unless it is
+// given a Spool to replay them from.
+type BuildBuffer struct {
+	store storage.Store
+	size  int
+	wake  chan struct{}
+
+	mu     sync.Mutex
+	builds []bufferedBuild
+	spool  *Spool
+}
+
+// NewBuildBuffer creates a BuildBuffer for up to size builds to be created in store.
+// Run must be called for the builds to be flushed.
+func NewBuildBuffer(store storage.Store, size int) *BuildBuffer {
+	return &BuildBuffer{
+		store: store,
+		size:  size,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Put buffers b, and calls created once it is created. It returns false if the
+// buffer is full, in which case b is not buffered. Putting into a nil
+// BuildBuffer always fails.
+func (q *BuildBuffer) Put(b *brigade.Build, created func()) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.builds) >= q.size {
+		bufferedBuildsTotal.WithLabelValues("dropped").Inc()
+		return false
+	}
+	q.builds = append(q.builds, bufferedBuild{build: b, created: created, spooled: q.spool.put(spoolBuffer, b)})
+	bufferDepth.Set(float64(len(q.builds)))
+	bufferedBuildsTotal.WithLabelValues("buffered").Inc()
+	q.signal()
+	return true
+}
+
+// replay buffers the builds that were buffered in s when the gateway last
+// exited, calling created for each once it is created, and spools the builds
+// put from now on to s. Replayed builds are buffered even if they exceed the
+// size of the buffer.
+func (q *BuildBuffer) replay(s *Spool, created func(b *brigade.Build)) error {
+	builds, err := s.load(spoolBuffer)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.spool = s
+	for _, sb := range builds {
+		b := sb.Build
+		log.Printf("Replaying buffered %q build for project %s", b.Type, b.ProjectID)
+		q.builds = append(q.builds, bufferedBuild{build: b, created: func() { created(b) }, spooled: sb.name})
+	}
+	bufferDepth.Set(float64(len(q.builds)))
+	if len(q.builds) > 0 {
+		q.signal()
+	}
+	return nil
+}
+
+// signal wakes Run up, unless it is already due to flush.
+func (q *BuildBuffer) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of buffered builds.
+func (q *BuildBuffer) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.builds)
+}
+
+// Run flushes the buffer whenever builds are put into it, until stop is closed.
+// While the store is unavailable, the oldest build is retried with exponential
+// backoff.
+func (q *BuildBuffer) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-q.wake:
+		}
+
+		delay := bufferRetryInterval
+		for q.flush() {
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxBufferRetryInterval {
+				delay = maxBufferRetryInterval
+			}
+		}
+	}
+}
+
+// flush creates the buffered builds in order, and returns true if it stopped
+// at one that failed to be created.
+func (q *BuildBuffer) flush() bool {
+	for {
+		q.mu.Lock()
+		if len(q.builds) == 0 {
+			q.mu.Unlock()
+			return false
+		}
+		next := q.builds[0]
+		q.mu.Unlock()
+
+		if err := q.store.CreateBuild(next.build); err != nil {
+			log.Printf("Failed to flush buffered %q build for project %s, %d build(s) remain buffered: %s", next.build.Type, next.build.ProjectID, q.Len(), err)
+			return true
+		}
+
+		log.Printf("Flushed buffered %q build for project %s", next.build.Type, next.build.ProjectID)
+		bufferedBuildsTotal.WithLabelValues("flushed").Inc()
+		emitTotal.WithLabelValues(BrigadeTarget, "success").Inc()
+		if next.created != nil {
+			next.created()
+		}
+
+		q.mu.Lock()
+		q.builds = q.builds[1:]
+		bufferDepth.Set(float64(len(q.builds)))
+		q.spool.Remove(next.spooled)
+		q.mu.Unlock()
+	}
+}
@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// setBufferRetryInterval shortens the delays between flush attempts to d, and
+// returns a func that restores them
+func setBufferRetryInterval(d time.Duration) func() {
+	interval, max := bufferRetryInterval, maxBufferRetryInterval
+	bufferRetryInterval, maxBufferRetryInterval = d, 4*d
+	return func() {
+		bufferRetryInterval, maxBufferRetryInterval = interval, max
+	}
+}
+
+func waitForFlush(t *testing.T, q *BuildBuffer) {
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the buffer to be flushed, %d build(s) remain", q.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBuildBuffer(t *testing.T) {
+	defer setBufferRetryInterval(time.Millisecond)()
+
+	store := &flakyBuildStore{testStore: newTestStore(), failType: "push", failures: 3}
+	q := NewBuildBuffer(store, 2)
+
+	var created []string
+	for _, id := range []string{"first", "second"} {
+		id := id
+		if !q.Put(&brigade.Build{ProjectID: id, Type: "push"}, func() { created = append(created, id) }) {
+			t.Fatalf("expected %s to be buffered", id)
+		}
+	}
+	if q.Put(&brigade.Build{ProjectID: "third", Type: "push"}, nil) {
+		t.Error("expected a build put into the full buffer to be dropped")
+	}
+	if got := testutil.ToFloat64(bufferDepth); got != 2 {
+		t.Errorf("expected a buffer depth of 2, got %v", got)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.Run(stop)
+	waitForFlush(t, q)
+
+	if store.attempts != 5 {
+		t.Errorf("expected 3 failed and 2 successful attempts, got %d", store.attempts)
+	}
+	if len(store.builds) != 2 || store.builds[0].ProjectID != "first" || store.builds[1].ProjectID != "second" {
+		t.Fatalf("expected the builds to be created in the order they were buffered, got %v", store.builds)
+	}
+	if strings.Join(created, ",") != "first,second" {
+		t.Errorf("expected the created callbacks in order, got %v", created)
+	}
+	if got := testutil.ToFloat64(bufferDepth); got != 0 {
+		t.Errorf("expected a buffer depth of 0, got %v", got)
+	}
+}
+
+func TestBuildBuffer_nil(t *testing.T) {
+	var q *BuildBuffer
+	if q.Put(&brigade.Build{Type: "push"}, nil) {
+		t.Error("expected putting into a nil buffer to fail")
+	}
+}
+
+func TestGithubHandler_bufferedBuild(t *testing.T) {
+	defer setBufferRetryInterval(time.Millisecond)()
+
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	// The project lookup shares the store's error, so make only CreateBuild fail.
+	s.store = &flakyBuildStore{testStore: store, failType: "milestone", failures: createBuildAttempts}
+	s.opts.Buffer = NewBuildBuffer(s.store, 10)
+	audit := &bytes.Buffer{}
+	s.opts.AuditLog = NewAuditLog(audit)
+
+	w := handleTestEvent(t, s, "milestone", []byte(fmt.Sprintf(testMilestonePayload, "created")))
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 when a build is buffered, got %d\n%s", w.Code, w.Body.String())
+	}
+	res := struct {
+		Builds map[string]TargetStatus `json:"builds"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Builds["milestone"][BrigadeTarget]; got != statusBuffered {
+		t.Errorf("expected the milestone build to be %q, got %q", statusBuffered, got)
+	}
+	if got := res.Builds["milestone:created"][BrigadeTarget]; got != "ok" {
+		t.Errorf("expected the milestone:created build to be created, got %q", got)
+	}
+	if strings.Contains(audit.String(), `"event":"milestone",`) {
+		t.Errorf("expected no audit record before the buffered build is created, got %s", audit.String())
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.opts.Buffer.Run(stop)
+	waitForFlush(t, s.opts.Buffer)
+
+	if len(store.builds) != 2 {
+		t.Fatalf("expected both builds to be created once the store recovers, got %d", len(store.builds))
+	}
+	if !strings.Contains(audit.String(), `"event":"milestone",`) {
+		t.Errorf("expected an audit record once the buffered build is created, got %s", audit.String())
+	}
+}
@@ -2,10 +2,13 @@ package webhook
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/google/go-github/v27/github"
@@ -25,6 +28,67 @@ var (
 // StatusContext names the context for a particular status message.
 const StatusContext = "brigade"
 
+// DefaultBaseURL and DefaultUploadURL are the URLs of the GitHub API used for
+// projects without a base URL of their own, instead of github.com. Set them with
+// SetDefaultURLs.
+var (
+	DefaultBaseURL   string
+	DefaultUploadURL string
+)
+
+// SetDefaultURLs sets DefaultBaseURL and DefaultUploadURL after checking that
+// they are absolute http(s) URLs. The upload URL defaults to the base URL, like
+// for a proxy serving both.
+func SetDefaultURLs(baseURL, uploadURL string) error {
+	if baseURL == "" {
+		if uploadURL != "" {
+			return errors.New("a GitHub upload URL requires a GitHub API URL")
+		}
+		DefaultBaseURL, DefaultUploadURL = "", ""
+		return nil
+	}
+	if uploadURL == "" {
+		uploadURL = baseURL
+	}
+	for _, s := range []string{baseURL, uploadURL} {
+		u, err := url.Parse(s)
+		if err != nil {
+			return fmt.Errorf("invalid GitHub URL %q: %v", s, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid GitHub URL %q: must be an absolute http or https URL", s)
+		}
+	}
+	DefaultBaseURL, DefaultUploadURL = baseURL, uploadURL
+	return nil
+}
+
+// newClient creates a GitHub client for the API at baseURL, or at DefaultBaseURL
+// if empty, or else github.com.
+func newClient(baseURL, uploadURL string, tc *http.Client) (*github.Client, error) {
+	if baseURL == "" {
+		baseURL, uploadURL = DefaultBaseURL, DefaultUploadURL
+	}
+	if baseURL != "" {
+		return github.NewEnterpriseClient(baseURL, uploadURL, tc)
+	}
+	return github.NewClient(tc), nil
+}
+
+// PullRequestURL returns the API URL of the pull request number of owner/repo,
+// at the API at baseURL, or at DefaultBaseURL if empty, or else github.com.
+func PullRequestURL(baseURL, owner, repo string, number int) (string, error) {
+	client, err := newClient(baseURL, "", nil)
+	if err != nil {
+		return "", err
+	}
+	u, err := client.BaseURL.Parse(fmt.Sprintf("repos/%v/%v/pulls/%d", owner, repo, number))
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
 // GhClient gets a new GitHub client object.
 //
 // It authenticates with an OAUTH2 token.
@@ -33,12 +97,35 @@ const StatusContext = "brigade"
 // that instead of the hosted GitHub API server.
 func GhClient(gh brigade.Github) (*github.Client, error) {
 	t := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: gh.Token})
-	c := context.Background()
-	tc := oauth2.NewClient(c, t)
-	if gh.BaseURL != "" {
-		return github.NewEnterpriseClient(gh.BaseURL, gh.UploadURL, tc)
+	tc := oauth2.NewClient(clientContext(), t)
+	return newClient(gh.BaseURL, gh.UploadURL, tc)
+}
+
+// DiscoverAppID looks up the ID of the GitHub App the key belongs to via GET /app.
+//
+// GitHub identifies the App by the issuer of the JWT, so issuer must be the
+// client ID of the App.
+func DiscoverAppID(c context.Context, issuer string, key []byte, cfg brigade.Github) (int, error) {
+	tok, err := JWT(issuer, key)
+	if err != nil {
+		return 0, err
 	}
-	return github.NewClient(tc), nil
+	client, err := GhClient(brigade.Github{
+		Token:     tok,
+		BaseURL:   cfg.BaseURL,
+		UploadURL: cfg.UploadURL,
+	})
+	if err != nil {
+		return 0, err
+	}
+	app, _, err := client.Apps.Get(c, "")
+	if err != nil {
+		return 0, err
+	}
+	if app.GetID() == 0 {
+		return 0, errors.New("GitHub returned no app ID")
+	}
+	return int(app.GetID()), nil
 }
 
 // setRepoStatus sets the status on a particular commit in a repo.
@@ -46,9 +133,9 @@ func setRepoStatus(commit string, proj *brigade.Project, status *github.RepoStat
 	if proj.Github.Token == "" {
 		return fmt.Errorf("status update skipped because no GitHubToken exists on %s", proj.Name)
 	}
-	parts := strings.SplitN(proj.Repo.Name, "/", 3)
-	if len(parts) != 3 {
-		return fmt.Errorf("project name %q is malformed", proj.Repo.Name)
+	owner, repo, err := splitRepoName(proj.Repo.Name)
+	if err != nil {
+		return err
 	}
 	c := context.Background()
 	client, err := GhClient(proj.Github)
@@ -57,26 +144,31 @@ func setRepoStatus(commit string, proj *brigade.Project, status *github.RepoStat
 	}
 	_, _, err = client.Repositories.CreateStatus(
 		c,
-		parts[1],
-		parts[2],
+		owner,
+		repo,
 		commit,
 		status)
 	return err
 }
 
+// SetRepoStatus sets the status on a particular commit in the repo of proj,
+// authenticating with the GitHub token of proj.
+func SetRepoStatus(commit string, proj *brigade.Project, status *github.RepoStatus) error {
+	return setRepoStatus(commit, proj, status)
+}
+
 // GetRepoStatus gets the Brigade repository status.
 // The ref can be a SHA or a branch or tag.
-func GetRepoStatus(proj *brigade.Project, ref string) (*github.RepoStatus, error) {
-	c := context.Background()
+func GetRepoStatus(c context.Context, proj *brigade.Project, ref string) (*github.RepoStatus, error) {
 	client, err := GhClient(proj.Github)
 	if err != nil {
 		return nil, err
 	}
-	parts := strings.SplitN(proj.Repo.Name, "/", 3) // github.com/ORG/REPO
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("project name %q is malformed", proj.Repo.Name)
+	owner, repo, err := splitRepoName(proj.Repo.Name)
+	if err != nil {
+		return nil, err
 	}
-	statii, _, err := client.Repositories.ListStatuses(c, parts[1], parts[2], ref, &github.ListOptions{})
+	statii, _, err := client.Repositories.ListStatuses(c, owner, repo, ref, &github.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -89,33 +181,31 @@ func GetRepoStatus(proj *brigade.Project, ref string) (*github.RepoStatus, error
 }
 
 // GetLastCommit gets the last commit on the give reference (branch name or tag).
-func GetLastCommit(proj *brigade.Project, ref string) (string, error) {
-	c := context.Background()
+func GetLastCommit(c context.Context, proj *brigade.Project, ref string) (string, error) {
 	client, err := GhClient(proj.Github)
 	if err != nil {
 		return "", err
 	}
-	parts := strings.SplitN(proj.Repo.Name, "/", 3)
-	if len(parts) != 3 {
-		return "", fmt.Errorf("project name %q is malformed", proj.Repo.Name)
+	owner, repo, err := splitRepoName(proj.Repo.Name)
+	if err != nil {
+		return "", err
 	}
-	sha, _, err := client.Repositories.GetCommitSHA1(c, parts[1], parts[2], ref, "")
+	sha, _, err := client.Repositories.GetCommitSHA1(c, owner, repo, ref, "")
 	return sha, err
 }
 
 // GetFileContents returns the contents for a particular file in the project.
-func GetFileContents(proj *brigade.Project, ref, path string) ([]byte, error) {
-	c := context.Background()
+func GetFileContents(c context.Context, proj *brigade.Project, ref, path string) ([]byte, error) {
 	client, err := GhClient(proj.Github)
 	if err != nil {
 		return []byte{}, err
 	}
-	parts := strings.SplitN(proj.Repo.Name, "/", 3)
-	if len(parts) != 3 {
-		return nil, fmt.Errorf("project name %q is malformed", proj.Repo.Name)
+	owner, repo, err := splitRepoName(proj.Repo.Name)
+	if err != nil {
+		return nil, err
 	}
 	opts := &github.RepositoryContentGetOptions{Ref: ref}
-	r, err := client.Repositories.DownloadContents(c, parts[1], parts[2], path, opts)
+	r, err := client.Repositories.DownloadContents(c, owner, repo, path, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -144,21 +234,91 @@ func (s *githubHook) installationToken(appID, installationID int, cfg brigade.Gi
 	}
 
 	ctx := context.Background()
-	itok, _, err := ghc.Apps.CreateInstallationToken(ctx, int64(installationID))
+	itok, res, err := ghc.Apps.CreateInstallationToken(ctx, int64(installationID))
 	if err != nil {
 		return "", time.Time{}, err
 	}
+	ObserveInstallationToken(itok.GetExpiresAt(), res)
 	return itok.GetToken(), itok.GetExpiresAt(), nil
 }
 
+const (
+	// maxClockSkew is the difference to GitHub's clock above which we warn
+	maxClockSkew = 30 * time.Second
+	// minTokenLifetime is the lifetime below which an installation token is
+	// implausibly short. GitHub issues them with a lifetime of one hour.
+	minTokenLifetime = 50 * time.Minute
+)
+
+// ObserveInstallationToken records the clock skew to GitHub, as seen from the
+// response that issued an installation token, and warns about skew and tokens
+// that expire implausibly soon.
+func ObserveInstallationToken(expiresAt time.Time, res *github.Response) {
+	now := time.Now()
+	if res != nil {
+		if date, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+			skew := now.Sub(date)
+			clockSkewSeconds.Set(skew.Seconds())
+			if skew > maxClockSkew || skew < -maxClockSkew {
+				log.Printf("WARNING: the local clock is %s off from GitHub's, which may result in rejected JWTs", skew.Round(time.Second))
+			}
+		}
+	}
+	if !expiresAt.IsZero() {
+		if lifetime := expiresAt.Sub(now); lifetime < minTokenLifetime {
+			shortLivedTokensTotal.Inc()
+			log.Printf("WARNING: installation token expires in %s, which indicates clock skew", lifetime.Round(time.Second))
+		}
+	}
+}
+
 // InstallationTokenClient uses an installation token to authenticate to the Github API.
 func InstallationTokenClient(instToken, baseURL, uploadURL string) (*github.Client, error) {
 	// For installation tokens, Github uses a different token type ("token" instead of "bearer")
 	t := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: instToken, TokenType: "token"})
-	c := context.Background()
-	tc := oauth2.NewClient(c, t)
-	if baseURL != "" {
-		return github.NewEnterpriseClient(baseURL, uploadURL, tc)
+	tc := oauth2.NewClient(clientContext(), t)
+	return newClient(baseURL, uploadURL, tc)
+}
+
+// Polling of the mergeable state of pull requests
+const (
+	mergeablePollAttempts = 3
+	mergeablePollInterval = time.Second
+)
+
+// MergeableState describes whether a pull request can be merged.
+type MergeableState struct {
+	// Mergeable is nil while GitHub is still computing it
+	Mergeable *bool
+	// State is GitHub's mergeable_state, like "clean", "dirty" or "unknown"
+	State string
+}
+
+// GetMergeableState fetches the mergeable state of a pull request.
+//
+// GitHub computes mergeability asynchronously, so while it is unknown this polls
+// up to attempts times, waiting interval between polls. Mergeable is left nil if it
+// is still unknown after the last attempt.
+func GetMergeableState(c context.Context, client *github.Client, owner, repo string, number, attempts int, interval time.Duration) (*MergeableState, error) {
+	ms := &MergeableState{}
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-c.Done():
+				return nil, c.Err()
+			case <-time.After(interval):
+			}
+		}
+
+		pr, _, err := client.PullRequests.Get(c, owner, repo, number)
+		if err != nil {
+			return nil, err
+		}
+		ms.Mergeable = pr.Mergeable
+		ms.State = pr.GetMergeableState()
+		if ms.Mergeable != nil {
+			break
+		}
 	}
-	return github.NewClient(tc), nil
+	return ms, nil
 }
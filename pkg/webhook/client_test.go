@@ -1,9 +1,20 @@
 package webhook
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestGHClient(t *testing.T) {
@@ -25,3 +36,256 @@ func TestGHClient(t *testing.T) {
 		t.Errorf("Expected %q, got %q", c.UploadURL.String(), gh.UploadURL)
 	}
 }
+
+func TestGHClient_defaultURLs(t *testing.T) {
+	defer SetDefaultURLs("", "")
+	if err := SetDefaultURLs("https://ghe.example.com/api/v3/", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		gh           brigade.Github
+		base, upload string
+	}{
+		{name: "project without URLs", base: "https://ghe.example.com/api/v3/", upload: "https://ghe.example.com/api/v3/"},
+		{name: "project with URLs", gh: brigade.Github{BaseURL: "http://example.com/base/", UploadURL: "http://example.com/upload/"}, base: "http://example.com/base/", upload: "http://example.com/upload/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := map[string]func() (*github.Client, error){
+				"token": func() (*github.Client, error) { return GhClient(tt.gh) },
+				"installation": func() (*github.Client, error) {
+					return InstallationTokenClient("v1.installation-token", tt.gh.BaseURL, tt.gh.UploadURL)
+				},
+			}
+			for name, newClient := range clients {
+				c, err := newClient()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.BaseURL.String() != tt.base || c.UploadURL.String() != tt.upload {
+					t.Errorf("%s client: expected %q and %q, got %q and %q", name, tt.base, tt.upload, c.BaseURL, c.UploadURL)
+				}
+			}
+		})
+	}
+}
+
+func TestGHClient_defaultURLsRequests(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"sha":"c1"}`))
+	}))
+	defer ts.Close()
+	defer SetDefaultURLs("", "")
+	if err := SetDefaultURLs(ts.URL+"/api/v3/", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := InstallationTokenClient("v1.installation-token", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.Repositories.GetCommit(context.Background(), "myorg", "myapp", "master"); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 || paths[0] != "/api/v3/repos/myorg/myapp/commits/master" {
+		t.Errorf("expected the request to go to the default API URL, got %v", paths)
+	}
+}
+
+func TestSetDefaultURLs(t *testing.T) {
+	defer SetDefaultURLs("", "")
+	tests := []struct {
+		base, upload string
+		valid        bool
+	}{
+		{valid: true},
+		{base: "https://ghe.example.com/api/v3/", valid: true},
+		{base: "https://ghe.example.com/api/v3/", upload: "https://ghe.example.com/api/uploads/", valid: true},
+		{upload: "https://ghe.example.com/api/uploads/"},
+		{base: "ghe.example.com/api/v3"},
+		{base: "ftp://ghe.example.com/"},
+		{base: "https://ghe.example.com/api/v3/", upload: "://uploads"},
+	}
+	for _, tt := range tests {
+		if err := SetDefaultURLs(tt.base, tt.upload); (err == nil) != tt.valid {
+			t.Errorf("%q, %q: unexpected error %v", tt.base, tt.upload, err)
+		}
+	}
+}
+
+func TestGetFileContents_cancelled(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	proj := &brigade.Project{
+		Repo: brigade.Repo{Name: "github.com/myorg/myapp"},
+		Github: brigade.Github{
+			Token:     "totallyFake",
+			BaseURL:   ts.URL + "/",
+			UploadURL: ts.URL + "/",
+		},
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := GetFileContents(c, proj, "master", "brigade.js")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected an error from a cancelled context")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetFileContents did not return after its context was cancelled")
+	}
+}
+
+func TestGetMergeableState(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []string
+		mergeable *bool
+		state     string
+		requests  int
+	}{
+		{
+			name:      "mergeable",
+			responses: []string{`{"number":1,"mergeable":true,"mergeable_state":"clean"}`},
+			mergeable: github.Bool(true),
+			state:     "clean",
+			requests:  1,
+		},
+		{
+			name:      "unmergeable",
+			responses: []string{`{"number":1,"mergeable":false,"mergeable_state":"dirty"}`},
+			mergeable: github.Bool(false),
+			state:     "dirty",
+			requests:  1,
+		},
+		{
+			name: "computed after polling",
+			responses: []string{
+				`{"number":1,"mergeable":null,"mergeable_state":"unknown"}`,
+				`{"number":1,"mergeable":false,"mergeable_state":"dirty"}`,
+			},
+			mergeable: github.Bool(false),
+			state:     "dirty",
+			requests:  2,
+		},
+		{
+			name: "unknown",
+			responses: []string{
+				`{"number":1,"mergeable":null,"mergeable_state":"unknown"}`,
+				`{"number":1,"mergeable":null,"mergeable_state":"unknown"}`,
+				`{"number":1,"mergeable":null,"mergeable_state":"unknown"}`,
+			},
+			state:    "unknown",
+			requests: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/repos/myorg/myapp/pulls/1" {
+					t.Errorf("unexpected path %q", r.URL.Path)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.responses[requests]))
+				requests++
+			}))
+			defer ts.Close()
+
+			client, err := InstallationTokenClient("totallyFake", ts.URL+"/", ts.URL+"/")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ms, err := GetMergeableState(context.Background(), client, "myorg", "myapp", 1, 3, time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (ms.Mergeable == nil) != (tt.mergeable == nil) || (ms.Mergeable != nil && *ms.Mergeable != *tt.mergeable) {
+				t.Errorf("expected mergeable %v, got %v", tt.mergeable, ms.Mergeable)
+			}
+			if ms.State != tt.state {
+				t.Errorf("expected mergeable state %q, got %q", tt.state, ms.State)
+			}
+			if requests != tt.requests {
+				t.Errorf("expected %d request(s), got %d", tt.requests, requests)
+			}
+		})
+	}
+}
+
+func TestDiscoverAppID(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	var authorization string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app" {
+			http.NotFound(w, r)
+			return
+		}
+		authorization = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":42,"slug":"brigade-cd","name":"brigade-cd"}`))
+	}))
+	defer ts.Close()
+
+	cfg := brigade.Github{BaseURL: ts.URL + "/", UploadURL: ts.URL + "/"}
+	appID, err := DiscoverAppID(context.Background(), "Iv1.8a61f9b3a7aba766", key, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appID != 42 {
+		t.Errorf("expected app ID 42, got %d", appID)
+	}
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		t.Errorf("expected a bearer JWT, got %q", authorization)
+	}
+
+	if _, err := DiscoverAppID(context.Background(), "Iv1.8a61f9b3a7aba766", []byte("not a key"), cfg); err == nil {
+		t.Error("expected an error for an invalid key")
+	}
+}
+
+func TestObserveInstallationToken(t *testing.T) {
+	skewed := &github.Response{Response: &http.Response{Header: http.Header{}}}
+	skewed.Header.Set("Date", time.Now().Add(-2*time.Minute).UTC().Format(http.TimeFormat))
+
+	before := testutil.ToFloat64(shortLivedTokensTotal)
+	ObserveInstallationToken(time.Now().Add(58*time.Minute), skewed)
+
+	if skew := testutil.ToFloat64(clockSkewSeconds); skew < 115 || skew > 125 {
+		t.Errorf("expected a clock skew of about 120s, got %f", skew)
+	}
+	if got := testutil.ToFloat64(shortLivedTokensTotal); got != before {
+		t.Errorf("expected a token expiring in an hour not to be counted, got %f", got-before)
+	}
+
+	ObserveInstallationToken(time.Now().Add(5*time.Minute), nil)
+	if got := testutil.ToFloat64(shortLivedTokensTotal); got != before+1 {
+		t.Errorf("expected a token expiring in 5 minutes to be counted, got %f", got-before)
+	}
+}
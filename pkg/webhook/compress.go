@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// compressionGzip is the compression of the payloads compressed by CompressPayload
+const compressionGzip = "gzip"
+
+// compressedPayload is the envelope of a compressed payload. Workers tell it
+// apart from an uncompressed payload by the "compression" field.
+type compressedPayload struct {
+	Compression string `json:"compression"`
+	// Payload is the gzipped payload, base64-encoded by encoding/json
+	Payload []byte `json:"payload"`
+}
+
+// CompressPayload gzips the payload into an envelope when it is larger than
+// threshold bytes, so that large payloads fit in the build secret. Smaller
+// payloads, or any payload with a threshold of zero, are returned as is.
+func CompressPayload(payload []byte, threshold int) ([]byte, error) {
+	if threshold <= 0 || len(payload) <= threshold {
+		return payload, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(compressedPayload{Compression: compressionGzip, Payload: buf.Bytes()})
+}
+
+// DecompressPayload returns the payload inside an envelope created by
+// CompressPayload. Uncompressed payloads are returned as is.
+func DecompressPayload(payload []byte) ([]byte, error) {
+	env := compressedPayload{}
+	if err := json.Unmarshal(payload, &env); err != nil || env.Compression == "" {
+		return payload, nil
+	}
+	if env.Compression != compressionGzip {
+		return nil, fmt.Errorf("unsupported payload compression %q", env.Compression)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(env.Payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
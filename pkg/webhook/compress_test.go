@@ -0,0 +1,82 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCompressPayload(t *testing.T) {
+	large := []byte(`{"type":"push","body":{"message":"` + strings.Repeat("a", 1000) + `"}}`)
+	small := []byte(`{"type":"push"}`)
+
+	tests := []struct {
+		name       string
+		payload    []byte
+		threshold  int
+		compressed bool
+	}{
+		{name: "above threshold", payload: large, threshold: 100, compressed: true},
+		{name: "below threshold", payload: small, threshold: 100},
+		{name: "at threshold", payload: small, threshold: len(small)},
+		{name: "disabled", payload: large, threshold: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := CompressPayload(tt.payload, tt.threshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			env := struct {
+				Compression string `json:"compression"`
+			}{}
+			if err := json.Unmarshal(out, &env); err != nil {
+				t.Fatal(err)
+			}
+			if got := env.Compression == "gzip"; got != tt.compressed {
+				t.Fatalf("expected compressed to be %t, got %s", tt.compressed, out)
+			}
+			if tt.compressed && len(out) >= len(tt.payload) {
+				t.Errorf("expected the compressed payload to be smaller than %d bytes, got %d", len(tt.payload), len(out))
+			}
+
+			roundTripped, err := DecompressPayload(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(roundTripped, tt.payload) {
+				t.Errorf("expected the payload to round-trip, got %s", roundTripped)
+			}
+		})
+	}
+
+	if _, err := DecompressPayload([]byte(`{"compression":"zstd","payload":""}`)); err == nil {
+		t.Error("expected an error for an unsupported compression")
+	}
+}
+
+func TestGithubHandler_compression(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.CompressionThreshold = 1
+
+	handleTestEvent(t, s, "milestone", []byte(`{"action":"created","milestone":{"id":3361444},"repository":{"full_name":"baxterthehacker/public-repo"},"sender":{"id":6752317}}`))
+
+	if len(store.builds) != 2 {
+		t.Fatalf("expected 2 builds, got %d", len(store.builds))
+	}
+	payload, err := DecompressPayload(store.builds[0].Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := ActivityPayload{}
+	if err := json.Unmarshal(payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if pl.TargetID != 3361444 {
+		t.Errorf("expected the decompressed payload to carry the milestone, got %s", payload)
+	}
+}
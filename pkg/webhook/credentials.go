@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+)
+
+// ErrNoCredentials is returned by Credentials when a project has neither a
+// static GitHub token nor an installation token.
+var ErrNoCredentials = errors.New("neither a GitHub token nor an App installation is available")
+
+// Credentials returns the GitHub config of proj to call the API with. The static
+// token of proj is used if it has one. Otherwise the installation token returned
+// by installationToken is, as projects of an App usually have no static token.
+// A nil installationToken, or one returning an empty token, results in
+// ErrNoCredentials.
+func Credentials(proj *brigade.Project, installationToken func() (string, error)) (brigade.Github, error) {
+	cfg := proj.Github
+	if cfg.Token != "" {
+		return cfg, nil
+	}
+	if installationToken == nil {
+		return cfg, ErrNoCredentials
+	}
+	tok, err := installationToken()
+	if err != nil {
+		return cfg, fmt.Errorf("failed to negotiate an installation token: %v", err)
+	}
+	if tok == "" {
+		return cfg, ErrNoCredentials
+	}
+	cfg.Token = tok
+	return cfg, nil
+}
+
+// withCredentials returns a copy of proj with the credentials selected by
+// Credentials, negotiating an installation token of the App for the repo of proj
+// if needed.
+func (s *githubHook) withCredentials(c context.Context, proj *brigade.Project) (*brigade.Project, error) {
+	var installationToken func() (string, error)
+	if s.opts.AppID != 0 && s.installations != nil {
+		installationToken = func() (string, error) {
+			id, err := s.installations.installationID(c, proj.Name)
+			if err != nil {
+				return "", err
+			}
+			if id == 0 {
+				return "", fmt.Errorf("no installation of the App has access to %s", proj.Name)
+			}
+			tok, _, err := s.getToken(s.opts.AppID, int(id), proj.Github)
+			return tok, err
+		}
+	}
+	cfg, err := Credentials(proj, installationToken)
+	if err != nil {
+		return nil, err
+	}
+	p := *proj
+	p.Github = cfg
+	return &p, nil
+}
+
+// fileFromGithub fetches a file of the repo of proj, with the credentials of withCredentials.
+func (s *githubHook) fileFromGithub(c context.Context, commit, path string, proj *brigade.Project) ([]byte, error) {
+	p, err := s.withCredentials(c, proj)
+	if err != nil {
+		return nil, err
+	}
+	return getFileFromGithub(c, commit, path, p)
+}
+
+// setRepoStatus sets the status of a commit in the repo of proj, with the
+// credentials of withCredentials.
+func (s *githubHook) setRepoStatus(commit string, proj *brigade.Project, status *github.RepoStatus) error {
+	p, err := s.withCredentials(context.Background(), proj)
+	if err != nil {
+		return err
+	}
+	return setRepoStatus(commit, p, status)
+}
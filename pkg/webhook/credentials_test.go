@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestCredentials(t *testing.T) {
+	installed := func() (string, error) { return "v1.installation", nil }
+	tests := []struct {
+		name              string
+		static            string
+		installationToken func() (string, error)
+		expected          string
+		expectedErr       bool
+	}{
+		{name: "static token", static: "oauth", expected: "oauth"},
+		{name: "static token preferred", static: "oauth", installationToken: installed, expected: "oauth"},
+		{name: "installation token", installationToken: installed, expected: "v1.installation"},
+		{name: "no App", expectedErr: true},
+		{name: "no installation token", installationToken: func() (string, error) { return "", nil }, expectedErr: true},
+		{name: "failed negotiation", installationToken: func() (string, error) { return "", errors.New("suspended") }, expectedErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proj := &brigade.Project{Github: brigade.Github{Token: tt.static, BaseURL: "https://ghe.example.com/api/v3/"}}
+			cfg, err := Credentials(proj, tt.installationToken)
+			if tt.expectedErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if cfg.Token != tt.expected {
+				t.Errorf("expected token %q, got %q", tt.expected, cfg.Token)
+			}
+			if cfg.BaseURL != proj.Github.BaseURL {
+				t.Errorf("expected the base URL to be kept, got %q", cfg.BaseURL)
+			}
+		})
+	}
+}
+
+func TestGithubHook_withCredentials(t *testing.T) {
+	s := &githubHook{opts: GithubOpts{AppID: 42}}
+	s.installations = newInstallationCache(time.Minute, func(c context.Context) (map[string]int64, error) {
+		return map[string]int64{"myorg/app": 7}, nil
+	})
+	var negotiated []int
+	s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+		negotiated = append(negotiated, installationID)
+		return "v1.token", time.Now().Add(time.Hour), nil
+	}
+
+	p, err := s.withCredentials(context.Background(), &brigade.Project{Name: "myorg/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Github.Token != "v1.token" || len(negotiated) != 1 || negotiated[0] != 7 {
+		t.Errorf("expected the token of installation 7, got %q after negotiating %v", p.Github.Token, negotiated)
+	}
+
+	proj := &brigade.Project{Name: "myorg/app", Github: brigade.Github{Token: "oauth"}}
+	if p, err = s.withCredentials(context.Background(), proj); err != nil {
+		t.Fatal(err)
+	}
+	if p.Github.Token != "oauth" || len(negotiated) != 1 {
+		t.Errorf("expected the static token without negotiation, got %q", p.Github.Token)
+	}
+
+	if _, err := s.withCredentials(context.Background(), &brigade.Project{Name: "myorg/other"}); err == nil {
+		t.Error("expected an error for a repo without an installation")
+	}
+}
@@ -3,6 +3,7 @@ package webhook
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"time"
 
@@ -19,6 +20,21 @@ func SHA1HMAC(salt, message []byte) string {
 	return fmt.Sprintf("sha1=%x", sum)
 }
 
+// SHA256HMAC computes the GitHub SHA256 HMAC of X-Hub-Signature-256.
+func SHA256HMAC(salt, message []byte) string {
+	digest := hmac.New(sha256.New, salt)
+	digest.Write(message)
+	sum := digest.Sum(nil)
+	return fmt.Sprintf("sha256=%x", sum)
+}
+
+// JWTBackdate is how far the issue time of JWTs is set in the past, so that they
+// are not rejected as issued in the future when the local clock is ahead of GitHub's.
+var JWTBackdate = 60 * time.Second
+
+// MaxJWTBackdate is the largest JWTBackdate that still results in a valid JWT
+const MaxJWTBackdate = 5 * time.Minute
+
 func JWT(appID string, keyPEM []byte) (string, error) {
 	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyPEM)
 	if err != nil {
@@ -27,7 +43,7 @@ func JWT(appID string, keyPEM []byte) (string, error) {
 
 	now := time.Now()
 	claim := &jwt.StandardClaims{
-		IssuedAt:  now.Unix(),
+		IssuedAt:  now.Add(-JWTBackdate).Unix(),
 		ExpiresAt: now.Add(5 * time.Minute).Unix(),
 		Issuer:    appID,
 	}
@@ -1,7 +1,14 @@
 package webhook
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
 )
 
 func TestSHA1HMAC(t *testing.T) {
@@ -12,3 +19,44 @@ func TestSHA1HMAC(t *testing.T) {
 		t.Fatalf("Expected \n\t%q, got\n\t%q", expect, got)
 	}
 }
+
+func TestSHA256HMAC(t *testing.T) {
+	salt := []byte("It's a Secret to Everybody")
+	message := []byte("Hello, World!")
+	expect := "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17"
+	if got := SHA256HMAC(salt, message); got != expect {
+		t.Fatalf("Expected \n\t%q, got\n\t%q", expect, got)
+	}
+}
+
+func TestJWT_backdated(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	now := time.Now()
+	tok, err := JWT("13", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := &jwt.StandardClaims{}
+	if _, err := jwt.ParseWithClaims(tok, claims, func(*jwt.Token) (interface{}, error) {
+		return &rsaKey.PublicKey, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := now.Add(-60 * time.Second).Unix()
+	if claims.IssuedAt < expected-1 || claims.IssuedAt > expected+1 {
+		t.Errorf("expected iat to be backdated by 60s to %d, got %d", expected, claims.IssuedAt)
+	}
+	if claims.ExpiresAt-claims.IssuedAt > 600 {
+		t.Errorf("expected the JWT to be valid for at most 10 minutes, got %ds", claims.ExpiresAt-claims.IssuedAt)
+	}
+	if claims.Issuer != "13" {
+		t.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+}
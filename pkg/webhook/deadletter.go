@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+)
+
+// DeadLetters persists builds that could not be created in Brigade, so that
+// operators can inspect and replay them.
+type DeadLetters interface {
+	// Put persists b along with the error of the last attempt to create it.
+	Put(b *brigade.Build, cause error) error
+}
+
+// DeadLetter is a build that could not be created, as persisted by DirDeadLetters.
+type DeadLetter struct {
+	// Build is the build spec, with the payload as is
+	Build *brigade.Build `json:"build"`
+	// Error is the error of the last attempt to create the build
+	Error string `json:"error"`
+	// Failed is when the last attempt failed
+	Failed time.Time `json:"failed"`
+}
+
+// DirDeadLetters persists every dead letter as a JSON file in a directory.
+type DirDeadLetters struct {
+	dir string
+	now func() time.Time
+}
+
+// NewDirDeadLetters creates DirDeadLetters for dir, creating dir if missing.
+func NewDirDeadLetters(dir string) (*DirDeadLetters, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DirDeadLetters{dir: dir, now: time.Now}, nil
+}
+
+// unsafeFileChars are the characters of project IDs and build types replaced in file names
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Put writes b to a file named after its project, type and the time of the failure.
+func (d *DirDeadLetters) Put(b *brigade.Build, cause error) error {
+	dl := DeadLetter{Build: b, Error: cause.Error(), Failed: d.now().UTC()}
+	data, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s-%d.json",
+		unsafeFileChars.ReplaceAllString(b.ProjectID, "_"),
+		unsafeFileChars.ReplaceAllString(b.Type, "_"),
+		dl.Failed.UnixNano())
+	// The payload may contain tokens, so the file is only readable by us
+	return ioutil.WriteFile(filepath.Join(d.dir, name), data, 0600)
+}
+
+// CreateBuildOrDeadLetter creates b like CreateBuild, and puts it into dl once
+// every attempt failed, unless dl is nil. The error of the last attempt is
+// returned either way, as the build is still not created.
+func CreateBuildOrDeadLetter(ctx context.Context, store storage.Store, dl DeadLetters, b *brigade.Build) error {
+	err := CreateBuild(ctx, store, b)
+	if err == nil || dl == nil {
+		return err
+	}
+	putDeadLetter(dl, b, err)
+	return err
+}
+
+// putDeadLetter puts b, which failed to be created due to err, into dl.
+func putDeadLetter(dl DeadLetters, b *brigade.Build, err error) {
+	if dl == nil {
+		return
+	}
+	if dlErr := dl.Put(b, err); dlErr != nil {
+		log.Printf("Failed to put %q build for project %s into the dead-letter store, the build is lost: %s", b.Type, b.ProjectID, dlErr)
+		deadLettersTotal.WithLabelValues("failure").Inc()
+	} else {
+		log.Printf("Put %q build for project %s into the dead-letter store", b.Type, b.ProjectID)
+		deadLettersTotal.WithLabelValues("success").Inc()
+	}
+}
@@ -0,0 +1,119 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testDeadLetters records the builds put into it, and fails with err
+type testDeadLetters struct {
+	builds []*brigade.Build
+	causes []error
+	err    error
+}
+
+func (d *testDeadLetters) Put(b *brigade.Build, cause error) error {
+	d.builds = append(d.builds, b)
+	d.causes = append(d.causes, cause)
+	return d.err
+}
+
+func TestCreateBuildOrDeadLetter(t *testing.T) {
+	tests := []struct {
+		name       string
+		failures   int
+		deadLetter bool
+	}{
+		{name: "created", failures: 0},
+		{name: "created on retry", failures: createBuildAttempts - 1},
+		{name: "persistent failure", failures: createBuildAttempts, deadLetter: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &flakyBuildStore{testStore: newTestStore(), failType: "push", failures: tt.failures}
+			dl := &testDeadLetters{}
+			before := testutil.ToFloat64(deadLettersTotal.WithLabelValues("success"))
+
+			err := CreateBuildOrDeadLetter(context.Background(), store, dl, &brigade.Build{ProjectID: "brigade-1234", Type: "push"})
+
+			if tt.deadLetter != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.deadLetter {
+				if len(dl.builds) != 0 {
+					t.Errorf("expected no dead letters, got %d", len(dl.builds))
+				}
+				return
+			}
+			if len(dl.builds) != 1 || dl.builds[0].Type != "push" {
+				t.Fatalf("expected the push build to be a dead letter, got %v", dl.builds)
+			}
+			if dl.causes[0] != err {
+				t.Errorf("expected the cause %v, got %v", err, dl.causes[0])
+			}
+			if got := testutil.ToFloat64(deadLettersTotal.WithLabelValues("success")) - before; got != 1 {
+				t.Errorf("expected the dead letter to be counted once, got %v", got)
+			}
+		})
+	}
+}
+
+func TestCreateBuildOrDeadLetter_noDeadLetters(t *testing.T) {
+	store := &flakyBuildStore{testStore: newTestStore(), failType: "push", failures: createBuildAttempts}
+	if err := CreateBuildOrDeadLetter(context.Background(), store, nil, &brigade.Build{Type: "push"}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestDirDeadLetters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead-letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := NewDirDeadLetters(filepath.Join(dir, "nested"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &brigade.Build{
+		ProjectID: "brigade-1234",
+		Type:      "issue_comment:created",
+		Provider:  "github",
+		Revision:  &brigade.Revision{Commit: "abc123"},
+		Payload:   []byte(`{"type":"issue_comment"}`),
+	}
+	if err := d.Put(b, errors.New("store unavailable")); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "nested", "brigade-1234-issue_comment_created-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 dead letter file, got %v", files)
+	}
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl := DeadLetter{}
+	if err := json.Unmarshal(data, &dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Error != "store unavailable" {
+		t.Errorf("unexpected error %q", dl.Error)
+	}
+	if dl.Build.Type != b.Type || dl.Build.Revision.Commit != "abc123" || string(dl.Build.Payload) != string(b.Payload) {
+		t.Errorf("unexpected build %+v", dl.Build)
+	}
+}
@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+// debouncer coalesces builds for the same project, ref and event type.
+//
+// Every scheduled build restarts the quiet period for its key, and only the most
+// recent build is emitted once the quiet period elapses.
+type debouncer struct {
+	window time.Duration
+	emit   func(b *brigade.Build)
+	// spool persists the pending builds, if set
+	spool *Spool
+
+	mu      sync.Mutex
+	pending map[string]*pendingBuild
+}
+
+type pendingBuild struct {
+	build *brigade.Build
+	timer *time.Timer
+	// spooled is the name of the build in the spool, if persisted
+	spooled string
+}
+
+func newDebouncer(window time.Duration, emit func(b *brigade.Build)) *debouncer {
+	return &debouncer{
+		window:  window,
+		emit:    emit,
+		pending: map[string]*pendingBuild{},
+	}
+}
+
+// schedule replaces any pending build with the same key by b.
+func (d *debouncer) schedule(b *brigade.Build) {
+	d.add(b, d.spool.put(spoolDebounce, b))
+}
+
+// replay schedules the builds that were pending in the spool when the gateway
+// last exited, restarting their quiet periods.
+func (d *debouncer) replay() error {
+	builds, err := d.spool.load(spoolDebounce)
+	if err != nil {
+		return err
+	}
+	for _, sb := range builds {
+		log.Printf("Replaying pending %q build of %s for project %s", sb.Build.Type, describeRevision(sb.Build.Revision), sb.Build.ProjectID)
+		d.add(sb.Build, sb.name)
+	}
+	return nil
+}
+
+// add replaces any pending build with the same key by b, spooled as spooled.
+func (d *debouncer) add(b *brigade.Build, spooled string) {
+	key := debounceKey(b)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if p, ok := d.pending[key]; ok {
+		p.timer.Stop()
+		d.spool.Remove(p.spooled)
+		log.Printf("Superseding pending %q build of %s for project %s", b.Type, describeRevision(p.build.Revision), b.ProjectID)
+	}
+	p := &pendingBuild{build: b, spooled: spooled}
+	p.timer = time.AfterFunc(d.window, func() { d.fire(key, p) })
+	d.pending[key] = p
+}
+
+func (d *debouncer) fire(key string, p *pendingBuild) {
+	d.mu.Lock()
+	if d.pending[key] != p {
+		// Superseded by a build scheduled while the timer was firing
+		d.mu.Unlock()
+		return
+	}
+	delete(d.pending, key)
+	d.mu.Unlock()
+
+	d.emit(p.build)
+	// The build is created, or else buffered or dead-lettered, by now
+	d.spool.Remove(p.spooled)
+}
+
+func debounceKey(b *brigade.Build) string {
+	var ref string
+	if b.Revision != nil {
+		ref = b.Revision.Ref
+	}
+	return b.ProjectID + "\x00" + ref + "\x00" + b.Type
+}
+
+func describeRevision(rev *brigade.Revision) string {
+	if rev == nil {
+		return "no revision"
+	}
+	if rev.Commit == "" {
+		return rev.Ref
+	}
+	return rev.Ref + "@" + rev.Commit
+}
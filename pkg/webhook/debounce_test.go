@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestDebouncer(t *testing.T) {
+	emitted := make(chan *brigade.Build, 10)
+	d := newDebouncer(50*time.Millisecond, func(b *brigade.Build) {
+		emitted <- b
+	})
+
+	push := func(project, ref, commit string) {
+		d.schedule(&brigade.Build{
+			ProjectID: project,
+			Type:      "push",
+			Revision:  &brigade.Revision{Ref: ref, Commit: commit},
+		})
+	}
+
+	// Several rapid pushes to the same branch, and one to another branch
+	for _, commit := range []string{"c1", "c2", "c3", "c4"} {
+		push("brigade-1234", "refs/heads/master", commit)
+		time.Sleep(5 * time.Millisecond)
+	}
+	push("brigade-1234", "refs/heads/develop", "d1")
+
+	builds := map[string]string{}
+	timeout := time.After(5 * time.Second)
+	for len(builds) < 2 {
+		select {
+		case b := <-emitted:
+			if _, ok := builds[b.Revision.Ref]; ok {
+				t.Fatalf("expected a single build for %s, got a second one for %s", b.Revision.Ref, b.Revision.Commit)
+			}
+			builds[b.Revision.Ref] = b.Revision.Commit
+		case <-timeout:
+			t.Fatalf("timed out waiting for builds, got %v", builds)
+		}
+	}
+
+	if builds["refs/heads/master"] != "c4" {
+		t.Errorf("expected only the latest master revision c4 to be built, got %q", builds["refs/heads/master"])
+	}
+	if builds["refs/heads/develop"] != "d1" {
+		t.Errorf("expected develop to be built independently, got %q", builds["refs/heads/develop"])
+	}
+
+	select {
+	case b := <-emitted:
+		t.Errorf("unexpected extra build of %s", describeRevision(b.Revision))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestGithubHandler_debounced(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.debouncer = newDebouncer(time.Hour, func(b *brigade.Build) {
+		t.Errorf("unexpected emission of %q", b.Type)
+	})
+
+	w := handleTestIssueComment(t, s)
+
+	if w.Code != 202 {
+		t.Fatalf("expected 202 for debounced builds, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 0 {
+		t.Fatalf("expected no builds to be created before the window elapses, got %d", len(store.builds))
+	}
+}
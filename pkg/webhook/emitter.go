@@ -0,0 +1,91 @@
+package webhook
+
+import (
+	"context"
+	"log"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+)
+
+// BrigadeTarget is the name of the primary target, the Brigade store.
+const BrigadeTarget = "brigade"
+
+// Emitter is a target that receives builds: the primary one, which creates
+// them in the Brigade store, or a secondary one that receives every build
+// created in Brigade.
+type Emitter interface {
+	// Name identifies the target in logs, metrics and responses.
+	Name() string
+	// Emit sends the build to the target.
+	Emit(b *brigade.Build) error
+}
+
+// storeEmitter is the primary target, which creates builds in the Brigade
+// store with CreateBuild, until ctx is done.
+type storeEmitter struct {
+	ctx   context.Context
+	store storage.Store
+}
+
+func (e storeEmitter) Name() string {
+	return BrigadeTarget
+}
+
+func (e storeEmitter) Emit(b *brigade.Build) error {
+	return CreateBuild(e.ctx, e.store, b)
+}
+
+// TargetStatus maps each target name to the outcome of emitting a build to it:
+// either "ok", "debounced", "duplicate", "buffered", "throttled" or the error message.
+type TargetStatus map[string]string
+
+// statusDebounced is the status of a build that is pending in the debouncer
+const statusDebounced = "debounced"
+
+// statusDuplicate is the status of a build that was already created for the delivery
+const statusDuplicate = "duplicate"
+
+// emitToTargets emits the build to the primary target, like a storeEmitter,
+// putting it into buf, or into dl if buf is full or nil or the build was
+// cancelled, if that fails, and
+// then hands it to every secondary emitter. created is called once the build is
+// emitted to the primary target, which is later for buffered builds.
+//
+// All targets are attempted regardless of earlier failures. The returned error is
+// non-nil only when the primary build could not be emitted nor buffered;
+// failures of secondary emitters are reported through the TargetStatus only.
+func emitToTargets(primary Emitter, dl DeadLetters, buf *BuildBuffer, emitters []Emitter, b *brigade.Build, created func()) (TargetStatus, error) {
+	status := TargetStatus{}
+
+	err := primary.Emit(b)
+	switch {
+	case err == nil:
+		recordEmit(status, primary.Name(), b, nil)
+		created()
+	case err != context.Canceled && err != context.DeadlineExceeded && buf.Put(b, created):
+		log.Printf("Buffered %q build for project %s until the store recovers: %s", b.Type, b.ProjectID, err)
+		status[primary.Name()] = statusBuffered
+		err = nil
+	default:
+		putDeadLetter(dl, b, err)
+		recordEmit(status, primary.Name(), b, err)
+	}
+
+	for _, e := range emitters {
+		recordEmit(status, e.Name(), b, e.Emit(b))
+	}
+
+	return status, err
+}
+
+func recordEmit(status TargetStatus, target string, b *brigade.Build, err error) {
+	if err != nil {
+		log.Printf("Failed to emit %q build for project %s to %s: %s", b.Type, b.ProjectID, target, err)
+		emitTotal.WithLabelValues(target, "failure").Inc()
+		status[target] = err.Error()
+		return
+	}
+	emitTotal.WithLabelValues(target, "success").Inc()
+	status[target] = "ok"
+}
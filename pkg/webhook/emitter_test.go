@@ -0,0 +1,170 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+type testEmitter struct {
+	name   string
+	builds []*brigade.Build
+	err    error
+}
+
+func (e *testEmitter) Name() string {
+	return e.name
+}
+
+func (e *testEmitter) Emit(b *brigade.Build) error {
+	e.builds = append(e.builds, b)
+	return e.err
+}
+
+func handleTestIssueComment(t *testing.T, s *githubHook) *httptest.ResponseRecorder {
+	payload, err := ioutil.ReadFile("testdata/github-issue_comment-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	r.Header.Add("X-GitHub-Event", "issue_comment")
+	r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
+
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = r
+
+	s.Handle(ctx)
+	return w
+}
+
+func TestGithubHandler_secondaryEmitterFails(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	ok := &testEmitter{name: "ok-target"}
+	broken := &testEmitter{name: "broken-target", err: errors.New("connection refused")}
+	s.opts.Emitters = []Emitter{broken, ok}
+
+	failuresBefore := testutil.ToFloat64(emitTotal.WithLabelValues("broken-target", "failure"))
+	successesBefore := testutil.ToFloat64(emitTotal.WithLabelValues("ok-target", "success"))
+
+	w := handleTestIssueComment(t, s)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 when the primary build succeeds, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 2 {
+		t.Fatalf("expected 2 Brigade builds, got %d", len(store.builds))
+	}
+	if len(ok.builds) != 2 {
+		t.Errorf("expected the healthy emitter to be attempted despite the other failing, got %d builds", len(ok.builds))
+	}
+
+	res := struct {
+		Builds map[string]TargetStatus `json:"builds"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	for _, et := range []string{"issue_comment", "issue_comment:created"} {
+		status := res.Builds[et]
+		if status[BrigadeTarget] != "ok" || status["ok-target"] != "ok" || status["broken-target"] != "connection refused" {
+			t.Errorf("unexpected target status for %q: %v", et, status)
+		}
+	}
+
+	if got := testutil.ToFloat64(emitTotal.WithLabelValues("broken-target", "failure")) - failuresBefore; got != 2 {
+		t.Errorf("expected 2 failures recorded for broken-target, got %v", got)
+	}
+	if got := testutil.ToFloat64(emitTotal.WithLabelValues("ok-target", "success")) - successesBefore; got != 2 {
+		t.Errorf("expected 2 successes recorded for ok-target, got %v", got)
+	}
+}
+
+func TestGithubHandler_primaryEmitterFails(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	secondary := &testEmitter{name: "secondary"}
+	s.opts.Emitters = []Emitter{secondary}
+
+	// The project lookup shares the store's error, so make only CreateBuild fail.
+	s.store = &failingBuildStore{testStore: store}
+
+	w := handleTestIssueComment(t, s)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 when the primary build fails, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(secondary.builds) != 2 {
+		t.Errorf("expected the secondary emitter to still be attempted, got %d builds", len(secondary.builds))
+	}
+}
+
+type failingBuildStore struct {
+	*testStore
+}
+
+func (s *failingBuildStore) CreateBuild(build *brigade.Build) error {
+	return errors.New("store unavailable")
+}
+
+func TestEmitToTargets_primary(t *testing.T) {
+	b := &brigade.Build{ProjectID: "brigade-1234", Type: "push"}
+
+	store := newTestStore()
+	status, err := emitToTargets(storeEmitter{context.Background(), store}, nil, nil, nil, b, func() {})
+	if err != nil || status[BrigadeTarget] != "ok" || len(store.builds) != 1 {
+		t.Fatalf("expected the build in the store, got %v, %v and %d builds", status, err, len(store.builds))
+	}
+
+	primary := &testEmitter{name: "primary"}
+	secondary := &testEmitter{name: "secondary"}
+	created := false
+	status, err = emitToTargets(primary, nil, nil, []Emitter{secondary}, b, func() { created = true })
+	if err != nil || !created {
+		t.Fatalf("expected the build to be emitted to the primary target, got %v", err)
+	}
+	if len(primary.builds) != 1 || len(secondary.builds) != 1 {
+		t.Errorf("expected the build in both targets, got %d and %d", len(primary.builds), len(secondary.builds))
+	}
+	if status["primary"] != "ok" || status["secondary"] != "ok" {
+		t.Errorf("expected per-target statuses of both targets, got %v", status)
+	}
+
+	failing := &testEmitter{name: "primary", err: errors.New("connection refused")}
+	if _, err := emitToTargets(failing, nil, nil, []Emitter{secondary}, b, func() {}); err == nil {
+		t.Error("expected the error of the primary target")
+	}
+}
+
+func TestEmitToTargets_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	store := newTestStore()
+	buf := NewBuildBuffer(store, 10)
+	dl := &testDeadLetters{}
+
+	status, err := emitToTargets(storeEmitter{ctx, store}, dl, buf, nil, &brigade.Build{ProjectID: "brigade-1234", Type: "push"}, func() {})
+	if err != context.Canceled {
+		t.Fatalf("expected the error of the context, got %v", err)
+	}
+	if buf.Len() != 0 || len(store.builds) != 0 {
+		t.Errorf("expected a cancelled build not to be buffered, got %d buffered and %d builds", buf.Len(), len(store.builds))
+	}
+	if len(dl.builds) != 1 || status[BrigadeTarget] != context.Canceled.Error() {
+		t.Errorf("expected the cancelled build in the dead letters, got %d and status %v", len(dl.builds), status)
+	}
+}
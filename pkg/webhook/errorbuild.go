@@ -0,0 +1,67 @@
+package webhook
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// actionError is the action of builds for deliveries whose build could not be
+// prepared, see GithubOpts.EmitErrors
+const actionError = "error"
+
+// ErrorPayload is the payload of "<event>:error" builds.
+type ErrorPayload struct {
+	Type string `json:"type"`
+	// Reason is why the build for the event could not be prepared, like a
+	// failure to negotiate a token or to fetch the pull request
+	Reason string      `json:"reason"`
+	Body   interface{} `json:"body"`
+}
+
+// emitError emits an "<eventType>:error" build carrying reason, if enabled by
+// GithubOpts.EmitErrors, so that a worker can tell the user what went wrong, like
+// by commenting on the pull request. The response has already been written, so
+// failures are only logged.
+func (s *githubHook) emitError(c *gin.Context, eventType string, body []byte, proj *brigade.Project, reason error) {
+	if !s.opts.EmitErrors || reason == errBuildSkipped {
+		return
+	}
+	et := eventType + ":" + actionError
+
+	delivery := c.Request.Header.Get(deliveryHeader)
+	key := delivery + "\x00" + et
+	guarded := s.deliveries != nil && delivery != ""
+	if guarded && !s.deliveries.Reserve(key) {
+		log.Printf("Skipping %q build that was already created for delivery %s", et, delivery)
+		return
+	}
+	// Only a created build keeps the reservation
+	created := false
+	defer func() {
+		if guarded && !created {
+			s.deliveries.Release(key)
+		}
+	}()
+
+	pl := ErrorPayload{Type: eventType, Reason: reason.Error()}
+	var err error
+	if pl.Body, err = decodeBody(body); err != nil {
+		log.Printf("Failed to parse body of %q build: %s", et, err)
+		return
+	}
+	payload, err := json.Marshal(pl)
+	if err != nil {
+		log.Printf("Failed to encode %q payload: %s", et, err)
+		return
+	}
+
+	status, err := s.build(c.Request.Context(), delivery, et, brigade.Revision{Ref: s.defaultRef()}, payload, proj)
+	if err != nil {
+		log.Printf("Failed to emit %q build: %s", et, err)
+		return
+	}
+	created = status != nil
+}
@@ -0,0 +1,76 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestGithubHandler_emitErrors(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-issue_comment_pull_request_author_allowed-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		emitErrors bool
+		err        error
+		code       int
+		expected   bool
+	}{
+		{name: "fetch failure", emitErrors: true, err: errors.New("pull request not found"), code: http.StatusInternalServerError, expected: true},
+		{name: "auth failure", emitErrors: true, err: ErrAuthFailed, code: http.StatusForbidden, expected: true},
+		{name: "disabled", err: errors.New("pull request not found"), code: http.StatusInternalServerError},
+		{name: "skipped", emitErrors: true, err: errBuildSkipped, code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EmitErrors = tt.emitErrors
+			s.handleIssueCommentEvent = func(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte, error) {
+				c.JSON(tt.code, gin.H{"status": tt.err.Error()})
+				return rev, body, tt.err
+			}
+
+			w := handleTestEvent(t, s, "issue_comment", payload)
+
+			if w.Code != tt.code {
+				t.Fatalf("expected the response of the failure, %d, got %d\n%s", tt.code, w.Code, w.Body.String())
+			}
+			if !tt.expected {
+				if len(store.builds) != 0 {
+					t.Errorf("expected no builds, got %s", store.builds[0].Type)
+				}
+				return
+			}
+			if len(store.builds) != 1 || store.builds[0].Type != "issue_comment:error" {
+				t.Fatalf("expected an issue_comment:error build, got %v", store.builds)
+			}
+			pl := struct {
+				ErrorPayload
+				Body struct {
+					Issue struct {
+						Number int `json:"number"`
+					} `json:"issue"`
+				} `json:"body"`
+			}{}
+			if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.Type != "issue_comment" || pl.Reason != tt.err.Error() {
+				t.Errorf("expected the reason %q for issue_comment, got %q for %q", tt.err, pl.Reason, pl.Type)
+			}
+			if pl.Body.Issue.Number != 2 {
+				t.Errorf("expected the body of the event in the payload, got issue %d", pl.Body.Issue.Number)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// Gateway identifies the brigade-cd gateway that emitted a build.
+//
+// It is stamped into every build payload so that a misbehaving deploy can be
+// correlated with a specific gateway rollout.
+type Gateway struct {
+	Version    string `json:"version"`
+	ConfigHash string `json:"configHash"`
+}
+
+// ConfigHash computes a short, stable hash of the given configuration.
+//
+// The configuration is hashed in its JSON form, so identical configurations
+// always produce identical hashes. Callers should leave secrets out of cfg.
+func ConfigHash(cfg interface{}) (string, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("%x", sum)[0:16], nil
+}
+
+// StampGateway adds the gateway information to the top level of a JSON object payload.
+//
+// An empty payload results in an object containing only the gateway information.
+func StampGateway(payload []byte, gw Gateway) ([]byte, error) {
+	return stamp(payload, "gateway", gw)
+}
+
+// stamp sets the top-level key of a JSON object payload to v.
+func stamp(payload []byte, key string, v interface{}) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return nil, fmt.Errorf("payload is not a JSON object: %v", err)
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields[key] = b
+	return json.Marshal(fields)
+}
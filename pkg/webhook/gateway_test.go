@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestConfigHash(t *testing.T) {
+	type cfg struct {
+		AppID         int
+		EmittedEvents []string
+	}
+
+	a, err := ConfigHash(cfg{AppID: 1, EmittedEvents: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ConfigHash(cfg{AppID: 1, EmittedEvents: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("expected identical configs to hash identically, got %q and %q", a, b)
+	}
+
+	c, err := ConfigHash(cfg{AppID: 2, EmittedEvents: []string{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == c {
+		t.Errorf("expected different configs to hash differently, both got %q", a)
+	}
+}
+
+func TestStampGateway(t *testing.T) {
+	gw := Gateway{Version: "v1.2.3", ConfigHash: "0123456789abcdef"}
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "empty", payload: nil},
+		{name: "object", payload: []byte(`{"type":"issue_comment","body":{"id":1}}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stamped, err := StampGateway(tt.payload, gw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pl := struct {
+				Type    string   `json:"type"`
+				Gateway *Gateway `json:"gateway"`
+			}{}
+			if err := json.Unmarshal(stamped, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.Gateway == nil || *pl.Gateway != gw {
+				t.Errorf("expected gateway %+v, got %+v", gw, pl.Gateway)
+			}
+			if len(tt.payload) > 0 && pl.Type != "issue_comment" {
+				t.Errorf("expected existing fields to be preserved, got type %q", pl.Type)
+			}
+
+			again, err := StampGateway(tt.payload, gw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(again) != string(stamped) {
+				t.Errorf("expected stable output, got\n\t%s\nand\n\t%s", stamped, again)
+			}
+		})
+	}
+
+	if _, err := StampGateway([]byte(`"not an object"`), gw); err == nil {
+		t.Error("expected an error stamping a non-object payload")
+	}
+}
+
+func TestGithubHandler_gatewayStamp(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.Gateway = Gateway{Version: "v1.2.3", ConfigHash: "0123456789abcdef"}
+
+	if _, err := s.build(context.Background(), "", "issue_comment", brigade.Revision{Ref: "refs/heads/master"}, nil, store.proj); err != nil {
+		t.Fatal(err)
+	}
+
+	pl := struct {
+		Gateway Gateway `json:"gateway"`
+	}{}
+	if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if pl.Gateway != s.opts.Gateway {
+		t.Errorf("expected gateway %+v, got %+v", s.opts.Gateway, pl.Gateway)
+	}
+}
@@ -1,14 +1,16 @@
 package webhook
 
 import (
-	"crypto/subtle"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/google/go-github/v27/github"
 	"gopkg.in/gin-gonic/gin.v1"
@@ -19,6 +21,8 @@ import (
 
 const hubSignatureHeader = "X-Hub-Signature"
 
+const deliveryHeader = "X-GitHub-Delivery"
+
 // ErrAuthFailed indicates some part of the auth handshake failed
 //
 // This is usually indicative of an auth failure between the client library and GitHub
@@ -28,36 +32,387 @@ type githubHook struct {
 	store                   storage.Store
 	getFile                 fileGetter
 	createStatus            statusCreator
+	getToken                tokenGetter
+	getPullRequest          pullRequestGetter
+	getReactions            reactionGetter
 	handleIssueCommentEvent iceUpdater
 	opts                    GithubOpts
 	allowedAuthors          []string
 	// key is the x509 certificate key as ASCII-armored (PEM) data
 	key []byte
+	// debouncer coalesces builds when a debounce window is configured
+	debouncer *debouncer
+	// deliveries guards against creating builds twice for redelivered events
+	deliveries *DeliveryGuard
+	// installations resolves the installation of events that carry none
+	installations *installationCache
+	repoInfo      *repoInfoCache
+	// rateLimits limits the builds per project, if GithubOpts.RateLimits is set
+	rateLimits *rateLimiter
+	// pullRequests caches the pull requests of issue comments by ETag, if enabled
+	pullRequests *pullRequestCache
+	// appSlug is the slug of the App, added to payloads with installation tokens
+	appSlug *AppSlug
+	// trustedProxies are the parsed GithubOpts.TrustedProxies
+	trustedProxies []*net.IPNet
 }
 
 // GithubOpts provides options for configuring a GitHub hook
+//
+// Fields that are secrets or not part of the configuration are excluded from
+// the JSON form, which is used to compute the config hash.
 type GithubOpts struct {
 	AppID               int
-	DefaultSharedSecret string
+	DefaultSharedSecret string `json:"-"`
 	EmittedEvents       []string
+	// Gateway is stamped into the payload of every emitted build
+	Gateway Gateway `json:"-"`
+	// Emitters are secondary targets that receive every build created in Brigade
+	Emitters []Emitter `json:"-"`
+	// DeadLetters persists builds that could not be created in Brigade, if set
+	DeadLetters DeadLetters `json:"-"`
+	// AuditLog records every created build, if set
+	AuditLog *AuditLog `json:"-"`
+	// Buffer holds builds that could not be created in Brigade until the store
+	// recovers, if set, answering their deliveries with 202
+	Buffer *BuildBuffer `json:"-"`
+	// Spool persists the builds held by the debouncer and the Buffer, if set, and
+	// those it holds from before a restart are replayed
+	Spool *Spool `json:"-"`
+	// RequireMergeable skips builds for pull requests GitHub reports as unmergeable
+	RequireMergeable bool
+	// DebounceWindow is the quiet period after which only the latest of several builds
+	// for the same project, ref and event type is emitted. Zero disables debouncing.
+	DebounceWindow time.Duration
+	// RejectUnsigned rejects deliveries for repos without a secret with 403
+	RejectUnsigned bool
+	// AllowUnsigned accepts deliveries for repos without a secret, without
+	// validating the signature
+	AllowUnsigned bool
+	// EventProjects routes builds for an event type, e.g. "release" or "release:published",
+	// to the named Brigade project instead of the one derived from the repo
+	EventProjects map[string]string
+	// PayloadPretty logs the indented payload of every build, with the token redacted
+	PayloadPretty bool
+	// CheckRunAppID passes the ID of the app that created a re-requested check run
+	// through to the payload, so that workers can ignore the check runs of other apps
+	CheckRunAppID bool
+	// EmitOnDraftPR builds draft pull requests, which are skipped by default
+	EmitOnDraftPR bool
+	// IgnoredStatus is the HTTP status of responses to valid deliveries that are
+	// deliberately not built, like 202 or 204. Zero means 200.
+	IgnoredStatus int
+	// BodyFields maps event types, with or without the action, to the dot-separated
+	// paths of the only body fields to keep in their payloads, like `comment.id`.
+	// The full body is kept for event types without an allowlist.
+	BodyFields map[string][]string
+	// EmitPing emits a "ping" build for pings of repo hooks, to test the wiring
+	// end to end. The event type must be emitted as well.
+	EmitPing bool
+	// ServiceAccounts maps Brigade project names to the Kubernetes service account
+	// their workers run as, which is passed to the worker in the payload
+	ServiceAccounts map[string]string
+	// RateLimits maps Brigade project names to the number of builds created for
+	// them per minute, in bursts of up to as many builds. Deliveries with builds
+	// beyond the limit are answered with 429. Other projects aren't limited.
+	RateLimits map[string]int
+	// SignatureAlgorithms maps Brigade project names to the signature algorithms,
+	// SignatureSHA1 and SignatureSHA256, their deliveries must be signed with.
+	// Projects without an entry are validated with SHA-256, or SHA-1 for
+	// deliveries without a SHA-256 signature.
+	SignatureAlgorithms map[string][]string
+	// RefTemplate renders the Ref of the revision of every build. Nil leaves refs
+	// in the "refs/heads/master" form.
+	RefTemplate *RefTemplate
+	// CompressionThreshold is the size in bytes above which build payloads are
+	// gzipped, see CompressPayload. Zero disables compression.
+	CompressionThreshold int
+	// Provider is the Provider of emitted builds, "github" if empty
+	Provider string
+	// EnterpriseSuffix appends "-enterprise" to the Provider of builds for
+	// projects on a GitHub Enterprise host, i.e. with a Github.BaseURL
+	EnterpriseSuffix bool
+	// RepoInfo adds the topics and description of the repo to payloads, at the
+	// cost of an API call per repo every few minutes
+	RepoInfo bool
+	// PullRequestCacheSize is the number of pull requests fetched for issue
+	// comments that are cached along with their ETag, so that refetching an
+	// unchanged pull request doesn't count against the rate limit. Zero disables
+	// the cache.
+	PullRequestCacheSize int
+	// MaxProcessBodyBytes is the size in bytes above which deliveries are
+	// rejected with 413, without being processed. Zero accepts any size.
+	MaxProcessBodyBytes int
+	// MaxRetainBodyBytes is the size in bytes of the JSON form of the body above
+	// which the body is truncated in build payloads and their logs, see
+	// truncateBody. Zero retains bodies of any size.
+	MaxRetainBodyBytes int
+	// DeliveryCacheSize is the number of X-GitHub-Delivery IDs, and of the
+	// builds created for them, that are remembered to skip redeliveries, evicting
+	// the least recently used. Zero uses DefaultDeliveryCacheSize.
+	DeliveryCacheSize int
+	// BuildTypes renames the types of builds, like issue_comment:created to
+	// deploy_comment, for workers that expect legacy event names. Everything
+	// else, like EmittedEvents, matches the original event type.
+	BuildTypes map[string]string
+	// CoalesceActions emits a single build for an event with an action, instead
+	// of one for the event type and another for the type qualified by the
+	// action, see coalesce.
+	CoalesceActions bool
+	// VerifyPullRequestHead fetches pull requests again right before emitting
+	// builds for comments on them, and skips the build if the head moved since,
+	// narrowing the window for pushing other code after a comment approved a build
+	VerifyPullRequestHead bool
+	// PullStats adds the diff stats of pull requests to the payloads of builds
+	// for comments on them
+	PullStats bool
+	// DefaultInstallationID is the installation of events that carry none and
+	// whose repo no installation is found for, like for an App with a single
+	// installation. Zero disables the fallback.
+	DefaultInstallationID int64
+	// StrictRepos rejects deliveries for projects whose Repo.Name is not in the
+	// form HOST/OWNER/NAME with 500, before any GitHub API call for the repo
+	StrictRepos bool
+	// WorkflowRunConclusions are the conclusions of completed workflow runs that
+	// emit builds, DefaultWorkflowRunConclusions if empty
+	WorkflowRunConclusions []string
+	// ApprovalReaction is the content of a reaction, like "+1", with which an
+	// allowed author approves a comment of the App on a pull request, see
+	// handleIssueComment. Empty disables approvals by reaction.
+	ApprovalReaction string
+	// EmitErrors emits an "<event>:error" build with the reason when the build
+	// for an event can't be prepared, like when negotiating a token or fetching
+	// the pull request of a comment fails. The delivery still fails.
+	EmitErrors bool
+	// CaseInsensitiveRepos matches the repos of deliveries that no project is
+	// found for by the exact name to projects case-insensitively, ignoring the
+	// host, see findProject. Such deliveries list every project.
+	CaseInsensitiveRepos bool
+	// RequireTLS rejects deliveries that didn't arrive over TLS with 400. Those
+	// from TrustedProxies may say so with X-Forwarded-Proto: https instead.
+	RequireTLS bool
+	// TrustedProxies are the CIDRs or IPs of the proxies, like the ingress
+	// controller, whose X-Forwarded-Proto header is trusted, see ParseTrustedProxies
+	TrustedProxies []string
+	// DefaultBranch is the branch of the ref of builds for events that aren't
+	// about a ref, or whose ref isn't resolved, DefaultBranch if empty
+	DefaultBranch string
+	// InstallationTargetTypes are the installation target types of the hooks
+	// whose deliveries are processed, like "repository", as sent in the
+	// X-GitHub-Hook-Installation-Target-Type header. Empty processes all.
+	InstallationTargetTypes []string
 }
 
-type fileGetter func(commit, path string, proj *brigade.Project) ([]byte, error)
+// DefaultProvider is the Provider of builds emitted for webhook events
+const DefaultProvider = "github"
+
+// DefaultBranch is the fallback branch of the ref of builds, for compatibility
+// with repos created before GitHub defaulted to "main"
+const DefaultBranch = "master"
+
+// Validate checks that the options are consistent.
+func (o GithubOpts) Validate() error {
+	if o.RejectUnsigned && o.AllowUnsigned {
+		return errors.New("rejecting and allowing unsigned deliveries are mutually exclusive")
+	}
+	for et, p := range o.EventProjects {
+		if et == "" || p == "" {
+			return fmt.Errorf("invalid route from event type %q to project %q", et, p)
+		}
+	}
+	if o.IgnoredStatus != 0 && (o.IgnoredStatus < 200 || o.IgnoredStatus > 299) {
+		return fmt.Errorf("status %d for ignored deliveries is not a 2xx status", o.IgnoredStatus)
+	}
+	for p, sa := range o.ServiceAccounts {
+		if err := ValidateServiceAccount(sa); err != nil {
+			return fmt.Errorf("project %q: %v", p, err)
+		}
+	}
+	for p, algs := range o.SignatureAlgorithms {
+		if err := ValidateSignatureAlgorithms(algs); err != nil {
+			return fmt.Errorf("project %q: %v", p, err)
+		}
+	}
+	if err := ValidateRateLimits(o.RateLimits); err != nil {
+		return err
+	}
+	for et, bt := range o.BuildTypes {
+		if et == "" || bt == "" {
+			return fmt.Errorf("invalid rename of event type %q to build type %q", et, bt)
+		}
+	}
+	if err := ValidateWorkflowRunConclusions(o.WorkflowRunConclusions); err != nil {
+		return err
+	}
+	if err := ValidateApprovalReaction(o.ApprovalReaction); err != nil {
+		return err
+	}
+	if strings.HasPrefix(o.DefaultBranch, "refs/") || strings.ContainsAny(o.DefaultBranch, " \t\n") {
+		return fmt.Errorf("default branch %q must be a branch name, like main", o.DefaultBranch)
+	}
+	for _, t := range o.InstallationTargetTypes {
+		if strings.TrimSpace(t) == "" {
+			return errors.New("installation target types must not be empty")
+		}
+	}
+	if _, err := ParseTrustedProxies(o.TrustedProxies); err != nil {
+		return err
+	}
+	if o.PullRequestCacheSize < 0 {
+		return fmt.Errorf("pull request cache size %d must not be negative", o.PullRequestCacheSize)
+	}
+	if o.DeliveryCacheSize < 0 {
+		return fmt.Errorf("delivery cache size %d must not be negative", o.DeliveryCacheSize)
+	}
+	if o.MaxProcessBodyBytes < 0 {
+		return fmt.Errorf("maximum body size to process %d must not be negative", o.MaxProcessBodyBytes)
+	}
+	if o.MaxRetainBodyBytes < 0 {
+		return fmt.Errorf("maximum body size to retain %d must not be negative", o.MaxRetainBodyBytes)
+	}
+	if o.DefaultInstallationID < 0 {
+		return fmt.Errorf("default installation ID %d is not a valid installation ID", o.DefaultInstallationID)
+	}
+	if features := o.AppFeatures(); o.AppID == 0 && len(features) > 0 {
+		return fmt.Errorf("APP_ID must be set for %s, which authenticate as the GitHub App", strings.Join(features, ", "))
+	}
+	return nil
+}
+
+// appEvents are the event types whose builds carry an installation token
+var appEvents = []string{"issue_comment", "pull_request", "check_run"}
+
+// AppFeatures returns the configured features that authenticate as the GitHub
+// App, and thus need the AppID. Without any, the gateway can run without an App.
+//
+// Events count only when EmittedEvents names them, so that the default `*`
+// doesn't require an App. See WildcardAppEvents for the ones matched otherwise.
+func (o GithubOpts) AppFeatures() []string {
+	var features []string
+	for _, event := range appEvents {
+		if namesEvent(o.EmittedEvents, event) {
+			features = append(features, fmt.Sprintf("%q events", event))
+		}
+	}
+	if o.RequireMergeable {
+		features = append(features, "-require-mergeable")
+	}
+	if o.RepoInfo {
+		features = append(features, "-repo-info")
+	}
+	if o.DefaultInstallationID != 0 {
+		features = append(features, "-default-installation-id")
+	}
+	if o.ApprovalReaction != "" {
+		features = append(features, "-approval-reaction")
+	}
+	return features
+}
+
+// WildcardAppEvents returns the events that authenticate as the GitHub App and
+// are emitted as EmittedEvents matches them with `*` or a glob, without naming
+// them. They don't need the AppID to start, but their builds fail without it.
+func (o GithubOpts) WildcardAppEvents() []string {
+	var events []string
+	for _, event := range appEvents {
+		if excluded(o.EmittedEvents, event) || namesEvent(o.EmittedEvents, event) {
+			continue
+		}
+		for _, e := range o.EmittedEvents {
+			if !strings.HasPrefix(e, "!") && matchesEvent(e, event) {
+				events = append(events, event)
+				break
+			}
+		}
+	}
+	return events
+}
+
+// namesEvent tells whether patterns name event, with or without actions, rather
+// than match it with a glob, and don't exclude it.
+func namesEvent(patterns []string, event string) bool {
+	if excluded(patterns, event) {
+		return false
+	}
+	for _, p := range patterns {
+		name := strings.SplitN(p, ":", 2)[0]
+		if !strings.Contains(name, "*") && strings.EqualFold(name, event) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveryCacheSize is the size of the DeliveryGuard of the handler
+func (o GithubOpts) deliveryCacheSize() int {
+	if o.DeliveryCacheSize == 0 {
+		return DefaultDeliveryCacheSize
+	}
+	return o.DeliveryCacheSize
+}
+
+type fileGetter func(c context.Context, commit, path string, proj *brigade.Project) ([]byte, error)
 
 type statusCreator func(commit string, proj *brigade.Project, status *github.RepoStatus) error
 
-type iceUpdater func(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte)
+type tokenGetter func(appID, installationID int, cfg brigade.Github) (string, time.Time, error)
+
+type pullRequestGetter func(c *gin.Context, s *githubHook, token, repo string, number int, proj *brigade.Project) (*github.PullRequest, error)
+
+// iceUpdater enriches the revision and payload for an issue comment on a pull request.
+//
+// A non-nil error means the response has already been written and no build must be emitted.
+type iceUpdater func(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte, error)
+
+// errBuildSkipped is returned when a delivery is deliberately not turned into a build
+var errBuildSkipped = errors.New("build skipped")
 
 // NewGithubHookHandler creates a GitHub webhook handler.
 func NewGithubHookHandler(s storage.Store, authors []string, x509Key []byte, opts GithubOpts) gin.HandlerFunc {
 	gh := &githubHook{
 		store:                   s,
-		getFile:                 getFileFromGithub,
-		createStatus:            setRepoStatus,
 		handleIssueCommentEvent: handleIssueCommentEvent,
+		getPullRequest:          getPullRequestFromGithub,
 		allowedAuthors:          authors,
 		key:                     x509Key,
 		opts:                    opts,
+		deliveries:              NewBoundedDeliveryGuard(DefaultDeliveryTTL, opts.deliveryCacheSize()),
+	}
+	gh.getToken = gh.installationToken
+	gh.getFile = gh.fileFromGithub
+	gh.getReactions = gh.commentReactions
+	gh.createStatus = gh.setRepoStatus
+	gh.installations = newInstallationCache(installationsTTL, gh.listInstallationRepos)
+	gh.repoInfo = newRepoInfoCache(repoInfoTTL)
+	if len(opts.RateLimits) > 0 {
+		gh.rateLimits = newRateLimiter(opts.RateLimits)
+	}
+	if opts.PullRequestCacheSize > 0 {
+		gh.pullRequests = newPullRequestCache(opts.PullRequestCacheSize)
+	}
+	if opts.AppID != 0 {
+		gh.appSlug = NewAppSlug(opts.AppID, x509Key)
+	}
+	if proxies, err := ParseTrustedProxies(opts.TrustedProxies); err != nil {
+		log.Printf("WARNING: ignoring invalid trusted proxies: %s", err)
+	} else {
+		gh.trustedProxies = proxies
+	}
+	if opts.DebounceWindow > 0 {
+		gh.debouncer = newDebouncer(opts.DebounceWindow, func(b *brigade.Build) {
+			// The build may stand for several deliveries, so none is audited
+			emitToTargets(storeEmitter{context.Background(), gh.store}, gh.opts.DeadLetters, gh.opts.Buffer, gh.opts.Emitters, b, func() { gh.audit("", "", b) })
+		})
+		gh.debouncer.spool = opts.Spool
+		if err := gh.debouncer.replay(); err != nil {
+			log.Printf("WARNING: failed to replay pending builds: %s", err)
+		}
+	}
+	if opts.Spool != nil && opts.Buffer != nil {
+		// The deliveries of replayed builds are not known, so none is audited
+		if err := opts.Buffer.replay(opts.Spool, func(b *brigade.Build) { gh.audit("", "", b) }); err != nil {
+			log.Printf("WARNING: failed to replay buffered builds: %s", err)
+		}
 	}
 
 	return gh.Handle
@@ -67,36 +422,186 @@ func NewGithubHookHandler(s storage.Store, authors []string, x509Key []byte, opt
 //
 // It does this by sniffing the event from the header, and routing accordingly.
 func (s *githubHook) Handle(c *gin.Context) {
+	if !s.checkTLS(c) || !readRoute(c) || !s.checkInstallationTarget(c) {
+		return
+	}
 	event := c.Request.Header.Get("X-GitHub-Event")
 	switch event {
 	case "ping":
 		log.Print("Received ping from GitHub")
+		if s.opts.EmitPing && s.shouldEmit(event) {
+			s.handlePing(c, event)
+			return
+		}
 		c.JSON(200, gin.H{"message": "OK"})
 		return
 	case "issue_comment":
 		s.handleIssueComment(c, event)
+	case "push":
+		s.handlePush(c, event)
+	case "pull_request":
+		s.handlePullRequest(c, event)
+	case "milestone", "project_card":
+		s.handleActivity(c, event)
+	case "check_run":
+		s.handleCheckRun(c, event)
+	case "package", "registry_package":
+		s.handlePackage(c, event)
+	case "workflow_run":
+		s.handleWorkflowRun(c, event)
+	case "installation", "installation_repositories":
+		s.handleInstallation(c, event)
 	default:
 		// Issue #127: Don't return an error for unimplemented events.
 		log.Printf("Unsupported event %q", event)
-		c.JSON(200, gin.H{"message": "Ignored"})
+		s.ignore(c, gin.H{"message": "Ignored"})
 		return
 	}
 }
 
-// handleIssueComment handles an "issue_comment" event type
-func (s *githubHook) handleIssueComment(c *gin.Context, eventType string) {
-	body, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
+// ignore responds to a valid delivery that is deliberately not built.
+//
+// The response has no body if the configured status doesn't allow one.
+func (s *githubHook) ignore(c *gin.Context, res gin.H) {
+	code := s.opts.IgnoredStatus
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if code == http.StatusNoContent {
+		c.Status(code)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.JSON(code, res)
+}
+
+// readEvent reads the body of the delivery exactly once and parses it as eventType,
+// the event type of the header.
+//
+// It writes the error response and returns false when the body is malformed.
+func (s *githubHook) readEvent(c *gin.Context, eventType string) ([]byte, interface{}, bool) {
+	body, err := readBody(c.Request.Body, s.opts.MaxProcessBodyBytes)
+	if err == errBodyTooLarge {
+		log.Printf("Rejecting %q delivery with a body larger than %d bytes", eventType, s.opts.MaxProcessBodyBytes)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"status": fmt.Sprintf("body larger than %d bytes", s.opts.MaxProcessBodyBytes)})
+		return nil, nil, false
+	} else if err != nil {
 		log.Printf("Failed to read body: %s", err)
 		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
-		return
+		return nil, nil, false
 	}
 	defer c.Request.Body.Close()
 
-	e, err := github.ParseWebHook(eventType, body)
-	if err != nil {
+	e, err := parseWebHook(eventType, body)
+	if mismatch, ok := err.(*EventMismatchError); ok {
+		log.Printf("Failed to parse body: %s", mismatch)
+		c.JSON(http.StatusBadRequest, gin.H{"status": mismatch.Error()})
+		return nil, nil, false
+	} else if err != nil {
 		log.Printf("Failed to parse body: %s", err)
 		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		return nil, nil, false
+	}
+	return body, e, true
+}
+
+// rejectUnexpected responds to an event that parsed as a type the handler of
+// eventType doesn't support.
+func (s *githubHook) rejectUnexpected(c *gin.Context, eventType string, e interface{}) {
+	err := unexpectedEvent(eventType, e)
+	log.Printf("Failed to parse payload: %s", err)
+	c.JSON(http.StatusBadRequest, gin.H{"status": err.Error()})
+}
+
+// getProject looks up the Brigade project for repo.
+//
+// It writes the error response and returns false when there is none.
+func (s *githubHook) getProject(c *gin.Context, repo string) (*brigade.Project, bool) {
+	proj, err := s.store.GetProject(repo)
+	if err != nil && s.opts.CaseInsensitiveRepos {
+		if found, ferr := findProject(s.store, repo); ferr != nil {
+			log.Printf("WARNING: failed to match repo %q to a project case-insensitively: %s", repo, ferr)
+		} else if found != nil {
+			log.Printf("Matched repo %q to project %q case-insensitively", repo, found.Name)
+			proj, err = found, nil
+		}
+	}
+	if err != nil {
+		log.Printf("Project %q not found. No secret loaded. %s", repo, err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "project not found"})
+		return nil, false
+	}
+	if s.opts.StrictRepos {
+		if err := ValidateRepoName(proj.Repo.Name); err != nil {
+			log.Printf("Project %q is misconfigured: %s", proj.Name, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"status": fmt.Sprintf("project %q is misconfigured: %s", proj.Name, err)})
+			return nil, false
+		}
+	}
+	return proj, true
+}
+
+// pingRepo is the part of a "ping" event that go-github doesn't decode
+type pingRepo struct {
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// handlePing emits a no-op "ping" build, so that the wiring from GitHub through
+// Brigade to the worker can be tested by redelivering the ping.
+//
+// Pings for App or organization hooks are not about a repo, and are only acknowledged.
+func (s *githubHook) handlePing(c *gin.Context, eventType string) {
+	body, _, ok := s.readEvent(c, eventType)
+	if !ok {
+		return
+	}
+
+	pr := pingRepo{}
+	if err := json.Unmarshal(body, &pr); err != nil || pr.Repository.FullName == "" {
+		log.Print("Not emitting a ping build as the ping is not for a repo")
+		c.JSON(200, gin.H{"message": "OK"})
+		return
+	}
+	repo := pr.Repository.FullName
+
+	proj, ok := s.getProject(c, repo)
+	if !ok {
+		return
+	}
+
+	if !s.validate(c, repo, proj, body) {
+		return
+	}
+
+	res := &Payload{Type: eventType}
+	var err error
+	if res.Body, err = decodeBody(body); err != nil {
+		log.Printf("Failed to re-parse body: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Our parser is probably broken"})
+		return
+	}
+	payload, err := json.Marshal(res)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "JSON encoding error"})
+		return
+	}
+
+	s.emit(c, eventType, "", brigade.Revision{Ref: s.defaultRef()}, payload, proj)
+}
+
+// handleIssueComment handles an "issue_comment" event type
+//
+// With GithubOpts.ApprovalReaction, a comment of the App on a pull request that
+// an allowed author reacted to with the reaction emits builds with the action
+// "approved" instead of its own, for the head of the pull request. GitHub sends
+// no events for reactions, so they are checked when the comment is delivered,
+// like when it is edited or the delivery is redelivered.
+func (s *githubHook) handleIssueComment(c *gin.Context, eventType string) {
+	body, e, ok := s.readEvent(c, eventType)
+	if !ok {
 		return
 	}
 
@@ -112,61 +617,196 @@ func (s *githubHook) handleIssueComment(c *gin.Context, eventType string) {
 		action = e.GetAction()
 		repo = e.Repo.GetFullName()
 	default:
-		log.Printf("Failed to parse payload")
-		c.JSON(http.StatusBadRequest, gin.H{"status": "Received data is not supported or not valid JSON"})
+		s.rejectUnexpected(c, eventType, e)
 		return
 	}
 
-	proj, err := s.store.GetProject(repo)
-	if err != nil {
-		log.Printf("Project %q not found. No secret loaded. %s", repo, err)
-		c.JSON(http.StatusBadRequest, gin.H{"status": "project not found"})
+	proj, ok := s.getProject(c, repo)
+	if !ok {
 		return
 	}
 
-	var sharedSecret = proj.SharedSecret
-	if sharedSecret == "" {
-		sharedSecret = s.opts.DefaultSharedSecret
-	}
-	if sharedSecret == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"status": "No secret is configured for this repo."})
-		return
-	}
-
-	signature := c.Request.Header.Get(hubSignatureHeader)
-	if err := validateSignature(signature, sharedSecret, body); err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"status": "malformed signature"})
+	if !s.validate(c, repo, proj, body) {
 		return
 	}
 
+	var err error
 	if ice != nil && (action == "created" || action == "edited") {
 		// If there are Pull Request links, this issue matches a Pull Request,
 		// so we should fetch and set corresponding revision values
 		prLinks := ice.Issue.GetPullRequestLinks()
 		if prLinks != nil {
+			approved := false
+			if s.opts.ApprovalReaction != "" && s.isAppComment(c.Request.Context(), ice) {
+				if approved, err = s.approvedByReaction(c, ice, proj); err != nil {
+					s.emitError(c, eventType, body, proj, err)
+					return
+				}
+			}
 			// If author association of issue comment is not in allowed list, we return,
 			// as we don't wish to populate event with actionable data (for requesting check runs, etc.)
-			if assoc := ice.Comment.GetAuthorAssociation(); !s.isAllowedAuthor(assoc) {
+			if assoc := ice.Comment.GetAuthorAssociation(); !approved && !s.isAllowedAuthor(assoc) {
 				log.Printf("not fetching corresponding pull request as issue comment is from disallowed author %s", assoc)
 			} else {
-				rev, payload = s.handleIssueCommentEvent(c, s, ice, rev, proj, body)
+				rev, payload, err = s.handleIssueCommentEvent(c, s, ice, rev, proj, body)
+				if err != nil {
+					s.emitError(c, eventType, body, proj, err)
+					return
+				}
+				if approved {
+					action = actionApproved
+				}
 			}
 		}
 	}
 
-	// If rev ref still unset, set to master so builds can instantiate
+	// If rev ref still unset, set to the default branch so builds can instantiate
 	if rev.Ref == "" {
-		rev.Ref = "refs/heads/master"
+		rev.Ref = s.defaultRef()
 	}
 
-	// Schedule a build using the raw eventType
-	s.build(eventType, rev, payload, proj)
-	// For events that have an action, schedule a second build for eventType:action
+	s.emit(c, eventType, action, rev, payload, proj)
+}
+
+// emit schedules a build using the raw eventType and, for events that have an action,
+// a second build for eventType:action. It then writes the response.
+//
+// Builds already created for the same X-GitHub-Delivery are skipped, so that
+// redelivering a partially failed delivery only retries the failed builds.
+// Deliveries whose builds were all created, or are being created by a
+// concurrent delivery with the same ID, are answered with 200 and a duplicate
+// status when they are redelivered, without building anything.
+//
+// The response is 200 only when every Brigade build was created, regardless of
+// the outcome for secondary emitters. Per-target statuses are included either way.
+func (s *githubHook) emit(c *gin.Context, eventType, action string, rev brigade.Revision, payload []byte, proj *brigade.Project) {
+	eventTypes := []string{eventType}
 	if action != "" {
-		s.build(fmt.Sprintf("%s:%s", eventType, action), rev, payload, proj)
+		eventTypes = append(eventTypes, fmt.Sprintf("%s:%s", eventType, action))
+	}
+
+	if s.opts.CoalesceActions {
+		eventTypes, payload = s.coalesce(eventTypes, payload)
+	}
+	payload = stampInstallationTarget(c, payload)
+
+	delivery := c.Request.Header.Get(deliveryHeader)
+	guarded := s.deliveries != nil && delivery != ""
+	if guarded && !s.deliveries.Reserve(delivery) {
+		log.Printf("Skipping delivery %s that was already processed", delivery)
+		c.JSON(http.StatusOK, gin.H{"status": statusDuplicate})
+		return
+	}
+	builds := map[string]TargetStatus{}
+	failed := false
+	debounced := false
+	buffered := false
+	throttled := false
+	for _, et := range eventTypes {
+		key := delivery + "\x00" + et
+		if guarded && !s.deliveries.Reserve(key) {
+			log.Printf("Skipping %q build that was already created for delivery %s", et, delivery)
+			builds[et] = TargetStatus{BrigadeTarget: statusDuplicate}
+			continue
+		}
+		status, err := s.build(c.Request.Context(), delivery, et, rev, payload, proj)
+		if guarded && (status == nil || err != nil) {
+			s.deliveries.Release(key)
+		}
+		if status != nil {
+			builds[et] = status
+			debounced = debounced || status[BrigadeTarget] == statusDebounced
+			buffered = buffered || status[BrigadeTarget] == statusBuffered
+		}
+		if err == errThrottled {
+			throttled = true
+		} else if err != nil {
+			failed = true
+		}
+	}
+
+	if guarded && (failed || throttled) {
+		s.deliveries.Release(delivery)
+	}
+	if failed {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed to create build", "builds": builds})
+		return
+	}
+	if throttled {
+		c.JSON(http.StatusTooManyRequests, gin.H{"status": "rate limit of the project exceeded", "builds": builds})
+		return
+	}
+	if debounced || buffered {
+		c.JSON(http.StatusAccepted, gin.H{"status": "Accepted", "builds": builds})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "Complete", "builds": builds})
+}
+
+// coalesce turns the builds for the event types of a delivery into one, to
+// reduce churn in workers. The rules are:
+//
+//   - Only the builds for the same delivery coalesce, which share the project,
+//     revision and payload. Use GithubOpts.DebounceWindow across deliveries.
+//   - They coalesce only if more than one of the event types is emitted.
+//   - The coalesced build has the type of the first emitted event type, the one
+//     without an action, and its routes and body fields apply.
+//   - The "actions" field of its payload lists every emitted event type.
+func (s *githubHook) coalesce(eventTypes []string, payload []byte) ([]string, []byte) {
+	var actions []string
+	for _, et := range eventTypes {
+		if s.shouldEmit(et) {
+			actions = append(actions, et)
+		}
+	}
+	if len(actions) < 2 {
+		return eventTypes, payload
+	}
+	stamped, err := stamp(payload, "actions", actions)
+	if err != nil {
+		log.Printf("Failed to stamp actions into %q payload, not coalescing: %s", actions[0], err)
+		return eventTypes, payload
+	}
+	return actions[:1], stamped
+}
+
+// validate checks the signature of the delivery against the project's shared secret,
+// or the default one if the project has none.
+//
+// It writes the error response and returns false when the delivery must not be processed.
+func (s *githubHook) validate(c *gin.Context, repo string, proj *brigade.Project, body []byte) bool {
+	var sharedSecret = proj.SharedSecret
+	if sharedSecret == "" {
+		sharedSecret = s.opts.DefaultSharedSecret
+	}
+	if sharedSecret == "" {
+		switch {
+		case s.opts.RejectUnsigned:
+			log.Printf("Rejecting delivery for %q as no secret is configured for it", repo)
+			c.JSON(http.StatusForbidden, gin.H{"status": "No secret is configured for this repo."})
+			return false
+		case s.opts.AllowUnsigned:
+			log.Printf("WARNING: accepting unsigned delivery for %q as no secret is configured for it", repo)
+			return true
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "No secret is configured for this repo."})
+		return false
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "Complete"})
+	if err := s.checkSignature(c.Request.Header, proj.Name, sharedSecret, body); err != nil {
+		if proj.SharedSecret != "" {
+			// The repo has its own secret, so the sender most likely is GitHub
+			// and the secret has been rotated on only one side.
+			log.Printf("WARNING: signature mismatch for %q, which has a project secret configured. The secret may be misconfigured or have been rotated: %s", repo, err)
+			signatureFailuresTotal.WithLabelValues(signatureFailureMisconfigured).Inc()
+		} else {
+			log.Printf("Signature mismatch for %q, which has no project secret configured. The delivery may not be from GitHub: %s", repo, err)
+			signatureFailuresTotal.WithLabelValues(signatureFailureUnknownSender).Inc()
+		}
+		c.JSON(http.StatusForbidden, gin.H{"status": "malformed signature"})
+		return false
+	}
+	return true
 }
 
 // handleIssueCommentEvent runs further processing with a given github.IssueCommentEvent,
@@ -176,28 +816,54 @@ func (s *githubHook) handleIssueComment(c *gin.Context, eventType string) {
 // This extra context empowers consumers of the resulting Brigade event with the ability
 // to (re-)trigger actions on the Pull Request itself, such as (re-)running Check Runs,
 // Check Suites or otherwise running jobs that consume/use the PR commit/branch data.
-func handleIssueCommentEvent(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte) {
-	appID := s.opts.AppID
-	instID := ice.Installation.GetID()
+func handleIssueCommentEvent(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte, error) {
+	return s.pullRequestBuild(c, "issue_comment", ice.Installation, ice.Repo, ice.Issue.GetNumber(), nil, rev, proj, body)
+}
+
+// pullRequestBuild prepares the revision and payload of a build for the head of
+// the pull request number of repo, negotiating an installation token for the
+// payload. The pull request is fetched with the token if nil, like for issue
+// comments, whose events don't carry it.
+//
+// It applies what GithubOpts configures for every build of a pull request:
+// drafts and, with RequireMergeable, unmergeable pull requests are skipped, and
+// PullStats, RepoInfo and VerifyPullRequestHead apply.
+//
+// A non-nil error means the response has already been written and no build must be emitted.
+func (s *githubHook) pullRequestBuild(c *gin.Context, eventType string, inst *github.Installation, repo *github.Repository, number int, pullRequest *github.PullRequest, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte, error) {
+	appID := s.appID(c)
+	instID := s.routeInstallationID(c, inst, repo.GetFullName())
 
 	if appID == 0 || instID == 0 {
 		log.Printf("App ID and Installation ID must both be set. App: %d, Installation: %d", appID, instID)
 		c.JSON(http.StatusForbidden, gin.H{"status": ErrAuthFailed})
-		return rev, body
+		return rev, body, ErrAuthFailed
 	}
 
-	tok, timeout, err := s.installationToken(int(appID), int(instID), proj.Github)
+	tok, timeout, err := s.getToken(int(appID), int(instID), proj.Github)
 	if err != nil {
 		log.Printf("Failed to negotiate a token: %s", err)
 		c.JSON(http.StatusForbidden, gin.H{"status": ErrAuthFailed})
-		return rev, body
+		return rev, body, ErrAuthFailed
 	}
 
-	pullRequest, err := getPRFromIssueComment(c, s, tok, ice, proj)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError,
-			gin.H{"status": "failed to fetch pull request for corresponding issue comment"})
-		return rev, body
+	if pullRequest == nil {
+		pullRequest, err = s.getPullRequest(c, s, tok, repo.GetFullName(), number, proj)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError,
+				gin.H{"status": "failed to fetch pull request for corresponding issue comment"})
+			return rev, body, err
+		}
+	}
+
+	if err := s.checkDraft(c, pullRequest); err != nil {
+		return rev, body, err
+	}
+
+	if s.opts.RequireMergeable {
+		if err := s.checkMergeable(c, tok, repo, pullRequest, proj); err != nil {
+			return rev, body, err
+		}
 	}
 
 	// Populate the brigade.Revision, as per usual
@@ -211,39 +877,138 @@ func handleIssueCommentEvent(c *gin.Context, s *githubHook, ice *github.IssueCom
 	// The check run utility that requests check runs requires these values
 	// and does not have access to he brigade.Revision object above.
 	res := &Payload{
-		Body:         ice,
 		AppID:        appID,
 		InstID:       int(instID),
-		Type:         "issue_comment",
+		Type:         eventType,
 		Token:        tok,
 		TokenExpires: timeout,
 		Commit:       rev.Commit,
 		Branch:       rev.Ref,
+		PullHeadSHA:  pullRequest.Head.GetSHA(),
 	}
+	s.stampInstallation(c.Request.Context(), instID, res)
+	if s.opts.PullStats {
+		res.PullStats = &PullStats{
+			Additions:    pullRequest.GetAdditions(),
+			Deletions:    pullRequest.GetDeletions(),
+			ChangedFiles: pullRequest.GetChangedFiles(),
+		}
+	}
+	s.enrichRepo(c.Request.Context(), tok, repo.GetFullName(), proj, res)
 
 	// Remarshal the body back into JSON
-	pl := map[string]interface{}{}
-	err = json.Unmarshal(body, &pl)
-	res.Body = pl
+	res.Body, err = decodeBody(body)
 	if err != nil {
 		log.Printf("Failed to re-parse body: %s", err)
 		c.JSON(http.StatusBadRequest, gin.H{"status": "Our parser is probably broken"})
-		return rev, body
+		return rev, body, err
 	}
 
 	payload, err := json.Marshal(res)
 	if err != nil {
 		log.Print(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"status": "JSON encoding error"})
-		return rev, body
+		return rev, body, err
+	}
+
+	if s.opts.VerifyPullRequestHead {
+		if err := s.verifyHead(c, tok, repo.GetFullName(), proj, pullRequest); err != nil {
+			return rev, body, err
+		}
+	}
+	return rev, payload, nil
+}
+
+// stampInstallation adds the installation and the slug of the App to the payload
+// of a build with an installation token. Failing to fetch the slug is logged
+// rather than failing the build, as most workers don't need it. The slug of an
+// App of the /github/:app/:inst route other than GithubOpts.AppID isn't known.
+func (s *githubHook) stampInstallation(c context.Context, instID int64, res *Payload) {
+	res.InstallationID = instID
+	if res.AppID != s.opts.AppID {
+		return
+	}
+	slug, err := s.appSlug.Get(c)
+	if err != nil {
+		log.Printf("WARNING: failed to get the slug of App %d: %s", s.opts.AppID, err)
+	}
+	res.AppSlug = slug
+}
+
+// verifyHead fetches the pull request again and skips the build if its head
+// moved away from the one of pr, which the build was prepared for.
+func (s *githubHook) verifyHead(c *gin.Context, token, repo string, proj *brigade.Project, pr *github.PullRequest) error {
+	current, err := s.getPullRequest(c, s, token, repo, pr.GetNumber(), proj)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed to verify the head of the pull request"})
+		return err
+	}
+	if sha := current.Head.GetSHA(); sha != pr.Head.GetSHA() {
+		log.Printf("WARNING: skipping build for pull request %d as its head moved from %s to %s since the build was prepared", pr.GetNumber(), pr.Head.GetSHA(), sha)
+		s.ignore(c, gin.H{"status": "Ignored", "reason": "pull request head changed"})
+		return errBuildSkipped
+	}
+	return nil
+}
+
+// decodeBody decodes the raw body of a delivery to be embedded into a payload.
+//
+// Numbers are kept as json.Number, as float64 would lose the precision of large IDs.
+func decodeBody(body []byte) (map[string]interface{}, error) {
+	pl := map[string]interface{}{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	err := d.Decode(&pl)
+	return pl, err
+}
+
+// checkDraft skips the build of a draft pull request unless drafts are to be built.
+func (s *githubHook) checkDraft(c *gin.Context, pullRequest *github.PullRequest) error {
+	if !pullRequest.GetDraft() || s.opts.EmitOnDraftPR {
+		return nil
 	}
-	return rev, payload
+	log.Printf("Skipping build for pull request %d as it is a draft", pullRequest.GetNumber())
+	s.ignore(c, gin.H{"status": "Ignored", "reason": "pull request is a draft"})
+	return errBuildSkipped
 }
 
-// getPRFromIssueComment fetches a pull request from a corresponding github.IssueCommentEvent
-func getPRFromIssueComment(c *gin.Context, s *githubHook, token string, ice *github.IssueCommentEvent, proj *brigade.Project) (*github.PullRequest, error) {
-	repo := ice.Repo.GetFullName()
+// checkMergeable resolves the mergeable state of the pull request, polling GitHub
+// if it is still being computed.
+//
+// It writes the response and returns errBuildSkipped when the pull request is known
+// to be unmergeable. An unknown state doesn't prevent the build.
+func (s *githubHook) checkMergeable(c *gin.Context, token string, repo *github.Repository, pullRequest *github.PullRequest, proj *brigade.Project) error {
+	ms := &MergeableState{Mergeable: pullRequest.Mergeable, State: pullRequest.GetMergeableState()}
+	if ms.Mergeable == nil {
+		client, err := InstallationTokenClient(token, proj.Github.BaseURL, proj.Github.UploadURL)
+		if err != nil {
+			log.Printf("Failed to create a new installation token client: %s", err)
+			c.JSON(http.StatusForbidden, gin.H{"status": ErrAuthFailed})
+			return ErrAuthFailed
+		}
+		ms, err = GetMergeableState(c.Request.Context(), client, repo.GetOwner().GetLogin(), repo.GetName(), pullRequest.GetNumber(), mergeablePollAttempts, mergeablePollInterval)
+		if err != nil {
+			log.Printf("Failed to get mergeable state of pull request %d: %s", pullRequest.GetNumber(), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "failed to fetch mergeable state of pull request"})
+			return err
+		}
+	}
+
+	if ms.Mergeable == nil {
+		log.Printf("Mergeable state of pull request %d is still unknown, building anyway", pullRequest.GetNumber())
+		return nil
+	}
+	if !*ms.Mergeable {
+		log.Printf("Skipping build for pull request %d as it is not mergeable (%s)", pullRequest.GetNumber(), ms.State)
+		s.ignore(c, gin.H{"status": "Ignored", "reason": "pull request is not mergeable"})
+		return errBuildSkipped
+	}
+	return nil
+}
 
+// getPullRequestFromGithub fetches the pull request number of repo, like the
+// one of an issue comment
+func getPullRequestFromGithub(c *gin.Context, s *githubHook, token, repo string, number int, proj *brigade.Project) (*github.PullRequest, error) {
 	client, err := InstallationTokenClient(token, proj.Github.BaseURL, proj.Github.UploadURL)
 	if err != nil {
 		log.Printf("Failed to create a new installation token client: %s", err)
@@ -257,7 +1022,16 @@ func getPRFromIssueComment(c *gin.Context, s *githubHook, token string, ice *git
 	}
 	owner, pname := projectNames[0], projectNames[1]
 
-	pullRequest, resp, err := client.PullRequests.Get(c, owner, pname, ice.Issue.GetNumber())
+	if s.pullRequests != nil {
+		pullRequest, err := s.pullRequests.fetch(c.Request.Context(), client, owner, pname, number)
+		if err != nil {
+			log.Printf("Failed to get pull request: %s", err)
+			return nil, err
+		}
+		return pullRequest, nil
+	}
+
+	pullRequest, resp, err := client.PullRequests.Get(c.Request.Context(), owner, pname, number)
 	if err != nil {
 		log.Printf("Failed to get pull request: %s", err)
 		return nil, err
@@ -280,47 +1054,195 @@ func (s *githubHook) isAllowedAuthor(author string) bool {
 }
 
 func (s *githubHook) shouldEmit(eventType string) bool {
-	eventAction := strings.Split(eventType, ":")
+	return emits(s.opts.EmittedEvents, eventType)
+}
 
-	var event, action string
-	event = eventAction[0]
-	if len(eventAction) > 1 {
-		action = eventAction[1]
+// emits tells whether the patterns of GithubOpts.EmittedEvents match
+// eventType. Patterns starting with ! are negations, which exclude the event
+// types they match even if other patterns match them, like `*,!push`.
+func emits(patterns []string, eventType string) bool {
+	matched := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if matchesEvent(p[1:], eventType) {
+				return false
+			}
+		} else if matchesEvent(p, eventType) {
+			matched = true
+		}
 	}
+	return matched
+}
 
-	for _, e := range s.opts.EmittedEvents {
-
-		if e == "*" || e == event || e == event+":"+action {
+// excluded tells whether a negation of patterns matches event, and thus the
+// event with every action, like `!issue_comment` or `!*`.
+func excluded(patterns []string, event string) bool {
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") && matchesEvent(p[1:], event) {
 			return true
 		}
 	}
 	return false
 }
 
-func getFileFromGithub(commit, path string, proj *brigade.Project) ([]byte, error) {
-	return GetFileContents(proj, commit, path)
+// matchesEvent tells whether pattern matches eventType, ignoring case, as the
+// -events flag uppercases them. An event, like `issue_comment`, matches the
+// event type with and without any action, like `issue_comment:created`. A
+// trailing * matches any suffix, so that `pull_request:*` matches every action
+// but not the bare event, and `*` everything.
+func matchesEvent(pattern, eventType string) bool {
+	pattern, eventType = strings.ToLower(pattern), strings.ToLower(eventType)
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(eventType, strings.TrimSuffix(pattern, "*"))
+	}
+	if pattern == eventType {
+		return true
+	}
+	return !strings.Contains(pattern, ":") && strings.HasPrefix(eventType, pattern+":")
 }
 
-func (s *githubHook) build(eventType string, rev brigade.Revision, payload []byte, proj *brigade.Project) error {
+func getFileFromGithub(c context.Context, commit, path string, proj *brigade.Project) ([]byte, error) {
+	return GetFileContents(c, proj, commit, path)
+}
+
+// build creates a build for eventType in Brigade and hands it to any secondary
+// emitters, and records it in the audit log for delivery.
+//
+// It returns a nil TargetStatus when the event type is not emitted.
+func (s *githubHook) build(ctx context.Context, delivery, eventType string, rev brigade.Revision, payload []byte, proj *brigade.Project) (TargetStatus, error) {
 	if !s.shouldEmit(eventType) {
-		return nil
+		return nil, nil
+	}
+	if allowed, ok := s.bodyFields(eventType); ok && len(payload) > 0 {
+		if pruned, err := pruneBody(payload, allowed); err != nil {
+			log.Printf("Failed to prune %q payload: %s", eventType, err)
+		} else {
+			payload = pruned
+		}
+	}
+	if truncated, ok, err := truncateBody(payload, s.opts.MaxRetainBodyBytes); err != nil {
+		log.Printf("Failed to truncate the body of %q payload: %s", eventType, err)
+	} else if ok {
+		log.Printf("WARNING: truncated the body of %q payload to %d bytes", eventType, s.opts.MaxRetainBodyBytes)
+		payload = truncated
+	}
+	if stamped, err := StampGateway(payload, s.opts.Gateway); err != nil {
+		log.Printf("Failed to stamp gateway info into %q payload: %s", eventType, err)
+	} else {
+		payload = stamped
+	}
+	proj, err := s.routeProject(eventType, proj)
+	if err != nil {
+		log.Printf("Failed to route %q build: %s", eventType, err)
+		emitTotal.WithLabelValues(BrigadeTarget, "failure").Inc()
+		return TargetStatus{BrigadeTarget: err.Error()}, err
+	}
+	if s.rateLimits != nil && !s.rateLimits.allow(proj.ID, proj.Name) {
+		log.Printf("WARNING: not creating %q build for project %s, which exceeded its rate limit of %d builds per minute", eventType, proj.Name, s.opts.RateLimits[proj.Name])
+		return TargetStatus{BrigadeTarget: statusThrottled}, errThrottled
+	}
+	if sa := s.opts.ServiceAccounts[proj.Name]; sa != "" {
+		if stamped, err := StampServiceAccount(payload, sa); err != nil {
+			log.Printf("Failed to stamp service account into %q payload: %s", eventType, err)
+		} else {
+			payload = stamped
+		}
+	}
+	if s.opts.PayloadPretty {
+		if pretty, err := prettyPayload(payload); err != nil {
+			log.Printf("DEBUG: %q payload for project %s is not a JSON object: %s", eventType, proj.ID, err)
+		} else {
+			log.Printf("DEBUG: %q payload for project %s:\n%s", eventType, proj.ID, pretty)
+		}
+	}
+	if compressed, err := CompressPayload(payload, s.opts.CompressionThreshold); err != nil {
+		log.Printf("Failed to compress %q payload: %s", eventType, err)
+	} else {
+		payload = compressed
+	}
+	provider := s.provider(proj)
+	if err := s.opts.RefTemplate.Apply(provider, eventType, &rev); err != nil {
+		log.Printf("WARNING: failed to render the ref of %q build, emitting %q: %s", eventType, rev.Ref, err)
 	}
 	b := &brigade.Build{
 		ProjectID: proj.ID,
-		Type:      eventType,
-		Provider:  "github",
+		Type:      RenameBuildType(s.opts.BuildTypes, eventType),
+		Provider:  provider,
 		Revision:  &rev,
 		Payload:   payload,
 	}
-	return s.store.CreateBuild(b)
+	if s.debouncer != nil {
+		s.debouncer.schedule(b)
+		return TargetStatus{BrigadeTarget: statusDebounced}, nil
+	}
+	return emitToTargets(storeEmitter{ctx, s.store}, s.opts.DeadLetters, s.opts.Buffer, s.opts.Emitters, b, func() { s.audit(delivery, proj.Name, b) })
 }
 
-// validateSignature compares the salted digest in the header with our own computing of the body.
-func validateSignature(signature, secretKey string, payload []byte) error {
-	sum := SHA1HMAC([]byte(secretKey), payload)
-	if subtle.ConstantTimeCompare([]byte(sum), []byte(signature)) != 1 {
-		log.Printf("Expected signature %q (sum), got %q (hub-signature)", sum, signature)
-		return errors.New("payload signature check failed")
+// audit records the creation of b in the audit log, if any. Failures are logged
+// rather than failing the delivery, as the build has been created.
+func (s *githubHook) audit(delivery, project string, b *brigade.Build) {
+	if err := s.opts.AuditLog.Record(NewAuditRecord(delivery, project, b)); err != nil {
+		log.Printf("WARNING: failed to record %q build for project %s in the audit log: %s", b.Type, b.ProjectID, err)
 	}
-	return nil
+}
+
+// RenameBuildType returns the name that eventType is renamed to in renames,
+// or eventType itself if it isn't renamed.
+func RenameBuildType(renames map[string]string, eventType string) string {
+	if renamed, ok := renames[eventType]; ok {
+		return renamed
+	}
+	return eventType
+}
+
+// provider returns the Provider of builds for proj.
+func (s *githubHook) provider(proj *brigade.Project) string {
+	provider := s.opts.Provider
+	if provider == "" {
+		provider = DefaultProvider
+	}
+	if s.opts.EnterpriseSuffix && proj.Github.BaseURL != "" {
+		provider += "-enterprise"
+	}
+	return provider
+}
+
+// defaultRef returns the ref of builds for events that aren't about a ref, or
+// whose ref isn't resolved, like comments on issues.
+func (s *githubHook) defaultRef() string {
+	branch := s.opts.DefaultBranch
+	if branch == "" {
+		branch = DefaultBranch
+	}
+	return "refs/heads/" + branch
+}
+
+// routeProject returns the project that builds for eventType are routed to.
+//
+// An exact match of eventType takes precedence over a match of the event type
+// without its action. Without a route, the repo-derived project proj is returned.
+func (s *githubHook) routeProject(eventType string, proj *brigade.Project) (*brigade.Project, error) {
+	name, ok := s.opts.EventProjects[eventType]
+	if !ok {
+		name, ok = s.opts.EventProjects[strings.SplitN(eventType, ":", 2)[0]]
+	}
+	if !ok {
+		return proj, nil
+	}
+	routed, err := s.store.GetProject(name)
+	if err != nil {
+		return nil, fmt.Errorf("project %q for event type %q not found: %s", name, eventType, err)
+	}
+	return routed, nil
+}
+
+// validateSignature compares the salted digest in the headers with our own computing of the body.
+//
+// The SHA-256 signature of X-Hub-Signature-256 is preferred. The legacy SHA-1
+// signature of X-Hub-Signature is only checked if the former is absent.
+func validateSignature(h http.Header, secretKey string, payload []byte) error {
+	if signature := h.Get(hubSignature256Header); signature != "" {
+		return validateSignatureWith(SignatureSHA256, signature, secretKey, payload)
+	}
+	return validateSignatureWith(SignatureSHA1, h.Get(hubSignatureHeader), secretKey, payload)
 }
@@ -0,0 +1,124 @@
+package webhook
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// activityActions are the actions of project-management events that emit builds.
+// Every other action is acknowledged and ignored.
+var activityActions = map[string][]string{
+	"milestone":    {"created", "closed"},
+	"project_card": {"moved"},
+}
+
+// ActivityPayload is the payload of builds for project-management events like
+// "milestone" and "project_card".
+type ActivityPayload struct {
+	Type string `json:"type"`
+	// ActorID and Actor identify the user that triggered the event
+	ActorID int64  `json:"actorID"`
+	Actor   string `json:"actor"`
+	// TargetID is the ID of the milestone or project card the event is about
+	TargetID int64 `json:"targetID"`
+	// ColumnID and FromColumnID are the destination and origin project columns of a moved card
+	ColumnID     int64       `json:"columnID,omitempty"`
+	FromColumnID int64       `json:"fromColumnID,omitempty"`
+	Body         interface{} `json:"body"`
+}
+
+// projectCardChanges is the part of the "changes" of a project_card event that
+// go-github doesn't decode.
+type projectCardChanges struct {
+	Changes struct {
+		ColumnID struct {
+			From int64 `json:"from"`
+		} `json:"column_id"`
+	} `json:"changes"`
+}
+
+// handleActivity handles "milestone" and "project_card" event types
+func (s *githubHook) handleActivity(c *gin.Context, eventType string) {
+	body, e, ok := s.readEvent(c, eventType)
+	if !ok {
+		return
+	}
+
+	var action string
+	var repo string
+	var sender *github.User
+	pl := ActivityPayload{Type: eventType}
+
+	switch e := e.(type) {
+	case *github.MilestoneEvent:
+		action = e.GetAction()
+		repo = e.Repo.GetFullName()
+		sender = e.Sender
+		pl.TargetID = e.Milestone.GetID()
+	case *github.ProjectCardEvent:
+		action = e.GetAction()
+		repo = e.Repo.GetFullName()
+		sender = e.Sender
+		pl.TargetID = e.ProjectCard.GetID()
+		pl.ColumnID = e.ProjectCard.GetColumnID()
+		if action == "moved" {
+			changes := projectCardChanges{}
+			if err := json.Unmarshal(body, &changes); err != nil {
+				log.Printf("Failed to parse changes of project card %d: %s", pl.TargetID, err)
+			}
+			pl.FromColumnID = changes.Changes.ColumnID.From
+		}
+	default:
+		s.rejectUnexpected(c, eventType, e)
+		return
+	}
+
+	proj, ok := s.getProject(c, repo)
+	if !ok {
+		return
+	}
+
+	if !s.validate(c, repo, proj, body) {
+		return
+	}
+
+	if !isActivityAction(eventType, action) {
+		log.Printf("Ignoring %q event with action %q", eventType, action)
+		s.ignore(c, gin.H{"status": "Ignored"})
+		return
+	}
+
+	pl.ActorID = sender.GetID()
+	pl.Actor = sender.GetLogin()
+
+	var err error
+	if pl.Body, err = decodeBody(body); err != nil {
+		log.Printf("Failed to parse body: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		return
+	}
+
+	payload, err := json.Marshal(pl)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "JSON encoding error"})
+		return
+	}
+
+	rev := brigade.Revision{Ref: s.defaultRef()}
+	s.emit(c, eventType, action, rev, payload, proj)
+}
+
+func isActivityAction(eventType, action string) bool {
+	for _, a := range activityActions[eventType] {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+const testMilestonePayload = `{
+  "action": "%s",
+  "milestone": {"id": 3361444, "number": 1, "title": "v1.0"},
+  "repository": {"id": 35129377, "full_name": "baxterthehacker/public-repo"},
+  "sender": {"id": 6752317, "login": "baxterthehacker"}
+}`
+
+const testProjectCardPayload = `{
+  "action": "%s",
+  "changes": {"column_id": {"from": 1003}},
+  "project_card": {"id": 2018, "column_id": 1004, "note": "deploy"},
+  "repository": {"id": 35129377, "full_name": "baxterthehacker/public-repo"},
+  "sender": {"id": 6752317, "login": "baxterthehacker"}
+}`
+
+func handleTestEvent(t *testing.T, s *githubHook, event string, payload []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	r.Header.Add("X-GitHub-Event", event)
+	r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
+
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = r
+
+	s.Handle(ctx)
+	return w
+}
+
+func TestGithubHandler_activity(t *testing.T) {
+	tests := []struct {
+		event        string
+		payload      string
+		action       string
+		targetID     int64
+		columnID     int64
+		fromColumnID int64
+		ignored      bool
+	}{
+		{event: "milestone", payload: testMilestonePayload, action: "created", targetID: 3361444},
+		{event: "milestone", payload: testMilestonePayload, action: "closed", targetID: 3361444},
+		{event: "milestone", payload: testMilestonePayload, action: "edited", ignored: true},
+		{event: "project_card", payload: testProjectCardPayload, action: "moved", targetID: 2018, columnID: 1004, fromColumnID: 1003},
+		{event: "project_card", payload: testProjectCardPayload, action: "created", ignored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.event+":"+tt.action, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+
+			payload := []byte(fmt.Sprintf(tt.payload, tt.action))
+			w := handleTestEvent(t, s, tt.event, payload)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			if tt.ignored {
+				if len(store.builds) != 0 {
+					t.Fatalf("expected no builds for ignored action, got %d", len(store.builds))
+				}
+				return
+			}
+			if len(store.builds) != 2 {
+				t.Fatalf("expected 2 builds, got %d", len(store.builds))
+			}
+			if got, want := store.builds[1].Type, tt.event+":"+tt.action; got != want {
+				t.Errorf("expected build type %q, got %q", want, got)
+			}
+
+			pl := ActivityPayload{}
+			if err := json.Unmarshal(store.builds[1].Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.ActorID != 6752317 || pl.Actor != "baxterthehacker" {
+				t.Errorf("unexpected actor %d/%q", pl.ActorID, pl.Actor)
+			}
+			if pl.TargetID != tt.targetID {
+				t.Errorf("expected target ID %d, got %d", tt.targetID, pl.TargetID)
+			}
+			if pl.ColumnID != tt.columnID || pl.FromColumnID != tt.fromColumnID {
+				t.Errorf("expected columns %d->%d, got %d->%d", tt.fromColumnID, tt.columnID, pl.FromColumnID, pl.ColumnID)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_activityNotEmitted(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.EmittedEvents = []string{"milestone:closed"}
+
+	w := handleTestEvent(t, s, "milestone", []byte(fmt.Sprintf(testMilestonePayload, "created")))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 0 {
+		t.Fatalf("expected no builds for events that are not emitted, got %d", len(store.builds))
+	}
+}
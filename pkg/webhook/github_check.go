@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// handleCheckRun handles a "check_run" event type.
+//
+// Only re-requested check runs emit builds. The check runs the workers create
+// themselves would otherwise trigger builds for their own progress.
+func (s *githubHook) handleCheckRun(c *gin.Context, eventType string) {
+	body, e, ok := s.readEvent(c, eventType)
+	if !ok {
+		return
+	}
+
+	cre, ok := e.(*github.CheckRunEvent)
+	if !ok {
+		s.rejectUnexpected(c, eventType, e)
+		return
+	}
+	action := cre.GetAction()
+	repo := cre.Repo.GetFullName()
+
+	proj, ok := s.getProject(c, repo)
+	if !ok {
+		return
+	}
+
+	if !s.validate(c, repo, proj, body) {
+		return
+	}
+
+	if action != "rerequested" {
+		log.Printf("Ignoring %q event with action %q", eventType, action)
+		s.ignore(c, gin.H{"status": "Ignored"})
+		return
+	}
+
+	appID := s.appID(c)
+	instID := s.routeInstallationID(c, cre.Installation, repo)
+	if appID == 0 || instID == 0 {
+		log.Printf("App ID and Installation ID must both be set. App: %d, Installation: %d", appID, instID)
+		c.JSON(http.StatusForbidden, gin.H{"status": ErrAuthFailed})
+		return
+	}
+
+	tok, timeout, err := s.getToken(appID, int(instID), proj.Github)
+	if err != nil {
+		log.Printf("Failed to negotiate a token: %s", err)
+		c.JSON(http.StatusForbidden, gin.H{"status": ErrAuthFailed})
+		return
+	}
+
+	run := cre.CheckRun
+	rev := brigade.Revision{
+		Commit: run.GetHeadSHA(),
+		Ref:    s.defaultRef(),
+	}
+	if branch := run.CheckSuite.GetHeadBranch(); branch != "" {
+		rev.Ref = fmt.Sprintf("refs/heads/%s", branch)
+	}
+
+	res := &Payload{
+		AppID:              appID,
+		InstID:             int(instID),
+		Type:               eventType,
+		Token:              tok,
+		TokenExpires:       timeout,
+		Commit:             rev.Commit,
+		Branch:             rev.Ref,
+		CheckRunName:       run.GetName(),
+		CheckRunExternalID: run.GetExternalID(),
+	}
+	if s.opts.CheckRunAppID {
+		res.CheckRunAppID = run.App.GetID()
+	}
+	s.stampInstallation(c.Request.Context(), instID, res)
+	s.enrichRepo(c.Request.Context(), tok, repo, proj, res)
+
+	if res.Body, err = decodeBody(body); err != nil {
+		log.Printf("Failed to re-parse body: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Our parser is probably broken"})
+		return
+	}
+
+	payload, err := json.Marshal(res)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "JSON encoding error"})
+		return
+	}
+
+	s.emit(c, eventType, action, rev, payload, proj)
+}
@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+const testCheckRunPayload = `{
+  "action": "%s",
+  "check_run": {
+    "id": 128620228,
+    "head_sha": "ec26c3e57ca3a959ca5aad62de7213c562f8c821",
+    "external_id": "test-unit",
+    "name": "Unit tests",
+    "check_suite": {"id": 118578147, "head_branch": "changes"},
+    "app": {"id": 2}
+  },
+  "installation": {"id": 2311213},
+  "repository": {"id": 35129377, "full_name": "baxterthehacker/public-repo"},
+  "sender": {"id": 6752317, "login": "baxterthehacker"}
+}`
+
+func TestGithubHandler_checkRunRerequested(t *testing.T) {
+	tests := []struct {
+		name          string
+		action        string
+		checkRunAppID bool
+		expectedAppID int64
+		ignored       bool
+	}{
+		{name: "rerequested", action: "rerequested"},
+		{name: "rerequested with app ID", action: "rerequested", checkRunAppID: true, expectedAppID: 2},
+		{name: "created", action: "created", ignored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.AppID = 13
+			s.opts.CheckRunAppID = tt.checkRunAppID
+			s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+				return "v1.installation-token", time.Time{}, nil
+			}
+
+			w := handleTestEvent(t, s, "check_run", []byte(fmt.Sprintf(testCheckRunPayload, tt.action)))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			if tt.ignored {
+				if len(store.builds) != 0 {
+					t.Fatalf("expected no builds, got %d", len(store.builds))
+				}
+				return
+			}
+			if len(store.builds) != 2 || store.builds[1].Type != "check_run:rerequested" {
+				t.Fatalf("expected check_run and check_run:rerequested builds, got %d builds", len(store.builds))
+			}
+
+			b := store.builds[1]
+			if b.Revision.Commit != "ec26c3e57ca3a959ca5aad62de7213c562f8c821" || b.Revision.Ref != "refs/heads/changes" {
+				t.Errorf("unexpected revision %s", describeRevision(b.Revision))
+			}
+
+			pl := Payload{}
+			if err := json.Unmarshal(b.Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.CheckRunName != "Unit tests" {
+				t.Errorf("expected check run name %q, got %q", "Unit tests", pl.CheckRunName)
+			}
+			if pl.CheckRunExternalID != "test-unit" {
+				t.Errorf("expected check run external ID %q, got %q", "test-unit", pl.CheckRunExternalID)
+			}
+			if pl.CheckRunAppID != tt.expectedAppID {
+				t.Errorf("expected check run app ID %d, got %d", tt.expectedAppID, pl.CheckRunAppID)
+			}
+			if pl.Token != "v1.installation-token" {
+				t.Errorf("expected the installation token in the payload, got %q", pl.Token)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// repoNames returns the full names of repos.
+func repoNames(repos []*github.Repository) []string {
+	names := make([]string, 0, len(repos))
+	for _, r := range repos {
+		names = append(names, r.GetFullName())
+	}
+	return names
+}
+
+// handleInstallation handles "installation" and "installation_repositories"
+// events, which GitHub sends when the App is installed or uninstalled, or repos
+// are added to or removed from an installation. The cache of the installations
+// of repos is updated accordingly.
+//
+// The events are not about a repo, so builds are only emitted for them if they
+// are routed to a project with GithubOpts.EventProjects, like
+// installation=myorg/provisioner. Otherwise they are verified with
+// GithubOpts.DefaultSharedSecret, the secret of the App.
+func (s *githubHook) handleInstallation(c *gin.Context, eventType string) {
+	body, e, ok := s.readEvent(c, eventType)
+	if !ok {
+		return
+	}
+
+	var action string
+	var inst *github.Installation
+	var added, removed []string
+	switch e := e.(type) {
+	case *github.InstallationEvent:
+		action = e.GetAction()
+		inst = e.Installation
+		added = repoNames(e.Repositories)
+	case *github.InstallationRepositoriesEvent:
+		action = e.GetAction()
+		inst = e.Installation
+		added, removed = repoNames(e.RepositoriesAdded), repoNames(e.RepositoriesRemoved)
+	default:
+		s.rejectUnexpected(c, eventType, e)
+		return
+	}
+	instID := inst.GetID()
+	if instID == 0 {
+		log.Printf("Failed to parse body: %q event without an installation", eventType)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		return
+	}
+	account := fmt.Sprintf("installation %d of %s", instID, inst.GetAccount().GetLogin())
+
+	proj, err := s.routeProject(fmt.Sprintf("%s:%s", eventType, action), nil)
+	if err != nil {
+		log.Printf("Failed to route %q build: %s", eventType, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "project not found"})
+		return
+	}
+	if proj == nil {
+		if s.opts.DefaultSharedSecret == "" && !s.opts.AllowUnsigned {
+			log.Printf("Ignoring %q event for %s, as there is neither a project it is routed to nor a default secret to verify it with", eventType, account)
+			s.ignore(c, gin.H{"status": "Ignored"})
+			return
+		}
+		if !s.validate(c, account, &brigade.Project{}, body) {
+			return
+		}
+	} else if !s.validate(c, account, proj, body) {
+		return
+	}
+
+	if s.installations != nil {
+		switch action {
+		case "deleted", "suspend":
+			s.installations.forget(instID)
+		default:
+			s.installations.update(instID, added, removed)
+		}
+		log.Printf("Updated the repos of %s after %q event with action %q", account, eventType, action)
+	}
+
+	if proj == nil {
+		s.ignore(c, gin.H{"status": "Ignored"})
+		return
+	}
+
+	res := &Payload{Type: eventType, InstallationID: instID}
+	if res.Body, err = decodeBody(body); err != nil {
+		log.Printf("Failed to parse body: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		return
+	}
+	payload, err := json.Marshal(res)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "JSON encoding error"})
+		return
+	}
+
+	s.emit(c, eventType, action, brigade.Revision{Ref: s.defaultRef()}, payload, proj)
+}
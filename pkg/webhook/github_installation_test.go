@@ -0,0 +1,122 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const testInstallationPayload = `{
+  "action": "%s",
+  "installation": {"id": 2, "account": {"login": "octocat"}},
+  "repositories": [{"id": 1296269, "full_name": "octocat/Hello-World"}],
+  "sender": {"id": 1, "login": "octocat"}
+}`
+
+const testInstallationRepositoriesPayload = `{
+  "action": "%s",
+  "installation": {"id": 2, "account": {"login": "octocat"}},
+  "repository_selection": "selected",
+  "repositories_added": [{"id": 1296269, "full_name": "octocat/Hello-World"}],
+  "repositories_removed": [{"id": 1296270, "full_name": "octocat/Spoon-Knife"}],
+  "sender": {"id": 1, "login": "octocat"}
+}`
+
+func TestGithubHandler_installation(t *testing.T) {
+	tests := []struct {
+		event   string
+		payload string
+		action  string
+		repos   map[string]int64
+	}{
+		{
+			event: "installation", payload: testInstallationPayload, action: "created",
+			repos: map[string]int64{"myorg/myapp": 1, "octocat/spoon-knife": 2, "octocat/hello-world": 2},
+		},
+		{
+			event: "installation", payload: testInstallationPayload, action: "deleted",
+			repos: map[string]int64{"myorg/myapp": 1},
+		},
+		{
+			event: "installation_repositories", payload: testInstallationRepositoriesPayload, action: "added",
+			repos: map[string]int64{"myorg/myapp": 1, "octocat/hello-world": 2},
+		},
+		{
+			event: "installation_repositories", payload: testInstallationRepositoriesPayload, action: "removed",
+			repos: map[string]int64{"myorg/myapp": 1, "octocat/hello-world": 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.event+":"+tt.action, func(t *testing.T) {
+			for _, routed := range []bool{false, true} {
+				store := newTestStore()
+				s := newTestGithubHandler(store, t)
+				s.installations = newInstallationCache(installationsTTL, nil)
+				s.installations.repos = map[string]int64{"myorg/myapp": 1, "octocat/spoon-knife": 2}
+				if routed {
+					s.opts.EventProjects = map[string]string{tt.event: "baxterthehacker/public-repo"}
+				} else {
+					s.opts.DefaultSharedSecret = "asdf"
+				}
+
+				w := handleTestEvent(t, s, tt.event, []byte(fmt.Sprintf(tt.payload, tt.action)))
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("routed %v: expected 200, got %d\n%s", routed, w.Code, w.Body.String())
+				}
+				if !reflect.DeepEqual(s.installations.repos, tt.repos) {
+					t.Errorf("routed %v: expected cached repos %v, got %v", routed, tt.repos, s.installations.repos)
+				}
+				if !routed {
+					if len(store.builds) != 0 {
+						t.Errorf("expected no builds without a route, got %d", len(store.builds))
+					}
+					continue
+				}
+				if len(store.builds) != 2 {
+					t.Fatalf("expected 2 builds, got %d", len(store.builds))
+				}
+				if got, want := store.builds[1].Type, tt.event+":"+tt.action; got != want {
+					t.Errorf("expected build type %q, got %q", want, got)
+				}
+				if store.builds[1].Revision.Ref != "refs/heads/master" {
+					t.Errorf("expected the default ref, got %q", store.builds[1].Revision.Ref)
+				}
+				pl := Payload{}
+				if err := json.Unmarshal(store.builds[1].Payload, &pl); err != nil {
+					t.Fatal(err)
+				}
+				if pl.InstallationID != 2 {
+					t.Errorf("expected installation 2 in the payload, got %d", pl.InstallationID)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_installationUnverified(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.installations = newInstallationCache(installationsTTL, nil)
+	s.installations.repos = map[string]int64{"octocat/hello-world": 2}
+
+	w := handleTestEvent(t, s, "installation", []byte(fmt.Sprintf(testInstallationPayload, "deleted")))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(s.installations.repos) != 1 {
+		t.Errorf("expected the cache to be left alone without a secret to verify the event, got %v", s.installations.repos)
+	}
+
+	s.opts.DefaultSharedSecret = "other"
+	if w := handleTestEvent(t, s, "installation", []byte(fmt.Sprintf(testInstallationPayload, "deleted"))); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a signature mismatch, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(s.installations.repos) != 1 {
+		t.Errorf("expected the cache to be left alone for a signature mismatch, got %v", s.installations.repos)
+	}
+}
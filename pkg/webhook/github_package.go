@@ -0,0 +1,151 @@
+package webhook
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// packageActionPublished is the only action of package events that emits builds
+const packageActionPublished = "published"
+
+// Package is the package of a "package" or "registry_package" event.
+type Package struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	PackageType string `json:"package_type"`
+	HTMLURL     string `json:"html_url"`
+	// PackageVersion is the published version
+	PackageVersion *PackageVersion `json:"package_version"`
+}
+
+// PackageVersion is a version of a Package.
+type PackageVersion struct {
+	ID      int64  `json:"id"`
+	Version string `json:"version"`
+	// ContainerMetadata is set for container images
+	ContainerMetadata *struct {
+		Tag struct {
+			Name   string `json:"name"`
+			Digest string `json:"digest"`
+		} `json:"tag"`
+	} `json:"container_metadata"`
+}
+
+// PackageEvent is a "package" event, which go-github doesn't support.
+type PackageEvent struct {
+	Action  string             `json:"action"`
+	Package *Package           `json:"package"`
+	Repo    *github.Repository `json:"repository"`
+	Sender  *github.User       `json:"sender"`
+}
+
+// RegistryPackageEvent is a "registry_package" event, the predecessor of the
+// "package" event that GitHub still sends for GitHub Container Registry.
+type RegistryPackageEvent struct {
+	Action          string             `json:"action"`
+	RegistryPackage *Package           `json:"registry_package"`
+	Repo            *github.Repository `json:"repository"`
+	Sender          *github.User       `json:"sender"`
+}
+
+// PackagePayload is the payload of builds for published packages.
+type PackagePayload struct {
+	Type string `json:"type"`
+	// ActorID and Actor identify the user that published the package
+	ActorID int64  `json:"actorID"`
+	Actor   string `json:"actor"`
+	// Name and PackageType identify the package, like an image of type "container"
+	Name        string `json:"name"`
+	PackageType string `json:"packageType"`
+	// Version is the published version, and Tag and Digest the tag and digest of container images
+	Version string      `json:"version"`
+	Tag     string      `json:"tag,omitempty"`
+	Digest  string      `json:"digest,omitempty"`
+	Body    interface{} `json:"body"`
+}
+
+// handlePackage handles "package" and "registry_package" event types
+func (s *githubHook) handlePackage(c *gin.Context, eventType string) {
+	body, e, ok := s.readEvent(c, eventType)
+	if !ok {
+		return
+	}
+
+	var action string
+	var repo string
+	var sender *github.User
+	var pkg *Package
+
+	switch e := e.(type) {
+	case *PackageEvent:
+		action = e.Action
+		repo = e.Repo.GetFullName()
+		sender = e.Sender
+		pkg = e.Package
+	case *RegistryPackageEvent:
+		action = e.Action
+		repo = e.Repo.GetFullName()
+		sender = e.Sender
+		pkg = e.RegistryPackage
+	default:
+		s.rejectUnexpected(c, eventType, e)
+		return
+	}
+	if pkg == nil {
+		log.Printf("Failed to parse body: %q event without a package", eventType)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		return
+	}
+
+	proj, ok := s.getProject(c, repo)
+	if !ok {
+		return
+	}
+
+	if !s.validate(c, repo, proj, body) {
+		return
+	}
+
+	if action != packageActionPublished {
+		log.Printf("Ignoring %q event with action %q", eventType, action)
+		s.ignore(c, gin.H{"status": "Ignored"})
+		return
+	}
+
+	pl := PackagePayload{
+		Type:        eventType,
+		ActorID:     sender.GetID(),
+		Actor:       sender.GetLogin(),
+		Name:        pkg.Name,
+		PackageType: pkg.PackageType,
+	}
+	if v := pkg.PackageVersion; v != nil {
+		pl.Version = v.Version
+		if v.ContainerMetadata != nil {
+			pl.Tag = v.ContainerMetadata.Tag.Name
+			pl.Digest = v.ContainerMetadata.Tag.Digest
+		}
+	}
+
+	var err error
+	if pl.Body, err = decodeBody(body); err != nil {
+		log.Printf("Failed to parse body: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		return
+	}
+
+	payload, err := json.Marshal(pl)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "JSON encoding error"})
+		return
+	}
+
+	rev := brigade.Revision{Ref: s.defaultRef()}
+	s.emit(c, eventType, action, rev, payload, proj)
+}
@@ -0,0 +1,108 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+const testPackagePayload = `{
+  "action": "%s",
+  "%s": {
+    "id": 1001,
+    "name": "public-repo",
+    "package_type": "container",
+    "html_url": "https://github.com/baxterthehacker/public-repo/pkgs/container/public-repo",
+    "package_version": {
+      "id": 2002,
+      "version": "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+      "container_metadata": {
+        "tag": {"name": "v1.2.3", "digest": "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}
+      }
+    }
+  },
+  "repository": {"id": 35129377, "full_name": "baxterthehacker/public-repo"},
+  "sender": {"id": 6752317, "login": "baxterthehacker"}
+}`
+
+func TestGithubHandler_package(t *testing.T) {
+	tests := []struct {
+		event   string
+		action  string
+		ignored bool
+	}{
+		{event: "package", action: "published"},
+		{event: "registry_package", action: "published"},
+		{event: "package", action: "updated", ignored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.event+":"+tt.action, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+
+			payload := []byte(fmt.Sprintf(testPackagePayload, tt.action, tt.event))
+			w := handleTestEvent(t, s, tt.event, payload)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			if tt.ignored {
+				if len(store.builds) != 0 {
+					t.Fatalf("expected no builds for ignored action, got %d", len(store.builds))
+				}
+				return
+			}
+			if len(store.builds) != 2 {
+				t.Fatalf("expected 2 builds, got %d", len(store.builds))
+			}
+			if got, want := store.builds[1].Type, tt.event+":published"; got != want {
+				t.Errorf("expected build type %q, got %q", want, got)
+			}
+
+			pl := PackagePayload{}
+			if err := json.Unmarshal(store.builds[1].Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.Name != "public-repo" || pl.PackageType != "container" {
+				t.Errorf("unexpected package %q of type %q", pl.Name, pl.PackageType)
+			}
+			if pl.Version != "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+				t.Errorf("unexpected version %q", pl.Version)
+			}
+			if pl.Tag != "v1.2.3" || pl.Digest != pl.Version {
+				t.Errorf("unexpected tag %q and digest %q", pl.Tag, pl.Digest)
+			}
+			if pl.ActorID != 6752317 || pl.Actor != "baxterthehacker" {
+				t.Errorf("unexpected actor %d/%q", pl.ActorID, pl.Actor)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_packageNotEmitted(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.EmittedEvents = []string{"milestone"}
+
+	w := handleTestEvent(t, s, "package", []byte(fmt.Sprintf(testPackagePayload, "published", "package")))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 0 {
+		t.Fatalf("expected no builds for events that are not emitted, got %d", len(store.builds))
+	}
+}
+
+func TestGithubHandler_packageMismatch(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+
+	w := handleTestEvent(t, s, "package", []byte(fmt.Sprintf(testPackagePayload, "published", "registry_package")))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d\n%s", w.Code, w.Body.String())
+	}
+}
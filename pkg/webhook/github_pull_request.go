@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"log"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// handlePullRequest handles "pull_request" events, emitting builds for the head
+// of the pull request, like when it is opened, synchronized or reopened.
+//
+// Pull requests of authors whose association isn't allowed are acknowledged and
+// ignored, as they could run arbitrary code in the worker. Otherwise the builds
+// are prepared like for comments on pull requests, see pullRequestBuild.
+func (s *githubHook) handlePullRequest(c *gin.Context, eventType string) {
+	body, e, ok := s.readEvent(c, eventType)
+	if !ok {
+		return
+	}
+
+	pre, ok := e.(*github.PullRequestEvent)
+	if !ok {
+		s.rejectUnexpected(c, eventType, e)
+		return
+	}
+	repo := pre.Repo.GetFullName()
+
+	proj, ok := s.getProject(c, repo)
+	if !ok {
+		return
+	}
+
+	if !s.validate(c, repo, proj, body) {
+		return
+	}
+
+	pr := pre.PullRequest
+	if assoc := pr.GetAuthorAssociation(); !s.isAllowedAuthor(assoc) {
+		log.Printf("Ignoring %q event for pull request %d from disallowed author %s", eventType, pr.GetNumber(), assoc)
+		s.ignore(c, gin.H{"status": "Ignored", "reason": "author not allowed"})
+		return
+	}
+
+	rev, payload, err := s.pullRequestBuild(c, eventType, pre.Installation, pre.Repo, pr.GetNumber(), pr, brigade.Revision{}, proj, body)
+	if err != nil {
+		return
+	}
+
+	s.emit(c, eventType, pre.GetAction(), rev, payload, proj)
+}
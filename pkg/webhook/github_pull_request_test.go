@@ -0,0 +1,167 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testPullRequestPayload(t *testing.T, action string) []byte {
+	payload, err := ioutil.ReadFile("testdata/github-pull_request-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Replace(payload, []byte(`"action": "opened"`), []byte(`"action": "`+action+`"`), 1)
+}
+
+func TestGithubHandler_pullRequest(t *testing.T) {
+	for _, action := range []string{"opened", "synchronize"} {
+		t.Run(action, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+
+			w := handleTestEvent(t, s, "pull_request", testPullRequestPayload(t, action))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			expected := []string{"pull_request", "pull_request:" + action}
+			if len(store.builds) != len(expected) {
+				t.Fatalf("expected builds %v, got %d", expected, len(store.builds))
+			}
+			for i, b := range store.builds {
+				if b.Type != expected[i] {
+					t.Errorf("expected build %d to be %q, got %q", i, expected[i], b.Type)
+				}
+				if b.Revision.Commit != "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c" || b.Revision.Ref != "refs/pull/1/head" {
+					t.Errorf("expected the head of pull request 1, got %s", describeRevision(b.Revision))
+				}
+			}
+
+			pl := struct {
+				Payload
+				Body struct {
+					Action string `json:"action"`
+				} `json:"body"`
+			}{}
+			if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.Type != "pull_request" || pl.Commit != store.builds[0].Revision.Commit || pl.Branch != "refs/pull/1/head" {
+				t.Errorf("expected the revision in the payload, got type %q, commit %q and branch %q", pl.Type, pl.Commit, pl.Branch)
+			}
+			if pl.Body.Action != action {
+				t.Errorf("expected the body of the event in the payload, got action %q", pl.Body.Action)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_pullRequestEmittedEvents(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.EmittedEvents = []string{"pull_request:synchronize"}
+
+	for _, action := range []string{"opened", "synchronize"} {
+		if w := handleTestEvent(t, s, "pull_request", testPullRequestPayload(t, action)); w.Code != http.StatusOK {
+			t.Fatalf("expected 200 for %s, got %d\n%s", action, w.Code, w.Body.String())
+		}
+	}
+
+	if len(store.builds) != 1 || store.builds[0].Type != "pull_request:synchronize" {
+		t.Fatalf("expected only a pull_request:synchronize build, got %v", store.builds)
+	}
+}
+
+func TestGithubHandler_pullRequestDisallowedAuthor(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-pull_request-payload-failed-perms.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+
+	w := handleTestEvent(t, s, "pull_request", payload)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 0 {
+		t.Errorf("expected no build for a disallowed author, got %d", len(store.builds))
+	}
+	if !strings.Contains(w.Body.String(), "author not allowed") {
+		t.Errorf("expected the author as the reason, got %s", w.Body.String())
+	}
+}
+
+func TestGithubHandler_pullRequestRequireMergeable(t *testing.T) {
+	tests := []struct {
+		mergeable string
+		builds    int
+		reason    string
+	}{
+		{mergeable: "true", builds: 2},
+		{mergeable: "false", reason: "pull request is not mergeable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mergeable, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.RequireMergeable = true
+
+			payload := bytes.Replace(testPullRequestPayload(t, "opened"), []byte(`"mergeable": null`), []byte(`"mergeable": `+tt.mergeable), 1)
+			w := handleTestEvent(t, s, "pull_request", payload)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.builds {
+				t.Fatalf("expected %d builds, got %d", tt.builds, len(store.builds))
+			}
+			if tt.reason != "" && !strings.Contains(w.Body.String(), tt.reason) {
+				t.Errorf("expected %q as the reason, got %s", tt.reason, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGithubHandler_pullRequestPullStats(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.PullStats = enabled
+
+			payload := bytes.Replace(testPullRequestPayload(t, "opened"), []byte(`"additions": 1`), []byte(`"additions": 10`), 1)
+			if w := handleTestEvent(t, s, "pull_request", payload); w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds, got none")
+			}
+
+			var expected *PullStats
+			if enabled {
+				expected = &PullStats{Additions: 10, Deletions: 1, ChangedFiles: 1}
+			}
+			for _, b := range store.builds {
+				pl := Payload{}
+				if err := json.Unmarshal(b.Payload, &pl); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(pl.PullStats, expected) {
+					t.Errorf("expected pull stats %+v in the payload of %s, got %+v", expected, b.Type, pl.PullStats)
+				}
+				if pl.Token != "v1.installation-token" || pl.InstallationID != 234 {
+					t.Errorf("expected the installation token in the payload of %s", b.Type)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package webhook
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// handlePush handles "push" events, emitting a build for the head commit of the
+// pushed ref. Pushes deleting a branch or tag are acknowledged and ignored, as
+// there is nothing to build.
+func (s *githubHook) handlePush(c *gin.Context, eventType string) {
+	body, e, ok := s.readEvent(c, eventType)
+	if !ok {
+		return
+	}
+
+	pe, ok := e.(*github.PushEvent)
+	if !ok {
+		s.rejectUnexpected(c, eventType, e)
+		return
+	}
+	repo := pe.Repo.GetFullName()
+
+	proj, ok := s.getProject(c, repo)
+	if !ok {
+		return
+	}
+
+	if !s.validate(c, repo, proj, body) {
+		return
+	}
+
+	if pe.GetDeleted() {
+		log.Printf("Ignoring %q event deleting %s", eventType, pe.GetRef())
+		s.ignore(c, gin.H{"status": "Ignored", "reason": "ref deleted"})
+		return
+	}
+
+	rev := brigade.Revision{
+		Commit: pe.HeadCommit.GetID(),
+		Ref:    pe.GetRef(),
+	}
+	pl := Payload{
+		Type:   eventType,
+		Commit: rev.Commit,
+		Branch: rev.Ref,
+	}
+
+	var err error
+	if pl.Body, err = decodeBody(body); err != nil {
+		log.Printf("Failed to parse body: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		return
+	}
+
+	payload, err := json.Marshal(pl)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "JSON encoding error"})
+		return
+	}
+
+	s.emit(c, eventType, "", rev, payload, proj)
+}
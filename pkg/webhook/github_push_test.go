@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGithubHandler_push(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+
+	w := handleTestEvent(t, s, "push", payload)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 1 || store.builds[0].Type != "push" {
+		t.Fatalf("expected a push build, got %v", store.builds)
+	}
+	rev := store.builds[0].Revision
+	if rev.Commit != "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c" || rev.Ref != "refs/heads/changes" {
+		t.Errorf("expected the head commit of refs/heads/changes, got %s", describeRevision(rev))
+	}
+
+	pl := struct {
+		Payload
+		Body struct {
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		} `json:"body"`
+	}{}
+	if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if pl.Type != "push" || pl.Commit != rev.Commit || pl.Branch != rev.Ref {
+		t.Errorf("expected the revision in the payload, got type %q, commit %q and branch %q", pl.Type, pl.Commit, pl.Branch)
+	}
+	if pl.Body.Repository.FullName != "baxterthehacker/public-repo" {
+		t.Errorf("expected the body of the event in the payload, got repo %q", pl.Body.Repository.FullName)
+	}
+}
+
+func TestGithubHandler_pushDeletedBranch(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-push-delete-branch.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+
+	w := handleTestEvent(t, s, "push", payload)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 0 {
+		t.Errorf("expected no build for a deleted branch, got %d", len(store.builds))
+	}
+	if !strings.Contains(w.Body.String(), "ref deleted") {
+		t.Errorf("expected the deletion as the reason, got %s", w.Body.String())
+	}
+}
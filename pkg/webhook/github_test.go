@@ -2,13 +2,21 @@ package webhook
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-github/v27/github"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	gin "gopkg.in/gin-gonic/gin.v1"
 
 	"github.com/brigadecore/brigade/pkg/brigade"
@@ -44,20 +52,24 @@ func newTestGithubHandler(store storage.Store, t *testing.T) *githubHook {
 	return &githubHook{
 		store:          store,
 		allowedAuthors: []string{"OWNER"},
-		getFile: func(commit, path string, proj *brigade.Project) ([]byte, error) {
+		getFile: func(c context.Context, commit, path string, proj *brigade.Project) ([]byte, error) {
 			return []byte(""), nil
 		},
 		createStatus: func(commit string, proj *brigade.Project, status *github.RepoStatus) error {
 			return nil
 		},
-		handleIssueCommentEvent: func(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte) {
+		handleIssueCommentEvent: func(c *gin.Context, s *githubHook, ice *github.IssueCommentEvent, rev brigade.Revision, proj *brigade.Project, body []byte) (brigade.Revision, []byte, error) {
 			revision := brigade.Revision{
 				Commit: "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
 				Ref:    "refs/pull/2/head",
 			}
-			return revision, []byte{}
+			return revision, []byte{}, nil
+		},
+		getToken: func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+			return "v1.installation-token", time.Time{}, nil
 		},
 		opts: GithubOpts{
+			AppID:         13,
 			EmittedEvents: []string{"*"},
 		},
 	}
@@ -292,6 +304,46 @@ func TestGithubHandler_ping(t *testing.T) {
 	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected error: %d\n%s", w.Code, w.Body.String())
 	}
+	if len(store.builds) != 0 {
+		t.Fatalf("expected no builds for pings by default, got %d", len(store.builds))
+	}
+}
+
+func TestGithubHandler_emitPing(t *testing.T) {
+	repoPing := []byte(`{"zen":"Keep it logically awesome.","hook_id":109948940,"repository":{"id":35129377,"full_name":"baxterthehacker/public-repo"}}`)
+	appPing := []byte(`{"zen":"Keep it logically awesome.","hook_id":109948940}`)
+
+	tests := []struct {
+		name          string
+		payload       []byte
+		emittedEvents []string
+		builds        int
+	}{
+		{name: "repo hook", payload: repoPing, emittedEvents: []string{"*"}, builds: 1},
+		{name: "app hook", payload: appPing, emittedEvents: []string{"*"}},
+		{name: "ping not emitted", payload: repoPing, emittedEvents: []string{"push"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.EmitPing = true
+			s.opts.EmittedEvents = tt.emittedEvents
+
+			w := handleTestEvent(t, s, "ping", tt.payload)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.builds {
+				t.Fatalf("expected %d builds, got %d", tt.builds, len(store.builds))
+			}
+			if tt.builds > 0 && store.builds[0].Type != "ping" {
+				t.Errorf("expected a ping build, got %q", store.builds[0].Type)
+			}
+		})
+	}
 }
 
 func TestGithubHandler_badevent(t *testing.T) {
@@ -373,3 +425,852 @@ func TestGithubHandler_shouldEmit(t *testing.T) {
 		})
 	}
 }
+
+func TestGithubHandler_shouldEmit_patterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		emitted  []string
+		ignored  []string
+	}{
+		{
+			name:     "everything",
+			patterns: []string{"*"},
+			emitted:  []string{"push", "pull_request", "pull_request:opened"},
+		},
+		{
+			name:     "exact event and action",
+			patterns: []string{"issue_comment:created"},
+			emitted:  []string{"issue_comment:created"},
+			ignored:  []string{"issue_comment", "issue_comment:edited", "issue_comment:created_by"},
+		},
+		{
+			name:     "actions glob",
+			patterns: []string{"pull_request:*"},
+			emitted:  []string{"pull_request:opened", "pull_request:synchronize"},
+			ignored:  []string{"pull_request", "pull_request_review:submitted"},
+		},
+		{
+			name:     "prefix glob",
+			patterns: []string{"pull_request*"},
+			emitted:  []string{"pull_request", "pull_request:opened", "pull_request_review:submitted"},
+			ignored:  []string{"push"},
+		},
+		{
+			name:     "negated event",
+			patterns: []string{"*", "!push"},
+			emitted:  []string{"pull_request", "pull_request:opened"},
+			ignored:  []string{"push"},
+		},
+		{
+			name:     "negation takes precedence regardless of order",
+			patterns: []string{"!pull_request:closed", "pull_request", "pull_request:closed"},
+			emitted:  []string{"pull_request", "pull_request:opened"},
+			ignored:  []string{"pull_request:closed"},
+		},
+		{
+			name:     "negated glob",
+			patterns: []string{"pull_request", "!pull_request:*"},
+			emitted:  []string{"pull_request"},
+			ignored:  []string{"pull_request:opened"},
+		},
+		{
+			name:     "uppercased by the flag",
+			patterns: []string{"PULL_REQUEST:*", "!PULL_REQUEST:CLOSED"},
+			emitted:  []string{"pull_request:opened"},
+			ignored:  []string{"pull_request", "pull_request:closed"},
+		},
+		{
+			name:     "negations alone",
+			patterns: []string{"!push"},
+			ignored:  []string{"push", "pull_request"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &githubHook{opts: GithubOpts{EmittedEvents: tt.patterns}}
+			for _, et := range tt.emitted {
+				if !s.shouldEmit(et) {
+					t.Errorf("expected %v to emit %q", tt.patterns, et)
+				}
+			}
+			for _, et := range tt.ignored {
+				if s.shouldEmit(et) {
+					t.Errorf("expected %v not to emit %q", tt.patterns, et)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_defaultBranch(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-issue_comment-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		branch   string
+		expected string
+	}{
+		{expected: "refs/heads/master"},
+		{branch: "main", expected: "refs/heads/main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.DefaultBranch = tt.branch
+
+			if w := handleTestEvent(t, s, "issue_comment", payload); w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds for the comment")
+			}
+			for _, b := range store.builds {
+				if b.Revision.Ref != tt.expected {
+					t.Errorf("expected %q build for %s, got %s", b.Type, tt.expected, b.Revision.Ref)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_chunkedBody(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+
+	payload, err := ioutil.ReadFile("testdata/github-issue_comment-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+
+	var transferEncoding []string
+	router := gin.New()
+	router.POST("/events/github", func(c *gin.Context) {
+		transferEncoding = c.Request.TransferEncoding
+		s.Handle(c)
+	})
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	// Write the body in small pieces through a pipe so that the client has no
+	// way of knowing the length upfront and falls back to chunked encoding.
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < len(payload); i += 512 {
+			end := i + 512
+			if end > len(payload) {
+				end = len(payload)
+			}
+			pw.Write(payload[i:end])
+		}
+		pw.Close()
+	}()
+
+	r, err := http.NewRequest("POST", ts.URL+"/events/github", pr)
+	if err != nil {
+		t.Fatalf("failed to create request: %s", err)
+	}
+	r.Header.Add("X-GitHub-Event", "issue_comment")
+	r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("failed to send request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if len(transferEncoding) != 1 || transferEncoding[0] != "chunked" {
+		t.Fatalf("expected a chunked request, got transfer encoding %v", transferEncoding)
+	}
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("unexpected error: %d\n%s", res.StatusCode, body)
+	}
+	if len(store.builds) != 2 {
+		t.Fatalf("expected 2 builds but %d build(s) were created", len(store.builds))
+	}
+}
+
+func TestGithubHandler_signatureFailure(t *testing.T) {
+	tests := []struct {
+		name          string
+		projectSecret string
+		reason        string
+	}{
+		{
+			name:          "project secret configured",
+			projectSecret: "asdf",
+			reason:        signatureFailureMisconfigured,
+		},
+		{
+			name:   "default secret only",
+			reason: signatureFailureUnknownSender,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.SharedSecret = tt.projectSecret
+			s := newTestGithubHandler(store, t)
+			s.opts.DefaultSharedSecret = "default"
+
+			payload, err := ioutil.ReadFile("testdata/github-issue_comment-payload.json")
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			before := map[string]float64{}
+			for _, reason := range []string{signatureFailureMisconfigured, signatureFailureUnknownSender} {
+				before[reason] = testutil.ToFloat64(signatureFailuresTotal.WithLabelValues(reason))
+			}
+
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err)
+			}
+			r.Header.Add("X-GitHub-Event", "issue_comment")
+			r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("wrong"), payload))
+
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = r
+
+			s.Handle(ctx)
+
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("expected 403, got %d\n%s", w.Code, w.Body.String())
+			}
+			if len(store.builds) != 0 {
+				t.Fatalf("expected no builds, got %d", len(store.builds))
+			}
+			for reason, b := range before {
+				expected := 0.0
+				if reason == tt.reason {
+					expected = 1
+				}
+				if got := testutil.ToFloat64(signatureFailuresTotal.WithLabelValues(reason)) - b; got != expected {
+					t.Errorf("expected %v failure(s) with reason %q, got %v", expected, reason, got)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_checkMergeable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"number":2,"mergeable":false,"mergeable_state":"dirty"}`))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		mergeable *bool
+		skipped   bool
+	}{
+		{name: "mergeable", mergeable: github.Bool(true)},
+		{name: "unmergeable", mergeable: github.Bool(false), skipped: true},
+		{name: "computed by polling", skipped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.Github = brigade.Github{BaseURL: ts.URL + "/", UploadURL: ts.URL + "/"}
+			s := newTestGithubHandler(store, t)
+
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request, _ = http.NewRequest("POST", "", nil)
+
+			repo := &github.Repository{Name: github.String("public-repo"), Owner: &github.User{Login: github.String("baxterthehacker")}}
+			pr := &github.PullRequest{Number: github.Int(2), Mergeable: tt.mergeable}
+
+			err := s.checkMergeable(ctx, "totallyFake", repo, pr, store.proj)
+			if tt.skipped {
+				if err != errBuildSkipped {
+					t.Fatalf("expected the build to be skipped, got %v", err)
+				}
+				if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Ignored") {
+					t.Errorf("unexpected response: %d\n%s", w.Code, w.Body.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_unsigned(t *testing.T) {
+	tests := []struct {
+		name           string
+		rejectUnsigned bool
+		allowUnsigned  bool
+		code           int
+		builds         int
+	}{
+		{name: "default", code: http.StatusInternalServerError},
+		{name: "strict", rejectUnsigned: true, code: http.StatusForbidden},
+		{name: "allowed", allowUnsigned: true, code: http.StatusOK, builds: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.SharedSecret = ""
+			s := newTestGithubHandler(store, t)
+			s.opts.RejectUnsigned = tt.rejectUnsigned
+			s.opts.AllowUnsigned = tt.allowUnsigned
+
+			payload, err := ioutil.ReadFile("testdata/github-issue_comment-payload.json")
+			if err != nil {
+				t.Fatalf("failed to read testdata: %s", err)
+			}
+
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
+			if err != nil {
+				t.Fatalf("failed to create request: %s", err)
+			}
+			r.Header.Add("X-GitHub-Event", "issue_comment")
+
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = r
+
+			s.Handle(ctx)
+
+			if w.Code != tt.code {
+				t.Fatalf("expected %d, got %d\n%s", tt.code, w.Code, w.Body.String())
+			}
+			if len(store.builds) != tt.builds {
+				t.Fatalf("expected %d build(s), got %d", tt.builds, len(store.builds))
+			}
+		})
+	}
+}
+
+func TestGithubOpts_Validate(t *testing.T) {
+	if err := (GithubOpts{RejectUnsigned: true, AllowUnsigned: true}).Validate(); err == nil {
+		t.Error("expected an error when both rejecting and allowing unsigned deliveries")
+	}
+	if err := (GithubOpts{RejectUnsigned: true}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (GithubOpts{EventProjects: map[string]string{"release": ""}}).Validate(); err == nil {
+		t.Error("expected an error for a route to an empty project name")
+	}
+	if err := (GithubOpts{BuildTypes: map[string]string{"issue_comment:created": ""}}).Validate(); err == nil {
+		t.Error("expected an error for a rename to an empty build type")
+	}
+	if err := (GithubOpts{AppID: 13, DefaultInstallationID: -1}).Validate(); err == nil {
+		t.Error("expected an error for a negative default installation ID")
+	}
+	if err := (GithubOpts{RequireTLS: true, TrustedProxies: []string{"ingress"}}).Validate(); err == nil {
+		t.Error("expected an error for a trusted proxy that is not an IP")
+	}
+	if err := (GithubOpts{DefaultBranch: "refs/heads/main"}).Validate(); err == nil {
+		t.Error("expected an error for a default branch that is a ref")
+	}
+}
+
+func TestGithubOpts_Validate_appID(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     GithubOpts
+		mustFail bool
+	}{
+		{name: "all events without an App", opts: GithubOpts{EmittedEvents: []string{"*"}}},
+		{name: "issue comments without an App", opts: GithubOpts{EmittedEvents: []string{"push", "issue_comment:created"}}, mustFail: true},
+		{name: "check runs without an App", opts: GithubOpts{EmittedEvents: []string{"CHECK_RUN"}}, mustFail: true},
+		{name: "mergeability without an App", opts: GithubOpts{EmittedEvents: []string{"push"}, RequireMergeable: true}, mustFail: true},
+		{name: "repo info without an App", opts: GithubOpts{EmittedEvents: []string{"push"}, RepoInfo: true}, mustFail: true},
+		{name: "default installation without an App", opts: GithubOpts{EmittedEvents: []string{"push"}, DefaultInstallationID: 2311213}, mustFail: true},
+		{name: "approval reaction without an App", opts: GithubOpts{EmittedEvents: []string{"push"}, ApprovalReaction: "+1"}, mustFail: true},
+		{name: "glob of issue comments without an App", opts: GithubOpts{EmittedEvents: []string{"issue*"}}},
+		{name: "actions of issue comments without an App", opts: GithubOpts{EmittedEvents: []string{"issue_comment:*"}}, mustFail: true},
+		{name: "check runs named beside all events", opts: GithubOpts{EmittedEvents: []string{"*", "!issue_comment", "check_run:created"}}, mustFail: true},
+		{name: "App-less events", opts: GithubOpts{EmittedEvents: []string{"push", "milestone"}}},
+		{name: "App events excluded", opts: GithubOpts{EmittedEvents: []string{"*", "!issue_comment", "!pull_request", "!check_run"}}},
+		{name: "all events with an App", opts: GithubOpts{AppID: 13, EmittedEvents: []string{"*"}, RequireMergeable: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if tt.mustFail {
+				if err == nil || !strings.Contains(err.Error(), "APP_ID must be set") {
+					t.Fatalf("expected an error about APP_ID, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGithubOpts_WildcardAppEvents(t *testing.T) {
+	tests := []struct {
+		events   []string
+		expected []string
+	}{
+		{events: []string{"*"}, expected: []string{"issue_comment", "pull_request", "check_run"}},
+		{events: []string{"ISSUE*", "PUSH"}, expected: []string{"issue_comment"}},
+		{events: []string{"*", "!issue_comment", "pull_request:opened"}, expected: []string{"check_run"}},
+		{events: []string{"*", "!issue_comment", "!pull_request", "!check_run"}},
+		{events: []string{"push", "check_run"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.events, ","), func(t *testing.T) {
+			if got := (GithubOpts{EmittedEvents: tt.events}).WildcardAppEvents(); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+// routingStore serves additional projects by name on top of the repo-derived one,
+// which is served for any name of the form "owner/repo"
+type routingStore struct {
+	*testStore
+	projects map[string]*brigade.Project
+}
+
+func (s *routingStore) GetProject(name string) (*brigade.Project, error) {
+	if p, ok := s.projects[name]; ok {
+		return p, nil
+	}
+	if !strings.Contains(name, "/") {
+		return nil, errors.New("project not found")
+	}
+	return s.testStore.GetProject(name)
+}
+
+func TestGithubHandler_eventProjects(t *testing.T) {
+	tests := []struct {
+		name     string
+		routes   map[string]string
+		expected map[string]string
+		code     int
+	}{
+		{
+			name: "no routes",
+			expected: map[string]string{
+				"issue_comment":         "brigade-repo",
+				"issue_comment:created": "brigade-repo",
+			},
+			code: http.StatusOK,
+		},
+		{
+			name:   "event type route",
+			routes: map[string]string{"issue_comment": "comment-pipeline"},
+			expected: map[string]string{
+				"issue_comment":         "brigade-comments",
+				"issue_comment:created": "brigade-comments",
+			},
+			code: http.StatusOK,
+		},
+		{
+			name: "action route takes precedence",
+			routes: map[string]string{
+				"issue_comment":         "comment-pipeline",
+				"issue_comment:created": "review-pipeline",
+			},
+			expected: map[string]string{
+				"issue_comment":         "brigade-comments",
+				"issue_comment:created": "brigade-reviews",
+			},
+			code: http.StatusOK,
+		},
+		{
+			name:   "missing routed project",
+			routes: map[string]string{"issue_comment:created": "missing-pipeline"},
+			expected: map[string]string{
+				"issue_comment": "brigade-repo",
+			},
+			code: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestStore()
+			ts.proj.ID = "brigade-repo"
+			store := &routingStore{
+				testStore: ts,
+				projects: map[string]*brigade.Project{
+					"comment-pipeline": {ID: "brigade-comments"},
+					"review-pipeline":  {ID: "brigade-reviews"},
+				},
+			}
+			s := newTestGithubHandler(store, t)
+			s.opts.EventProjects = tt.routes
+
+			w := handleTestIssueComment(t, s)
+
+			if w.Code != tt.code {
+				t.Fatalf("expected %d, got %d\n%s", tt.code, w.Code, w.Body.String())
+			}
+			got := map[string]string{}
+			for _, b := range ts.builds {
+				got[b.Type] = b.ProjectID
+			}
+			if len(got) != len(tt.expected) {
+				t.Fatalf("expected builds %v, got %v", tt.expected, got)
+			}
+			for et, id := range tt.expected {
+				if got[et] != id {
+					t.Errorf("expected %q build for project %q, got %q", et, id, got[et])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	body := []byte(`{"comment":{"id":9007199254740993,"node_id":"MDEyOklzc3VlQ29tbWVudDE="},"created_at":1564600000123}`)
+
+	pl, err := decodeBody(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.Marshal(Payload{Body: pl})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{`"id":9007199254740993`, `"created_at":1564600000123`} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("expected %s to survive the remarshal, got %s", expected, out)
+		}
+	}
+}
+
+func TestGithubHandler_checkDraft(t *testing.T) {
+	tests := []struct {
+		name          string
+		draft         *bool
+		emitOnDraftPR bool
+		skipped       bool
+	}{
+		{name: "ready for review", draft: github.Bool(false)},
+		{name: "draft state unknown"},
+		{name: "draft", draft: github.Bool(true), skipped: true},
+		{name: "draft when enabled", draft: github.Bool(true), emitOnDraftPR: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestGithubHandler(newTestStore(), t)
+			s.opts.EmitOnDraftPR = tt.emitOnDraftPR
+
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request, _ = http.NewRequest("POST", "", nil)
+
+			err := s.checkDraft(ctx, &github.PullRequest{Number: github.Int(2), Draft: tt.draft})
+			if tt.skipped {
+				if err != errBuildSkipped {
+					t.Fatalf("expected the build to be skipped, got %v", err)
+				}
+				if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "draft") {
+					t.Errorf("unexpected response: %d\n%s", w.Code, w.Body.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_ignoredStatus(t *testing.T) {
+	tests := []struct {
+		ignoredStatus int
+		expected      int
+	}{
+		{ignoredStatus: 0, expected: http.StatusOK},
+		{ignoredStatus: http.StatusAccepted, expected: http.StatusAccepted},
+		{ignoredStatus: http.StatusNoContent, expected: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.expected), func(t *testing.T) {
+			s := newTestGithubHandler(newTestStore(), t)
+			s.opts.IgnoredStatus = tt.ignoredStatus
+
+			unsupported := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(unsupported)
+			ctx.Request, _ = http.NewRequest("POST", "", nil)
+			ctx.Request.Header.Add("X-GitHub-Event", "funzone")
+			s.Handle(ctx)
+
+			ignoredAction := handleTestEvent(t, s, "milestone", []byte(fmt.Sprintf(testMilestonePayload, "edited")))
+
+			for _, w := range []*httptest.ResponseRecorder{unsupported, ignoredAction} {
+				if w.Code != tt.expected {
+					t.Errorf("expected %d, got %d\n%s", tt.expected, w.Code, w.Body.String())
+				}
+				if tt.expected == http.StatusNoContent && w.Body.Len() != 0 {
+					t.Errorf("expected no body, got %s", w.Body.String())
+				}
+			}
+
+			processed := handleTestIssueComment(t, s)
+			if processed.Code != http.StatusOK {
+				t.Errorf("expected 200 for processed deliveries, got %d", processed.Code)
+			}
+		})
+	}
+
+	if err := (GithubOpts{IgnoredStatus: http.StatusNotFound}).Validate(); err == nil {
+		t.Error("expected an error for a non-2xx status")
+	}
+}
+
+func TestGithubHandler_provider(t *testing.T) {
+	tests := []struct {
+		name             string
+		provider         string
+		enterpriseSuffix bool
+		baseURL          string
+		expected         string
+	}{
+		{name: "default", expected: "github"},
+		{name: "configured", provider: "github-enterprise", expected: "github-enterprise"},
+		{name: "suffix on enterprise host", enterpriseSuffix: true, baseURL: "https://ghe.example.com/api/v3/", expected: "github-enterprise"},
+		{name: "no suffix on github.com", enterpriseSuffix: true, expected: "github"},
+		{name: "suffix on configured provider", provider: "acme", enterpriseSuffix: true, baseURL: "https://ghe.example.com/api/v3/", expected: "acme-enterprise"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.Github.BaseURL = tt.baseURL
+			s := newTestGithubHandler(store, t)
+			s.opts.Provider = tt.provider
+			s.opts.EnterpriseSuffix = tt.enterpriseSuffix
+
+			handleTestEvent(t, s, "milestone", []byte(fmt.Sprintf(testMilestonePayload, "created")))
+
+			if len(store.builds) != 2 {
+				t.Fatalf("expected 2 builds, got %d", len(store.builds))
+			}
+			for _, b := range store.builds {
+				if b.Provider != tt.expected {
+					t.Errorf("expected provider %q on %q build, got %q", tt.expected, b.Type, b.Provider)
+				}
+			}
+		})
+	}
+}
+
+func TestGithubHandler_buildTypes(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.EmittedEvents = []string{"milestone:created"}
+	s.opts.BuildTypes = map[string]string{
+		"milestone:created": "legacy_milestone",
+		"milestone":         "never_emitted",
+	}
+
+	handleTestEvent(t, s, "milestone", []byte(fmt.Sprintf(testMilestonePayload, "created")))
+
+	if len(store.builds) != 1 {
+		t.Fatalf("expected only the emitted milestone:created build, got %d builds", len(store.builds))
+	}
+	if b := store.builds[0]; b.Type != "legacy_milestone" {
+		t.Errorf("expected the build type to be renamed to legacy_milestone, got %q", b.Type)
+	}
+}
+
+func TestGithubHandler_coalesceActions(t *testing.T) {
+	tests := []struct {
+		name          string
+		coalesce      bool
+		emittedEvents []string
+		types         []string
+		actions       []string
+	}{
+		{name: "separate", emittedEvents: []string{"*"}, types: []string{"milestone", "milestone:created"}},
+		{name: "coalesced", coalesce: true, emittedEvents: []string{"*"}, types: []string{"milestone"}, actions: []string{"milestone", "milestone:created"}},
+		{name: "single emitted type", coalesce: true, emittedEvents: []string{"milestone:created"}, types: []string{"milestone:created"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.CoalesceActions = tt.coalesce
+			s.opts.EmittedEvents = tt.emittedEvents
+
+			w := handleTestEvent(t, s, "milestone", []byte(fmt.Sprintf(testMilestonePayload, "created")))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+
+			var types []string
+			for _, b := range store.builds {
+				types = append(types, b.Type)
+			}
+			if strings.Join(types, ",") != strings.Join(tt.types, ",") {
+				t.Fatalf("expected builds %v, got %v", tt.types, types)
+			}
+
+			pl := struct {
+				Actions  []string `json:"actions"`
+				TargetID int64    `json:"targetID"`
+			}{}
+			if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(pl.Actions, ",") != strings.Join(tt.actions, ",") {
+				t.Errorf("expected actions %v, got %v", tt.actions, pl.Actions)
+			}
+			if pl.TargetID != 3361444 {
+				t.Errorf("expected the payload to be kept, got %s", store.builds[0].Payload)
+			}
+		})
+	}
+}
+
+func TestHandleIssueCommentEvent_verifyPullRequestHead(t *testing.T) {
+	tests := []struct {
+		name    string
+		verify  bool
+		heads   []string
+		skipped bool
+		fetches int
+	}{
+		{name: "unverified", heads: []string{"c1", "c2"}, fetches: 1},
+		{name: "head unchanged", verify: true, heads: []string{"c1", "c1"}, fetches: 2},
+		{name: "head changed", verify: true, heads: []string{"c1", "c2"}, skipped: true, fetches: 2},
+	}
+
+	body, err := ioutil.ReadFile("testdata/github-issue_comment_pull_request_author_allowed-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestGithubHandler(newTestStore(), t)
+			s.opts.AppID = 13
+			s.opts.VerifyPullRequestHead = tt.verify
+			s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+				return "v1.installation-token", time.Time{}, nil
+			}
+			fetches := 0
+			s.getPullRequest = func(c *gin.Context, s *githubHook, token, repo string, number int, proj *brigade.Project) (*github.PullRequest, error) {
+				head := tt.heads[fetches]
+				fetches++
+				return &github.PullRequest{Number: github.Int(2), Head: &github.PullRequestBranch{SHA: github.String(head)}}, nil
+			}
+
+			ice := &github.IssueCommentEvent{}
+			if err := json.Unmarshal(body, ice); err != nil {
+				t.Fatal(err)
+			}
+			ice.Installation = &github.Installation{ID: github.Int64(2311213)}
+
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request, _ = http.NewRequest("POST", "", nil)
+
+			rev, payload, err := handleIssueCommentEvent(ctx, s, ice, brigade.Revision{}, newTestStore().proj, body)
+			if fetches != tt.fetches {
+				t.Errorf("expected %d fetches of the pull request, got %d", tt.fetches, fetches)
+			}
+			if tt.skipped {
+				if err != errBuildSkipped {
+					t.Fatalf("expected the build to be skipped, got %v", err)
+				}
+				if !strings.Contains(w.Body.String(), "pull request head changed") {
+					t.Errorf("unexpected response: %d\n%s", w.Code, w.Body.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v\n%s", err, w.Body.String())
+			}
+			if rev.Commit != "c1" {
+				t.Errorf("expected the revision to be pinned to c1, got %q", rev.Commit)
+			}
+			pl := Payload{}
+			if err := json.Unmarshal(payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.PullHeadSHA != "c1" {
+				t.Errorf("expected the head SHA c1 to be recorded in the payload, got %q", pl.PullHeadSHA)
+			}
+		})
+	}
+}
+
+func TestHandleIssueCommentEvent_pullStats(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		expected *PullStats
+	}{
+		{name: "disabled"},
+		{name: "enabled", enabled: true, expected: &PullStats{Additions: 10, Deletions: 3, ChangedFiles: 2}},
+	}
+
+	body, err := ioutil.ReadFile("testdata/github-issue_comment_pull_request_author_allowed-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestGithubHandler(newTestStore(), t)
+			s.opts.AppID = 13
+			s.opts.PullStats = tt.enabled
+			s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+				return "v1.installation-token", time.Time{}, nil
+			}
+			s.getPullRequest = func(c *gin.Context, s *githubHook, token, repo string, number int, proj *brigade.Project) (*github.PullRequest, error) {
+				return &github.PullRequest{
+					Number:       github.Int(2),
+					Head:         &github.PullRequestBranch{SHA: github.String("c1")},
+					Additions:    github.Int(10),
+					Deletions:    github.Int(3),
+					ChangedFiles: github.Int(2),
+				}, nil
+			}
+
+			ice := &github.IssueCommentEvent{}
+			if err := json.Unmarshal(body, ice); err != nil {
+				t.Fatal(err)
+			}
+			ice.Installation = &github.Installation{ID: github.Int64(2311213)}
+
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request, _ = http.NewRequest("POST", "", nil)
+
+			_, payload, err := handleIssueCommentEvent(ctx, s, ice, brigade.Revision{}, newTestStore().proj, body)
+			if err != nil {
+				t.Fatalf("unexpected error: %v\n%s", err, w.Body.String())
+			}
+			pl := Payload{}
+			if err := json.Unmarshal(payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pl.PullStats, tt.expected) {
+				t.Errorf("expected pull stats %+v, got %+v", tt.expected, pl.PullStats)
+			}
+		})
+	}
+}
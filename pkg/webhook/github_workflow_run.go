@@ -0,0 +1,170 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// workflowRunActionCompleted is the only action of workflow_run events that emits builds
+const workflowRunActionCompleted = "completed"
+
+// DefaultWorkflowRunConclusions are the conclusions of completed workflow runs
+// that emit builds, unless GithubOpts.WorkflowRunConclusions is set
+var DefaultWorkflowRunConclusions = []string{"success"}
+
+// workflowRunConclusions are the conclusions GitHub reports for completed workflow runs
+var workflowRunConclusions = []string{"success", "failure", "neutral", "cancelled", "skipped", "timed_out", "action_required", "stale", "startup_failure"}
+
+// ValidateWorkflowRunConclusions checks that conclusions are conclusions of workflow runs.
+func ValidateWorkflowRunConclusions(conclusions []string) error {
+	for _, c := range conclusions {
+		known := false
+		for _, k := range workflowRunConclusions {
+			known = known || k == c
+		}
+		if !known {
+			return fmt.Errorf("workflow run conclusion %q is not one of %s", c, strings.Join(workflowRunConclusions, ", "))
+		}
+	}
+	return nil
+}
+
+// WorkflowRun is the run of a GitHub Actions workflow of a "workflow_run" event.
+type WorkflowRun struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	RunNumber  int    `json:"run_number"`
+	Event      string `json:"event"`
+	Status     string `json:"status"`
+	Conclusion string `json:"conclusion"`
+	WorkflowID int64  `json:"workflow_id"`
+	HeadBranch string `json:"head_branch"`
+	HeadSHA    string `json:"head_sha"`
+	HTMLURL    string `json:"html_url"`
+}
+
+// WorkflowRunEvent is a "workflow_run" event, which go-github doesn't support.
+type WorkflowRunEvent struct {
+	Action      string       `json:"action"`
+	WorkflowRun *WorkflowRun `json:"workflow_run"`
+	Workflow    *struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+		Path string `json:"path"`
+	} `json:"workflow"`
+	Repo   *github.Repository `json:"repository"`
+	Sender *github.User       `json:"sender"`
+}
+
+// WorkflowRunPayload is the payload of builds for completed workflow runs.
+type WorkflowRunPayload struct {
+	Type string `json:"type"`
+	// ActorID and Actor identify the user that triggered the workflow run
+	ActorID int64  `json:"actorID"`
+	Actor   string `json:"actor"`
+	// Workflow is the name of the workflow, and RunID and RunNumber identify the run
+	Workflow   string      `json:"workflow"`
+	RunID      int64       `json:"runID"`
+	RunNumber  int         `json:"runNumber"`
+	Conclusion string      `json:"conclusion"`
+	HeadBranch string      `json:"headBranch"`
+	HeadSHA    string      `json:"headSHA"`
+	Body       interface{} `json:"body"`
+}
+
+// emitsConclusion returns true if workflow runs that completed with conclusion
+// emit builds, as configured by WorkflowRunConclusions.
+func (s *githubHook) emitsConclusion(conclusion string) bool {
+	conclusions := s.opts.WorkflowRunConclusions
+	if len(conclusions) == 0 {
+		conclusions = DefaultWorkflowRunConclusions
+	}
+	for _, c := range conclusions {
+		if c == conclusion {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWorkflowRun handles "workflow_run" events, emitting builds for workflow
+// runs that completed with one of the configured conclusions, so that deploys
+// can be chained off GitHub Actions workflows.
+func (s *githubHook) handleWorkflowRun(c *gin.Context, eventType string) {
+	body, e, ok := s.readEvent(c, eventType)
+	if !ok {
+		return
+	}
+
+	wre, ok := e.(*WorkflowRunEvent)
+	if !ok {
+		s.rejectUnexpected(c, eventType, e)
+		return
+	}
+	run := wre.WorkflowRun
+	if run == nil {
+		log.Printf("Failed to parse body: %q event without a workflow run", eventType)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		return
+	}
+	repo := wre.Repo.GetFullName()
+
+	proj, ok := s.getProject(c, repo)
+	if !ok {
+		return
+	}
+
+	if !s.validate(c, repo, proj, body) {
+		return
+	}
+
+	if wre.Action != workflowRunActionCompleted {
+		log.Printf("Ignoring %q event with action %q", eventType, wre.Action)
+		s.ignore(c, gin.H{"status": "Ignored"})
+		return
+	}
+	if !s.emitsConclusion(run.Conclusion) {
+		log.Printf("Ignoring %q event for run %d with conclusion %q", eventType, run.ID, run.Conclusion)
+		s.ignore(c, gin.H{"status": "Ignored"})
+		return
+	}
+
+	pl := WorkflowRunPayload{
+		Type:       eventType,
+		ActorID:    wre.Sender.GetID(),
+		Actor:      wre.Sender.GetLogin(),
+		Workflow:   run.Name,
+		RunID:      run.ID,
+		RunNumber:  run.RunNumber,
+		Conclusion: run.Conclusion,
+		HeadBranch: run.HeadBranch,
+		HeadSHA:    run.HeadSHA,
+	}
+	if wre.Workflow != nil && wre.Workflow.Name != "" {
+		pl.Workflow = wre.Workflow.Name
+	}
+
+	var err error
+	if pl.Body, err = decodeBody(body); err != nil {
+		log.Printf("Failed to parse body: %s", err)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "Malformed body"})
+		return
+	}
+
+	payload, err := json.Marshal(pl)
+	if err != nil {
+		log.Print(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "JSON encoding error"})
+		return
+	}
+
+	rev := brigade.Revision{Commit: run.HeadSHA, Ref: fmt.Sprintf("refs/heads/%s", run.HeadBranch)}
+	s.emit(c, eventType, wre.Action, rev, payload, proj)
+}
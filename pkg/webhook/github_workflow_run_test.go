@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+const testWorkflowRunPayload = `{
+  "action": "%s",
+  "workflow_run": {
+    "id": 30433642,
+    "name": "Build",
+    "run_number": 562,
+    "event": "push",
+    "status": "completed",
+    "conclusion": "%s",
+    "workflow_id": 159038,
+    "head_branch": "main",
+    "head_sha": "acb5820ced9479c074f688cc328bf03f341a511d",
+    "html_url": "https://github.com/baxterthehacker/public-repo/actions/runs/30433642"
+  },
+  "workflow": {"id": 159038, "name": "Build and test", "path": ".github/workflows/build.yml"},
+  "repository": {"id": 35129377, "full_name": "baxterthehacker/public-repo"},
+  "sender": {"id": 6752317, "login": "baxterthehacker"}
+}`
+
+func TestGithubHandler_workflowRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      string
+		conclusion  string
+		conclusions []string
+		ignored     bool
+	}{
+		{name: "success", action: "completed", conclusion: "success"},
+		{name: "failure", action: "completed", conclusion: "failure", ignored: true},
+		{name: "configured failure", action: "completed", conclusion: "failure", conclusions: []string{"success", "failure"}},
+		{name: "requested", action: "requested", ignored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.WorkflowRunConclusions = tt.conclusions
+
+			w := handleTestEvent(t, s, "workflow_run", []byte(fmt.Sprintf(testWorkflowRunPayload, tt.action, tt.conclusion)))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			if tt.ignored {
+				if len(store.builds) != 0 {
+					t.Fatalf("expected no builds, got %d", len(store.builds))
+				}
+				return
+			}
+			if len(store.builds) != 2 || store.builds[1].Type != "workflow_run:completed" {
+				t.Fatalf("expected a workflow_run:completed build, got %d builds", len(store.builds))
+			}
+			b := store.builds[1]
+			if b.Revision.Commit != "acb5820ced9479c074f688cc328bf03f341a511d" || b.Revision.Ref != "refs/heads/main" {
+				t.Errorf("unexpected revision %+v", b.Revision)
+			}
+
+			pl := WorkflowRunPayload{}
+			if err := json.Unmarshal(b.Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.Workflow != "Build and test" || pl.RunID != 30433642 || pl.RunNumber != 562 {
+				t.Errorf("unexpected workflow %q, run %d/%d", pl.Workflow, pl.RunID, pl.RunNumber)
+			}
+			if pl.HeadSHA != b.Revision.Commit || pl.HeadBranch != "main" || pl.Conclusion != tt.conclusion {
+				t.Errorf("unexpected head %s of %q with conclusion %q", pl.HeadSHA, pl.HeadBranch, pl.Conclusion)
+			}
+		})
+	}
+}
+
+func TestGithubHandler_workflowRunNotEmitted(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.EmittedEvents = []string{"milestone"}
+
+	w := handleTestEvent(t, s, "workflow_run", []byte(fmt.Sprintf(testWorkflowRunPayload, "completed", "success")))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 0 {
+		t.Fatalf("expected no builds for events that are not emitted, got %d", len(store.builds))
+	}
+}
+
+func TestValidateWorkflowRunConclusions(t *testing.T) {
+	if err := ValidateWorkflowRunConclusions([]string{"success", "neutral"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := ValidateWorkflowRunConclusions([]string{"passed"}); err == nil {
+		t.Error("expected an error for an unknown conclusion")
+	}
+}
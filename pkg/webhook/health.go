@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// projectsHealthTTL is how long a projects health report is served from cache.
+// Every report makes a few GitHub API calls per project, so this bounds the API
+// usage of the endpoint regardless of how often it is called.
+const projectsHealthTTL = time.Minute
+
+// ProjectHealth reports whether a Brigade project is ready to receive builds.
+type ProjectHealth struct {
+	// SecretSet is true if the project has a shared secret to verify deliveries with
+	SecretSet bool `json:"secretSet"`
+	// InstallationID is the App installation with access to the repo, if any
+	InstallationID int64 `json:"installationID,omitempty"`
+	// Installed is true if a token could be negotiated for the installation
+	Installed bool `json:"installed"`
+	// RepoAccessible is true if the repo could be fetched with the token
+	RepoAccessible bool `json:"repoAccessible"`
+	// Error explains why the project is not ready
+	Error string `json:"error,omitempty"`
+}
+
+// Ready returns true if the project is ready to receive builds.
+func (h ProjectHealth) Ready() bool {
+	return h.Error == ""
+}
+
+// projectsHealth checks the readiness of every Brigade project.
+type projectsHealth struct {
+	hook      *githubHook
+	checkRepo func(c context.Context, token string, proj *brigade.Project) error
+	ttl       time.Duration
+	now       func() time.Time
+
+	// mu serializes the reports, so that concurrent calls share the cached one
+	mu      sync.Mutex
+	report  map[string]ProjectHealth
+	checked time.Time
+}
+
+// NewProjectsHealthHandler creates a handler that reports the readiness of every
+// Brigade project, keyed by project name.
+func NewProjectsHealthHandler(s storage.Store, x509Key []byte, opts GithubOpts) gin.HandlerFunc {
+	gh := &githubHook{
+		store: s,
+		key:   x509Key,
+		opts:  opts,
+	}
+	gh.getToken = gh.installationToken
+	gh.installations = newInstallationCache(installationsTTL, gh.listInstallationRepos)
+	ph := &projectsHealth{
+		hook:      gh,
+		checkRepo: getRepo,
+		ttl:       projectsHealthTTL,
+		now:       time.Now,
+	}
+	return ph.Handle
+}
+
+// Handle responds with the cached report, or a new one once the cache expired.
+func (ph *projectsHealth) Handle(c *gin.Context) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	if ph.report == nil || ph.now().Sub(ph.checked) >= ph.ttl {
+		report, err := ph.check(c.Request.Context())
+		if err != nil {
+			log.Printf("Failed to list projects: %s", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "failed to list projects"})
+			return
+		}
+		ph.report = report
+		ph.checked = ph.now()
+	}
+
+	status := "OK"
+	for _, h := range ph.report {
+		if !h.Ready() {
+			status = "Degraded"
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"status": status, "checked": ph.checked, "projects": ph.report})
+}
+
+func (ph *projectsHealth) check(c context.Context) (map[string]ProjectHealth, error) {
+	projs, err := ph.hook.store.GetProjects()
+	if err != nil {
+		return nil, err
+	}
+	report := map[string]ProjectHealth{}
+	for _, proj := range projs {
+		report[proj.Name] = ph.checkProject(c, proj)
+	}
+	return report, nil
+}
+
+// checkProject authenticates as the installation with access to the repo of
+// proj, or with the GitHub token of proj without an App, and fetches the repo.
+func (ph *projectsHealth) checkProject(c context.Context, proj *brigade.Project) ProjectHealth {
+	s := ph.hook
+	h := ProjectHealth{SecretSet: proj.SharedSecret != "" || s.opts.DefaultSharedSecret != ""}
+
+	token := proj.Github.Token
+	if s.opts.AppID != 0 {
+		id, err := s.installations.installationID(c, proj.Name)
+		if err != nil {
+			h.Error = "failed to list installations: " + err.Error()
+			return h
+		}
+		if id == 0 {
+			h.Error = "no installation of the App has access to the repo"
+			return h
+		}
+		h.InstallationID = id
+		if token, _, err = s.getToken(s.opts.AppID, int(id), proj.Github); err != nil {
+			h.Error = "failed to negotiate an installation token: " + err.Error()
+			return h
+		}
+		h.Installed = true
+	} else if token == "" {
+		h.Error = "neither an App ID nor a GitHub token is configured"
+		return h
+	}
+
+	if err := ph.checkRepo(c, token, proj); err != nil {
+		h.Error = "repo is not accessible: " + err.Error()
+		return h
+	}
+	h.RepoAccessible = true
+	return h
+}
+
+// getRepo fetches the repo of proj, as a cheap authenticated call.
+func getRepo(c context.Context, token string, proj *brigade.Project) error {
+	parts := strings.Split(proj.Name, "/")
+	if len(parts) != 2 {
+		return errors.New("invalid repo name")
+	}
+	client, err := InstallationTokenClient(token, proj.Github.BaseURL, proj.Github.UploadURL)
+	if err != nil {
+		return err
+	}
+	_, _, err = client.Repositories.Get(c, parts[0], parts[1])
+	return err
+}
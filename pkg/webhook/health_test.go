@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+// projectsStore serves a fixed list of projects
+type projectsStore struct {
+	projs []*brigade.Project
+	err   error
+	storage.Store
+}
+
+func (s *projectsStore) GetProjects() ([]*brigade.Project, error) {
+	return s.projs, s.err
+}
+
+func newTestProjectsHealth(store storage.Store, appID int) (*projectsHealth, *int) {
+	s := &githubHook{store: store, opts: GithubOpts{AppID: appID}}
+	s.installations = newInstallationCache(time.Minute, func(c context.Context) (map[string]int64, error) {
+		return map[string]int64{
+			"myorg/app":    1,
+			"myorg/broken": 2,
+			"myorg/gone":   1,
+		}, nil
+	})
+	s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+		if installationID == 2 {
+			return "", time.Time{}, errors.New("installation suspended")
+		}
+		return "v1.token", time.Now().Add(time.Hour), nil
+	}
+	calls := 0
+	return &projectsHealth{
+		hook: s,
+		checkRepo: func(c context.Context, token string, proj *brigade.Project) error {
+			calls++
+			if proj.Name == "myorg/gone" {
+				return errors.New("404 Not Found")
+			}
+			return nil
+		},
+		ttl: time.Minute,
+		now: time.Now,
+	}, &calls
+}
+
+func getProjectsHealth(t *testing.T, ph *projectsHealth) (int, map[string]ProjectHealth) {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest("GET", "/projects/health", nil)
+	ph.Handle(ctx)
+
+	res := struct {
+		Projects map[string]ProjectHealth `json:"projects"`
+	}{}
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, res.Projects
+}
+
+func TestProjectsHealth(t *testing.T) {
+	store := &projectsStore{projs: []*brigade.Project{
+		{Name: "myorg/app", SharedSecret: "asdf"},
+		{Name: "myorg/broken", SharedSecret: "asdf"},
+		{Name: "myorg/gone"},
+		{Name: "myorg/uninstalled"},
+	}}
+	ph, calls := newTestProjectsHealth(store, 13)
+
+	code, report := getProjectsHealth(t, ph)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	expected := map[string]ProjectHealth{
+		"myorg/app":         {SecretSet: true, InstallationID: 1, Installed: true, RepoAccessible: true},
+		"myorg/broken":      {SecretSet: true, InstallationID: 2, Error: "failed to negotiate an installation token: installation suspended"},
+		"myorg/gone":        {InstallationID: 1, Installed: true, Error: "repo is not accessible: 404 Not Found"},
+		"myorg/uninstalled": {Error: "no installation of the App has access to the repo"},
+	}
+	for name, want := range expected {
+		if got := report[name]; got != want {
+			t.Errorf("%s: expected %+v, got %+v", name, want, got)
+		}
+	}
+
+	getProjectsHealth(t, ph)
+	if *calls != 2 {
+		t.Errorf("expected the second report to be served from cache, got %d repo checks", *calls)
+	}
+}
+
+func TestProjectsHealth_withoutApp(t *testing.T) {
+	store := &projectsStore{projs: []*brigade.Project{
+		{Name: "myorg/app", Github: brigade.Github{Token: "ghp_token"}},
+		{Name: "myorg/tokenless"},
+	}}
+	ph, _ := newTestProjectsHealth(store, 0)
+
+	_, report := getProjectsHealth(t, ph)
+	if h := report["myorg/app"]; !h.RepoAccessible || h.Installed {
+		t.Errorf("expected the repo to be accessible with the project token, got %+v", h)
+	}
+	if h := report["myorg/tokenless"]; h.Ready() {
+		t.Errorf("expected a project without a token not to be ready, got %+v", h)
+	}
+}
+
+func TestProjectsHealth_storeFailure(t *testing.T) {
+	ph, _ := newTestProjectsHealth(&projectsStore{err: errors.New("store unavailable")}, 13)
+	if code, _ := getProjectsHealth(t, ph); code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", code)
+	}
+}
@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+)
+
+// installationsTTL is how long the repos of the App's installations are cached
+const installationsTTL = 10 * time.Minute
+
+// ListInstallationRepos lists the repos accessible to every installation of the
+// App, and returns the installation ID of each repo keyed by its lowercased full name.
+//
+// appClient must authenticate as the App, and installationClient must return a
+// client authenticating as the given installation.
+func ListInstallationRepos(c context.Context, appClient *github.Client, installationClient func(instID int64) (*github.Client, error)) (map[string]int64, error) {
+	repos := map[string]int64{}
+
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		insts, res, err := appClient.Apps.ListInstallations(c, opt)
+		if err != nil {
+			return nil, fmt.Errorf("failed listing installations: %v", err)
+		}
+		for _, inst := range insts {
+			client, err := installationClient(inst.GetID())
+			if err != nil {
+				return nil, fmt.Errorf("failed authenticating as installation %d: %v", inst.GetID(), err)
+			}
+			if err := listRepos(c, client, inst.GetID(), repos); err != nil {
+				return nil, err
+			}
+		}
+		if res.NextPage == 0 {
+			return repos, nil
+		}
+		opt.Page = res.NextPage
+	}
+}
+
+func listRepos(c context.Context, client *github.Client, instID int64, repos map[string]int64) error {
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		rs, res, err := client.Apps.ListRepos(c, opt)
+		if err != nil {
+			return fmt.Errorf("failed listing repos of installation %d: %v", instID, err)
+		}
+		for _, r := range rs {
+			repos[strings.ToLower(r.GetFullName())] = instID
+		}
+		if res.NextPage == 0 {
+			return nil
+		}
+		opt.Page = res.NextPage
+	}
+}
+
+// installationCache resolves the installation that has access to a repo, for
+// events that don't carry the installation.
+type installationCache struct {
+	ttl  time.Duration
+	list func(c context.Context) (map[string]int64, error)
+	now  func() time.Time
+
+	mu      sync.Mutex
+	repos   map[string]int64
+	fetched time.Time
+}
+
+func newInstallationCache(ttl time.Duration, list func(c context.Context) (map[string]int64, error)) *installationCache {
+	return &installationCache{
+		ttl:  ttl,
+		list: list,
+		now:  time.Now,
+	}
+}
+
+// installationID returns the ID of the installation that has access to repo, or
+// zero if there is none. The repos are listed again once the TTL elapsed, or when
+// repo is unknown, as it may have been added to an installation since.
+func (ic *installationCache) installationID(c context.Context, repo string) (int64, error) {
+	repo = strings.ToLower(repo)
+
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	fresh := ic.repos != nil && ic.now().Sub(ic.fetched) < ic.ttl
+	if id, ok := ic.repos[repo]; ok && fresh {
+		return id, nil
+	}
+
+	repos, err := ic.list(c)
+	if err != nil {
+		return 0, err
+	}
+	ic.repos = repos
+	ic.fetched = ic.now()
+	return repos[repo], nil
+}
+
+// listInstallationRepos lists the repos of every installation of the App.
+func (s *githubHook) listInstallationRepos(c context.Context) (map[string]int64, error) {
+	tok, err := JWT(strconv.Itoa(s.opts.AppID), s.key)
+	if err != nil {
+		return nil, err
+	}
+	appClient, err := GhClient(brigade.Github{Token: tok})
+	if err != nil {
+		return nil, err
+	}
+	return ListInstallationRepos(c, appClient, func(instID int64) (*github.Client, error) {
+		tok, _, err := s.getToken(s.opts.AppID, int(instID), brigade.Github{})
+		if err != nil {
+			return nil, err
+		}
+		return InstallationTokenClient(tok, "", "")
+	})
+}
+
+// installationID returns the ID of the installation of the event, or else of the
+// installation that has access to repo, or else the default installation. It
+// returns zero if none is known.
+func (s *githubHook) installationID(c context.Context, inst *github.Installation, repo string) int64 {
+	if id := inst.GetID(); id != 0 {
+		return id
+	}
+	if s.installations != nil && s.opts.AppID != 0 {
+		id, err := s.installations.installationID(c, repo)
+		if err != nil {
+			log.Printf("Failed to resolve the installation for %q: %s", repo, err)
+		} else if id != 0 {
+			log.Printf("Resolved installation %d for %q, as the event carries none", id, repo)
+			return id
+		}
+	}
+	if id := s.opts.DefaultInstallationID; id != 0 {
+		log.Printf("Using the default installation %d for %q, as the event carries none", id, repo)
+		return id
+	}
+	return 0
+}
+
+// update adds the repos added to the installation instID to the cache, and
+// removes the removed ones, as told by installation events. Until the repos are
+// listed for the first time, nothing is cached and the update is a no-op.
+func (ic *installationCache) update(instID int64, added, removed []string) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if ic.repos == nil {
+		return
+	}
+	for _, r := range added {
+		ic.repos[strings.ToLower(r)] = instID
+	}
+	for _, r := range removed {
+		if ic.repos[strings.ToLower(r)] == instID {
+			delete(ic.repos, strings.ToLower(r))
+		}
+	}
+}
+
+// forget removes every repo of the installation instID from the cache, like
+// when the App is uninstalled, so that no token is negotiated for it anymore.
+func (ic *installationCache) forget(instID int64) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	for r, id := range ic.repos {
+		if id == instID {
+			delete(ic.repos, r)
+		}
+	}
+}
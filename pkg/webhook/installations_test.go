@@ -0,0 +1,173 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+)
+
+// newTestInstallationsServer serves two pages of installations, the second of
+// which has two pages of repos.
+func newTestInstallationsServer(t *testing.T) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		page := r.URL.Query().Get("page")
+		next := func(path string) {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=2>; rel="next"`, ts.URL, path))
+		}
+		switch {
+		case r.URL.Path == "/app/installations" && page == "":
+			next(r.URL.Path)
+			w.Write([]byte(`[{"id":1}]`))
+		case r.URL.Path == "/app/installations" && page == "2":
+			w.Write([]byte(`[{"id":2}]`))
+		case r.URL.Path == "/installation/repositories" && r.Header.Get("Authorization") == "token inst-1":
+			w.Write([]byte(`{"total_count":1,"repositories":[{"full_name":"myorg/myapp"}]}`))
+		case r.URL.Path == "/installation/repositories" && page == "":
+			next(r.URL.Path)
+			w.Write([]byte(`{"total_count":2,"repositories":[{"full_name":"OtherOrg/Web"}]}`))
+		case r.URL.Path == "/installation/repositories" && page == "2":
+			w.Write([]byte(`{"total_count":2,"repositories":[{"full_name":"otherorg/api"}]}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+	return ts
+}
+
+func TestListInstallationRepos(t *testing.T) {
+	ts := newTestInstallationsServer(t)
+	defer ts.Close()
+
+	appClient, err := GhClient(brigade.Github{Token: "jwt", BaseURL: ts.URL + "/", UploadURL: ts.URL + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos, err := ListInstallationRepos(context.Background(), appClient, func(instID int64) (*github.Client, error) {
+		return InstallationTokenClient(fmt.Sprintf("inst-%d", instID), ts.URL+"/", ts.URL+"/")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int64{"myorg/myapp": 1, "otherorg/web": 2, "otherorg/api": 2}
+	if len(repos) != len(expected) {
+		t.Fatalf("expected repos %v, got %v", expected, repos)
+	}
+	for repo, id := range expected {
+		if repos[repo] != id {
+			t.Errorf("expected installation %d for %s, got %d", id, repo, repos[repo])
+		}
+	}
+}
+
+func TestInstallationCache(t *testing.T) {
+	lists := 0
+	repos := map[string]int64{"myorg/myapp": 1}
+	now := time.Now()
+	ic := newInstallationCache(time.Minute, func(c context.Context) (map[string]int64, error) {
+		lists++
+		return repos, nil
+	})
+	ic.now = func() time.Time { return now }
+
+	lookup := func(repo string, expected int64, expectedLists int) {
+		t.Helper()
+		id, err := ic.installationID(context.Background(), repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != expected {
+			t.Errorf("expected installation %d for %s, got %d", expected, repo, id)
+		}
+		if lists != expectedLists {
+			t.Errorf("expected %d lists, got %d", expectedLists, lists)
+		}
+	}
+
+	lookup("MyOrg/MyApp", 1, 1)
+	lookup("myorg/myapp", 1, 1)
+
+	// Unknown repos may have been added to an installation since
+	repos = map[string]int64{"myorg/myapp": 1, "myorg/new": 3}
+	lookup("myorg/new", 3, 2)
+
+	now = now.Add(2 * time.Minute)
+	repos = map[string]int64{"myorg/myapp": 4}
+	lookup("myorg/myapp", 4, 3)
+}
+
+func TestGithubHandler_resolveInstallation(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.opts.AppID = 13
+	s.installations = newInstallationCache(time.Minute, func(c context.Context) (map[string]int64, error) {
+		return map[string]int64{"baxterthehacker/public-repo": 2311213}, nil
+	})
+	var gotInstID int
+	s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+		gotInstID = installationID
+		return "v1.installation-token", time.Time{}, nil
+	}
+
+	payload := strings.Replace(fmt.Sprintf(testCheckRunPayload, "rerequested"), `"installation": {"id": 2311213},`, "", 1)
+	w := handleTestEvent(t, s, "check_run", []byte(payload))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+	}
+	if gotInstID != 2311213 {
+		t.Errorf("expected the token of the resolved installation, got installation %d", gotInstID)
+	}
+}
+
+func TestGithubHandler_defaultInstallation(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		repos    map[string]int64
+		expected int
+	}{
+		{name: "explicit installation", payload: fmt.Sprintf(testCheckRunPayload, "rerequested"), expected: 2311213},
+		{name: "resolved installation", repos: map[string]int64{"baxterthehacker/public-repo": 7}, expected: 7},
+		{name: "default installation", repos: map[string]int64{}, expected: 42},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.AppID = 13
+			s.opts.DefaultInstallationID = 42
+			s.installations = newInstallationCache(time.Minute, func(c context.Context) (map[string]int64, error) {
+				return tt.repos, nil
+			})
+			var gotInstID int
+			s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+				gotInstID = installationID
+				return "v1.installation-token", time.Time{}, nil
+			}
+
+			payload := tt.payload
+			if payload == "" {
+				payload = strings.Replace(fmt.Sprintf(testCheckRunPayload, "rerequested"), `"installation": {"id": 2311213},`, "", 1)
+			}
+			w := handleTestEvent(t, s, "check_run", []byte(payload))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			if gotInstID != tt.expected {
+				t.Errorf("expected the token of installation %d, got installation %d", tt.expected, gotInstID)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package webhook
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+const (
+	installationTargetTypeHeader = "X-GitHub-Hook-Installation-Target-Type"
+	installationTargetIDHeader   = "X-GitHub-Hook-Installation-Target-ID"
+)
+
+// InstallationTarget is what the hook of a delivery is installed on, like a repo
+// for a repo hook, or the App for an App hook.
+type InstallationTarget struct {
+	// Type is the target type, like "repository", "organization" or "integration"
+	Type string `json:"type"`
+	ID   int64  `json:"id,omitempty"`
+}
+
+// installationTarget returns the target of the delivery, nil if its headers
+// don't tell.
+func installationTarget(c *gin.Context) *InstallationTarget {
+	typ := c.Request.Header.Get(installationTargetTypeHeader)
+	if typ == "" {
+		return nil
+	}
+	t := &InstallationTarget{Type: typ}
+	if id := c.Request.Header.Get(installationTargetIDHeader); id != "" {
+		var err error
+		if t.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+			log.Printf("WARNING: ignoring invalid %s header %q", installationTargetIDHeader, id)
+		}
+	}
+	return t
+}
+
+// checkInstallationTarget ignores deliveries whose target type is not one of
+// GithubOpts.InstallationTargetTypes, if set, like those of organization hooks
+// when only repo hooks are to be built. Deliveries without the header are
+// ignored too, as their target is not known.
+//
+// It writes the response and returns false when the delivery must not be processed.
+func (s *githubHook) checkInstallationTarget(c *gin.Context) bool {
+	if len(s.opts.InstallationTargetTypes) == 0 {
+		return true
+	}
+	typ := c.Request.Header.Get(installationTargetTypeHeader)
+	for _, t := range s.opts.InstallationTargetTypes {
+		if strings.EqualFold(t, typ) {
+			return true
+		}
+	}
+	log.Printf("Ignoring delivery for installation target type %q, which is not one of %s", typ, strings.Join(s.opts.InstallationTargetTypes, ", "))
+	s.ignore(c, gin.H{"status": "Ignored", "reason": "installation target type not accepted"})
+	return false
+}
+
+// stampInstallationTarget adds the target of the delivery to the payload, if
+// known, as "installationTarget".
+func stampInstallationTarget(c *gin.Context, payload []byte) []byte {
+	t := installationTarget(c)
+	if t == nil {
+		return payload
+	}
+	stamped, err := stamp(payload, "installationTarget", t)
+	if err != nil {
+		log.Printf("Failed to stamp the installation target into the payload: %s", err)
+		return payload
+	}
+	return stamped
+}
@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestGithubHandler_installationTarget(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		types      []string
+		targetType string
+		targetID   int64
+		built      bool
+	}{
+		{name: "repo hook accepting all", targetType: "repository", targetID: 35129377, built: true},
+		{name: "org hook accepting all", targetType: "organization", targetID: 6752317, built: true},
+		{name: "no header accepting all", built: true},
+		{name: "repo hook accepting repos", types: []string{"repository"}, targetType: "repository", targetID: 35129377, built: true},
+		{name: "org hook accepting repos", types: []string{"repository"}, targetType: "organization", targetID: 6752317},
+		{name: "no header accepting repos", types: []string{"repository"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.InstallationTargetTypes = tt.types
+
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Add("X-GitHub-Event", "push")
+			r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
+			if tt.targetType != "" {
+				r.Header.Add("X-GitHub-Hook-Installation-Target-Type", tt.targetType)
+				r.Header.Add("X-GitHub-Hook-Installation-Target-ID", strconv.FormatInt(tt.targetID, 10))
+			}
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = r
+
+			s.Handle(ctx)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+			}
+			if !tt.built {
+				if len(store.builds) != 0 {
+					t.Errorf("expected no build, got %d", len(store.builds))
+				}
+				return
+			}
+			if len(store.builds) != 1 {
+				t.Fatalf("expected a build, got %d", len(store.builds))
+			}
+			pl := struct {
+				InstallationTarget *InstallationTarget `json:"installationTarget"`
+			}{}
+			if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if tt.targetType == "" {
+				if pl.InstallationTarget != nil {
+					t.Errorf("expected no installation target, got %+v", pl.InstallationTarget)
+				}
+				return
+			}
+			if pl.InstallationTarget == nil || pl.InstallationTarget.Type != tt.targetType || pl.InstallationTarget.ID != tt.targetID {
+				t.Errorf("expected the %s target %d in the payload, got %+v", tt.targetType, tt.targetID, pl.InstallationTarget)
+			}
+		})
+	}
+}
@@ -3,11 +3,13 @@ package webhook
 import (
 	"os"
 	"testing"
+	"time"
 
 	gin "gopkg.in/gin-gonic/gin.v1"
 )
 
 func TestMain(m *testing.M) {
 	gin.SetMode(gin.TestMode)
+	createBuildBackoff = time.Millisecond
 	os.Exit(m.Run())
 }
@@ -0,0 +1,90 @@
+package webhook
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// emitTotal counts builds emitted to each target, labelled by outcome.
+	emitTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "brigade_cd_emit_total",
+			Help: "Number of builds emitted, partitioned by target and result.",
+		},
+		[]string{"target", "result"},
+	)
+
+	// signatureFailuresTotal counts deliveries rejected due to a signature mismatch.
+	signatureFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "brigade_cd_webhook_signature_failures_total",
+			Help: "Number of deliveries rejected due to a signature mismatch, partitioned by the likely reason.",
+		},
+		[]string{"reason"},
+	)
+
+	// clockSkewSeconds is the difference between the local clock and GitHub's.
+	clockSkewSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "brigade_cd_github_clock_skew_seconds",
+			Help: "Seconds the local clock was ahead of GitHub's when the last installation token was negotiated.",
+		},
+	)
+
+	// deadLettersTotal counts builds put into the dead-letter store, labelled by outcome.
+	deadLettersTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "brigade_cd_dead_letters_total",
+			Help: "Number of builds that could not be created and were put into the dead-letter store, partitioned by result.",
+		},
+		[]string{"result"},
+	)
+
+	// bufferDepth is the number of builds held in the BuildBuffer.
+	bufferDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "brigade_cd_buffered_builds",
+			Help: "Number of builds held in the buffer until the Brigade store recovers.",
+		},
+	)
+
+	// bufferedBuildsTotal counts builds put into, dropped by and flushed from the BuildBuffer.
+	bufferedBuildsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "brigade_cd_buffered_builds_total",
+			Help: "Number of builds that the Brigade store was unavailable for, partitioned by whether they were buffered, dropped as the buffer was full, or flushed.",
+		},
+		[]string{"result"},
+	)
+
+	// throttledBuildsTotal counts builds rejected by the rate limit of their project.
+	throttledBuildsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "brigade_cd_throttled_builds_total",
+			Help: "Number of builds that exceeded the rate limit of their project and were answered with 429, partitioned by project.",
+		},
+		[]string{"project"},
+	)
+
+	// shortLivedTokensTotal counts installation tokens that expire implausibly soon.
+	shortLivedTokensTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "brigade_cd_installation_token_short_lived_total",
+			Help: "Number of negotiated installation tokens that expire implausibly soon, which indicates clock skew.",
+		},
+	)
+)
+
+// Reasons for signature failures
+const (
+	// signatureFailureMisconfigured is a mismatch for a repo with its own secret,
+	// which usually results from a secret rotation or misconfiguration
+	signatureFailureMisconfigured = "misconfigured"
+	// signatureFailureUnknownSender is a mismatch for a repo without its own secret,
+	// which usually means the delivery is not from GitHub
+	signatureFailureUnknownSender = "unknown_sender"
+)
+
+func init() {
+	prometheus.MustRegister(emitTotal, signatureFailuresTotal, clockSkewSeconds, shortLivedTokensTotal, deadLettersTotal, bufferDepth, bufferedBuildsTotal, throttledBuildsTotal)
+}
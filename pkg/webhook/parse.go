@@ -0,0 +1,92 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/go-github/v27/github"
+)
+
+// eventKeys are the top-level fields that tell the bodies of the handled event
+// types apart, most specific first. GitHub sends them with every event of the type.
+var eventKeys = []struct {
+	event string
+	key   string
+}{
+	{"check_run", "check_run"},
+	{"registry_package", "registry_package"},
+	{"package", "package"},
+	{"workflow_run", "workflow_run"},
+	{"installation_repositories", "repositories_added"},
+	{"project_card", "project_card"},
+	{"milestone", "milestone"},
+	{"issue_comment", "comment"},
+}
+
+// customEvents create the types of the events that go-github doesn't parse
+var customEvents = map[string]func() interface{}{
+	"package":          func() interface{} { return &PackageEvent{} },
+	"registry_package": func() interface{} { return &RegistryPackageEvent{} },
+	"workflow_run":     func() interface{} { return &WorkflowRunEvent{} },
+}
+
+// EventMismatchError is returned when the body of a delivery doesn't match the
+// event type of its X-GitHub-Event header.
+type EventMismatchError struct {
+	// Header is the event type of the header
+	Header string
+	// Body is what the body parsed as, an event type or a Go type
+	Body string
+}
+
+func (e *EventMismatchError) Error() string {
+	return fmt.Sprintf("event type mismatch: header says %q, but the body parsed as %s", e.Header, e.Body)
+}
+
+// parseWebHook parses body as the event type of the header. Unlike
+// github.ParseWebHook, which decodes any JSON object into the type of the header,
+// it fails with an EventMismatchError when the body lacks the fields of that event
+// type, naming the event type the body looks like instead. It also parses the
+// customEvents.
+func parseWebHook(eventType string, body []byte) (interface{}, error) {
+	var e interface{}
+	if newEvent, ok := customEvents[eventType]; ok {
+		e = newEvent()
+		if err := json.Unmarshal(body, e); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if e, err = github.ParseWebHook(eventType, body); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	for _, ek := range eventKeys {
+		if ek.event != eventType {
+			continue
+		}
+		if _, ok := fields[ek.key]; ok {
+			return e, nil
+		}
+		parsed := "an unknown event"
+		for _, other := range eventKeys {
+			if _, ok := fields[other.key]; ok {
+				parsed = fmt.Sprintf("%q", other.event)
+				break
+			}
+		}
+		return nil, &EventMismatchError{Header: eventType, Body: parsed}
+	}
+	return e, nil
+}
+
+// unexpectedEvent builds the error for a parsed event that a handler of
+// eventType doesn't support.
+func unexpectedEvent(eventType string, e interface{}) error {
+	return &EventMismatchError{Header: eventType, Body: fmt.Sprintf("%T", e)}
+}
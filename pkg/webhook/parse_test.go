@@ -0,0 +1,67 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v27/github"
+)
+
+func TestParseWebHook(t *testing.T) {
+	checkRun := []byte(fmt.Sprintf(testCheckRunPayload, "rerequested"))
+	milestone := []byte(fmt.Sprintf(testMilestonePayload, "created"))
+
+	tests := []struct {
+		name      string
+		eventType string
+		body      []byte
+		mismatch  string
+	}{
+		{name: "match", eventType: "check_run", body: checkRun},
+		{name: "known event in body", eventType: "issue_comment", body: checkRun, mismatch: `event type mismatch: header says "issue_comment", but the body parsed as "check_run"`},
+		{name: "unknown event in body", eventType: "milestone", body: []byte(`{"action":"created","zen":"Keep it logically awesome."}`), mismatch: `event type mismatch: header says "milestone", but the body parsed as an unknown event`},
+		{name: "event without known fields", eventType: "push", body: milestone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseWebHook(tt.eventType, tt.body)
+			if tt.mismatch == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if _, ok := err.(*EventMismatchError); !ok {
+				t.Fatalf("expected an EventMismatchError, got %v", err)
+			}
+			if err.Error() != tt.mismatch {
+				t.Errorf("expected %q, got %q", tt.mismatch, err.Error())
+			}
+		})
+	}
+
+	err := unexpectedEvent("issue_comment", &github.PushEvent{})
+	if expected := `event type mismatch: header says "issue_comment", but the body parsed as *github.PushEvent`; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestGithubHandler_eventMismatch(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+
+	w := handleTestEvent(t, s, "issue_comment", []byte(fmt.Sprintf(testCheckRunPayload, "rerequested")))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d\n%s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `header says \"issue_comment\", but the body parsed as \"check_run\"`) {
+		t.Errorf("expected the mismatch to be named, got %s", w.Body.String())
+	}
+	if len(store.builds) != 0 {
+		t.Errorf("expected no builds, got %d", len(store.builds))
+	}
+}
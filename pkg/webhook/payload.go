@@ -1,6 +1,13 @@
 package webhook
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// redacted replaces secrets in logged payloads
+const redacted = "REDACTED"
 
 // Payload represents the data sent as the payload of an event.
 type Payload struct {
@@ -12,4 +19,46 @@ type Payload struct {
 	InstID       int         `json:"-"`
 	Commit       string      `json:"commit"`
 	Branch       string      `json:"branch"`
+	// InstallationID and AppSlug identify the installation of the App the token
+	// was negotiated for, for workers that negotiate tokens of their own
+	InstallationID int64  `json:"installationID,omitempty"`
+	AppSlug        string `json:"appSlug,omitempty"`
+	// CheckRunName and CheckRunExternalID identify a re-requested check run.
+	// By convention, workers set the external ID of the check runs they create
+	// to the name of the job, so that only that job is re-run.
+	CheckRunName       string `json:"checkRunName,omitempty"`
+	CheckRunExternalID string `json:"checkRunExternalID,omitempty"`
+	// CheckRunAppID is the ID of the app that created a re-requested check run,
+	// if enabled by GithubOpts.CheckRunAppID
+	CheckRunAppID int64 `json:"checkRunAppID,omitempty"`
+	// PullHeadSHA is the head of the pull request when the build was emitted,
+	// which workers should check out rather than the head of the branch
+	PullHeadSHA string `json:"pullHeadSHA,omitempty"`
+	// RepoTopics and RepoDescription describe the repo, if enabled by GithubOpts.RepoInfo
+	RepoTopics      []string `json:"repoTopics,omitempty"`
+	RepoDescription string   `json:"repoDescription,omitempty"`
+	// PullStats is the diff of the pull request, if enabled by GithubOpts.PullStats
+	PullStats *PullStats `json:"pullStats,omitempty"`
+}
+
+// PullStats are the diff stats of a pull request.
+type PullStats struct {
+	Additions    int `json:"additions"`
+	Deletions    int `json:"deletions"`
+	ChangedFiles int `json:"changedFiles"`
+}
+
+// prettyPayload indents the JSON payload of a build for logging, with the token
+// redacted.
+func prettyPayload(payload []byte) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&fields); err != nil {
+		return nil, err
+	}
+	if tok, ok := fields["token"]; ok && string(tok) != `""` && string(tok) != "null" {
+		fields["token"] = json.RawMessage(`"` + redacted + `"`)
+	}
+	return json.MarshalIndent(fields, "", "  ")
 }
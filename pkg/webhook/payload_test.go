@@ -0,0 +1,38 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrettyPayload(t *testing.T) {
+	payload := []byte(`{"type":"pull_request","token":"v1.secret","body":{"number":1}}`)
+
+	pretty, err := prettyPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(pretty)
+
+	if strings.Contains(got, "v1.secret") {
+		t.Errorf("expected the token to be redacted, got\n%s", got)
+	}
+	if !strings.Contains(got, "\n  \"token\": \"REDACTED\"") {
+		t.Errorf("expected an indented, redacted token, got\n%s", got)
+	}
+	if !strings.Contains(got, "\n  \"body\": {\n    \"number\": 1\n  }") {
+		t.Errorf("expected the body to be indented, got\n%s", got)
+	}
+
+	empty, err := prettyPayload([]byte(`{"type":"issue_comment","token":""}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(empty), redacted) {
+		t.Errorf("expected an empty token to be left as is, got\n%s", empty)
+	}
+
+	if _, err := prettyPayload([]byte(`[]`)); err == nil {
+		t.Error("expected an error for a payload that is not an object")
+	}
+}
@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// bodyFields returns the allowlist of body fields for eventType, if any.
+//
+// An exact match of eventType takes precedence over a match of the event type
+// without its action.
+func (s *githubHook) bodyFields(eventType string) ([]string, bool) {
+	fields, ok := s.opts.BodyFields[eventType]
+	if !ok {
+		fields, ok = s.opts.BodyFields[strings.SplitN(eventType, ":", 2)[0]]
+	}
+	return fields, ok
+}
+
+// pruneBody drops every field of the "body" of a JSON object payload that isn't in
+// the allowlist of dot-separated paths like `comment.id`.
+//
+// Allowing a field keeps everything below it.
+func pruneBody(payload []byte, allowed []string) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, fmt.Errorf("payload is not a JSON object: %v", err)
+	}
+	raw, ok := fields["body"]
+	if !ok {
+		return payload, nil
+	}
+	body := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return nil, fmt.Errorf("payload body is not a JSON object: %v", err)
+	}
+
+	pruned := map[string]interface{}{}
+	for _, path := range allowed {
+		copyField(pruned, body, strings.Split(path, "."))
+	}
+
+	b, err := json.Marshal(pruned)
+	if err != nil {
+		return nil, err
+	}
+	fields["body"] = b
+	return json.Marshal(fields)
+}
+
+// copyField copies the field at path from src to dst, creating parent objects as needed.
+// Missing fields are skipped.
+func copyField(dst map[string]interface{}, src map[string]json.RawMessage, path []string) {
+	v, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = v
+		return
+	}
+
+	child := map[string]json.RawMessage{}
+	if err := json.Unmarshal(v, &child); err != nil {
+		// Not an object, so there is nothing below it to keep
+		return
+	}
+	d, ok := dst[path[0]].(map[string]interface{})
+	if !ok {
+		if _, copied := dst[path[0]]; copied {
+			// The whole parent is already allowed
+			return
+		}
+		d = map[string]interface{}{}
+		dst[path[0]] = d
+	}
+	copyField(d, child, path[1:])
+}
@@ -0,0 +1,120 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestPruneBody(t *testing.T) {
+	payload := []byte(`{"type":"issue_comment","token":"v1.secret","body":{"action":"created","comment":{"id":9007199254740993,"body":"lgtm","user":{"login":"octocat"}},"issue":{"number":2,"title":"Fix it"},"repository":{"full_name":"org/repo"}}}`)
+
+	tests := []struct {
+		name     string
+		allowed  []string
+		expected string
+	}{
+		{
+			name:     "top-level and nested fields",
+			allowed:  []string{"action", "comment.id", "comment.user.login", "issue.number"},
+			expected: `{"action":"created","comment":{"id":9007199254740993,"user":{"login":"octocat"}},"issue":{"number":2}}`,
+		},
+		{
+			name:     "whole object",
+			allowed:  []string{"comment.id", "comment"},
+			expected: `{"comment":{"id":9007199254740993,"body":"lgtm","user":{"login":"octocat"}}}`,
+		},
+		{
+			name:     "missing and scalar parents",
+			allowed:  []string{"pull_request.number", "action.name"},
+			expected: `{}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pruned, err := pruneBody(payload, tt.allowed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pl := struct {
+				Type  string          `json:"type"`
+				Token string          `json:"token"`
+				Body  json.RawMessage `json:"body"`
+			}{}
+			if err := json.Unmarshal(pruned, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.Type != "issue_comment" || pl.Token != "v1.secret" {
+				t.Errorf("expected the fields outside the body to be kept, got %s", pruned)
+			}
+			if !jsonEqual(t, pl.Body, []byte(tt.expected)) {
+				t.Errorf("expected body %s, got %s", tt.expected, pl.Body)
+			}
+		})
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	var x, y interface{}
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// limitedStore rejects builds whose payload exceeds the size of a Kubernetes secret
+type limitedStore struct {
+	*testStore
+	limit int
+}
+
+func (s *limitedStore) CreateBuild(build *brigade.Build) error {
+	if len(build.Payload) > s.limit {
+		return errors.New("secret is too large")
+	}
+	return s.testStore.CreateBuild(build)
+}
+
+func TestGithubHandler_bodyFields(t *testing.T) {
+	large := fmt.Sprintf(`{"action":"created","comment":{"id":1,"body":%q},"issue":{"number":2},"repository":{"full_name":"baxterthehacker/public-repo"}}`, strings.Repeat("x", 4096))
+
+	build := func(bodyFields map[string][]string) (*limitedStore, error) {
+		store := &limitedStore{testStore: newTestStore(), limit: 1024}
+		s := newTestGithubHandler(store, t)
+		s.opts.BodyFields = bodyFields
+		payload := []byte(fmt.Sprintf(`{"type":"issue_comment","body":%s}`, large))
+		_, err := s.build(context.Background(), "", "issue_comment:created", brigade.Revision{Ref: "refs/heads/master"}, payload, store.proj)
+		return store, err
+	}
+
+	if _, err := build(nil); err == nil {
+		t.Fatal("expected the full body to exceed the limit")
+	}
+
+	store, err := build(map[string][]string{"issue_comment": {"action", "comment.id", "issue.number"}})
+	if err != nil {
+		t.Fatalf("expected the pruned payload to be accepted: %v", err)
+	}
+	pl := struct {
+		Body map[string]interface{} `json:"body"`
+	}{}
+	if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pl.Body["repository"]; ok {
+		t.Errorf("expected repository to be pruned, got %v", pl.Body)
+	}
+	if pl.Body["action"] != "created" {
+		t.Errorf("expected action to be kept, got %v", pl.Body)
+	}
+}
@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v27/github"
+)
+
+// cachedPullRequest is a pull request along with the ETag it was served with
+type cachedPullRequest struct {
+	key  string
+	etag string
+	pr   *github.PullRequest
+}
+
+// pullRequestCache remembers the pull requests fetched for issue comments, so
+// that repeated comments on a pull request that didn't change are answered by
+// GitHub with a 304, which doesn't count against the rate limit.
+//
+// It holds up to size pull requests, evicting the least recently used.
+type pullRequestCache struct {
+	size int
+
+	mu    sync.Mutex
+	order *list.List
+	prs   map[string]*list.Element
+}
+
+func newPullRequestCache(size int) *pullRequestCache {
+	return &pullRequestCache{
+		size:  size,
+		order: list.New(),
+		prs:   map[string]*list.Element{},
+	}
+}
+
+func pullRequestKey(owner, repo string, number int) string {
+	return fmt.Sprintf("%s/%s#%d", strings.ToLower(owner), strings.ToLower(repo), number)
+}
+
+func (pc *pullRequestCache) get(key string) (cachedPullRequest, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	el, ok := pc.prs[key]
+	if !ok {
+		return cachedPullRequest{}, false
+	}
+	pc.order.MoveToFront(el)
+	return el.Value.(cachedPullRequest), true
+}
+
+func (pc *pullRequestCache) put(key, etag string, pr *github.PullRequest) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	entry := cachedPullRequest{key: key, etag: etag, pr: pr}
+	if el, ok := pc.prs[key]; ok {
+		el.Value = entry
+		pc.order.MoveToFront(el)
+		return
+	}
+	pc.prs[key] = pc.order.PushFront(entry)
+	for pc.order.Len() > pc.size {
+		oldest := pc.order.Back()
+		pc.order.Remove(oldest)
+		delete(pc.prs, oldest.Value.(cachedPullRequest).key)
+	}
+}
+
+// fetch gets the pull request with client, sending the ETag of the cached copy,
+// if any, in If-None-Match, and returns the cached copy if GitHub answers that
+// it was not modified.
+func (pc *pullRequestCache) fetch(c context.Context, client *github.Client, owner, repo string, number int) (*github.PullRequest, error) {
+	key := pullRequestKey(owner, repo, number)
+	cached, ok := pc.get(key)
+
+	req, err := client.NewRequest("GET", fmt.Sprintf("repos/%v/%v/pulls/%d", owner, repo, number), nil)
+	if err != nil {
+		return nil, err
+	}
+	if ok && cached.etag != "" {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	pr := new(github.PullRequest)
+	resp, err := client.Do(c, req, pr)
+	if resp != nil && resp.StatusCode == http.StatusNotModified && ok {
+		return cached.pr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d getting pull request %s", resp.StatusCode, key)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		pc.put(key, etag, pr)
+	}
+	return pr, nil
+}
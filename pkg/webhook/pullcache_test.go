@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestGetPRFromIssueComment_etag(t *testing.T) {
+	etag, sha := `"v1"`, "c1"
+	var requests, notModified int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/api/v3/repos/myorg/myapp/pulls/2" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `{"number":2,"head":{"sha":%q}}`, sha)
+	}))
+	defer ts.Close()
+
+	s := &githubHook{pullRequests: newPullRequestCache(10)}
+	proj := &brigade.Project{Github: brigade.Github{BaseURL: ts.URL + "/api/v3/"}}
+	ice := &github.IssueCommentEvent{
+		Repo:  &github.Repository{FullName: github.String("myorg/myapp")},
+		Issue: &github.Issue{Number: github.Int(2)},
+	}
+	get := func() string {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest("POST", "/events/github", nil)
+		pr, err := getPullRequestFromGithub(ctx, s, "v1.installation-token", ice.Repo.GetFullName(), ice.Issue.GetNumber(), proj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pr.GetHead().GetSHA()
+	}
+
+	if got := get(); got != "c1" {
+		t.Fatalf("expected head c1, got %q", got)
+	}
+	if got := get(); got != "c1" || notModified != 1 {
+		t.Fatalf("expected the cached head c1 on a 304, got %q with %d 304s", got, notModified)
+	}
+
+	etag, sha = `"v2"`, "c2"
+	if got := get(); got != "c2" {
+		t.Fatalf("expected the refreshed head c2 on a 200, got %q", got)
+	}
+	if got := get(); got != "c2" || notModified != 2 {
+		t.Errorf("expected the refreshed head c2 to be cached, got %q with %d 304s", got, notModified)
+	}
+	if requests != 4 {
+		t.Errorf("expected 4 requests, got %d", requests)
+	}
+}
+
+func TestPullRequestCache_bounded(t *testing.T) {
+	pc := newPullRequestCache(2)
+	pc.put("myorg/myapp#1", `"a"`, &github.PullRequest{})
+	pc.put("myorg/myapp#2", `"b"`, &github.PullRequest{})
+	if _, ok := pc.get("myorg/myapp#1"); !ok {
+		t.Fatal("expected #1 to be cached")
+	}
+	pc.put("myorg/myapp#3", `"c"`, &github.PullRequest{})
+
+	if _, ok := pc.get("myorg/myapp#2"); ok {
+		t.Error("expected the least recently used #2 to be evicted")
+	}
+	for _, key := range []string{"myorg/myapp#1", "myorg/myapp#3"} {
+		if _, ok := pc.get(key); !ok {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+}
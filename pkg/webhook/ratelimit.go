@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// statusThrottled is the status of a build that exceeded the rate limit of its project
+const statusThrottled = "throttled"
+
+// errThrottled is returned for builds that exceed the rate limit of their project
+var errThrottled = errors.New("rate limit of the project exceeded")
+
+// ValidateRateLimits checks that every project of GithubOpts.RateLimits has a
+// positive number of builds per minute.
+func ValidateRateLimits(limits map[string]int) error {
+	for p, n := range limits {
+		if p == "" {
+			return errors.New("rate limits must be for a project")
+		}
+		if n <= 0 {
+			return fmt.Errorf("project %q: rate limit %d must be a positive number of builds per minute", p, n)
+		}
+	}
+	return nil
+}
+
+// bucket is the token bucket of a project
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the builds created for each project with a token bucket,
+// so that a flood of events for one project doesn't starve the others. The
+// bucket of a project holds as many builds as are allowed per minute, so that
+// bursts up to the limit are created at once, and refills continuously.
+type rateLimiter struct {
+	// perMinute maps project names to the number of builds allowed per minute.
+	// Projects that are missing here aren't limited.
+	perMinute map[string]int
+	now       func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(perMinute map[string]int) *rateLimiter {
+	return &rateLimiter{
+		perMinute: perMinute,
+		now:       time.Now,
+		buckets:   map[string]*bucket{},
+	}
+}
+
+// allow takes a token from the bucket of the project and returns false if there
+// is none left.
+func (rl *rateLimiter) allow(projectID, projectName string) bool {
+	limit, ok := rl.perMinute[projectName]
+	if !ok {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	b, ok := rl.buckets[projectID]
+	if !ok {
+		b = &bucket{tokens: float64(limit), last: now}
+		rl.buckets[projectID] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * float64(limit)
+	if b.tokens > float64(limit) {
+		b.tokens = float64(limit)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		throttledBuildsTotal.WithLabelValues(projectName).Inc()
+		return false
+	}
+	b.tokens--
+	return true
+}
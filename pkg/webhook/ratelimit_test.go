@@ -0,0 +1,80 @@
+package webhook
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestGithubHandler_rateLimits(t *testing.T) {
+	push, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestStore()
+	ts.proj.ID = "brigade-repo"
+	store := &routingStore{
+		testStore: ts,
+		projects: map[string]*brigade.Project{
+			"other-pipeline": {ID: "brigade-other", Name: "other-pipeline"},
+		},
+	}
+	s := newTestGithubHandler(store, t)
+	s.opts.EventProjects = map[string]string{"pull_request": "other-pipeline"}
+	s.opts.RateLimits = map[string]int{"baxterthehacker/public-repo": 1}
+	s.rateLimits = newRateLimiter(s.opts.RateLimits)
+	now := time.Date(2019, 7, 2, 1, 0, 0, 0, time.UTC)
+	s.rateLimits.now = func() time.Time { return now }
+
+	if w := handleTestEvent(t, s, "push", push); w.Code != http.StatusOK {
+		t.Fatalf("expected the first push to be built, got %d\n%s", w.Code, w.Body.String())
+	}
+	built := len(ts.builds)
+
+	if w := handleTestEvent(t, s, "push", push); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the second push to be throttled, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(ts.builds) != built {
+		t.Fatalf("expected no build for the throttled push, got %d", len(ts.builds)-built)
+	}
+
+	if w := handleTestEvent(t, s, "pull_request", testPullRequestPayload(t, "opened")); w.Code != http.StatusOK {
+		t.Fatalf("expected the pull request of the other project to be built, got %d\n%s", w.Code, w.Body.String())
+	}
+	for _, b := range ts.builds[built:] {
+		if b.ProjectID != "brigade-other" {
+			t.Errorf("expected %q build for the other project, got %s", b.Type, b.ProjectID)
+		}
+	}
+	built = len(ts.builds)
+
+	now = now.Add(time.Minute)
+	if w := handleTestEvent(t, s, "push", push); w.Code != http.StatusOK {
+		t.Fatalf("expected a push to be built once the bucket refilled, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(ts.builds) == built {
+		t.Error("expected a build once the bucket refilled")
+	}
+}
+
+func TestValidateRateLimits(t *testing.T) {
+	tests := []struct {
+		limits map[string]int
+		valid  bool
+	}{
+		{valid: true},
+		{limits: map[string]int{"myorg/myapp": 30}, valid: true},
+		{limits: map[string]int{"myorg/myapp": 0}},
+		{limits: map[string]int{"myorg/myapp": -1}},
+		{limits: map[string]int{"": 30}},
+	}
+	for _, tt := range tests {
+		if err := ValidateRateLimits(tt.limits); (err == nil) != tt.valid {
+			t.Errorf("%v: unexpected error %v", tt.limits, err)
+		}
+	}
+}
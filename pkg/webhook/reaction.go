@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// actionApproved is the action of builds for comments of the App approved by a reaction
+const actionApproved = "approved"
+
+// reactionContents are the contents of reactions GitHub supports
+var reactionContents = []string{"+1", "-1", "laugh", "confused", "heart", "hooray", "rocket", "eyes"}
+
+// ValidateApprovalReaction checks that reaction is the content of a GitHub
+// reaction, like "+1". Empty disables approvals by reaction.
+func ValidateApprovalReaction(reaction string) error {
+	if reaction == "" {
+		return nil
+	}
+	for _, r := range reactionContents {
+		if r == reaction {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown approval reaction %q, must be one of %v", reaction, reactionContents)
+}
+
+// reactionGetter returns the author associations of the users that reacted with
+// content to the comment of ice.
+type reactionGetter func(c context.Context, token string, ice *github.IssueCommentEvent, content string, proj *brigade.Project) ([]string, error)
+
+// isAppComment returns true if the comment of ice was made by the App.
+func (s *githubHook) isAppComment(c context.Context, ice *github.IssueCommentEvent) bool {
+	slug, err := s.appSlug.Get(c)
+	if err != nil {
+		log.Printf("WARNING: failed to get the slug of App %d, so its comments can't be approved: %s", s.opts.AppID, err)
+		return false
+	}
+	user := ice.Comment.GetUser()
+	return slug != "" && user.GetType() == "Bot" && user.GetLogin() == slug+"[bot]"
+}
+
+// approvedByReaction returns true if an allowed author reacted to the comment of
+// ice with GithubOpts.ApprovalReaction.
+//
+// A non-nil error means the response has already been written and no build must be emitted.
+func (s *githubHook) approvedByReaction(c *gin.Context, ice *github.IssueCommentEvent, proj *brigade.Project) (bool, error) {
+	instID := s.installationID(c.Request.Context(), ice.Installation, ice.Repo.GetFullName())
+	if instID == 0 {
+		log.Printf("Installation ID must be set to check the reactions to comment %d", ice.Comment.GetID())
+		c.JSON(http.StatusForbidden, gin.H{"status": ErrAuthFailed})
+		return false, ErrAuthFailed
+	}
+	tok, _, err := s.getToken(s.opts.AppID, int(instID), proj.Github)
+	if err != nil {
+		log.Printf("Failed to negotiate a token: %s", err)
+		c.JSON(http.StatusForbidden, gin.H{"status": ErrAuthFailed})
+		return false, ErrAuthFailed
+	}
+
+	assocs, err := s.getReactions(c.Request.Context(), tok, ice, s.opts.ApprovalReaction, proj)
+	if err != nil {
+		log.Printf("Failed to get the reactions to comment %d: %s", ice.Comment.GetID(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "failed to fetch reactions to comment"})
+		return false, err
+	}
+	for _, assoc := range assocs {
+		if s.isAllowedAuthor(assoc) {
+			log.Printf("Comment %d was approved with a %q reaction from an author with association %s", ice.Comment.GetID(), s.opts.ApprovalReaction, assoc)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// commentReactions lists the reactions to the comment of ice with GitHub.
+//
+// Reactions carry no author association, so it is approximated from the repo:
+// OWNER for the owner of the repo, COLLABORATOR for its collaborators, which
+// include members of the organization with access, and NONE otherwise.
+func (s *githubHook) commentReactions(c context.Context, token string, ice *github.IssueCommentEvent, content string, proj *brigade.Project) ([]string, error) {
+	client, err := InstallationTokenClient(token, proj.Github.BaseURL, proj.Github.UploadURL)
+	if err != nil {
+		return nil, err
+	}
+	owner, repo := ice.Repo.GetOwner().GetLogin(), ice.Repo.GetName()
+
+	var assocs []string
+	seen := map[string]bool{}
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		reactions, resp, err := client.Reactions.ListIssueCommentReactions(c, owner, repo, ice.Comment.GetID(), opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range reactions {
+			login := r.GetUser().GetLogin()
+			if r.GetContent() != content || seen[login] {
+				continue
+			}
+			seen[login] = true
+			assoc := "NONE"
+			if login == owner {
+				assoc = "OWNER"
+			} else if collaborator, _, err := client.Repositories.IsCollaborator(c, owner, repo, login); err != nil {
+				return nil, err
+			} else if collaborator {
+				assoc = "COLLABORATOR"
+			}
+			assocs = append(assocs, assoc)
+		}
+		if resp.NextPage == 0 {
+			return assocs, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
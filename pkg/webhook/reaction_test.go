@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+)
+
+// testAppCommentPayload returns the payload of a comment on a pull request by
+// the user login of the given type
+func testAppCommentPayload(t *testing.T, login, userType string) []byte {
+	body, err := ioutil.ReadFile("testdata/github-issue_comment_pull_request_author_allowed-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := map[string]interface{}{}
+	if err := json.Unmarshal(body, &pl); err != nil {
+		t.Fatal(err)
+	}
+	comment := pl["comment"].(map[string]interface{})
+	comment["author_association"] = "NONE"
+	comment["user"] = map[string]interface{}{"login": login, "type": userType}
+	pl["installation"] = map[string]interface{}{"id": 2311213}
+	body, err = json.Marshal(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestGithubHandler_approvalReaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		login        string
+		userType     string
+		assocs       []string
+		reactionsErr error
+		code         int
+		checked      bool
+		expected     string
+	}{
+		{name: "approved", login: "brigade-cd[bot]", userType: "Bot", assocs: []string{"NONE", "OWNER"}, code: http.StatusOK, checked: true, expected: "issue_comment:approved"},
+		{name: "disallowed reactors", login: "brigade-cd[bot]", userType: "Bot", assocs: []string{"NONE"}, code: http.StatusOK, checked: true, expected: "issue_comment:edited"},
+		{name: "not a comment of the App", login: "someone", userType: "User", assocs: []string{"OWNER"}, code: http.StatusOK, expected: "issue_comment:edited"},
+		{name: "other App", login: "other-app[bot]", userType: "Bot", assocs: []string{"OWNER"}, code: http.StatusOK, expected: "issue_comment:edited"},
+		{name: "reactions unavailable", login: "brigade-cd[bot]", userType: "Bot", reactionsErr: errors.New("unavailable"), code: http.StatusInternalServerError, checked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.AppID = 13
+			s.opts.ApprovalReaction = "+1"
+			s.appSlug = &AppSlug{get: func(c context.Context) (string, error) { return "brigade-cd", nil }}
+			s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+				return "v1.installation-token", time.Time{}, nil
+			}
+			checked := false
+			s.getReactions = func(c context.Context, token string, ice *github.IssueCommentEvent, content string, proj *brigade.Project) ([]string, error) {
+				checked = true
+				if content != "+1" {
+					t.Errorf("expected the reactions +1 to be checked, got %q", content)
+				}
+				return tt.assocs, tt.reactionsErr
+			}
+
+			w := handleTestEvent(t, s, "issue_comment", testAppCommentPayload(t, tt.login, tt.userType))
+
+			if w.Code != tt.code {
+				t.Fatalf("expected %d, got %d\n%s", tt.code, w.Code, w.Body.String())
+			}
+			if checked != tt.checked {
+				t.Errorf("expected the reactions to be checked: %t, got %t", tt.checked, checked)
+			}
+			if tt.expected == "" {
+				if len(store.builds) != 0 {
+					t.Errorf("expected no builds, got %d", len(store.builds))
+				}
+				return
+			}
+			if len(store.builds) != 2 || store.builds[1].Type != tt.expected {
+				t.Fatalf("expected builds issue_comment and %s, got %v", tt.expected, store.builds)
+			}
+			// Only approved comments of the App are enriched with the pull request
+			ref := "refs/heads/master"
+			if tt.expected == "issue_comment:approved" {
+				ref = "refs/pull/2/head"
+			}
+			if got := store.builds[1].Revision.Ref; got != ref {
+				t.Errorf("expected the ref %s, got %s", ref, got)
+			}
+		})
+	}
+}
+
+func TestCommentReactions(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/repos/Codertocat/Hello-World/issues/comments/393304133/reactions":
+			w.Write([]byte(`[
+				{"content": "+1", "user": {"login": "Codertocat"}},
+				{"content": "+1", "user": {"login": "collaborator"}},
+				{"content": "heart", "user": {"login": "fan"}},
+				{"content": "+1", "user": {"login": "stranger"}}
+			]`))
+		case "/repos/Codertocat/Hello-World/collaborators/collaborator":
+			w.WriteHeader(http.StatusNoContent)
+		case "/repos/Codertocat/Hello-World/collaborators/stranger":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			t.Errorf("unexpected path %q", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	s := newTestGithubHandler(newTestStore(), t)
+	proj := &brigade.Project{Github: brigade.Github{BaseURL: ts.URL + "/", UploadURL: ts.URL + "/"}}
+	ice := &github.IssueCommentEvent{}
+	if err := json.Unmarshal(testAppCommentPayload(t, "brigade-cd[bot]", "Bot"), ice); err != nil {
+		t.Fatal(err)
+	}
+
+	assocs, err := s.commentReactions(context.Background(), "v1.installation-token", ice, "+1", proj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"OWNER", "COLLABORATOR", "NONE"}
+	if len(assocs) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, assocs)
+	}
+	for i := range expected {
+		if assocs[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, assocs)
+		}
+	}
+}
+
+func TestValidateApprovalReaction(t *testing.T) {
+	for _, r := range []string{"", "+1", "rocket"} {
+		if err := ValidateApprovalReaction(r); err != nil {
+			t.Errorf("expected %q to be valid, got %s", r, err)
+		}
+	}
+	if err := ValidateApprovalReaction("thumbsup"); err == nil {
+		t.Error("expected an unknown reaction to be invalid")
+	}
+}
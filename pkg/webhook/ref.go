@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+// RefData is what a RefTemplate is rendered with.
+type RefData struct {
+	// Provider is the provider of the build, like "github" or "brigade-cd"
+	Provider string
+	// EventType is the type of the build, like "push" or "issue_comment:created"
+	EventType string
+	// Ref is the ref as emitted without a template, like "refs/heads/master" or "refs/pull/2/head"
+	Ref string
+	// Branch is Ref without the "refs/heads/" prefix
+	Branch string
+	// Commit is the commit SHA of the revision, which may be empty
+	Commit string
+}
+
+// RefTemplate renders the Ref of the revision of builds, for workers that
+// expect refs in a form other than "refs/heads/master", like "master" or
+// "master@<sha>". The template can tell builds apart by their provider and event type.
+type RefTemplate struct {
+	text string
+	tmpl *template.Template
+}
+
+// ParseRefTemplate parses a Go template for Revision.Ref, like
+// `{{.Branch}}@{{.Commit}}`.
+//
+// The template is rendered once with sample data, so that references to unknown
+// fields are reported now rather than when the first build is emitted.
+func ParseRefTemplate(text string) (*RefTemplate, error) {
+	tmpl, err := template.New("ref").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ref template %q: %v", text, err)
+	}
+	t := &RefTemplate{text: text, tmpl: tmpl}
+	sample := brigade.Revision{Ref: "refs/heads/master", Commit: "0000000000000000000000000000000000000000"}
+	if _, err := t.Render("github", "push", sample); err != nil {
+		return nil, fmt.Errorf("invalid ref template %q: %v", text, err)
+	}
+	return t, nil
+}
+
+// Render returns the Ref of rev as rendered by the template.
+func (t *RefTemplate) Render(provider, eventType string, rev brigade.Revision) (string, error) {
+	var buf bytes.Buffer
+	err := t.tmpl.Execute(&buf, RefData{
+		Provider:  provider,
+		EventType: eventType,
+		Ref:       rev.Ref,
+		Branch:    strings.TrimPrefix(rev.Ref, "refs/heads/"),
+		Commit:    rev.Commit,
+	})
+	if err != nil {
+		return "", err
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("template rendered an empty ref for %q", rev.Ref)
+	}
+	return buf.String(), nil
+}
+
+// Apply renders the Ref of rev with the template, leaving rev unchanged on
+// failure. A nil template leaves rev unchanged as well.
+func (t *RefTemplate) Apply(provider, eventType string, rev *brigade.Revision) error {
+	if t == nil {
+		return nil
+	}
+	ref, err := t.Render(provider, eventType, *rev)
+	if err != nil {
+		return err
+	}
+	rev.Ref = ref
+	return nil
+}
+
+// MarshalJSON returns the template text, so that it is part of the config hash.
+func (t *RefTemplate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.text)
+}
@@ -0,0 +1,79 @@
+package webhook
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestRefTemplate(t *testing.T) {
+	rev := brigade.Revision{Ref: "refs/heads/main", Commit: "c0ffee"}
+	tests := []struct {
+		text      string
+		provider  string
+		eventType string
+		expected  string
+	}{
+		{text: "{{.Ref}}", provider: "github", eventType: "push", expected: "refs/heads/main"},
+		{text: "{{.Branch}}", provider: "github", eventType: "push", expected: "main"},
+		{text: "{{.Branch}}@{{.Commit}}", provider: "brigade-cd", eventType: "releaseset:apply", expected: "main@c0ffee"},
+		{text: `{{if eq .Provider "brigade-cd"}}{{.Branch}}{{else}}{{.Ref}}{{end}}`, provider: "brigade-cd", eventType: "releaseset:apply", expected: "main"},
+		{text: `{{if eq .Provider "brigade-cd"}}{{.Branch}}{{else}}{{.Ref}}{{end}}`, provider: "github", eventType: "push", expected: "refs/heads/main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			tmpl, err := ParseRefTemplate(tt.text)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := rev
+			if err := tmpl.Apply(tt.provider, tt.eventType, &got); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Ref != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got.Ref)
+			}
+			if got.Commit != rev.Commit {
+				t.Errorf("expected the commit to be left as is, got %q", got.Commit)
+			}
+		})
+	}
+}
+
+func TestParseRefTemplate_invalid(t *testing.T) {
+	for _, text := range []string{"{{.Branch", "{{.Tag}}", ""} {
+		if _, err := ParseRefTemplate(text); err == nil {
+			t.Errorf("expected an error for %q", text)
+		}
+	}
+}
+
+func TestRefTemplate_nil(t *testing.T) {
+	var tmpl *RefTemplate
+	rev := brigade.Revision{Ref: "refs/heads/main"}
+	if err := tmpl.Apply("github", "push", &rev); err != nil || rev.Ref != "refs/heads/main" {
+		t.Errorf("expected a nil template to leave the ref as is, got %q (%v)", rev.Ref, err)
+	}
+}
+
+func TestGithubHandler_refTemplate(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	tmpl, err := ParseRefTemplate(`{{.Branch}}:{{.EventType}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.opts.RefTemplate = tmpl
+
+	handleTestEvent(t, s, "milestone", []byte(fmt.Sprintf(testMilestonePayload, "created")))
+
+	if len(store.builds) != 2 {
+		t.Fatalf("expected 2 builds, got %d", len(store.builds))
+	}
+	for _, b := range store.builds {
+		if expected := "master:" + b.Type; b.Revision.Ref != expected {
+			t.Errorf("expected ref %q, got %q", expected, b.Revision.Ref)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+// repoInfoTTL is how long the topics and description of a repo are cached
+const repoInfoTTL = 10 * time.Minute
+
+// repoInfo is what GithubOpts.RepoInfo adds to payloads
+type repoInfo struct {
+	topics      []string
+	description string
+	fetched     time.Time
+}
+
+// repoInfoCache caches the topics and description of repos, which rarely change,
+// to save an API call per delivery.
+type repoInfoCache struct {
+	ttl time.Duration
+	get func(c context.Context, token, repo string, proj *brigade.Project) (repoInfo, error)
+	now func() time.Time
+
+	mu    sync.Mutex
+	repos map[string]repoInfo
+}
+
+func newRepoInfoCache(ttl time.Duration) *repoInfoCache {
+	return &repoInfoCache{
+		ttl:   ttl,
+		get:   getRepoInfo,
+		now:   time.Now,
+		repos: map[string]repoInfo{},
+	}
+}
+
+// info returns the cached info of repo, fetching it with token once the TTL elapsed.
+func (rc *repoInfoCache) info(c context.Context, token, repo string, proj *brigade.Project) (repoInfo, error) {
+	key := strings.ToLower(repo)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if info, ok := rc.repos[key]; ok && rc.now().Sub(info.fetched) < rc.ttl {
+		return info, nil
+	}
+	info, err := rc.get(c, token, repo, proj)
+	if err != nil {
+		return repoInfo{}, err
+	}
+	info.fetched = rc.now()
+	rc.repos[key] = info
+	return info, nil
+}
+
+func getRepoInfo(c context.Context, token, repo string, proj *brigade.Project) (repoInfo, error) {
+	parts := strings.Split(repo, "/")
+	if len(parts) != 2 {
+		return repoInfo{}, errors.New("invalid repo name")
+	}
+	client, err := InstallationTokenClient(token, proj.Github.BaseURL, proj.Github.UploadURL)
+	if err != nil {
+		return repoInfo{}, err
+	}
+	r, _, err := client.Repositories.Get(c, parts[0], parts[1])
+	if err != nil {
+		return repoInfo{}, err
+	}
+	return repoInfo{topics: r.Topics, description: r.GetDescription()}, nil
+}
+
+// enrichRepo adds the topics and description of repo to res, if enabled by
+// GithubOpts.RepoInfo. Failures are logged rather than failing the build, as the
+// info is only a hint for routing.
+func (s *githubHook) enrichRepo(c context.Context, token, repo string, proj *brigade.Project, res *Payload) {
+	if !s.opts.RepoInfo || s.repoInfo == nil {
+		return
+	}
+	info, err := s.repoInfo.info(c, token, repo, proj)
+	if err != nil {
+		log.Printf("WARNING: failed to fetch the topics and description of %q: %s", repo, err)
+		return
+	}
+	res.RepoTopics = info.topics
+	res.RepoDescription = info.description
+}
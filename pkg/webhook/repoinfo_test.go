@@ -0,0 +1,75 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestGithubHandler_repoInfo(t *testing.T) {
+	tests := []struct {
+		name        string
+		enabled     bool
+		err         error
+		topics      []string
+		description string
+	}{
+		{name: "enriched", enabled: true, topics: []string{"deploy", "backend"}, description: "Public repo"},
+		{name: "not enriched"},
+		{name: "fetch failure", enabled: true, err: errors.New("403 Forbidden")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.AppID = 13
+			s.opts.RepoInfo = tt.enabled
+			s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+				return "v1.installation-token", time.Time{}, nil
+			}
+			fetches := 0
+			s.repoInfo = newRepoInfoCache(time.Minute)
+			s.repoInfo.get = func(c context.Context, token, repo string, proj *brigade.Project) (repoInfo, error) {
+				fetches++
+				if token != "v1.installation-token" || repo != "baxterthehacker/public-repo" {
+					t.Errorf("unexpected fetch of %q with token %q", repo, token)
+				}
+				return repoInfo{topics: []string{"deploy", "backend"}, description: "Public repo"}, tt.err
+			}
+
+			for i := 0; i < 2; i++ {
+				handleTestEvent(t, s, "check_run", []byte(fmt.Sprintf(testCheckRunPayload, "rerequested")))
+			}
+
+			if len(store.builds) != 4 {
+				t.Fatalf("expected 4 builds, got %d", len(store.builds))
+			}
+			pl := Payload{}
+			if err := json.Unmarshal(store.builds[3].Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pl.RepoTopics, tt.topics) || pl.RepoDescription != tt.description {
+				t.Errorf("expected topics %v and description %q, got %v and %q", tt.topics, tt.description, pl.RepoTopics, pl.RepoDescription)
+			}
+
+			expectedFetches := 0
+			if tt.enabled {
+				expectedFetches = 1
+				if tt.err != nil {
+					// Failures are not cached
+					expectedFetches = 2
+				}
+			}
+			if fetches != expectedFetches {
+				t.Errorf("expected %d fetches, got %d", expectedFetches, fetches)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+)
+
+// splitRepoName returns the owner and name of the repo of a project's
+// Repo.Name, which is in the form HOST/OWNER/NAME, like github.com/myorg/myapp.
+func splitRepoName(name string) (owner, repo string, err error) {
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", fmt.Errorf("project name %q is malformed", name)
+	}
+	return parts[1], parts[2], nil
+}
+
+// ValidateRepoName checks that name is a Repo.Name in the form HOST/OWNER/NAME,
+// like github.com/myorg/myapp, as needed to call the GitHub API for the repo.
+func ValidateRepoName(name string) error {
+	if name == "" {
+		return fmt.Errorf("repo name is empty, it must be in the form HOST/OWNER/NAME, like github.com/myorg/myapp")
+	}
+	if _, _, err := splitRepoName(name); err != nil {
+		return fmt.Errorf("repo name %q must be in the form HOST/OWNER/NAME, like github.com/myorg/myapp", name)
+	}
+	return nil
+}
+
+// ValidateProjectRepos checks that every project of s has a valid repo name,
+// returning an error naming the projects that don't.
+func ValidateProjectRepos(s storage.Store) error {
+	projs, err := s.GetProjects()
+	if err != nil {
+		return fmt.Errorf("failed to list projects: %v", err)
+	}
+	invalid := []string{}
+	for _, proj := range projs {
+		if err := ValidateRepoName(proj.Repo.Name); err != nil {
+			invalid = append(invalid, fmt.Sprintf("project %q: %v", proj.Name, err))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%d project(s) have an invalid repo: %s", len(invalid), strings.Join(invalid, "; "))
+	}
+	return nil
+}
+
+// normalizeRepoName returns the key repo names are matched by with
+// GithubOpts.CaseInsensitiveRepos, which is the lowercased OWNER/NAME, without
+// any scheme, host or .git suffix.
+func normalizeRepoName(name string) string {
+	n := strings.ToLower(strings.TrimSpace(name))
+	if i := strings.Index(n, "://"); i >= 0 {
+		n = n[i+len("://"):]
+	}
+	n = strings.TrimSuffix(strings.Trim(n, "/"), ".git")
+	if parts := strings.Split(n, "/"); len(parts) > 2 {
+		n = strings.Join(parts[len(parts)-2:], "/")
+	}
+	return n
+}
+
+// findProject returns the project of s whose name or repo name matches repo
+// once normalized, or nil if there is none. Of several matches, projects whose
+// name or repo name is exactly repo, apart from the host, are preferred, and
+// then the one whose name sorts first.
+func findProject(s storage.Store, repo string) (*brigade.Project, error) {
+	projs, err := s.GetProjects()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list projects: %v", err)
+	}
+	key := normalizeRepoName(repo)
+	exact := func(p *brigade.Project) bool {
+		for _, n := range []string{p.Name, p.Repo.Name} {
+			if n == repo || strings.HasSuffix(n, "/"+repo) {
+				return true
+			}
+		}
+		return false
+	}
+	matches := []*brigade.Project{}
+	for _, p := range projs {
+		if normalizeRepoName(p.Name) == key || normalizeRepoName(p.Repo.Name) == key {
+			matches = append(matches, p)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if ei, ej := exact(matches[i]), exact(matches[j]); ei != ej {
+			return ei
+		}
+		return matches[i].Name < matches[j].Name
+	})
+	return matches[0], nil
+}
@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestValidateRepoName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "github.com/myorg/myapp", valid: true},
+		{name: "ghe.example.com/myorg/myapp", valid: true},
+		{name: ""},
+		{name: "myorg/myapp"},
+		{name: "github.com//myapp"},
+		{name: "github.com/myorg/"},
+	}
+	for _, tt := range tests {
+		err := ValidateRepoName(tt.name)
+		if tt.valid != (err == nil) {
+			t.Errorf("%q: expected valid to be %t, got %v", tt.name, tt.valid, err)
+		}
+	}
+}
+
+func TestValidateProjectRepos(t *testing.T) {
+	store := &projectsStore{projs: []*brigade.Project{
+		{Name: "myorg/app", Repo: brigade.Repo{Name: "github.com/myorg/app"}},
+		{Name: "myorg/empty"},
+		{Name: "myorg/short", Repo: brigade.Repo{Name: "myorg/short"}},
+	}}
+	err := ValidateProjectRepos(store)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, p := range []string{"myorg/empty", "myorg/short"} {
+		if !strings.Contains(err.Error(), p) {
+			t.Errorf("expected the error to name %s, got %v", p, err)
+		}
+	}
+	if strings.Contains(err.Error(), `"myorg/app"`) {
+		t.Errorf("expected the error not to name the valid project, got %v", err)
+	}
+
+	store.projs = store.projs[:1]
+	if err := ValidateProjectRepos(store); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	store.err = errors.New("store unavailable")
+	if err := ValidateProjectRepos(store); err == nil {
+		t.Error("expected an error when the projects can't be listed")
+	}
+}
+
+func TestGithubHandler_strictRepos(t *testing.T) {
+	tests := []struct {
+		name     string
+		repoName string
+		strict   bool
+		code     int
+	}{
+		{name: "missing repo name", strict: true, code: http.StatusInternalServerError},
+		{name: "malformed repo name", repoName: "public-repo", strict: true, code: http.StatusInternalServerError},
+		{name: "valid repo name", repoName: "github.com/baxterthehacker/public-repo", strict: true, code: http.StatusOK},
+		{name: "not strict", code: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			store.proj.Repo.Name = tt.repoName
+			s := newTestGithubHandler(store, t)
+			s.opts.StrictRepos = tt.strict
+
+			w := handleTestEvent(t, s, "milestone", []byte(fmt.Sprintf(testMilestonePayload, "created")))
+
+			if w.Code != tt.code {
+				t.Fatalf("expected %d, got %d\n%s", tt.code, w.Code, w.Body.String())
+			}
+			if tt.code != http.StatusOK {
+				if len(store.builds) != 0 {
+					t.Errorf("expected no builds, got %d", len(store.builds))
+				}
+				if !strings.Contains(w.Body.String(), "baxterthehacker/public-repo") {
+					t.Errorf("expected the response to name the project, got %s", w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeRepoName(t *testing.T) {
+	for _, name := range []string{"myorg/myapp", "MyOrg/MyApp", "github.com/myorg/myapp", "GHE.example.com/MyOrg/myapp", "https://github.com/myorg/myapp.git", "/myorg/myapp/"} {
+		if got := normalizeRepoName(name); got != "myorg/myapp" {
+			t.Errorf("%q: expected myorg/myapp, got %q", name, got)
+		}
+	}
+}
+
+// namedProjectsStore serves a fixed list of projects, and looks them up by their exact name
+type namedProjectsStore struct {
+	projectsStore
+}
+
+func (s *namedProjectsStore) GetProject(name string) (*brigade.Project, error) {
+	for _, p := range s.projs {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func TestFindProject(t *testing.T) {
+	tests := []struct {
+		name     string
+		projs    []string
+		repo     string
+		expected string
+	}{
+		{name: "case", projs: []string{"other/app", "MyOrg/MyApp"}, repo: "myorg/myapp", expected: "MyOrg/MyApp"},
+		{name: "host", projs: []string{"github.com/myorg/myapp"}, repo: "MyOrg/MyApp", expected: "github.com/myorg/myapp"},
+		{name: "exact preferred", projs: []string{"MyOrg/MyApp", "myorg/MYAPP", "github.com/myorg/MyApp"}, repo: "myorg/MyApp", expected: "github.com/myorg/MyApp"},
+		{name: "sorted", projs: []string{"myorg/MYAPP", "MyOrg/MyApp"}, repo: "myorg/myApp", expected: "MyOrg/MyApp"},
+		{name: "none", projs: []string{"myorg/other"}, repo: "myorg/myapp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &projectsStore{}
+			for _, name := range tt.projs {
+				store.projs = append(store.projs, &brigade.Project{Name: name})
+			}
+			proj, err := findProject(store, tt.repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expected == "" {
+				if proj != nil {
+					t.Errorf("expected no project, got %q", proj.Name)
+				}
+				return
+			}
+			if proj == nil || proj.Name != tt.expected {
+				t.Errorf("expected project %q, got %v", tt.expected, proj)
+			}
+		})
+	}
+
+	// Projects are also matched by their repo name
+	store := &projectsStore{projs: []*brigade.Project{{Name: "app", Repo: brigade.Repo{Name: "github.com/MyOrg/MyApp"}}}}
+	if proj, err := findProject(store, "myorg/myapp"); err != nil || proj == nil || proj.Name != "app" {
+		t.Errorf("expected the project of the repo, got %v, %v", proj, err)
+	}
+}
+
+func TestGithubHandler_caseInsensitiveRepos(t *testing.T) {
+	payload := []byte(fmt.Sprintf(testMilestonePayload, "created"))
+	for _, insensitive := range []bool{false, true} {
+		t.Run(fmt.Sprint(insensitive), func(t *testing.T) {
+			builds := newTestStore()
+			s := newTestGithubHandler(builds, t)
+			s.opts.CaseInsensitiveRepos = insensitive
+			proj := *builds.proj
+			proj.Name = "BaxterTheHacker/Public-Repo"
+			s.store = &buildsProjectsStore{
+				namedProjectsStore: namedProjectsStore{projectsStore{projs: []*brigade.Project{&proj}}},
+				builds:             builds,
+			}
+
+			w := handleTestEvent(t, s, "milestone", payload)
+
+			if !insensitive {
+				if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "project not found") {
+					t.Errorf("expected the project not to be found, got %d\n%s", w.Code, w.Body.String())
+				}
+				return
+			}
+			if w.Code != http.StatusOK || len(builds.builds) != 2 {
+				t.Fatalf("expected builds for the project matched case-insensitively, got %d\n%s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// buildsProjectsStore is a namedProjectsStore that creates builds in a testStore
+type buildsProjectsStore struct {
+	namedProjectsStore
+	builds *testStore
+}
+
+func (s *buildsProjectsStore) CreateBuild(b *brigade.Build) error {
+	return s.builds.CreateBuild(b)
+}
@@ -0,0 +1,80 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// ParseTrustedProxies parses the CIDRs, like 10.0.0.0/8, or plain IPs of the
+// proxies whose X-Forwarded-Proto header is trusted, see GithubOpts.RequireTLS.
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is neither an IP nor a CIDR", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is neither an IP nor a CIDR", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// isTLS tells whether r arrived over TLS, either directly or via a trusted
+// proxy that says so with X-Forwarded-Proto. The header of other peers is
+// ignored, as anyone could set it.
+func isTLS(r *http.Request, trusted []*net.IPNet) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			// The proxy closest to the gateway appends the last value
+			protos := strings.Split(proto, ",")
+			return strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https")
+		}
+	}
+	return false
+}
+
+// checkTLS rejects deliveries that didn't arrive over TLS with 400, if required
+// by GithubOpts.RequireTLS.
+//
+// It writes the error response and returns false when the delivery must not be processed.
+func (s *githubHook) checkTLS(c *gin.Context) bool {
+	if !s.opts.RequireTLS || isTLS(c.Request, s.trustedProxies) {
+		return true
+	}
+	log.Printf("WARNING: rejecting delivery from %s that didn't arrive over TLS", c.Request.RemoteAddr)
+	c.JSON(http.StatusBadRequest, gin.H{"status": "TLS required"})
+	return false
+}
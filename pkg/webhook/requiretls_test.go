@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestGithubHandler_requireTLS(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		proto      string
+		tls        bool
+		expected   int
+	}{
+		{name: "http", remoteAddr: "10.0.0.1:1234", expected: http.StatusBadRequest},
+		{name: "direct https", remoteAddr: "192.0.2.1:1234", tls: true, expected: http.StatusOK},
+		{name: "forwarded https", remoteAddr: "10.0.0.1:1234", proto: "https", expected: http.StatusOK},
+		{name: "forwarded chain ending in https", remoteAddr: "10.0.0.1:1234", proto: "http, https", expected: http.StatusOK},
+		{name: "forwarded http", remoteAddr: "10.0.0.1:1234", proto: "http", expected: http.StatusBadRequest},
+		{name: "forwarded https from untrusted peer", remoteAddr: "192.0.2.1:1234", proto: "https", expected: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.RequireTLS = true
+			if s.trustedProxies, err = ParseTrustedProxies([]string{"10.0.0.0/8"}); err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			r.Header.Add("X-GitHub-Event", "push")
+			r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = r
+
+			s.Handle(ctx)
+
+			if w.Code != tt.expected {
+				t.Fatalf("expected %d, got %d\n%s", tt.expected, w.Code, w.Body.String())
+			}
+			if tt.expected != http.StatusOK && len(store.builds) != 0 {
+				t.Errorf("expected no build for a rejected delivery, got %d", len(store.builds))
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 3 || nets[1].String() != "192.0.2.1/32" || nets[2].String() != "::1/128" {
+		t.Errorf("expected plain IPs as single-address CIDRs, got %v", nets)
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "proxy"} {
+		if _, err := ParseTrustedProxies([]string{invalid}); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/brigadecore/brigade/pkg/storage"
+)
+
+// createBuildAttempts is the number of times creating a build is attempted
+const createBuildAttempts = 3
+
+// createBuildBackoff is the delay before the first retry, doubled for every retry after it
+var createBuildBackoff = 200 * time.Millisecond
+
+// CreateBuild creates b in the Brigade store, retrying failures with exponential
+// backoff. The error of the last attempt is returned, or the error of ctx once
+// it is done, like when the delivery timed out, without attempting again.
+func CreateBuild(ctx context.Context, store storage.Store, b *brigade.Build) error {
+	var err error
+	delay := createBuildBackoff
+	for i := 1; ; i++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err = store.CreateBuild(b); err == nil {
+			return nil
+		}
+		if i == createBuildAttempts {
+			return err
+		}
+		log.Printf("Attempt %d of %d to create %q build for project %s failed, retrying in %s: %s", i, createBuildAttempts, b.Type, b.ProjectID, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// DefaultDeliveryTTL is how long a delivery is remembered by a DeliveryGuard.
+// GitHub does not redeliver automatically, so this only needs to cover manual
+// redeliveries shortly after a partial failure.
+const DefaultDeliveryTTL = 30 * time.Minute
+
+// DefaultDeliveryCacheSize is the number of keys a DeliveryGuard of the GitHub
+// webhook handler remembers, unless GithubOpts.DeliveryCacheSize is set.
+const DefaultDeliveryCacheSize = 10000
+
+// DeliveryGuard remembers the builds created for recent deliveries, so that a
+// redelivery after a partial failure only creates the builds that failed.
+type DeliveryGuard struct {
+	ttl  time.Duration
+	size int
+	now  func() time.Time
+
+	mu sync.Mutex
+	// order has the least recently used key at the back, and ages the oldest
+	order *list.List
+	ages  *list.List
+	seen  map[string]*guardedKey
+}
+
+// guardedKey is a key recorded in a DeliveryGuard, along with when, and its
+// elements in the order and ages of the guard
+type guardedKey struct {
+	key       string
+	at        time.Time
+	used, age *list.Element
+}
+
+// NewDeliveryGuard creates a DeliveryGuard that remembers deliveries for ttl.
+func NewDeliveryGuard(ttl time.Duration) *DeliveryGuard {
+	return NewBoundedDeliveryGuard(ttl, 0)
+}
+
+// NewBoundedDeliveryGuard creates a DeliveryGuard that remembers up to size
+// keys for ttl, evicting the least recently used. Zero remembers any number.
+func NewBoundedDeliveryGuard(ttl time.Duration, size int) *DeliveryGuard {
+	return &DeliveryGuard{
+		ttl:   ttl,
+		size:  size,
+		now:   time.Now,
+		order: list.New(),
+		ages:  list.New(),
+		seen:  map[string]*guardedKey{},
+	}
+}
+
+// Seen returns true if a build was recorded for key within the TTL.
+func (g *DeliveryGuard) Seen(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.use(key)
+}
+
+// Record remembers that a build was created for key, and forgets expired keys
+// and, beyond the size, the least recently used ones.
+func (g *DeliveryGuard) Record(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.record(key)
+}
+
+// Reserve records key unless it was recorded within the TTL, and returns
+// whether it did, in one step. Of concurrent deliveries with the same key, only
+// the one that reserved it proceeds. The reservation is undone with Release if
+// its build fails.
+func (g *DeliveryGuard) Reserve(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.use(key) {
+		return false
+	}
+	g.record(key)
+	return true
+}
+
+// Release forgets key, so that a redelivery can reserve it again.
+func (g *DeliveryGuard) Release(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if k, ok := g.seen[key]; ok {
+		g.forget(k)
+	}
+}
+
+// use is Seen, with g.mu held
+func (g *DeliveryGuard) use(key string) bool {
+	k, ok := g.seen[key]
+	if !ok || g.now().Sub(k.at) >= g.ttl {
+		return false
+	}
+	g.order.MoveToFront(k.used)
+	return true
+}
+
+// record is Record, with g.mu held. Expired keys are forgotten from the back
+// of the ages, so that only they are visited.
+func (g *DeliveryGuard) record(key string) {
+	now := g.now()
+	for el := g.ages.Back(); el != nil && now.Sub(el.Value.(*guardedKey).at) >= g.ttl; el = g.ages.Back() {
+		g.forget(el.Value.(*guardedKey))
+	}
+	if k, ok := g.seen[key]; ok {
+		k.at = now
+		g.order.MoveToFront(k.used)
+		g.ages.MoveToFront(k.age)
+		return
+	}
+	k := &guardedKey{key: key, at: now}
+	k.used = g.order.PushFront(k)
+	k.age = g.ages.PushFront(k)
+	g.seen[key] = k
+	for g.size > 0 && g.order.Len() > g.size {
+		g.forget(g.order.Back().Value.(*guardedKey))
+	}
+}
+
+// forget removes k, with g.mu held
+func (g *DeliveryGuard) forget(k *guardedKey) {
+	g.order.Remove(k.used)
+	g.ages.Remove(k.age)
+	delete(g.seen, k.key)
+}
@@ -0,0 +1,359 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+// flakyBuildStore fails to create builds of failType the given number of times
+type flakyBuildStore struct {
+	*testStore
+	failType string
+	failures int
+	attempts int
+}
+
+func (s *flakyBuildStore) CreateBuild(build *brigade.Build) error {
+	if build.Type == s.failType {
+		s.attempts++
+		if s.failures > 0 {
+			s.failures--
+			return errors.New("store unavailable")
+		}
+	}
+	return s.testStore.CreateBuild(build)
+}
+
+func TestCreateBuild(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		attempts int
+		mustFail bool
+	}{
+		{name: "first attempt", failures: 0, attempts: 1},
+		{name: "transient failure", failures: 2, attempts: 3},
+		{name: "persistent failure", failures: 5, attempts: 3, mustFail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &flakyBuildStore{testStore: newTestStore(), failType: "push", failures: tt.failures}
+
+			err := CreateBuild(context.Background(), store, &brigade.Build{ProjectID: "brigade-1234", Type: "push"})
+
+			if tt.mustFail != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if store.attempts != tt.attempts {
+				t.Errorf("expected %d attempts, got %d", tt.attempts, store.attempts)
+			}
+			if !tt.mustFail && len(store.builds) != 1 {
+				t.Errorf("expected 1 build, got %d", len(store.builds))
+			}
+		})
+	}
+}
+
+// cancellingBuildStore cancels the context of the build on every attempt
+type cancellingBuildStore struct {
+	*flakyBuildStore
+	cancel func()
+}
+
+func (s *cancellingBuildStore) CreateBuild(build *brigade.Build) error {
+	err := s.flakyBuildStore.CreateBuild(build)
+	s.cancel()
+	return err
+}
+
+func TestCreateBuild_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// The delivery times out while the first attempt fails
+	store := &cancellingBuildStore{flakyBuildStore: &flakyBuildStore{testStore: newTestStore(), failType: "push", failures: 1}, cancel: cancel}
+
+	err := CreateBuild(ctx, store, &brigade.Build{ProjectID: "brigade-1234", Type: "push"})
+	if err != context.Canceled {
+		t.Fatalf("expected the error of the context, got %v", err)
+	}
+	if store.attempts != 1 || len(store.builds) != 0 {
+		t.Errorf("expected no retry once the context is done, got %d attempts and %d builds", store.attempts, len(store.builds))
+	}
+
+	if err := CreateBuild(ctx, store, &brigade.Build{ProjectID: "brigade-1234", Type: "push"}); err != context.Canceled {
+		t.Fatalf("expected the error of the context, got %v", err)
+	}
+	if store.attempts != 1 {
+		t.Errorf("expected no attempt with a done context, got %d attempts", store.attempts)
+	}
+}
+
+func TestDeliveryGuard(t *testing.T) {
+	now := time.Now()
+	g := NewDeliveryGuard(time.Minute)
+	g.now = func() time.Time { return now }
+
+	if g.Seen("a") {
+		t.Fatal("expected an unrecorded key not to be seen")
+	}
+	g.Record("a")
+	if !g.Seen("a") {
+		t.Fatal("expected a recorded key to be seen")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if g.Seen("a") {
+		t.Error("expected the key to expire after the TTL")
+	}
+	g.Record("b")
+	if _, ok := g.seen["a"]; ok {
+		t.Error("expected expired keys to be forgotten")
+	}
+}
+
+// blockingBuildStore creates builds once release is closed, signalling every
+// attempt on started
+type blockingBuildStore struct {
+	*testStore
+	mu      sync.Mutex
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingBuildStore) CreateBuild(build *brigade.Build) error {
+	s.started <- struct{}{}
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.testStore.CreateBuild(build)
+}
+
+func TestDeliveryGuard_reserve(t *testing.T) {
+	now := time.Now()
+	g := NewDeliveryGuard(time.Minute)
+	g.now = func() time.Time { return now }
+
+	if !g.Reserve("a") {
+		t.Fatal("expected an unrecorded key to be reserved")
+	}
+	if g.Reserve("a") || !g.Seen("a") {
+		t.Fatal("expected a reserved key not to be reserved again")
+	}
+	g.Release("a")
+	if g.Seen("a") || !g.Reserve("a") {
+		t.Fatal("expected a released key to be reserved again")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if !g.Reserve("a") {
+		t.Error("expected a key to be reserved again after the TTL")
+	}
+}
+
+func TestGithubHandler_redelivery(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.deliveries = NewDeliveryGuard(time.Minute)
+	// Fails for longer than the retries of the first delivery
+	s.store = &flakyBuildStore{testStore: store, failType: "issue_comment:created", failures: createBuildAttempts}
+
+	payload, err := ioutil.ReadFile("testdata/github-issue_comment-payload.json")
+	if err != nil {
+		t.Fatalf("failed to read testdata: %s", err)
+	}
+	deliver := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		r.Header.Add("X-GitHub-Event", "issue_comment")
+		r.Header.Add("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
+
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = r
+
+		s.Handle(ctx)
+		return w
+	}
+
+	if w := deliver(); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 for a partial failure, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 1 || store.builds[0].Type != "issue_comment" {
+		t.Fatalf("expected only the issue_comment build to be created, got %d builds", len(store.builds))
+	}
+
+	if w := deliver(); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for the redelivery, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 2 || store.builds[1].Type != "issue_comment:created" {
+		t.Fatalf("expected only the failed build to be created again, got %d builds", len(store.builds))
+	}
+
+	if w := deliver(); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a duplicate delivery, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 2 {
+		t.Fatalf("expected no builds for a duplicate delivery, got %d builds", len(store.builds))
+	}
+}
+
+func TestDeliveryGuard_size(t *testing.T) {
+	g := NewBoundedDeliveryGuard(time.Minute, 2)
+	g.Record("a")
+	g.Record("b")
+	// Seeing a makes b the least recently used
+	if !g.Seen("a") {
+		t.Fatal("expected a recorded key to be seen")
+	}
+	g.Record("c")
+	if g.Seen("b") {
+		t.Error("expected the least recently used key to be evicted")
+	}
+	if !g.Seen("a") || !g.Seen("c") {
+		t.Error("expected the recently used keys to be kept")
+	}
+	if len(g.seen) != 2 || g.order.Len() != 2 {
+		t.Errorf("expected 2 keys, got %d", len(g.seen))
+	}
+}
+
+func TestDeliveryGuard_expiry(t *testing.T) {
+	now := time.Now()
+	g := NewBoundedDeliveryGuard(time.Minute, 10)
+	g.now = func() time.Time { return now }
+
+	g.Record("a")
+	now = now.Add(30 * time.Second)
+	g.Record("b")
+	// Using a makes it the most recently used, but not the youngest
+	if !g.Seen("a") {
+		t.Fatal("expected a recorded key to be seen")
+	}
+
+	now = now.Add(45 * time.Second)
+	g.Record("c")
+	if _, ok := g.seen["a"]; ok {
+		t.Error("expected the expired key to be forgotten, although it was used")
+	}
+	if !g.Seen("b") || !g.Seen("c") {
+		t.Error("expected the keys within the TTL to be kept")
+	}
+	if len(g.seen) != 2 || g.order.Len() != 2 || g.ages.Len() != 2 {
+		t.Errorf("expected 2 keys, got %d", len(g.seen))
+	}
+}
+
+func TestGithubHandler_duplicateDelivery(t *testing.T) {
+	store := newTestStore()
+	s := newTestGithubHandler(store, t)
+	s.deliveries = NewBoundedDeliveryGuard(time.Minute, DefaultDeliveryCacheSize)
+
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver := func(delivery string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
+		if err != nil {
+			t.Fatalf("failed to create request: %s", err)
+		}
+		r.Header.Add("X-GitHub-Event", "push")
+		r.Header.Add("X-GitHub-Delivery", delivery)
+		r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
+
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = r
+
+		s.Handle(ctx)
+		return w
+	}
+
+	if w := deliver("72d3162e-cc78-11e3-81ab-4c9367dc0958"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d\n%s", w.Code, w.Body.String())
+	}
+	w := deliver("72d3162e-cc78-11e3-81ab-4c9367dc0958")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for the replayed delivery, got %d\n%s", w.Code, w.Body.String())
+	}
+	if body := strings.TrimSpace(w.Body.String()); body != `{"status":"duplicate"}` {
+		t.Errorf("expected a duplicate status, got %s", body)
+	}
+	if len(store.builds) != 1 {
+		t.Fatalf("expected a single build for the replayed delivery, got %d builds", len(store.builds))
+	}
+
+	if w := deliver("8a1e7d4c-cc78-11e3-81ab-4c9367dc0958"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for another delivery, got %d\n%s", w.Code, w.Body.String())
+	}
+	if len(store.builds) != 2 {
+		t.Errorf("expected a build for another delivery of the same event, got %d builds", len(store.builds))
+	}
+}
+
+func TestGithubHandler_concurrentDuplicateDelivery(t *testing.T) {
+	const replays = 5
+	store := &blockingBuildStore{testStore: newTestStore(), started: make(chan struct{}, replays), release: make(chan struct{})}
+	s := newTestGithubHandler(store.testStore, t)
+	s.store = store
+	s.deliveries = NewBoundedDeliveryGuard(time.Minute, DefaultDeliveryCacheSize)
+
+	payload, err := ioutil.ReadFile("testdata/github-push-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := make(chan int, replays)
+	bodies := make(chan string, replays)
+	for i := 0; i < replays; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/", bytes.NewReader(payload))
+			r.Header.Add("X-GitHub-Event", "push")
+			r.Header.Add("X-GitHub-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+			r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
+
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = r
+
+			s.Handle(ctx)
+			codes <- w.Code
+			bodies <- strings.TrimSpace(w.Body.String())
+		}()
+	}
+
+	// The replays are answered while the first delivery is still building
+	<-store.started
+	for i := 0; i < replays-1; i++ {
+		select {
+		case code := <-codes:
+			if body := <-bodies; code != http.StatusOK || body != `{"status":"duplicate"}` {
+				t.Errorf("expected 200 with a duplicate status for a replay, got %d: %s", code, body)
+			}
+		case <-store.started:
+			t.Fatal("expected a single build for the replayed delivery")
+		case <-time.After(time.Second):
+			t.Fatal("expected the replays to be answered as duplicates")
+		}
+	}
+	close(store.release)
+	if code := <-codes; code != http.StatusOK {
+		t.Errorf("expected 200 for the delivery, got %d: %s", code, <-bodies)
+	}
+	if len(store.builds) != 1 {
+		t.Errorf("expected a single build for the replayed delivery, got %d builds", len(store.builds))
+	}
+}
@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// Keys of the App and installation of the /github/:app/:inst route in the gin context
+const (
+	routeAppKey  = "brigade-cd.app"
+	routeInstKey = "brigade-cd.inst"
+)
+
+// readRoute reads the App and installation IDs of deliveries to the
+// /github/:app/:inst route, so that a gateway can serve several Apps addressed
+// by URL. The IDs of the plain /github route are left unset.
+//
+// It writes the error response and returns false when the IDs are invalid.
+func readRoute(c *gin.Context) bool {
+	app, inst := c.Params.ByName("app"), c.Params.ByName("inst")
+	if app == "" && inst == "" {
+		return true
+	}
+	appID, err := strconv.Atoi(app)
+	if err != nil || appID <= 0 {
+		log.Printf("Rejecting delivery for invalid App %q in the path", app)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "invalid App ID in path"})
+		return false
+	}
+	instID, err := strconv.ParseInt(inst, 10, 64)
+	if err != nil || instID <= 0 {
+		log.Printf("Rejecting delivery for invalid installation %q in the path", inst)
+		c.JSON(http.StatusBadRequest, gin.H{"status": "invalid installation ID in path"})
+		return false
+	}
+	c.Set(routeAppKey, appID)
+	c.Set(routeInstKey, instID)
+	return true
+}
+
+// appID returns the ID of the App of the delivery, the one of the route if
+// any, and GithubOpts.AppID otherwise.
+func (s *githubHook) appID(c *gin.Context) int {
+	if id, ok := c.Get(routeAppKey); ok {
+		return id.(int)
+	}
+	return s.opts.AppID
+}
+
+// routeInstallationID returns the installation of the delivery, the one of the
+// route if any, and the one resolved by installationID otherwise.
+func (s *githubHook) routeInstallationID(c *gin.Context, inst *github.Installation, repo string) int64 {
+	if id, ok := c.Get(routeInstKey); ok {
+		return id.(int64)
+	}
+	return s.installationID(c.Request.Context(), inst, repo)
+}
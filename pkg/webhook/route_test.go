@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+	"github.com/google/go-github/v27/github"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestGithubHandler_route(t *testing.T) {
+	payload, err := ioutil.ReadFile("testdata/github-issue_comment_pull_request_author_allowed-payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		code    int
+		appID   int
+		instID  int
+		rejects bool
+	}{
+		{path: "/events/github", code: http.StatusOK, appID: 13, instID: 1},
+		{path: "/events/github/42/2311213", code: http.StatusOK, appID: 42, instID: 2311213},
+		{path: "/events/github/app/2311213", code: http.StatusBadRequest, rejects: true},
+		{path: "/events/github/42/0", code: http.StatusBadRequest, rejects: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			s.opts.AppID = 13
+			s.opts.DefaultInstallationID = 1
+			s.handleIssueCommentEvent = handleIssueCommentEvent
+			var tokenApp, tokenInst int
+			s.getToken = func(appID, installationID int, cfg brigade.Github) (string, time.Time, error) {
+				tokenApp, tokenInst = appID, installationID
+				return "v1.installation-token", time.Time{}, nil
+			}
+			s.getPullRequest = func(c *gin.Context, s *githubHook, token, repo string, number int, proj *brigade.Project) (*github.PullRequest, error) {
+				return &github.PullRequest{Number: github.Int(2), Head: &github.PullRequestBranch{SHA: github.String("c1")}}, nil
+			}
+
+			router := gin.New()
+			router.POST("/events/github", s.Handle)
+			router.POST("/events/github/:app/:inst", s.Handle)
+
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", tt.path, bytes.NewReader(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Add("X-GitHub-Event", "issue_comment")
+			r.Header.Add("X-Hub-Signature", SHA1HMAC([]byte("asdf"), payload))
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.code {
+				t.Fatalf("expected %d, got %d\n%s", tt.code, w.Code, w.Body.String())
+			}
+			if tt.rejects {
+				if len(store.builds) != 0 {
+					t.Errorf("expected no builds, got %d", len(store.builds))
+				}
+				return
+			}
+			if tokenApp != tt.appID || tokenInst != tt.instID {
+				t.Errorf("expected a token for App %d and installation %d, got %d and %d", tt.appID, tt.instID, tokenApp, tokenInst)
+			}
+			if len(store.builds) == 0 {
+				t.Fatal("expected builds for the comment")
+			}
+			pl := Payload{}
+			if err := json.Unmarshal(store.builds[0].Payload, &pl); err != nil {
+				t.Fatal(err)
+			}
+			if pl.InstallationID != int64(tt.instID) {
+				t.Errorf("expected installation %d in the payload, got %d", tt.instID, pl.InstallationID)
+			}
+		})
+	}
+}
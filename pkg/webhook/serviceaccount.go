@@ -0,0 +1,24 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// StampServiceAccount adds the Kubernetes service account the worker should run as
+// to the top level of a JSON object payload.
+//
+// Brigade builds have no field for it, so workers read it from the payload.
+func StampServiceAccount(payload []byte, serviceAccount string) ([]byte, error) {
+	return stamp(payload, "serviceAccount", serviceAccount)
+}
+
+// ValidateServiceAccount checks that name is a valid Kubernetes service account name.
+func ValidateServiceAccount(name string) error {
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid service account name %q: %s", name, strings.Join(errs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestGithubHandler_serviceAccount(t *testing.T) {
+	ts := newTestStore()
+	ts.proj.ID = "brigade-repo"
+	store := &routingStore{
+		testStore: ts,
+		projects: map[string]*brigade.Project{
+			"deploy-pipeline": {ID: "brigade-deploy", Name: "deploy-pipeline"},
+		},
+	}
+	s := newTestGithubHandler(store, t)
+	s.opts.EventProjects = map[string]string{"issue_comment:created": "deploy-pipeline"}
+	s.opts.ServiceAccounts = map[string]string{"deploy-pipeline": "deployer"}
+
+	handleTestIssueComment(t, s)
+
+	if len(ts.builds) != 2 {
+		t.Fatalf("expected 2 builds, got %d", len(ts.builds))
+	}
+	for _, b := range ts.builds {
+		pl := struct {
+			ServiceAccount *string `json:"serviceAccount"`
+		}{}
+		if err := json.Unmarshal(b.Payload, &pl); err != nil {
+			t.Fatal(err)
+		}
+		switch b.ProjectID {
+		case "brigade-deploy":
+			if pl.ServiceAccount == nil || *pl.ServiceAccount != "deployer" {
+				t.Errorf("expected the %q build to run as deployer, got %v", b.Type, pl.ServiceAccount)
+			}
+		default:
+			if pl.ServiceAccount != nil {
+				t.Errorf("expected no service account for the %q build of project %s, got %q", b.Type, b.ProjectID, *pl.ServiceAccount)
+			}
+		}
+	}
+}
+
+func TestValidateServiceAccount(t *testing.T) {
+	for _, valid := range []string{"deployer", "brigade-worker", "ci.deploy"} {
+		if err := ValidateServiceAccount(valid); err != nil {
+			t.Errorf("unexpected error for %q: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"", "Deployer", "deploy_er", "-deployer"} {
+		if err := ValidateServiceAccount(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+	if err := (GithubOpts{ServiceAccounts: map[string]string{"myorg/myapp": "Bad_Name"}}).Validate(); err == nil {
+		t.Error("expected an error for an invalid service account")
+	}
+}
@@ -0,0 +1,83 @@
+package webhook
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// hubSignature256Header carries the SHA-256 HMAC of the body
+const hubSignature256Header = "X-Hub-Signature-256"
+
+// Signature algorithms projects can require with GithubOpts.SignatureAlgorithms
+const (
+	SignatureSHA1   = "sha1"
+	SignatureSHA256 = "sha256"
+)
+
+// signatureHeaders are the headers carrying the signature of each algorithm
+var signatureHeaders = map[string]string{
+	SignatureSHA1:   hubSignatureHeader,
+	SignatureSHA256: hubSignature256Header,
+}
+
+// ValidateSignatureAlgorithms checks that algs names one or more known algorithms.
+func ValidateSignatureAlgorithms(algs []string) error {
+	if len(algs) == 0 {
+		return fmt.Errorf("no signature algorithm is allowed")
+	}
+	for _, alg := range algs {
+		if _, ok := signatureHeaders[alg]; !ok {
+			return fmt.Errorf("unknown signature algorithm %q, must be %s or %s", alg, SignatureSHA1, SignatureSHA256)
+		}
+	}
+	return nil
+}
+
+// checkSignature validates the signature of the delivery for the named project.
+// Projects with allowed algorithms in GithubOpts.SignatureAlgorithms must carry
+// a signature of at least one of them, and every one present must match. The
+// signatures of other algorithms are ignored, so that a delivery signed with a
+// disallowed algorithm only is rejected. Other projects are validated with
+// validateSignature.
+func (s *githubHook) checkSignature(h http.Header, project, secretKey string, payload []byte) error {
+	algs, ok := s.opts.SignatureAlgorithms[project]
+	if !ok {
+		return validateSignature(h, secretKey, payload)
+	}
+
+	checked := 0
+	for _, alg := range algs {
+		signature := h.Get(signatureHeaders[alg])
+		if signature == "" {
+			continue
+		}
+		if err := validateSignatureWith(alg, signature, secretKey, payload); err != nil {
+			return err
+		}
+		checked++
+	}
+	if checked == 0 {
+		return fmt.Errorf("payload is not signed with any of the allowed algorithms %s", strings.Join(algs, ", "))
+	}
+	return nil
+}
+
+// validateSignatureWith compares the signature of algorithm alg with our own
+// computing of the body.
+func validateSignatureWith(alg, signature, secretKey string, payload []byte) error {
+	var sum string
+	switch alg {
+	case SignatureSHA256:
+		sum = SHA256HMAC([]byte(secretKey), payload)
+	default:
+		sum = SHA1HMAC([]byte(secretKey), payload)
+	}
+	if subtle.ConstantTimeCompare([]byte(sum), []byte(signature)) != 1 {
+		log.Printf("Expected signature %q (sum), got %q (hub-signature)", sum, signature)
+		return fmt.Errorf("payload %s signature check failed", alg)
+	}
+	return nil
+}
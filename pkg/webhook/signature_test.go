@@ -0,0 +1,152 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gin "gopkg.in/gin-gonic/gin.v1"
+)
+
+func TestGithubHandler_signatureAlgorithms(t *testing.T) {
+	payload := []byte(fmt.Sprintf(testMilestonePayload, "created"))
+	sha1Sig := SHA1HMAC([]byte("asdf"), payload)
+	sha256Sig := SHA256HMAC([]byte("asdf"), payload)
+	wrong256Sig := SHA256HMAC([]byte("wrong"), payload)
+
+	tests := []struct {
+		name       string
+		algs       []string
+		signatures map[string]string
+		expected   int
+	}{
+		{name: "no policy, sha1", signatures: map[string]string{hubSignatureHeader: sha1Sig}, expected: http.StatusOK},
+		{name: "no policy, sha256", signatures: map[string]string{hubSignature256Header: sha256Sig}, expected: http.StatusOK},
+		{name: "no policy, mismatched sha256 preferred", signatures: map[string]string{hubSignatureHeader: sha1Sig, hubSignature256Header: wrong256Sig}, expected: http.StatusForbidden},
+		{name: "sha1 only, sha1", algs: []string{SignatureSHA1}, signatures: map[string]string{hubSignatureHeader: sha1Sig}, expected: http.StatusOK},
+		{name: "sha1 only, mismatched sha256 ignored", algs: []string{SignatureSHA1}, signatures: map[string]string{hubSignatureHeader: sha1Sig, hubSignature256Header: wrong256Sig}, expected: http.StatusOK},
+		{name: "sha1 only, sha256", algs: []string{SignatureSHA1}, signatures: map[string]string{hubSignature256Header: sha256Sig}, expected: http.StatusForbidden},
+		{name: "sha256 only, sha256", algs: []string{SignatureSHA256}, signatures: map[string]string{hubSignature256Header: sha256Sig}, expected: http.StatusOK},
+		{name: "sha256 only, sha1", algs: []string{SignatureSHA256}, signatures: map[string]string{hubSignatureHeader: sha1Sig}, expected: http.StatusForbidden},
+		{name: "sha256 only, mismatched sha256", algs: []string{SignatureSHA256}, signatures: map[string]string{hubSignatureHeader: sha1Sig, hubSignature256Header: wrong256Sig}, expected: http.StatusForbidden},
+		{name: "both, sha1", algs: []string{SignatureSHA1, SignatureSHA256}, signatures: map[string]string{hubSignatureHeader: sha1Sig}, expected: http.StatusOK},
+		{name: "both, sha256", algs: []string{SignatureSHA1, SignatureSHA256}, signatures: map[string]string{hubSignature256Header: sha256Sig}, expected: http.StatusOK},
+		{name: "both, both", algs: []string{SignatureSHA1, SignatureSHA256}, signatures: map[string]string{hubSignatureHeader: sha1Sig, hubSignature256Header: sha256Sig}, expected: http.StatusOK},
+		{name: "both, one mismatched", algs: []string{SignatureSHA1, SignatureSHA256}, signatures: map[string]string{hubSignatureHeader: sha1Sig, hubSignature256Header: wrong256Sig}, expected: http.StatusForbidden},
+		{name: "both, unsigned", algs: []string{SignatureSHA1, SignatureSHA256}, expected: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			s := newTestGithubHandler(store, t)
+			if tt.algs != nil {
+				s.opts.SignatureAlgorithms = map[string][]string{store.proj.Name: tt.algs}
+			}
+
+			w := httptest.NewRecorder()
+			r, err := http.NewRequest("POST", "", bytes.NewReader(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.Header.Add("X-GitHub-Event", "milestone")
+			for h, sig := range tt.signatures {
+				r.Header.Add(h, sig)
+			}
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = r
+			s.Handle(ctx)
+
+			if w.Code != tt.expected {
+				t.Fatalf("expected %d, got %d\n%s", tt.expected, w.Code, w.Body.String())
+			}
+			if built := len(store.builds) > 0; built != (tt.expected == http.StatusOK) {
+				t.Errorf("unexpected builds %v", store.builds)
+			}
+		})
+	}
+}
+
+func TestValidateSignature(t *testing.T) {
+	payload := []byte(fmt.Sprintf(testMilestonePayload, "created"))
+	tampered := []byte(fmt.Sprintf(testMilestonePayload, "deleted"))
+
+	tests := []struct {
+		name       string
+		signatures map[string]string
+		payload    []byte
+		err        string
+	}{
+		{
+			name:       "sha256",
+			signatures: map[string]string{hubSignature256Header: SHA256HMAC([]byte("asdf"), payload)},
+			payload:    payload,
+		},
+		{
+			name:       "legacy sha1 only",
+			signatures: map[string]string{hubSignatureHeader: SHA1HMAC([]byte("asdf"), payload)},
+			payload:    payload,
+		},
+		{
+			name:       "sha256 preferred over a valid sha1",
+			signatures: map[string]string{hubSignatureHeader: SHA1HMAC([]byte("asdf"), payload), hubSignature256Header: SHA256HMAC([]byte("asdf"), tampered)},
+			payload:    payload,
+			err:        "payload sha256 signature check failed",
+		},
+		{
+			name:       "mismatched body, sha256",
+			signatures: map[string]string{hubSignatureHeader: SHA1HMAC([]byte("asdf"), payload), hubSignature256Header: SHA256HMAC([]byte("asdf"), payload)},
+			payload:    tampered,
+			err:        "payload sha256 signature check failed",
+		},
+		{
+			name:       "mismatched body, sha1",
+			signatures: map[string]string{hubSignatureHeader: SHA1HMAC([]byte("asdf"), payload)},
+			payload:    tampered,
+			err:        "payload sha1 signature check failed",
+		},
+		{
+			name:    "unsigned",
+			payload: payload,
+			err:     "payload sha1 signature check failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for name, sig := range tt.signatures {
+				h.Set(name, sig)
+			}
+			err := validateSignature(h, "asdf", tt.payload)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestValidateSignatureAlgorithms(t *testing.T) {
+	tests := []struct {
+		algs  []string
+		valid bool
+	}{
+		{algs: []string{SignatureSHA1}, valid: true},
+		{algs: []string{SignatureSHA256, SignatureSHA1}, valid: true},
+		{algs: []string{"md5"}},
+		{algs: []string{""}},
+		{},
+	}
+	for _, tt := range tests {
+		if err := ValidateSignatureAlgorithms(tt.algs); (err == nil) != tt.valid {
+			t.Errorf("%v: unexpected error %v", tt.algs, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+// Queues of builds persisted in a Spool
+const (
+	spoolDebounce = "debounce"
+	spoolBuffer   = "buffer"
+)
+
+// DefaultSpoolSize is the default number of builds a Spool holds
+const DefaultSpoolSize = 1000
+
+// ErrSpoolFull is returned by Spool.Put when the spool holds its maximum number of builds
+var ErrSpoolFull = errors.New("event queue spool is full")
+
+// spooledBuild is a build persisted by a Spool
+type spooledBuild struct {
+	Build   *brigade.Build `json:"build"`
+	Spooled time.Time      `json:"spooled"`
+
+	// name is the name of the file of the build
+	name string
+}
+
+// Spool persists the builds pending in the debouncer and the BuildBuffer as JSON
+// files in a directory, like on a persistent volume, so that they survive
+// restarts of the gateway and are replayed on startup. It holds up to a bounded
+// number of builds, beyond which builds are only held in memory.
+type Spool struct {
+	dir  string
+	size int
+	now  func() time.Time
+
+	mu    sync.Mutex
+	count int
+	last  int64
+}
+
+// NewSpool creates a Spool of up to size builds in dir, creating dir if missing.
+func NewSpool(dir string, size int) (*Spool, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("spool size %d must be positive", size)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, size: size, now: time.Now}
+	names, err := s.names("")
+	if err != nil {
+		return nil, err
+	}
+	s.count = len(names)
+	return s, nil
+}
+
+// names returns the names of the files of the spooled builds of queue, or of
+// every queue if empty, in the order they were put.
+func (s *Spool) names(queue string) ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, f := range files {
+		n := f.Name()
+		if f.IsDir() || filepath.Ext(n) != ".json" || !strings.HasPrefix(n, queue) {
+			continue
+		}
+		names = append(names, n)
+	}
+	// The names end in a zero-padded sequence number whose width is fixed
+	sort.Slice(names, func(i, j int) bool { return seqOf(names[i]) < seqOf(names[j]) })
+	return names, nil
+}
+
+func seqOf(name string) string {
+	return name[strings.LastIndex(name, "-")+1:]
+}
+
+// Put persists b in queue, and returns the name to remove it with once it is created.
+func (s *Spool) Put(queue string, b *brigade.Build) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count >= s.size {
+		return "", ErrSpoolFull
+	}
+
+	now := s.now().UTC()
+	// The sequence is the time, unless builds are put within the same nanosecond
+	seq := now.UnixNano()
+	if seq <= s.last {
+		seq = s.last + 1
+	}
+	s.last = seq
+
+	data, err := json.Marshal(spooledBuild{Build: b, Spooled: now})
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%020d.json", queue, seq)
+	// The payload may contain tokens, so the file is only readable by us
+	if err := ioutil.WriteFile(filepath.Join(s.dir, name), data, 0600); err != nil {
+		return "", err
+	}
+	s.count++
+	return name, nil
+}
+
+// put persists b in queue, logging failures, as the build is still held in memory.
+func (s *Spool) put(queue string, b *brigade.Build) string {
+	if s == nil {
+		return ""
+	}
+	name, err := s.Put(queue, b)
+	if err != nil {
+		log.Printf("WARNING: %q build for project %s is not persisted and is lost if the gateway exits: %s", b.Type, b.ProjectID, err)
+	}
+	return name
+}
+
+// Remove deletes the spooled build of the given name, once it is no longer pending.
+// Removing from a nil Spool, or an empty name, is a no-op.
+func (s *Spool) Remove(name string) {
+	if s == nil || name == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+		log.Printf("WARNING: failed to remove spooled build %s, which is replayed again on startup: %s", name, err)
+		return
+	}
+	s.count--
+}
+
+// load returns the spooled builds of queue, in the order they were put. Files
+// that can't be read are logged and skipped.
+func (s *Spool) load(queue string) ([]spooledBuild, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, err := s.names(queue + "-")
+	if err != nil {
+		return nil, err
+	}
+	builds := []spooledBuild{}
+	for _, n := range names {
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, n))
+		if err != nil {
+			log.Printf("WARNING: skipping unreadable spooled build %s: %s", n, err)
+			continue
+		}
+		sb := spooledBuild{}
+		if err := json.Unmarshal(data, &sb); err != nil || sb.Build == nil {
+			log.Printf("WARNING: skipping malformed spooled build %s: %v", n, err)
+			continue
+		}
+		sb.name = n
+		builds = append(builds, sb)
+	}
+	return builds, nil
+}
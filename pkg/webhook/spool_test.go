@@ -0,0 +1,193 @@
+package webhook
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func spooledFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.Put(spoolDebounce, &brigade.Build{ProjectID: "first", Type: "push"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(spoolBuffer, &brigade.Build{ProjectID: "buffered", Type: "push"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(spoolDebounce, &brigade.Build{ProjectID: "second", Type: "push"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(spoolDebounce, &brigade.Build{ProjectID: "third", Type: "push"}); err != ErrSpoolFull {
+		t.Errorf("expected putting into the full spool to fail with %q, got %v", ErrSpoolFull, err)
+	}
+
+	builds, err := s.load(spoolDebounce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 || builds[0].Build.ProjectID != "first" || builds[1].Build.ProjectID != "second" {
+		t.Fatalf("expected the debounced builds in the order they were put, got %v", builds)
+	}
+	if builds[0].name != first {
+		t.Errorf("expected the build to be loaded as %s, got %s", first, builds[0].name)
+	}
+
+	s.Remove(first)
+	if _, err := s.Put(spoolDebounce, &brigade.Build{ProjectID: "third", Type: "push"}); err != nil {
+		t.Errorf("expected a removed build to free up the spool, got %s", err)
+	}
+
+	// The spooled builds count towards the size after a restart
+	s, err = NewSpool(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put(spoolDebounce, &brigade.Build{ProjectID: "fourth", Type: "push"}); err != ErrSpoolFull {
+		t.Errorf("expected the reopened spool to be full, got %v", err)
+	}
+}
+
+func TestSpool_nil(t *testing.T) {
+	var s *Spool
+	if name := s.put(spoolBuffer, &brigade.Build{Type: "push"}); name != "" {
+		t.Errorf("expected no build to be spooled, got %s", name)
+	}
+	s.Remove("buffer-1.json")
+	if builds, err := s.load(spoolBuffer); err != nil || len(builds) != 0 {
+		t.Errorf("expected no builds, got %v, %v", builds, err)
+	}
+}
+
+func TestSpool_replayDebounced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSpool(dir, DefaultSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The gateway exits before the quiet period elapses
+	d := newDebouncer(time.Hour, func(b *brigade.Build) {
+		t.Errorf("unexpected build of %s before the restart", describeRevision(b.Revision))
+	})
+	d.spool = s
+	for _, commit := range []string{"c1", "c2"} {
+		d.schedule(&brigade.Build{ProjectID: "brigade-1234", Type: "push", Revision: &brigade.Revision{Ref: "refs/heads/master", Commit: commit}})
+	}
+	for _, p := range d.pending {
+		p.timer.Stop()
+	}
+	if files := spooledFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected only the latest build to remain spooled, got %v", files)
+	}
+
+	s, err = NewSpool(dir, DefaultSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emitted := make(chan *brigade.Build, 10)
+	d = newDebouncer(time.Millisecond, func(b *brigade.Build) { emitted <- b })
+	d.spool = s
+	if err := d.replay(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case b := <-emitted:
+		if b.Revision.Commit != "c2" {
+			t.Errorf("expected the latest revision c2 to be replayed, got %s", b.Revision.Commit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the replayed build")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(spooledFiles(t, dir)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the emitted build to be removed from the spool, got %v", spooledFiles(t, dir))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSpool_replayBuffered(t *testing.T) {
+	defer setBufferRetryInterval(time.Millisecond)()
+
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewSpool(dir, DefaultSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The gateway exits while the store is unavailable
+	store := newTestStore()
+	q := NewBuildBuffer(&failingBuildStore{testStore: store}, 10)
+	NewGithubHookHandler(q.store, nil, nil, GithubOpts{Buffer: q, Spool: s})
+	for _, id := range []string{"first", "second"} {
+		if !q.Put(&brigade.Build{ProjectID: id, Type: "push"}, nil) {
+			t.Fatalf("expected %s to be buffered", id)
+		}
+	}
+	if files := spooledFiles(t, dir); len(files) != 2 {
+		t.Fatalf("expected both buffered builds to be spooled, got %v", files)
+	}
+
+	s, err = NewSpool(dir, DefaultSpoolSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = NewBuildBuffer(store, 10)
+	audit := &bytes.Buffer{}
+	NewGithubHookHandler(store, nil, nil, GithubOpts{Buffer: q, Spool: s, AuditLog: NewAuditLog(audit)})
+	if q.Len() != 2 {
+		t.Fatalf("expected both builds to be replayed into the buffer, got %d", q.Len())
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.Run(stop)
+	waitForFlush(t, q)
+
+	if len(store.builds) != 2 || store.builds[0].ProjectID != "first" || store.builds[1].ProjectID != "second" {
+		t.Fatalf("expected the replayed builds to be created in order, got %v", store.builds)
+	}
+	if got := strings.Count(audit.String(), "\n"); got != 2 {
+		t.Errorf("expected an audit record per replayed build, got %s", audit.String())
+	}
+	if files := spooledFiles(t, dir); len(files) != 0 {
+		t.Errorf("expected the created builds to be removed from the spool, got %v", files)
+	}
+}
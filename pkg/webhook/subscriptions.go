@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+// alwaysDelivered are the events GitHub delivers to Apps without a subscription
+var alwaysDelivered = map[string]bool{
+	"ping":                      true,
+	"installation":              true,
+	"installation_repositories": true,
+	"github_app_authorization":  true,
+	"marketplace_purchase":      true,
+	"security_advisory":         true,
+}
+
+// app is the part of the GET /app response that go-github doesn't expose
+type app struct {
+	Slug   string   `json:"slug"`
+	Events []string `json:"events"`
+}
+
+// AppEvents returns the webhook events the GitHub App is subscribed to, via GET /app.
+func AppEvents(c context.Context, appID int, key []byte, cfg brigade.Github) ([]string, error) {
+	a, err := getApp(c, appID, key, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return a.Events, nil
+}
+
+// getApp gets the GitHub App via GET /app.
+func getApp(c context.Context, appID int, key []byte, cfg brigade.Github) (*app, error) {
+	tok, err := JWT(strconv.Itoa(appID), key)
+	if err != nil {
+		return nil, err
+	}
+	client, err := GhClient(brigade.Github{
+		Token:     tok,
+		BaseURL:   cfg.BaseURL,
+		UploadURL: cfg.UploadURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := client.NewRequest("GET", "app", nil)
+	if err != nil {
+		return nil, err
+	}
+	a := &app{}
+	if _, err := client.Do(c, req, a); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// EventDiscrepancies compares the events the App is subscribed to with the
+// emitted event types. It returns the emitted events that are never received, as
+// the App isn't subscribed to them, and the subscribed events that are received
+// but never emitted.
+//
+// Negations and globs of the emitted event types name no event of their own,
+// see emits. A subscribed event is emitted if a pattern matches it with or
+// without an action, unless a negation excludes it.
+func EventDiscrepancies(subscribed, emitted []string) (unsubscribed, unemitted []string) {
+	subs := map[string]bool{}
+	for _, e := range subscribed {
+		subs[strings.ToLower(e)] = true
+	}
+	patterns := []string{}
+	events := map[string]bool{}
+	for _, e := range emitted {
+		p := strings.ToLower(e)
+		patterns = append(patterns, p)
+		if event := strings.SplitN(p, ":", 2)[0]; !strings.HasPrefix(event, "!") && !strings.Contains(event, "*") {
+			events[event] = true
+		}
+	}
+
+	for e := range events {
+		if !subs[e] && !alwaysDelivered[e] && !excluded(patterns, e) {
+			unsubscribed = append(unsubscribed, e)
+		}
+	}
+	for e := range subs {
+		if excluded(patterns, e) || !events[e] && !emits(patterns, e) {
+			unemitted = append(unemitted, e)
+		}
+	}
+	sort.Strings(unsubscribed)
+	sort.Strings(unemitted)
+	return unsubscribed, unemitted
+}
+
+// CheckEventSubscriptions warns about discrepancies between the events the App
+// is subscribed to and the emitted event types. It never fails, as the
+// subscriptions may legitimately be managed elsewhere.
+func CheckEventSubscriptions(c context.Context, appID int, key []byte, cfg brigade.Github, emitted []string) {
+	subscribed, err := AppEvents(c, appID, key, cfg)
+	if err != nil {
+		log.Printf("WARNING: failed to fetch the events App %d is subscribed to: %s", appID, err)
+		return
+	}
+	unsubscribed, unemitted := EventDiscrepancies(subscribed, emitted)
+	if len(unsubscribed) > 0 {
+		log.Printf("WARNING: App %d is not subscribed to emitted events %s, so they are never received", appID, strings.Join(unsubscribed, ", "))
+	}
+	if len(unemitted) > 0 {
+		log.Printf("WARNING: App %d is subscribed to events %s, which are not emitted", appID, strings.Join(unemitted, ", "))
+	}
+}
@@ -0,0 +1,75 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+func TestAppEvents(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":42,"slug":"brigade-cd","events":["check_run","issue_comment","push"]}`))
+	}))
+	defer ts.Close()
+
+	cfg := brigade.Github{BaseURL: ts.URL + "/", UploadURL: ts.URL + "/"}
+	events, err := AppEvents(context.Background(), 42, key, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"check_run", "issue_comment", "push"}; !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+
+	unsubscribed, unemitted := EventDiscrepancies(events, []string{"issue_comment:created", "milestone", "ping"})
+	if expected := []string{"milestone"}; !reflect.DeepEqual(unsubscribed, expected) {
+		t.Errorf("expected unsubscribed events %v, got %v", expected, unsubscribed)
+	}
+	if expected := []string{"check_run", "push"}; !reflect.DeepEqual(unemitted, expected) {
+		t.Errorf("expected unemitted events %v, got %v", expected, unemitted)
+	}
+}
+
+func TestEventDiscrepancies_wildcard(t *testing.T) {
+	unsubscribed, unemitted := EventDiscrepancies([]string{"push"}, []string{"*"})
+	if len(unsubscribed) != 0 || len(unemitted) != 0 {
+		t.Errorf("expected no discrepancies with *, got %v and %v", unsubscribed, unemitted)
+	}
+}
+
+func TestEventDiscrepancies_patterns(t *testing.T) {
+	unsubscribed, unemitted := EventDiscrepancies([]string{"push", "pull_request", "issues"}, []string{"*", "!push"})
+	if len(unsubscribed) != 0 {
+		t.Errorf("expected negations not to be emitted events, got %v", unsubscribed)
+	}
+	if expected := []string{"push"}; !reflect.DeepEqual(unemitted, expected) {
+		t.Errorf("expected unemitted events %v, got %v", expected, unemitted)
+	}
+
+	unsubscribed, unemitted = EventDiscrepancies([]string{"pull_request", "pull_request_review", "push"}, []string{"pull_request*", "issues:*"})
+	if expected := []string{"issues"}; !reflect.DeepEqual(unsubscribed, expected) {
+		t.Errorf("expected unsubscribed events %v, got %v", expected, unsubscribed)
+	}
+	if expected := []string{"push"}; !reflect.DeepEqual(unemitted, expected) {
+		t.Errorf("expected unemitted events %v, got %v", expected, unemitted)
+	}
+}
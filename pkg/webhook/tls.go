@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// transport is the transport of every GitHub client, http.DefaultTransport if
+// nil. Set it with SetTLSFiles.
+var transport http.RoundTripper
+
+// NewTLSTransport creates a transport like http.DefaultTransport that trusts the
+// CA certificates of the PEM bundle caFile in addition to the system roots, and
+// presents the client certificate of the PEM files certFile and keyFile, if set.
+func NewTLSTransport(caFile, certFile, keyFile string) (*http.Transport, error) {
+	cfg := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM-encoded CA certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("a client certificate requires both a certificate and a key file")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       cfg,
+	}, nil
+}
+
+// SetTLSFiles makes every GitHub client use a transport created by
+// NewTLSTransport, like for GitHub Enterprise with an internal CA or mTLS. With
+// all files empty, the default transport is used.
+func SetTLSFiles(caFile, certFile, keyFile string) error {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		transport = nil
+		return nil
+	}
+	t, err := NewTLSTransport(caFile, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	transport = t
+	return nil
+}
+
+// clientContext returns the context of the oauth2 clients of GitHub clients,
+// which use its HTTP client as the base of their transport.
+func clientContext() context.Context {
+	c := context.Background()
+	if transport != nil {
+		c = context.WithValue(c, oauth2.HTTPClient, &http.Client{Transport: transport})
+	}
+	return c
+}
@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brigadecore/brigade/pkg/brigade"
+)
+
+// writeCA writes the certificate of ts to a PEM file in dir
+func writeCA(t *testing.T, dir string, ts *httptest.Server) string {
+	path := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(path, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewTLSTransport(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := writeCA(t, dir, ts)
+
+	tr, err := NewTLSTransport(caFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&http.Client{Transport: tr}).Get(ts.URL)
+	if err != nil {
+		t.Fatalf("expected the custom CA to be trusted: %v", err)
+	}
+	res.Body.Close()
+
+	if res, err := http.Get(ts.URL); err == nil {
+		res.Body.Close()
+		t.Error("expected the custom CA not to be trusted by the default transport")
+	}
+
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, files := range map[string][3]string{
+		"missing CA file":         {filepath.Join(dir, "missing.pem"), "", ""},
+		"CA file without PEM":     {notPEM, "", ""},
+		"cert without key":        {"", caFile, ""},
+		"key without cert":        {"", "", caFile},
+		"unparseable client cert": {"", notPEM, notPEM},
+	} {
+		if _, err := NewTLSTransport(files[0], files[1], files[2]); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSetTLSFiles(t *testing.T) {
+	apps := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apps++
+		w.Write([]byte(`{"id": 13}`))
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := SetTLSFiles(writeCA(t, dir, ts), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTLSFiles("", "", "")
+
+	c, err := GhClient(brigade.Github{Token: "totallyFake", BaseURL: ts.URL + "/", UploadURL: ts.URL + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Apps.Get(context.Background(), ""); err != nil {
+		t.Fatalf("expected the GitHub client to trust the custom CA: %v", err)
+	}
+	if apps != 1 {
+		t.Errorf("expected 1 request, got %d", apps)
+	}
+}